@@ -133,6 +133,9 @@ type cluster struct {
 	sessionMutex sync.RWMutex
 
 	done chan struct{}
+
+	// ops is the key-value operations bounded by the request timeout.
+	ops
 }
 
 // New creates a cluster asynchronously,
@@ -156,6 +159,8 @@ func New(opt *option.Options) (Cluster, error) {
 		done:           make(chan struct{}),
 	}
 
+	c.ops = ops{cls: c, newContext: c.requestContext}
+
 	c.initLayout()
 
 	c.run()
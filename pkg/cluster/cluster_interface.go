@@ -18,6 +18,7 @@
 package cluster
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -37,12 +38,32 @@ type (
 		GetPrefix(prefix string) (map[string]string, error)
 		GetRaw(key string) (*mvccpb.KeyValue, error)
 		GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error)
+		// GetRawMulti gets the keys and the keys with the prefixes in one transaction,
+		// so the result is a consistent snapshot.
+		GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error)
+		// GetRawMultiWithRevision is like GetRawMulti, and returns the revision of the store
+		// at which the snapshot is taken.
+		GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error)
+		// GetRawAtRevision gets the key at the revision of the store, the revision
+		// must not be compacted.
+		GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error)
+
+		// WithContext returns the cluster whose key-value requests are bounded by ctx
+		// besides the request timeout of the cluster.
+		WithContext(ctx context.Context) Cluster
 
 		Put(key, value string) error
 		PutUnderLease(key, value string) error
 		PutAndDelete(map[string]*string) error
 		PutAndDeleteUnderLease(map[string]*string) error
 
+		// PutIfAbsentUnderNewLease puts the key only if it doesn't exist, under a new lease
+		// with the ttl, the lease must be kept alive by the caller. It returns zero lease ID
+		// if the key already exists.
+		PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error)
+		KeepAliveLeaseOnce(leaseID int64) error
+		RevokeLease(leaseID int64) error
+
 		Delete(key string) error
 		DeletePrefix(prefix string) error
 
@@ -18,12 +18,14 @@
 package cluster
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
 )
@@ -243,6 +245,351 @@ func TestClusterSyncer(t *testing.T) {
 	wg.Wait()
 }
 
+func TestClusterSyncerStartRevision(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	c := cls.(*cluster)
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	if _, err = c.getClient(); err != nil {
+		t.Fatalf("get ready failed: %v", err)
+	}
+
+	c.Put("/revision/a", "1")
+	c.Put("/revision/b", "1")
+	kv, err := c.GetRaw("/revision/b")
+	if err != nil || kv == nil {
+		t.Fatalf("get raw failed: %v", err)
+	}
+	revision := kv.ModRevision
+
+	syncer, err := c.Syncer(time.Minute)
+	if err != nil {
+		t.Fatalf("new syncer failed: %v", err)
+	}
+	defer syncer.Close()
+
+	syncer.SetStartRevision(revision)
+	ch, err := syncer.SyncPrefix("/revision/")
+	if err != nil {
+		t.Fatalf("syncer sync prefix failed: %v", err)
+	}
+
+	select {
+	case m := <-ch:
+		t.Fatalf("data before the start revision should not be sent: %v", m)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	c.Put("/revision/c", "1")
+	select {
+	case m := <-ch:
+		if m["/revision/c"] != "1" || len(m) != 3 {
+			t.Errorf("unexpected data after the start revision: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("data after the start revision should be sent")
+	}
+
+	// the data changed after the start revision is sent at the beginning.
+	syncer2, err := c.Syncer(time.Minute)
+	if err != nil {
+		t.Fatalf("new syncer failed: %v", err)
+	}
+	defer syncer2.Close()
+
+	syncer2.SetStartRevision(revision)
+	ch2, err := syncer2.SyncPrefix("/revision/")
+	if err != nil {
+		t.Fatalf("syncer sync prefix failed: %v", err)
+	}
+	select {
+	case m := <-ch2:
+		if len(m) != 3 {
+			t.Errorf("unexpected data after the start revision: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("data changed after the start revision should be sent")
+	}
+}
+
+func TestClusterSyncerPrefixWithRevision(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	c := cls.(*cluster)
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	if _, err = c.getClient(); err != nil {
+		t.Fatalf("get ready failed: %v", err)
+	}
+
+	c.Put("/snapshot/a", "1")
+
+	syncer, err := c.Syncer(time.Minute)
+	if err != nil {
+		t.Fatalf("new syncer failed: %v", err)
+	}
+	defer syncer.Close()
+
+	ch, err := syncer.SyncPrefixWithRevision("/snapshot/")
+	if err != nil {
+		t.Fatalf("syncer sync prefix with revision failed: %v", err)
+	}
+
+	receive := func() *PrefixSnapshot {
+		select {
+		case snapshot := <-ch:
+			return snapshot
+		case <-time.After(5 * time.Second):
+			t.Fatalf("snapshot should be sent")
+		}
+		return nil
+	}
+
+	snapshot := receive()
+	kv, err := c.GetRaw("/snapshot/a")
+	if err != nil || kv == nil {
+		t.Fatalf("get raw failed: %v", err)
+	}
+	if snapshot.KVs["/snapshot/a"] != "1" || snapshot.Revision < kv.ModRevision {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+
+	// the revision increases after writes, including deletions.
+	last := snapshot.Revision
+	for _, write := range []func(){
+		func() { c.Put("/snapshot/b", "1") },
+		func() { c.Put("/snapshot/a", "2") },
+		func() { c.Delete("/snapshot/b") },
+	} {
+		write()
+		snapshot = receive()
+		if snapshot.Revision <= last {
+			t.Errorf("revision should increase, got %d after %d", snapshot.Revision, last)
+		}
+		last = snapshot.Revision
+	}
+	if len(snapshot.KVs) != 1 || snapshot.KVs["/snapshot/a"] != "2" {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestClusterGetRawAtRevision(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	c := cls.(*cluster)
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	client, err := c.getClient()
+	if err != nil {
+		t.Fatalf("get ready failed: %v", err)
+	}
+
+	revisions := []int64{}
+	for _, value := range []string{"1", "2"} {
+		c.Put("/revision/a", value)
+		kv, err := c.GetRaw("/revision/a")
+		if err != nil || kv == nil {
+			t.Fatalf("get raw failed: %v", err)
+		}
+		revisions = append(revisions, kv.ModRevision)
+	}
+	c.Delete("/revision/a")
+
+	for i, value := range []string{"1", "2"} {
+		kv, err := c.GetRawAtRevision("/revision/a", revisions[i])
+		if err != nil || kv == nil || string(kv.Value) != value {
+			t.Errorf("expect value %s at revision %d, got %v, %v", value, revisions[i], kv, err)
+		}
+	}
+	if kv, err := c.GetRawAtRevision("/revision/a", revisions[1]+1); err != nil || kv != nil {
+		t.Errorf("deleted key should be nil, got %v, %v", kv, err)
+	}
+
+	if _, err = client.Compact(context.Background(), revisions[1]); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	if _, err = c.GetRawAtRevision("/revision/a", revisions[0]); err != rpctypes.ErrCompacted {
+		t.Errorf("expect compacted error, got %v", err)
+	}
+}
+
+func TestClusterGetRawMulti(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	cls.Put("/multi/key", "1")
+	cls.Put("/multi/key2", "2")
+	cls.Put("/multi/prefix/a", "3")
+	cls.Put("/multi/prefix/b", "4")
+
+	kvs, err := cls.GetRawMulti([]string{"/multi/key", "/multi/missing"}, []string{"/multi/prefix/"})
+	if err != nil {
+		t.Fatalf("get raw multi failed: %v", err)
+	}
+	if len(kvs) != 3 || kvs["/multi/key"] == nil || kvs["/multi/prefix/a"] == nil || kvs["/multi/prefix/b"] == nil {
+		t.Errorf("unexpected kvs: %v", kvs)
+	}
+}
+
+func TestClusterGetRawMultiWithRevision(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	cls.Put("/multi-revision/a", "1")
+	cls.Put("/other", "2")
+
+	kvs, revision, err := cls.GetRawMultiWithRevision(nil, []string{"/multi-revision/"})
+	if err != nil {
+		t.Fatalf("get raw multi with revision failed: %v", err)
+	}
+	other, _ := cls.GetRaw("/other")
+	if len(kvs) != 1 || other == nil || revision < other.ModRevision {
+		t.Errorf("revision %d should be the one of the store, got kvs %v", revision, kvs)
+	}
+}
+
+func TestClusterPutIfAbsentUnderNewLease(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	leaseID, err := cls.PutIfAbsentUnderNewLease("/lease/key", "1", time.Minute)
+	if err != nil || leaseID == 0 {
+		t.Fatalf("put if absent failed: %d, %v", leaseID, err)
+	}
+	if err = cls.KeepAliveLeaseOnce(leaseID); err != nil {
+		t.Errorf("keep alive lease failed: %v", err)
+	}
+
+	if id, err := cls.PutIfAbsentUnderNewLease("/lease/key", "2", time.Minute); err != nil || id != 0 {
+		t.Errorf("put existing key should return zero lease, got: %d, %v", id, err)
+	}
+	if value, _ := cls.Get("/lease/key"); value == nil || *value != "1" {
+		t.Errorf("existing key should not be overwritten: %v", value)
+	}
+
+	if err = cls.RevokeLease(leaseID); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+	if value, _ := cls.Get("/lease/key"); value != nil {
+		t.Errorf("key should be deleted after revoking the lease: %v", *value)
+	}
+}
+
+func TestClusterSyncerReestablished(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	c := cls.(*cluster)
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	client, err := c.getClient()
+	if err != nil {
+		t.Fatalf("get ready failed: %v", err)
+	}
+
+	c.Put("/reestablished/a", "1")
+	kv, err := c.GetRaw("/reestablished/a")
+	if err != nil || kv == nil {
+		t.Fatalf("get raw failed: %v", err)
+	}
+	revision := kv.ModRevision
+	c.Put("/reestablished/a", "2")
+	c.Put("/reestablished/a", "3")
+	kv, _ = c.GetRaw("/reestablished/a")
+	if _, err = client.Compact(context.Background(), kv.ModRevision); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	syncer, err := c.Syncer(time.Minute)
+	if err != nil {
+		t.Fatalf("new syncer failed: %v", err)
+	}
+	defer syncer.Close()
+
+	// watching from a compacted revision forces a re-establishment.
+	syncer.SetStartRevision(revision - 1)
+	ch, err := syncer.SyncPrefix("/reestablished/")
+	if err != nil {
+		t.Fatalf("syncer sync prefix failed: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("data should be sent")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for syncer.ReestablishedCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("watcher should be re-established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestClusterWatcher(t *testing.T) {
 	opts, _, _ := mockMembers(1)
 	cls, err := New(opts[0])
@@ -482,3 +829,39 @@ func TestUtilEqual(t *testing.T) {
 		t.Error("isKeyValueEqual invalid, should equal")
 	}
 }
+
+func TestClusterWithContext(t *testing.T) {
+	opts, _, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	c := cls.(*cluster)
+	defer func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		cls.CloseServer(wg)
+		wg.Wait()
+	}()
+
+	if _, err = c.getClient(); err != nil {
+		t.Fatalf("get ready failed: %v", err)
+	}
+
+	if err = cls.WithContext(context.Background()).Put("/context/a", "1"); err != nil {
+		t.Fatalf("put with context failed: %v", err)
+	}
+	if value, err := cls.Get("/context/a"); err != nil || value == nil || *value != "1" {
+		t.Errorf("expect value 1, got %v, %v", value, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = cls.WithContext(ctx).Put("/context/a", "2"); err == nil {
+		t.Errorf("put with canceled context should fail")
+	}
+	if value, err := cls.Get("/context/a"); err != nil || value == nil || *value != "1" {
+		t.Errorf("canceled put should not be applied, got %v, %v", value, err)
+	}
+}
@@ -18,15 +18,66 @@
 package cluster
 
 import (
+	"context"
+	"math"
+	"time"
+
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+type (
+	// ops is the key-value operations of the cluster, whose requests are bounded by
+	// the contexts from newContext.
+	ops struct {
+		cls        *cluster
+		newContext func() context.Context
+		// abortContext aborts STM if not nil.
+		abortContext context.Context
+	}
+
+	// contextCluster is the cluster whose key-value requests are bounded by
+	// the context besides the request timeout of the cluster.
+	contextCluster struct {
+		*cluster
+		ops
+	}
 )
 
+// WithContext returns the cluster whose key-value requests are bounded by ctx
+// besides the request timeout of the cluster, the requests are canceled once
+// ctx is done.
+func (c *cluster) WithContext(ctx context.Context) Cluster {
+	return &contextCluster{
+		cluster: c,
+		ops: ops{
+			cls: c,
+			newContext: func() context.Context {
+				reqCtx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+				go func() {
+					<-reqCtx.Done()
+					cancel()
+				}()
+				return reqCtx
+			},
+			abortContext: ctx,
+		},
+	}
+}
+
+func (c *ops) getClient() (*clientv3.Client, error) { return c.cls.getClient() }
+
+func (c *ops) getLease() (clientv3.LeaseID, error) { return c.cls.getLease() }
+
+func (c *ops) requestContext() context.Context { return c.newContext() }
+
 // PutUnderLease stores data under lease.
 // The lifecycle of lease is the same with the member,
 // it will be revoked after purging the member.
-func (c *cluster) PutUnderLease(key, value string) error {
+func (c *ops) PutUnderLease(key, value string) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -42,7 +93,7 @@ func (c *cluster) PutUnderLease(key, value string) error {
 	return err
 }
 
-func (c *cluster) Put(key, value string) error {
+func (c *ops) Put(key, value string) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -53,15 +104,15 @@ func (c *cluster) Put(key, value string) error {
 	return err
 }
 
-func (c *cluster) PutAndDeleteUnderLease(kvs map[string]*string) error {
+func (c *ops) PutAndDeleteUnderLease(kvs map[string]*string) error {
 	return c.putAndDelete(kvs, true)
 }
 
-func (c *cluster) PutAndDelete(kvs map[string]*string) error {
+func (c *ops) PutAndDelete(kvs map[string]*string) error {
 	return c.putAndDelete(kvs, false)
 }
 
-func (c *cluster) putAndDelete(kvs map[string]*string, underLease bool) error {
+func (c *ops) putAndDelete(kvs map[string]*string, underLease bool) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -90,7 +141,57 @@ func (c *cluster) putAndDelete(kvs map[string]*string, underLease bool) error {
 	return err
 }
 
-func (c *cluster) Delete(key string) error {
+func (c *ops) PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	lease, err := client.Grant(c.requestContext(), seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Txn(c.requestContext()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err == nil && resp.Succeeded {
+		return int64(lease.ID), nil
+	}
+
+	if _, revokeErr := client.Revoke(c.requestContext(), lease.ID); revokeErr != nil {
+		logger.Errorf("revoke lease %d failed: %v", lease.ID, revokeErr)
+	}
+
+	return 0, err
+}
+
+func (c *ops) KeepAliveLeaseOnce(leaseID int64) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.KeepAliveOnce(c.requestContext(), clientv3.LeaseID(leaseID))
+	return err
+}
+
+func (c *ops) RevokeLease(leaseID int64) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Revoke(c.requestContext(), clientv3.LeaseID(leaseID))
+	return err
+}
+
+func (c *ops) Delete(key string) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -101,7 +202,7 @@ func (c *cluster) Delete(key string) error {
 	return err
 }
 
-func (c *cluster) DeletePrefix(prefix string) error {
+func (c *ops) DeletePrefix(prefix string) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -112,7 +213,7 @@ func (c *cluster) DeletePrefix(prefix string) error {
 	return err
 }
 
-func (c *cluster) Get(key string) (*string, error) {
+func (c *ops) Get(key string) (*string, error) {
 	kv, err := c.GetRaw(key)
 	if err != nil || kv == nil {
 		return nil, err
@@ -123,7 +224,7 @@ func (c *cluster) Get(key string) (*string, error) {
 	return &value, nil
 }
 
-func (c *cluster) GetRaw(key string) (*mvccpb.KeyValue, error) {
+func (c *ops) GetRaw(key string) (*mvccpb.KeyValue, error) {
 	client, err := c.getClient()
 	if err != nil {
 		return nil, err
@@ -141,7 +242,25 @@ func (c *cluster) GetRaw(key string) (*mvccpb.KeyValue, error) {
 	return resp.Kvs[0], nil
 }
 
-func (c *cluster) GetPrefix(prefix string) (map[string]string, error) {
+func (c *ops) GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(c.requestContext(), key, clientv3.WithRev(revision))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	return resp.Kvs[0], nil
+}
+
+func (c *ops) GetPrefix(prefix string) (map[string]string, error) {
 	kvs := make(map[string]string)
 	rawKVs, err := c.GetRawPrefix(prefix)
 	if err != nil {
@@ -155,7 +274,7 @@ func (c *cluster) GetPrefix(prefix string) (map[string]string, error) {
 	return kvs, nil
 }
 
-func (c *cluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+func (c *ops) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
 	kvs := make(map[string]*mvccpb.KeyValue)
 
 	client, err := c.getClient()
@@ -175,11 +294,50 @@ func (c *cluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, erro
 	return kvs, nil
 }
 
-func (c *cluster) STM(apply func(concurrency.STM) error) error {
+func (c *ops) GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error) {
+	kvs, _, err := c.GetRawMultiWithRevision(keys, prefixes)
+	return kvs, err
+}
+
+func (c *ops) GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error) {
+	kvs := make(map[string]*mvccpb.KeyValue)
+
+	client, err := c.getClient()
+	if err != nil {
+		return kvs, 0, err
+	}
+
+	ops := make([]clientv3.Op, 0, len(keys)+len(prefixes))
+	for _, key := range keys {
+		ops = append(ops, clientv3.OpGet(key))
+	}
+	for _, prefix := range prefixes {
+		ops = append(ops, clientv3.OpGet(prefix, clientv3.WithPrefix()))
+	}
+
+	resp, err := client.Txn(c.requestContext()).Then(ops...).Commit()
+	if err != nil {
+		return kvs, 0, err
+	}
+
+	for _, r := range resp.Responses {
+		for _, kv := range r.GetResponseRange().Kvs {
+			kvs[string(kv.Key)] = kv
+		}
+	}
+
+	return kvs, resp.Header.Revision, nil
+}
+
+func (c *ops) STM(apply func(concurrency.STM) error) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
 	}
-	_, err = concurrency.NewSTM(client, apply)
+	if c.abortContext != nil {
+		_, err = concurrency.NewSTM(client, apply, concurrency.WithAbortContext(c.abortContext))
+	} else {
+		_, err = concurrency.NewSTM(client, apply)
+	}
 	return err
 }
@@ -20,6 +20,7 @@ package cluster
 import (
 	"bytes"
 	"context"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -35,12 +36,24 @@ import (
 // is to ensure data consistency, as Etcd watcher may be cancelled if it cannot catch
 // up with the key-value store.
 type Syncer struct {
-	cluster      *cluster
-	client       *clientv3.Client
-	pullInterval time.Duration
-	done         chan struct{}
+	cluster       *cluster
+	client        *clientv3.Client
+	pullInterval  time.Duration
+	startRevision int64
+	channelBuffer int
+	reestablished uint64
+	done          chan struct{}
 }
 
+// PrefixSnapshot is the data of a prefix with the revision of the store at which it was pulled.
+type PrefixSnapshot struct {
+	Revision int64
+	KVs      map[string]string
+}
+
+// defaultSyncerChannelBuffer is the default buffer size of the channels returned by Sync* methods.
+const defaultSyncerChannelBuffer = 10
+
 func (c *cluster) Syncer(pullInterval time.Duration) (*Syncer, error) {
 	client, err := c.getClient()
 	if err != nil {
@@ -54,40 +67,76 @@ func (c *cluster) Syncer(pullInterval time.Duration) (*Syncer, error) {
 	}, nil
 }
 
-func (s *Syncer) pull(key string, prefix bool) (map[string]*mvccpb.KeyValue, error) {
-	if prefix {
-		result, err := s.cluster.GetRawPrefix(key)
-		if err != nil {
-			logger.Errorf("failed to pull data for prefix %s: %v", key, err)
-		}
-		return result, err
+// SetStartRevision makes the syncer send data only if it has been changed
+// after the revision, instead of sending the full data at the beginning.
+// If the revision has been compacted, the syncer falls back to sending the
+// full data. It must be called before any Sync* method.
+func (s *Syncer) SetStartRevision(revision int64) {
+	s.startRevision = revision
+}
+
+// SetChannelBuffer sets the buffer size of the channels returned by Sync* methods,
+// a larger buffer keeps the watch from blocking on a slow consumer at the cost of
+// memory. Non-positive size means the default. It must be called before any Sync* method.
+func (s *Syncer) SetChannelBuffer(size int) {
+	s.channelBuffer = size
+}
+
+func (s *Syncer) channelBufferSize() int {
+	if s.channelBuffer <= 0 {
+		return defaultSyncerChannelBuffer
 	}
+	return s.channelBuffer
+}
 
-	kv, err := s.cluster.GetRaw(key)
-	if err != nil {
-		logger.Errorf("failed to pull data for key %s: %v", key, err)
-		return nil, err
+// ReestablishedCount returns how many times the syncer has re-established
+// its watcher after Etcd canceled it.
+func (s *Syncer) ReestablishedCount() uint64 {
+	return atomic.LoadUint64(&s.reestablished)
+}
+
+// pull pulls the data of the key or the prefix, along with the revision of the store.
+func (s *Syncer) pull(key string, prefix bool) (map[string]*mvccpb.KeyValue, int64, error) {
+	var keys, prefixes []string
+	if prefix {
+		prefixes = []string{key}
+	} else {
+		keys = []string{key}
 	}
 
-	result := make(map[string]*mvccpb.KeyValue)
-	if kv != nil {
-		result[string(kv.Key)] = kv
+	result, revision, err := s.cluster.GetRawMultiWithRevision(keys, prefixes)
+	if err != nil {
+		logger.Errorf("failed to pull data for key %s (prefix: %v): %v", key, prefix, err)
+		return nil, 0, err
 	}
 
-	return result, nil
+	return result, revision, nil
 }
 
-func (s *Syncer) watch(key string, prefix bool) (clientv3.Watcher, clientv3.WatchChan) {
-	opts := make([]clientv3.OpOption, 0, 1)
+func (s *Syncer) watch(key string, prefix bool, revision int64) (clientv3.Watcher, clientv3.WatchChan) {
+	opts := make([]clientv3.OpOption, 0, 2)
 	if prefix {
 		opts = append(opts, clientv3.WithPrefix())
 	}
+	if revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision))
+	}
 	watcher := clientv3.NewWatcher(s.client)
 	watchChan := watcher.Watch(context.Background(), key, opts...)
-	logger.Debugf("watcher created for key %s (prefix: %v)", key, prefix)
+	logger.Debugf("watcher created for key %s (prefix: %v, revision: %d)", key, prefix, revision)
 	return watcher, watchChan
 }
 
+func isDataChangedAfter(data map[string]*mvccpb.KeyValue, revision int64) bool {
+	for _, kv := range data {
+		if kv != nil && kv.ModRevision > revision {
+			return true
+		}
+	}
+
+	return false
+}
+
 func isDataEqual(data1 map[string]*mvccpb.KeyValue, data2 map[string]*mvccpb.KeyValue) bool {
 	if len(data1) != len(data2) {
 		return false
@@ -122,28 +171,54 @@ func isKeyValueEqual(kv1, kv2 *mvccpb.KeyValue) bool {
 	return false
 }
 
-func (s *Syncer) run(key string, prefix bool, send func(data map[string]*mvccpb.KeyValue)) {
-	watcher, watchChan := s.watch(key, prefix)
-	defer watcher.Close()
+func (s *Syncer) run(key string, prefix bool, send func(data map[string]*mvccpb.KeyValue, revision int64)) {
+	startRevision := s.startRevision
+
+	var watchRevision int64
+	if startRevision > 0 {
+		watchRevision = startRevision + 1
+	}
+	watcher, watchChan := s.watch(key, prefix, watchRevision)
+	defer func() {
+		watcher.Close()
+	}()
 
 	ticker := time.NewTicker(s.pullInterval)
 	defer ticker.Stop()
 
 	data := make(map[string]*mvccpb.KeyValue)
+	// sent reports whether any data has been sent, the first change
+	// after the start revision must be sent even if the data pulled
+	// at the beginning already contains it.
+	sent := false
 
-	pullCompareSend := func() {
-		newData, err := s.pull(key, prefix)
+	pullCompareSend := func(force bool) {
+		newData, revision, err := s.pull(key, prefix)
 		if err != nil {
 			logger.Errorf("pull data for key %s (prefix: %v) failed: %v", key, prefix, err)
 			return
 		}
-		if !isDataEqual(data, newData) {
+		if force || !isDataEqual(data, newData) {
 			data = newData
-			send(data)
+			sent = true
+			send(data, revision)
 		}
 	}
 
-	pullCompareSend()
+	if startRevision > 0 {
+		newData, revision, err := s.pull(key, prefix)
+		if err != nil {
+			logger.Errorf("pull data for key %s (prefix: %v) failed: %v", key, prefix, err)
+		} else {
+			data = newData
+			if isDataChangedAfter(data, startRevision) {
+				sent = true
+				send(data, revision)
+			}
+		}
+	} else {
+		pullCompareSend(false)
+	}
 
 	for {
 		select {
@@ -151,7 +226,7 @@ func (s *Syncer) run(key string, prefix bool, send func(data map[string]*mvccpb.
 			return
 
 		case <-ticker.C:
-			pullCompareSend()
+			pullCompareSend(false)
 
 		case resp := <-watchChan:
 			if resp.Canceled {
@@ -159,23 +234,30 @@ func (s *Syncer) run(key string, prefix bool, send func(data map[string]*mvccpb.
 				// the key-value store. And no matter what happens, we restart the watcher.
 				logger.Debugf("watch key %s canceled: %v", key, resp.Err())
 				watcher.Close()
-				watcher, watchChan = s.watch(key, prefix)
+				watcher, watchChan = s.watch(key, prefix, 0)
+				atomic.AddUint64(&s.reestablished, 1)
+				if resp.CompactRevision != 0 && !sent {
+					// The start revision has been compacted, fall back to the full data.
+					logger.Warnf("revision %d of key %s has been compacted, send full data",
+						startRevision, key)
+					pullCompareSend(true)
+				}
 				continue
 			}
 			if resp.IsProgressNotify() {
 				continue
 			}
 
-			pullCompareSend()
+			pullCompareSend(!sent)
 		}
 	}
 }
 
 // Sync syncs a given Etcd key's value through the returned channel.
 func (s *Syncer) Sync(key string) (<-chan *string, error) {
-	ch := make(chan *string, 10)
+	ch := make(chan *string, s.channelBufferSize())
 
-	fn := func(data map[string]*mvccpb.KeyValue) {
+	fn := func(data map[string]*mvccpb.KeyValue, _ int64) {
 		if kv := data[key]; kv == nil {
 			ch <- nil
 		} else {
@@ -194,9 +276,9 @@ func (s *Syncer) Sync(key string) (<-chan *string, error) {
 
 // SyncRaw syncs a given Etcd key's raw Etcd mvccpb structure through the returned channel.
 func (s *Syncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
-	ch := make(chan *mvccpb.KeyValue, 10)
+	ch := make(chan *mvccpb.KeyValue, s.channelBufferSize())
 
-	fn := func(data map[string]*mvccpb.KeyValue) {
+	fn := func(data map[string]*mvccpb.KeyValue, _ int64) {
 		ch <- data[key]
 	}
 
@@ -210,9 +292,9 @@ func (s *Syncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
 
 // SyncPrefix syncs Etcd keys' values with the same prefix through the returned channel.
 func (s *Syncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
-	ch := make(chan map[string]string, 10)
+	ch := make(chan map[string]string, s.channelBufferSize())
 
-	fn := func(data map[string]*mvccpb.KeyValue) {
+	fn := func(data map[string]*mvccpb.KeyValue, _ int64) {
 		m := make(map[string]string, len(data))
 		for k, v := range data {
 			m[k] = string(v.Value)
@@ -228,11 +310,32 @@ func (s *Syncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
 	return ch, nil
 }
 
+// SyncPrefixWithRevision is like SyncPrefix, and each snapshot carries the revision
+// of the store at which it was pulled.
+func (s *Syncer) SyncPrefixWithRevision(prefix string) (<-chan *PrefixSnapshot, error) {
+	ch := make(chan *PrefixSnapshot, s.channelBufferSize())
+
+	fn := func(data map[string]*mvccpb.KeyValue, revision int64) {
+		m := make(map[string]string, len(data))
+		for k, v := range data {
+			m[k] = string(v.Value)
+		}
+		ch <- &PrefixSnapshot{Revision: revision, KVs: m}
+	}
+
+	go func() {
+		defer close(ch)
+		s.run(prefix, true, fn)
+	}()
+
+	return ch, nil
+}
+
 // SyncRawPrefix syncs Etcd keys' values with the same prefix in raw Etcd mvccpb structure format through the returned channel.
 func (s *Syncer) SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error) {
-	ch := make(chan map[string]*mvccpb.KeyValue, 10)
+	ch := make(chan map[string]*mvccpb.KeyValue, s.channelBufferSize())
 
-	fn := func(data map[string]*mvccpb.KeyValue) {
+	fn := func(data map[string]*mvccpb.KeyValue, _ int64) {
 		// make a copy of data as it may be modified after the function returns
 		m := make(map[string]*mvccpb.KeyValue, len(data))
 		for k, v := range data {
@@ -21,12 +21,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"reflect"
 
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/service"
 	"github.com/megaease/easegress/pkg/supervisor"
-	"github.com/megaease/easegress/pkg/v"
 )
 
 const (
@@ -120,6 +121,7 @@ func New(superSpec *supervisor.Spec) *API {
 // Close unregisters a API
 func (a *API) Close() {
 	api.UnregisterAPIs(apiGroupName)
+	a.service.Close()
 }
 
 func (a *API) registerAPIs() {
@@ -249,10 +251,43 @@ func (a *API) readAPISpec(r *http.Request, pbSpec interface{}, spec interface{})
 		return err
 	}
 
-	vr := v.Validate(spec)
-	if !vr.Valid() {
-		return fmt.Errorf("validate failed:\n%s", vr)
+	return a.service.ValidateSpec(specKind(spec), specName(spec), remoteHost(r), spec)
+}
+
+// remoteHost returns the host of the remote address of the request without the port,
+// so the requests from the same host share one source.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	return nil
+// specKind returns the type name of the spec as its kind, e.g. Service.
+func specKind(spec interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(spec)).Type().Name()
+}
+
+// specName returns the Name field of the spec, or empty if the spec has no name.
+func specName(spec interface{}) string {
+	value := reflect.Indirect(reflect.ValueOf(spec))
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+	name := value.FieldByName("Name")
+	if !name.IsValid() || name.Kind() != reflect.String {
+		return ""
+	}
+	return name.String()
+}
+
+// handleWriteError handles the error of writing through the service, the writes
+// rejected in read-only mode are forbidden, other errors are cluster errors.
+func handleWriteError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == service.ErrReadOnly {
+		api.HandleAPIError(w, r, http.StatusForbidden, err)
+		return
+	}
+	api.ClusterPanic(err)
 }
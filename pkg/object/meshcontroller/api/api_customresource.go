@@ -126,7 +126,10 @@ func (a *API) saveCustomResourceKind(w http.ResponseWriter, r *http.Request, upd
 		return err
 	}
 
-	a.service.PutCustomResourceKind(kind)
+	if err = a.service.PutCustomResourceKind(kind); err != nil {
+		handleWriteError(w, r, err)
+		return err
+	}
 	return nil
 }
 
@@ -158,7 +161,10 @@ func (a *API) deleteCustomResourceKind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.DeleteCustomResourceKind(name)
+	if err := a.service.DeleteCustomResourceKind(name); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
 	// TODO: remove custom resources?
 }
 
@@ -297,7 +303,10 @@ func (a *API) saveCustomResource(w http.ResponseWriter, r *http.Request, update
 		return err
 	}
 
-	a.service.PutCustomResource(resource)
+	if err = a.service.PutCustomResource(resource); err != nil {
+		handleWriteError(w, r, err)
+		return err
+	}
 	return nil
 }
 
@@ -334,7 +343,9 @@ func (a *API) deleteCustomResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.DeleteCustomResource(kind, name)
+	if err := a.service.DeleteCustomResource(kind, name); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
 
 func (a *API) watchCustomResources(w http.ResponseWriter, r *http.Request) {
@@ -89,7 +89,10 @@ func (a *API) createIngress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.PutIngressSpec(ingressSpec)
+	if err := a.service.PutIngressSpec(ingressSpec); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Location", path.Join(r.URL.Path, ingressSpec.Name))
 	w.WriteHeader(http.StatusCreated)
@@ -151,7 +154,9 @@ func (a *API) updateIngress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.PutIngressSpec(ingressSpec)
+	if err := a.service.PutIngressSpec(ingressSpec); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
 
 func (a *API) deleteIngress(w http.ResponseWriter, r *http.Request) {
@@ -170,5 +175,7 @@ func (a *API) deleteIngress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.DeleteIngressSpec(ingressName)
+	if err := a.service.DeleteIngressSpec(ingressName); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
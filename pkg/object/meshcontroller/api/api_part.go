@@ -285,7 +285,10 @@ func (a *API) createPartOfService(meta *partMeta) http.HandlerFunc {
 
 		meta.setPart(serviceSpec, part)
 
-		a.service.PutServiceSpec(serviceSpec)
+		if err := a.service.PutServiceSpec(serviceSpec); err != nil {
+			handleWriteError(w, r, err)
+			return
+		}
 
 		w.Header().Set("Location", r.URL.Path)
 		w.WriteHeader(http.StatusCreated)
@@ -327,7 +330,9 @@ func (a *API) updatePartOfService(meta *partMeta) http.HandlerFunc {
 		}
 
 		meta.setPart(serviceSpec, part)
-		a.service.PutServiceSpec(serviceSpec)
+		if err := a.service.PutServiceSpec(serviceSpec); err != nil {
+			handleWriteError(w, r, err)
+		}
 	})
 }
 
@@ -357,6 +362,8 @@ func (a *API) deletePartOfService(meta *partMeta) http.HandlerFunc {
 		}
 
 		meta.setPart(serviceSpec, nil)
-		a.service.PutServiceSpec(serviceSpec)
+		if err := a.service.PutServiceSpec(serviceSpec); err != nil {
+			handleWriteError(w, r, err)
+		}
 	})
 }
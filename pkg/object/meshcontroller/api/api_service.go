@@ -100,10 +100,21 @@ func (a *API) createService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = a.service.ValidateEgressAllowlist(serviceSpec); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
 	tenantSpec.Services = append(tenantSpec.Services, serviceSpec.Name)
 
-	a.service.PutServiceSpec(serviceSpec)
-	a.service.PutTenantSpec(tenantSpec)
+	if err = a.service.PutServiceSpec(serviceSpec); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
+	if err = a.service.PutTenantSpec(tenantSpec); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Location", path.Join(r.URL.Path, serviceSpec.Name))
 	w.WriteHeader(http.StatusCreated)
@@ -166,6 +177,11 @@ func (a *API) updateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = a.service.ValidateEgressAllowlist(serviceSpec); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
 	if serviceSpec.RegisterTenant != oldSpec.RegisterTenant {
 		newTenantSpec := a.service.GetTenantSpec(serviceSpec.RegisterTenant)
 		if newTenantSpec == nil {
@@ -181,8 +197,14 @@ func (a *API) updateService(w http.ResponseWriter, r *http.Request) {
 		}
 		oldTenantSpec.Services = stringtool.DeleteStrInSlice(oldTenantSpec.Services, serviceName)
 
-		a.service.PutTenantSpec(newTenantSpec)
-		a.service.PutTenantSpec(oldTenantSpec)
+		if err = a.service.PutTenantSpec(newTenantSpec); err != nil {
+			handleWriteError(w, r, err)
+			return
+		}
+		if err = a.service.PutTenantSpec(oldTenantSpec); err != nil {
+			handleWriteError(w, r, err)
+			return
+		}
 	}
 
 	globalCanaryHeaders := a.service.GetGlobalCanaryHeaders()
@@ -196,10 +218,15 @@ func (a *API) updateService(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		globalCanaryHeaders.ServiceHeaders[serviceName] = uniqueHeaders
-		a.service.PutGlobalCanaryHeaders(globalCanaryHeaders)
+		if err = a.service.PutGlobalCanaryHeaders(globalCanaryHeaders); err != nil {
+			handleWriteError(w, r, err)
+			return
+		}
 	}
 
-	a.service.PutServiceSpec(serviceSpec)
+	if err = a.service.PutServiceSpec(serviceSpec); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
 
 func (a *API) deleteService(w http.ResponseWriter, r *http.Request) {
@@ -225,6 +252,11 @@ func (a *API) deleteService(w http.ResponseWriter, r *http.Request) {
 
 	tenantSpec.Services = stringtool.DeleteStrInSlice(tenantSpec.Services, serviceName)
 
-	a.service.PutTenantSpec(tenantSpec)
-	a.service.DeleteServiceSpec(serviceName)
+	if err = a.service.PutTenantSpec(tenantSpec); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
+	if err = a.service.DeleteServiceSpec(serviceName); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
@@ -123,5 +123,7 @@ func (a *API) offlineServiceInstance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	instanceSpec.Status = spec.ServiceStatusOutOfService
-	a.service.PutServiceInstanceSpec(instanceSpec)
+	if err := a.service.PutServiceInstanceSpec(instanceSpec); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
@@ -30,6 +30,7 @@ import (
 
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/service"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
 )
 
@@ -99,7 +100,10 @@ func (a *API) createTenant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.PutTenantSpec(tenantSpec)
+	if err = a.service.PutTenantSpec(tenantSpec); err != nil {
+		handleWriteError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Location", path.Join(r.URL.Path, tenantSpec.Name))
 	w.WriteHeader(http.StatusCreated)
@@ -171,7 +175,9 @@ func (a *API) updateTenant(w http.ResponseWriter, r *http.Request) {
 	// NOTE: The fields below can't be updated.
 	tenantSpec.Services, tenantSpec.CreatedAt = oldSpec.Services, oldSpec.CreatedAt
 
-	a.service.PutTenantSpec(tenantSpec)
+	if err = a.service.PutTenantSpec(tenantSpec); err != nil {
+		handleWriteError(w, r, err)
+	}
 }
 
 func (a *API) deleteTenant(w http.ResponseWriter, r *http.Request) {
@@ -196,5 +202,12 @@ func (a *API) deleteTenant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.service.DeleteTenantSpec(tenantName)
+	err = a.service.DeleteTenantSpec(tenantName)
+	if err == service.ErrTenantHasServices {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("%s got services", tenantName))
+		return
+	}
+	if err != nil {
+		handleWriteError(w, r, err)
+	}
 }
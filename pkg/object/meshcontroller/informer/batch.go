@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"time"
+)
+
+// WithBatchWindow makes the prefix watches deliver only the last snapshot of the ones
+// arriving within the window after the first one, so the callback is called once per
+// burst. Every delivery is a whole snapshot of the prefix, so the last one of a batch
+// reflects all the changes of the batch including deletions. Zero window means no batching.
+func WithBatchWindow(window time.Duration) WatchOption {
+	return func(o *watchOptions) {
+		o.batchWindow = window
+	}
+}
+
+// batchPrefix keeps the last map arriving within the window after the first one of each
+// batch. The returning channel is closed after ch is closed and the last batch is sent.
+func batchPrefix(ch <-chan map[string]string, window time.Duration) <-chan map[string]string {
+	batchCh := make(chan map[string]string)
+
+	go func() {
+		defer close(batchCh)
+
+		for kvs := range ch {
+			last := kvs
+
+			closed := false
+			timer := time.NewTimer(window)
+		collect:
+			for {
+				select {
+				case more, ok := <-ch:
+					if !ok {
+						timer.Stop()
+						closed = true
+						break collect
+					}
+					last = more
+				case <-timer.C:
+					break collect
+				}
+			}
+
+			batchCh <- last
+			if closed {
+				return
+			}
+		}
+	}()
+
+	return batchCh
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// WatchSpec is the source of a computed watch.
+	WatchSpec struct {
+		// Prefix is the store prefix to watch, e.g. layout.ServiceInstanceStatusPrefix("order").
+		Prefix string
+	}
+
+	// ComputeFunc computes the derived value from the merged key values of all sources,
+	// the values are raw stored ones, which should be decoded by storage.Decode.
+	ComputeFunc func(kvs map[string]string) interface{}
+
+	// ComputedFunc is the callback function type for the changed computed value.
+	ComputedFunc func(newValue interface{}) bool
+
+	// computedWatcher watches the sources, and informs the derived value when it changes.
+	computedWatcher struct {
+		mutex   sync.Mutex
+		inf     *meshInformer
+		compute ComputeFunc
+		fn      ComputedFunc
+		options *watchOptions
+
+		// syncerKeys are the syncer keys of the sources, they are read-only.
+		syncerKeys []string
+		// snapshots are the last snapshots of the sources, nil means not synced yet.
+		snapshots []map[string]string
+		informed  bool
+		last      interface{}
+		stopped   bool
+	}
+)
+
+// OnComputed watches the prefixes of the sources, and recomputes the derived value
+// on any change after all sources are synced. The callback is called with the first
+// value, and then only when the value changes.
+func (inf *meshInformer) OnComputed(sources []WatchSpec, compute ComputeFunc, fn ComputedFunc, opts ...WatchOption) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("no source to compute")
+	}
+
+	id := atomic.AddUint64(&inf.computedWatches, 1)
+	syncerKeys := make([]string, len(sources))
+	for i, source := range sources {
+		syncerKeys[i] = fmt.Sprintf("computed-%d-%d-%s", id, i, source.Prefix)
+	}
+
+	w := &computedWatcher{
+		inf:        inf,
+		compute:    compute,
+		fn:         fn,
+		options:    newWatchOptions(opts),
+		syncerKeys: syncerKeys,
+		snapshots:  make([]map[string]string, len(sources)),
+	}
+
+	for i, source := range sources {
+		index := i
+		err := inf.onSpecs(source.Prefix, syncerKeys[index], func(kvs map[string]string) bool {
+			return w.update(index, kvs)
+		}, opts)
+		if err != nil {
+			w.stop()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *computedWatcher) update(index int, kvs map[string]string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return true
+	}
+
+	w.snapshots[index] = kvs
+	merged := map[string]string{}
+	for _, snapshot := range w.snapshots {
+		// wait for the data of all sources.
+		if snapshot == nil {
+			return true
+		}
+		for k, v := range snapshot {
+			merged[k] = v
+		}
+	}
+
+	continued := w.inf.invoke(w.syncerKeys[index], w.options, func() bool {
+		value := w.compute(merged)
+		if w.informed && reflect.DeepEqual(value, w.last) {
+			return true
+		}
+		w.informed, w.last = true, value
+		return w.options.callback(func() bool { return w.fn(value) })
+	})
+	if !continued {
+		w.stopped = true
+		go w.stop()
+	}
+
+	return continued
+}
+
+func (w *computedWatcher) stop() {
+	w.mutex.Lock()
+	w.stopped = true
+	w.mutex.Unlock()
+
+	for _, key := range w.syncerKeys {
+		w.inf.stopSyncOneKey(key)
+	}
+}
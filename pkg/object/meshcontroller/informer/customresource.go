@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+type (
+	// CustomResourceFactory creates the value of a known Go struct which a custom
+	// resource is decoded into, it must return a new pointer at every call.
+	CustomResourceFactory func() interface{}
+
+	// TypedCustomResourcesFunc is the callback function type for typed custom resources,
+	// the values are created by the factory of the watch.
+	TypedCustomResourcesFunc func(resources map[string]interface{}) bool
+)
+
+func customResourceSyncerKey(kind string) string {
+	return fmt.Sprintf("prefix-custom-resource-%s", kind)
+}
+
+// OnTypedCustomResources watches the custom resources of the kind, and decodes each
+// of them into the value created by the factory, so the consumers of well-known kinds
+// don't need to decode the generic custom resources themselves.
+func (inf *meshInformer) OnTypedCustomResources(kind string, factory CustomResourceFactory,
+	fn TypedCustomResourcesFunc, opts ...WatchOption) error {
+
+	if factory == nil {
+		return fmt.Errorf("factory of custom resource kind %s is nil", kind)
+	}
+	if v := factory(); v == nil || reflect.TypeOf(v).Kind() != reflect.Ptr {
+		return fmt.Errorf("factory of custom resource kind %s must return a pointer, got %T", kind, v)
+	}
+
+	storeKey := layout.CustomResourcePrefix(kind)
+	syncerKey := customResourceSyncerKey(kind)
+	options := newWatchOptions(opts)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
+
+	specsFunc := func(kvs map[string]string) bool {
+		resources := make(map[string]interface{})
+		for k, v := range kvs {
+			resource := factory()
+			if err := inf.decode(k, []byte(v), resource); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
+				continue
+			}
+
+			// NOTE: The typed value may not carry the name, so it's taken from the key.
+			name := strings.TrimSuffix(strings.TrimPrefix(k, storeKey), "/")
+			if !options.matchName(name) {
+				continue
+			}
+			resources[options.nameKey(k, name)] = resource
+		}
+
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(resources) {
+			return true
+		}
+
+		return options.callback(func() bool { return fn(resources) })
+	}
+
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
+}
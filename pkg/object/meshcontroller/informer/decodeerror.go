@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+type (
+	// DecodeErrorFunc is the callback function type for a prefix watch whose decode
+	// failures exceed the threshold, lastErr is the latest decode error.
+	DecodeErrorFunc func(syncerKey string, failures int, lastErr error)
+
+	// DecodeErrorThreshold is the threshold of decode failures of a prefix watch.
+	DecodeErrorThreshold struct {
+		// MaxFailures is the max tolerated count of failures within the window.
+		MaxFailures int
+		// Window is the period of counting failures, zero means the whole
+		// lifetime of the watch.
+		Window time.Duration
+		// Handler is called when the failures exceed MaxFailures, at most once per window.
+		Handler DecodeErrorFunc
+		// StopWatch makes the watch stop after calling the handler.
+		StopWatch bool
+	}
+
+	// decodeErrorTracker counts the decode failures of one prefix watch,
+	// it's only used in the goroutine of the watch.
+	decodeErrorTracker struct {
+		syncerKey string
+		threshold *DecodeErrorThreshold
+
+		windowStart time.Time
+		failures    int
+		lastErr     error
+	}
+)
+
+// WithDecodeErrorThreshold makes the prefix watches call the handler of the threshold
+// when their decode failures exceed it, and stop the watches if required. By default,
+// the corrupt values are logged and skipped forever.
+func WithDecodeErrorThreshold(threshold DecodeErrorThreshold) WatchOption {
+	return func(o *watchOptions) {
+		o.decodeErrorThreshold = &threshold
+	}
+}
+
+// newDecodeErrorTracker returns nil if no threshold is set,
+// and all methods of nil tracker are no-op.
+func (o *watchOptions) newDecodeErrorTracker(syncerKey string) *decodeErrorTracker {
+	if o.decodeErrorThreshold == nil {
+		return nil
+	}
+
+	return &decodeErrorTracker{
+		syncerKey:   syncerKey,
+		threshold:   o.decodeErrorThreshold,
+		windowStart: time.Now(),
+	}
+}
+
+// record records a decode failure.
+func (t *decodeErrorTracker) record(err error) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	if t.threshold.Window > 0 && now.Sub(t.windowStart) > t.threshold.Window {
+		t.windowStart, t.failures = now, 0
+	}
+
+	t.failures++
+	t.lastErr = err
+}
+
+// check calls the handler if the failures exceed the threshold.
+// The returning boolean flag means if the stuff continues to be watched.
+func (t *decodeErrorTracker) check() bool {
+	if t == nil || t.failures <= t.threshold.MaxFailures {
+		return true
+	}
+
+	logger.Errorf("decode failures of %s exceed the threshold %d: %d, last error: %v",
+		t.syncerKey, t.threshold.MaxFailures, t.failures, t.lastErr)
+	if t.threshold.Handler != nil {
+		t.threshold.Handler(t.syncerKey, t.failures, t.lastErr)
+	}
+
+	// NOTE: Start a new window, so the handler is called at most once per window.
+	t.windowStart, t.failures = time.Now(), 0
+
+	return !t.threshold.StopWatch
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+type (
+	// deletionWatcher watches the prefixes of all resources, and informs
+	// the keys disappearing from the snapshots of the prefixes.
+	deletionWatcher struct {
+		mutex   sync.Mutex
+		inf     *meshInformer
+		fn      DeletionFunc
+		options *watchOptions
+
+		syncerKeys []string
+		// last is the last snapshot of every resource type.
+		last    map[string]map[string]string
+		stopped bool
+	}
+)
+
+// OnAllDeletions watches deletions of services, service instances, tenants, ingresses
+// and custom resources. The deletions are informed one by one with the last known values,
+// and the callbacks are never called concurrently. The tenant of the informer is not
+// applied, all deletions in the mesh are informed.
+func (inf *meshInformer) OnAllDeletions(fn DeletionFunc, opts ...WatchOption) error {
+	w := &deletionWatcher{
+		inf:     inf,
+		fn:      fn,
+		options: newWatchOptions(opts),
+		last:    map[string]map[string]string{},
+	}
+
+	prefixes := []struct {
+		resourceType string
+		prefix       string
+	}{
+		{ResourceService, layout.ServiceSpecPrefix()},
+		{ResourceServiceInstanceSpec, layout.AllServiceInstanceSpecPrefix()},
+		{ResourceTenant, layout.TenantPrefix()},
+		{ResourceIngress, layout.IngressPrefix()},
+		{ResourceCustomResource, layout.AllCustomResourcePrefix()},
+	}
+
+	for _, p := range prefixes {
+		resourceType := p.resourceType
+		syncerKey := fmt.Sprintf("deletion-%s", resourceType)
+		err := inf.onSpecs(p.prefix, syncerKey, func(kvs map[string]string) bool {
+			return w.update(resourceType, kvs)
+		}, opts)
+		if err != nil {
+			w.stop()
+			return err
+		}
+
+		w.mutex.Lock()
+		w.syncerKeys = append(w.syncerKeys, syncerKey)
+		w.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// update informs the keys of the resource type deleted since the last snapshot,
+// the first snapshot is only recorded.
+func (w *deletionWatcher) update(resourceType string, kvs map[string]string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return true
+	}
+
+	last, informed := w.last[resourceType]
+	w.last[resourceType] = kvs
+	if !informed {
+		return true
+	}
+
+	deleted := []string{}
+	for key := range last {
+		if _, ok := kvs[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+
+	for _, key := range deleted {
+		continued := w.inf.invoke(fmt.Sprintf("deletion-%s", resourceType), w.options, func() bool {
+			return w.options.callback(func() bool { return w.fn(resourceType, key, last[key]) })
+		})
+		if !continued {
+			w.stopped = true
+			go w.stop()
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *deletionWatcher) stop() {
+	w.mutex.Lock()
+	w.stopped = true
+	syncerKeys := w.syncerKeys
+	w.syncerKeys = nil
+	w.mutex.Unlock()
+
+	for _, key := range syncerKeys {
+		w.inf.stopSyncOneKey(key)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// Delta is the changes of a snapshot against the last one, the keys are
+	// the same as the ones of the snapshot and sorted. A snapshot may carry
+	// more than one change, since the changes could be merged in syncing.
+	Delta struct {
+		Created []string
+		Updated []string
+		Deleted []string
+	}
+
+	// ServiceSpecsDeltaFunc is the callback function type for service specs with delta.
+	ServiceSpecsDeltaFunc func(snapshot map[string]*spec.Service, delta *Delta) bool
+
+	// ServiceInstanceSpecsDeltaFunc is the callback function type for service instance specs with delta.
+	ServiceInstanceSpecsDeltaFunc func(snapshot map[string]*spec.ServiceInstanceSpec, delta *Delta) bool
+
+	// TenantSpecsDeltaFunc is the callback function type for tenant specs with delta.
+	TenantSpecsDeltaFunc func(snapshot map[string]*spec.Tenant, delta *Delta) bool
+
+	// IngressSpecsDeltaFunc is the callback function type for ingress specs with delta.
+	IngressSpecsDeltaFunc func(snapshot map[string]*spec.Ingress, delta *Delta) bool
+
+	// deltaTracker computes the delta of snapshots against the last one.
+	deltaTracker struct {
+		// last is the last snapshot, it's a map from keys to spec pointers.
+		last reflect.Value
+	}
+)
+
+// Empty returns if nothing changes.
+func (d *Delta) Empty() bool {
+	return len(d.Created) == 0 && len(d.Updated) == 0 && len(d.Deleted) == 0
+}
+
+// update computes the delta of the snapshot, which must be a map from keys to
+// spec pointers. The first snapshot is informed as all keys are created.
+func (t *deltaTracker) update(snapshot interface{}) *Delta {
+	current := reflect.ValueOf(snapshot)
+	delta := &Delta{}
+
+	iter := current.MapRange()
+	for iter.Next() {
+		var last reflect.Value
+		if t.last.IsValid() {
+			last = t.last.MapIndex(iter.Key())
+		}
+		switch {
+		case !last.IsValid():
+			delta.Created = append(delta.Created, iter.Key().String())
+		case !reflect.DeepEqual(last.Interface(), iter.Value().Interface()):
+			delta.Updated = append(delta.Updated, iter.Key().String())
+		}
+	}
+
+	if t.last.IsValid() {
+		iter = t.last.MapRange()
+		for iter.Next() {
+			if !current.MapIndex(iter.Key()).IsValid() {
+				delta.Deleted = append(delta.Deleted, iter.Key().String())
+			}
+		}
+	}
+
+	sort.Strings(delta.Created)
+	sort.Strings(delta.Updated)
+	sort.Strings(delta.Deleted)
+	t.last = current
+
+	return delta
+}
+
+// OnAllServiceSpecsWithDelta watches all service specs like OnAllServiceSpecs,
+// and informs the delta against the last snapshot along with the snapshot.
+// The snapshots without any change are not informed.
+func (inf *meshInformer) OnAllServiceSpecsWithDelta(fn ServiceSpecsDeltaFunc, opts ...WatchOption) error {
+	t, options := &deltaTracker{}, newWatchOptions(opts)
+	return inf.OnAllServiceSpecs(func(snapshot map[string]*spec.Service) bool {
+		delta := t.update(snapshot)
+		if delta.Empty() {
+			return true
+		}
+		return options.callback(func() bool { return fn(snapshot, delta) })
+	}, withoutMaxEvents(opts)...)
+}
+
+// OnAllServiceInstanceSpecsWithDelta watches instance specs of all services like
+// OnAllServiceInstanceSpecs, and informs the delta along with the snapshot.
+func (inf *meshInformer) OnAllServiceInstanceSpecsWithDelta(fn ServiceInstanceSpecsDeltaFunc, opts ...WatchOption) error {
+	t, options := &deltaTracker{}, newWatchOptions(opts)
+	return inf.OnAllServiceInstanceSpecs(func(snapshot map[string]*spec.ServiceInstanceSpec) bool {
+		delta := t.update(snapshot)
+		if delta.Empty() {
+			return true
+		}
+		return options.callback(func() bool { return fn(snapshot, delta) })
+	}, withoutMaxEvents(opts)...)
+}
+
+// OnAllTenantSpecsWithDelta watches all tenant specs like OnAllTenantSpecs,
+// and informs the delta along with the snapshot.
+func (inf *meshInformer) OnAllTenantSpecsWithDelta(fn TenantSpecsDeltaFunc, opts ...WatchOption) error {
+	t, options := &deltaTracker{}, newWatchOptions(opts)
+	return inf.OnAllTenantSpecs(func(snapshot map[string]*spec.Tenant) bool {
+		delta := t.update(snapshot)
+		if delta.Empty() {
+			return true
+		}
+		return options.callback(func() bool { return fn(snapshot, delta) })
+	}, withoutMaxEvents(opts)...)
+}
+
+// OnAllIngressSpecsWithDelta watches all ingress specs like OnAllIngressSpecs,
+// and informs the delta along with the snapshot.
+func (inf *meshInformer) OnAllIngressSpecsWithDelta(fn IngressSpecsDeltaFunc, opts ...WatchOption) error {
+	t, options := &deltaTracker{}, newWatchOptions(opts)
+	return inf.OnAllIngressSpecs(func(snapshot map[string]*spec.Ingress) bool {
+		delta := t.update(snapshot)
+		if delta.Empty() {
+			return true
+		}
+		return options.callback(func() bool { return fn(snapshot, delta) })
+	}, withoutMaxEvents(opts)...)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// fanout delivers the data of one shared syncer to all its callbacks,
+	// exactly one of specFn and specsFn of the callbacks is set per fanout.
+	fanout struct {
+		mutex     sync.Mutex
+		inf       *meshInformer
+		syncerKey string
+		callbacks []*fanoutCallback
+
+		// the latest data, which is replayed to the joining callbacks.
+		informed  bool
+		lastEvent Event
+		lastValue string
+		lastKVs   map[string]string
+
+		stopped int32
+		done    chan struct{}
+	}
+
+	fanoutCallback struct {
+		options *watchOptions
+		specFn  specHandleFunc
+		specsFn specsHandleFunc
+
+		// isolated is created at the first delivery if the callback is isolated.
+		isolated *isolatedCallback
+	}
+)
+
+// WithSharedWatch makes the watch share one syncer with the other shared watches of
+// the same entry, instead of failing with ErrAlreadyWatched. The data is fanned out to
+// all callbacks, a joining callback is informed the latest data at once, and each
+// callback stops independently. The syncer stops after all callbacks stop.
+// NOTE: The syncer is created by the first watch, so only its start revision,
+// batch window and rate limit are used.
+func WithSharedWatch() WatchOption {
+	return func(o *watchOptions) {
+		o.shared = true
+	}
+}
+
+func newFanout(inf *meshInformer, syncerKey string) *fanout {
+	return &fanout{inf: inf, syncerKey: syncerKey, done: make(chan struct{})}
+}
+
+func (f *fanout) isStopped() bool {
+	return atomic.LoadInt32(&f.stopped) == 1
+}
+
+func (f *fanout) stop() {
+	if atomic.CompareAndSwapInt32(&f.stopped, 0, 1) {
+		close(f.done)
+	}
+}
+
+// add adds the callback and informs it the latest data if any. It reports
+// false if the fanout has stopped, so the caller should watch again.
+func (f *fanout) add(cb *fanoutCallback) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.isStopped() {
+		return false
+	}
+
+	if !f.informed || f.deliver(cb) {
+		f.callbacks = append(f.callbacks, cb)
+	}
+
+	return true
+}
+
+// onSpec is the specHandleFunc of the shared syncer.
+func (f *fanout) onSpec(event Event, value string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.informed, f.lastEvent, f.lastValue = true, event, value
+	return f.deliverAll()
+}
+
+// onSpecs is the specsHandleFunc of the shared syncer.
+func (f *fanout) onSpecs(kvs map[string]string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.informed, f.lastKVs = true, kvs
+	return f.deliverAll()
+}
+
+// deliverAll delivers the latest data to all callbacks, and removes the stopped ones.
+// It reports false if no callback is left, and the fanout stops.
+func (f *fanout) deliverAll() bool {
+	kept := f.callbacks[:0]
+	for _, cb := range f.callbacks {
+		if f.deliver(cb) {
+			kept = append(kept, cb)
+		}
+	}
+	for i := len(kept); i < len(f.callbacks); i++ {
+		f.callbacks[i] = nil
+	}
+	f.callbacks = kept
+
+	if len(f.callbacks) == 0 {
+		f.stop()
+		return false
+	}
+
+	return true
+}
+
+func (f *fanout) deliver(cb *fanoutCallback) bool {
+	if cb.options.isolateCallback {
+		return f.deliverIsolated(cb)
+	}
+
+	return f.inf.invoke(f.syncerKey, cb.options, func() bool {
+		if cb.specsFn != nil {
+			return cb.specsFn(f.lastKVs)
+		}
+		return cb.specFn(f.lastEvent, f.lastValue)
+	})
+}
@@ -19,18 +19,37 @@ package informer
 
 import (
 	"fmt"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"time"
 
 	yamljsontool "github.com/ghodss/yaml"
 	"github.com/tidwall/gjson"
 	"go.etcd.io/etcd/api/v3/mvccpb"
-	"gopkg.in/yaml.v2"
 
-	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+	"github.com/megaease/easegress/pkg/util/sampler"
+)
+
+const (
+	// ResourceService is the resource type of service spec.
+	ResourceService = "service"
+	// ResourceServiceInstanceSpec is the resource type of service instance spec.
+	ResourceServiceInstanceSpec = "serviceInstanceSpec"
+	// ResourceServiceInstanceStatus is the resource type of service instance status.
+	ResourceServiceInstanceStatus = "serviceInstanceStatus"
+	// ResourceTenant is the resource type of tenant spec.
+	ResourceTenant = "tenant"
+	// ResourceIngress is the resource type of ingress spec.
+	ResourceIngress = "ingress"
+	// ResourceCustomResource is the resource type of custom resource.
+	ResourceCustomResource = "customResource"
 )
 
 const (
@@ -58,6 +77,12 @@ const (
 
 	// ServiceCircuitBreaker is the path of service resilience's circuitBreaker part.
 	ServiceCircuitBreaker GJSONPath = "resilience.circuitBreaker"
+
+	// ServiceInstanceLastHeartbeatTime is the path of heartbeat time reported by instance.
+	ServiceInstanceLastHeartbeatTime GJSONPath = "lastHeartbeatTime"
+
+	// ServiceInstanceServerHeartbeatTime is the path of heartbeat time stamped by control plane.
+	ServiceInstanceServerHeartbeatTime GJSONPath = "serverHeartbeatTime"
 )
 
 type (
@@ -68,7 +93,62 @@ type (
 	}
 
 	// GJSONPath is the type of inform path, in GJSON syntax.
-	GJSONPath string
+	GJSONPath = spec.GJSONPath
+
+	// WatchOption is the option of a watch.
+	WatchOption func(*watchOptions)
+
+	// InformerOption is the option of an informer.
+	InformerOption func(*meshInformer)
+
+	watchOptions struct {
+		// events is the count of callback invocations, it's accessed atomically,
+		// so it's the first field to be 64-bit aligned.
+		events uint64
+
+		startRevision int64
+		recover       bool
+		ignoredPaths  GJSONPathSet
+		logicalKeys   bool
+
+		decodeErrorThreshold *DecodeErrorThreshold
+		nameFilter           *regexp.Regexp
+		shared               bool
+		batchWindow          time.Duration
+		rateLimit            *rateLimit
+		skipInitialSnapshot  bool
+		isolateCallback      bool
+
+		// revision is set to the revision of each snapshot before it's informed.
+		revision *int64
+
+		maxEvents int
+	}
+
+	// WatchStatus is the status of a watch.
+	WatchStatus struct {
+		SyncerKey string `yaml:"syncerKey"`
+		// Reestablished is how many times the watch has been re-established,
+		// a high count signals an unhealthy etcd or a slow consumer.
+		Reestablished uint64 `yaml:"reestablished"`
+	}
+
+	// Metrics is the metrics snapshot of the informer.
+	Metrics struct {
+		Watches       int    `yaml:"watches"`
+		Reestablished uint64 `yaml:"reestablished"`
+		// DecodeLatencies is the latency of decoding values per resource type,
+		// only the resource types having been decoded are included.
+		DecodeLatencies map[string]*DecodeLatency `yaml:"decodeLatencies"`
+	}
+
+	// DecodeLatency is the latency distribution of decoding values, in millisecond.
+	DecodeLatency struct {
+		Count float64 `yaml:"count"`
+		P50   float64 `yaml:"p50"`
+		P95   float64 `yaml:"p95"`
+		P99   float64 `yaml:"p99"`
+	}
 
 	specHandleFunc  func(event Event, value string) bool
 	specsHandleFunc func(map[string]string) bool
@@ -106,30 +186,73 @@ type (
 	// IngressSpecsFunc is the callback function type for service specs.
 	IngressSpecsFunc func(value map[string]*spec.Ingress) bool
 
+	// TenantServiceCountFunc is the callback function type for service counts of tenants,
+	// which is keyed by tenant names.
+	TenantServiceCountFunc func(counts map[string]int) bool
+
+	// ServiceTenantChangeFunc is the callback function type for a service moving
+	// from the old tenant to the new one.
+	ServiceTenantChangeFunc func(serviceName, oldTenant, newTenant string) bool
+
+	// DeletionFunc is the callback function type for deletions of all resources,
+	// prevValue is the last known value of the deleted key.
+	DeletionFunc func(resourceType, key, prevValue string) bool
+
 	// Informer is the interface for informing two type of storage changed for every Mesh spec structure.
 	//  1. Based on comparison between old and new part of entry.
 	//  2. Based on comparison on entries with the same prefix.
 	Informer interface {
-		OnPartOfServiceSpec(serviceName string, gjsonPath GJSONPath, fn ServiceSpecFunc) error
-		OnAllServiceSpecs(fn ServiceSpecsFunc) error
-
-		OnPartOfServiceInstanceSpec(serviceName, instanceID string, gjsonPath GJSONPath, fn ServicesInstanceSpecFunc) error
-		OnServiceInstanceSpecs(serviceName string, fn ServiceInstanceSpecsFunc) error
-		OnAllServiceInstanceSpecs(fn ServiceInstanceSpecsFunc) error
-
-		OnPartOfServiceInstanceStatus(serviceName, instanceID string, gjsonPath GJSONPath, fn ServiceInstanceStatusFunc) error
-		OnServiceInstanceStatuses(serviceName string, fn ServiceInstanceStatusesFunc) error
-		OnAllServiceInstanceStatuses(fn ServiceInstanceStatusesFunc) error
-
-		OnPartOfTenantSpec(tenantName string, gjsonPath GJSONPath, fn TenantSpecFunc) error
-		OnAllTenantSpecs(fn TenantSpecsFunc) error
-
-		OnPartOfIngressSpec(serviceName string, gjsonPath GJSONPath, fn IngressSpecFunc) error
-		OnAllIngressSpecs(fn IngressSpecsFunc) error
+		OnPartOfServiceSpec(serviceName string, gjsonPath GJSONPath, fn ServiceSpecFunc, opts ...WatchOption) error
+		OnPartsOfServiceSpec(serviceName string, paths GJSONPathSet, fn ServiceSpecFunc, opts ...WatchOption) error
+		OnServiceSpecPaths(serviceName string, handlers map[GJSONPath]ServiceSpecFunc, opts ...WatchOption) error
+		OnPartOfServiceSpecPatch(serviceName string, fn PatchFunc, opts ...WatchOption) error
+		OnAllServiceSpecs(fn ServiceSpecsFunc, opts ...WatchOption) error
+		OnAllServiceSpecsWithDelta(fn ServiceSpecsDeltaFunc, opts ...WatchOption) error
+		OnAllServiceSpecsWithRevision(fn ServiceSpecsRevisionFunc, opts ...WatchOption) error
+
+		OnPartOfServiceInstanceSpec(serviceName, instanceID string, gjsonPath GJSONPath, fn ServicesInstanceSpecFunc, opts ...WatchOption) error
+		OnPartsOfServiceInstanceSpec(serviceName, instanceID string, paths GJSONPathSet, fn ServicesInstanceSpecFunc, opts ...WatchOption) error
+		OnServiceInstanceSpecs(serviceName string, fn ServiceInstanceSpecsFunc, opts ...WatchOption) error
+		OnServiceInstanceSpecsMulti(serviceNames []string, fn ServiceInstanceSpecsMultiFunc, opts ...WatchOption) error
+		OnAllServiceInstanceSpecs(fn ServiceInstanceSpecsFunc, opts ...WatchOption) error
+		OnAllServiceInstanceSpecsWithDelta(fn ServiceInstanceSpecsDeltaFunc, opts ...WatchOption) error
+		OnAllServiceInstanceSpecsWithRevision(fn ServiceInstanceSpecsRevisionFunc, opts ...WatchOption) error
+
+		OnPartOfServiceInstanceStatus(serviceName, instanceID string, gjsonPath GJSONPath, fn ServiceInstanceStatusFunc, opts ...WatchOption) error
+		OnPartsOfServiceInstanceStatus(serviceName, instanceID string, paths GJSONPathSet, fn ServiceInstanceStatusFunc, opts ...WatchOption) error
+		OnServiceInstanceStatuses(serviceName string, fn ServiceInstanceStatusesFunc, opts ...WatchOption) error
+		OnAllServiceInstanceStatuses(fn ServiceInstanceStatusesFunc, opts ...WatchOption) error
+		OnAllServiceInstanceStatusesWithRevision(fn ServiceInstanceStatusesRevisionFunc, opts ...WatchOption) error
+		OnStaleInstances(serviceName string, staleAfter time.Duration, fn StaleInstancesFunc, opts ...WatchOption) error
+		OnZombieInstances(gracePeriod time.Duration, fn ZombieInstancesFunc, opts ...WatchOption) error
+
+		OnPartOfTenantSpec(tenantName string, gjsonPath GJSONPath, fn TenantSpecFunc, opts ...WatchOption) error
+		OnPartsOfTenantSpec(tenantName string, paths GJSONPathSet, fn TenantSpecFunc, opts ...WatchOption) error
+		OnAllTenantSpecs(fn TenantSpecsFunc, opts ...WatchOption) error
+		OnAllTenantSpecsWithDelta(fn TenantSpecsDeltaFunc, opts ...WatchOption) error
+		OnAllTenantSpecsWithRevision(fn TenantSpecsRevisionFunc, opts ...WatchOption) error
+		OnTenantServiceCount(fn TenantServiceCountFunc, opts ...WatchOption) error
+		OnServiceTenantChange(fn ServiceTenantChangeFunc, opts ...WatchOption) error
+
+		OnPartOfIngressSpec(serviceName string, gjsonPath GJSONPath, fn IngressSpecFunc, opts ...WatchOption) error
+		OnPartsOfIngressSpec(serviceName string, paths GJSONPathSet, fn IngressSpecFunc, opts ...WatchOption) error
+		OnAllIngressSpecs(fn IngressSpecsFunc, opts ...WatchOption) error
+		OnAllIngressSpecsWithDelta(fn IngressSpecsDeltaFunc, opts ...WatchOption) error
+		OnAllIngressSpecsWithRevision(fn IngressSpecsRevisionFunc, opts ...WatchOption) error
+
+		OnTypedCustomResources(kind string, factory CustomResourceFactory, fn TypedCustomResourcesFunc, opts ...WatchOption) error
+
+		OnValidationFailures(fn ValidationFailuresFunc, opts ...WatchOption) error
+
+		OnAllDeletions(fn DeletionFunc, opts ...WatchOption) error
+		OnComputed(sources []WatchSpec, compute ComputeFunc, fn ComputedFunc, opts ...WatchOption) error
 
 		StopWatchServiceSpec(serviceName string, gjsonPath GJSONPath)
 		StopWatchServiceInstanceSpec(serviceName string)
 
+		WatchStatus() []*WatchStatus
+		Metrics() *Metrics
+
 		Close()
 	}
 
@@ -137,12 +260,22 @@ type (
 	meshInformer struct {
 		mutex   sync.RWMutex
 		store   storage.Storage
-		syncers map[string]*cluster.Syncer
+		syncers map[string]storage.Syncer
+		// fanouts is the fanouts of the shared syncers, keyed by syncer keys.
+		fanouts map[string]*fanout
 
 		service         string
 		globalServices  map[string]bool   // name of service in global tenant
 		service2Tenants map[string]string // service name to its registered tenant
 
+		// channelBuffer is the buffer size of syncer channels, zero means the default.
+		channelBuffer int
+		// decodeSamplers is read-only after creating, the samplers are concurrently safe.
+		decodeSamplers map[string]*sampler.DurationSampler
+		// computedWatches is the count of computed watches, it's used atomically
+		// to generate unique syncer keys.
+		computedWatches uint64
+
 		closed bool
 		done   chan struct{}
 	}
@@ -157,21 +290,107 @@ var (
 
 	// ErrNotFound is the error when watching an entry which is not found.
 	ErrNotFound = fmt.Errorf("not found")
+
+	// ErrNilChannel is the error when the syncer returns a nil channel without error,
+	// which would block the watch forever.
+	ErrNilChannel = fmt.Errorf("syncer returned nil channel")
 )
 
+// WithStartRevision makes the watch only inform changes after the revision,
+// instead of informing the current data at the beginning. It falls back to
+// informing the current data if the revision has been compacted.
+func WithStartRevision(revision int64) WatchOption {
+	return func(o *watchOptions) {
+		o.startRevision = revision
+	}
+}
+
+// WithRecover makes the watch recover from the panic of its callback,
+// the event causing the panic is skipped but the watch keeps alive.
+// By default, the panic of callback is not recovered.
+func WithRecover() WatchOption {
+	return func(o *watchOptions) {
+		o.recover = true
+	}
+}
+
+// WithIgnoredPaths makes the status watches skip the changes only within the paths,
+// e.g. HeartbeatPaths filters out the pure heartbeat churn. The first value is always
+// informed. Only paths of dot-separated object keys are supported.
+func WithIgnoredPaths(paths ...GJSONPath) WatchOption {
+	return func(o *watchOptions) {
+		o.ignoredPaths = append(o.ignoredPaths, paths...)
+	}
+}
+
+// WithLogicalKeys makes the prefix watches deliver the maps keyed by the logical names
+// of resources parsed from the specs instead of the store keys. Instances are keyed by
+// their IDs, which are qualified as serviceName/instanceID when watching all services.
+func WithLogicalKeys() WatchOption {
+	return func(o *watchOptions) {
+		o.logicalKeys = true
+	}
+}
+
+// WithChannelBuffer sets the buffer size of the channels of all watches of the informer,
+// a larger buffer trades memory for resilience to slow callbacks on high-churn data.
+// By default, the buffer size of the storage is used.
+func WithChannelBuffer(size int) InformerOption {
+	return func(inf *meshInformer) {
+		inf.channelBuffer = size
+	}
+}
+
+func newWatchOptions(opts []WatchOption) *watchOptions {
+	o := &watchOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// instanceKey returns the logical key of the instance if required, otherwise the store key.
+func (o *watchOptions) instanceKey(storeKey string, all bool, serviceName, instanceID string) string {
+	switch {
+	case !o.logicalKeys:
+		return storeKey
+	case all:
+		return serviceName + "/" + instanceID
+	default:
+		return instanceID
+	}
+}
+
+// nameKey returns the name if logical keys are required, otherwise the store key.
+func (o *watchOptions) nameKey(storeKey, name string) string {
+	if o.logicalKeys {
+		return name
+	}
+	return storeKey
+}
+
 // NewInformer creates an informer
 // If service is specified, will only inform resource changes within the same tenant
 // of the service and the global tenant, note this only apply to service, service instance
 // and service status.
 // if service is empty, will inform all resource changes.
-func NewInformer(store storage.Storage, service string) Informer {
+func NewInformer(store storage.Storage, service string, opts ...InformerOption) Informer {
 	inf := &meshInformer{
 		store:           store,
-		syncers:         make(map[string]*cluster.Syncer),
+		syncers:         make(map[string]storage.Syncer),
+		fanouts:         make(map[string]*fanout),
 		done:            make(chan struct{}),
 		service:         service,
 		globalServices:  make(map[string]bool),
 		service2Tenants: make(map[string]string),
+		decodeSamplers:  make(map[string]*sampler.DurationSampler),
+	}
+	for _, resource := range []string{ResourceService, ResourceServiceInstanceSpec,
+		ResourceServiceInstanceStatus, ResourceTenant, ResourceIngress} {
+		inf.decodeSamplers[resource] = sampler.NewDurationSampler()
+	}
+	for _, opt := range opts {
+		opt(inf)
 	}
 
 	// empty service name means we won't filter data by tenant
@@ -188,7 +407,7 @@ func NewInformer(store storage.Storage, service string) Informer {
 	inf.buildServiceToTenantMap(services)
 
 	syncerKey := "informer-service"
-	inf.onSpecs(storeKey, syncerKey, inf.buildServiceToTenantMap)
+	inf.onSpecs(storeKey, syncerKey, inf.buildServiceToTenantMap, nil)
 
 	storeKey = layout.TenantSpecKey(spec.GlobalTenant)
 	tenants, err := inf.store.GetPrefix(storeKey)
@@ -199,16 +418,16 @@ func NewInformer(store storage.Storage, service string) Informer {
 	inf.updateGlobalServices(tenants)
 
 	syncerKey = "informer-global-tenant"
-	inf.onSpecs(storeKey, syncerKey, inf.updateGlobalServices)
+	inf.onSpecs(storeKey, syncerKey, inf.updateGlobalServices, nil)
 
 	return inf
 }
 
 func (inf *meshInformer) updateGlobalServices(kvs map[string]string) bool {
 	var tenant *spec.Tenant
-	for _, v := range kvs {
+	for k, v := range kvs {
 		t := &spec.Tenant{}
-		if err := yaml.Unmarshal([]byte(v), t); err != nil {
+		if err := inf.decode(k, []byte(v), t); err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
 		}
@@ -234,9 +453,9 @@ func (inf *meshInformer) updateGlobalServices(kvs map[string]string) bool {
 
 func (inf *meshInformer) buildServiceToTenantMap(kvs map[string]string) bool {
 	s2t := make(map[string]string, len(kvs))
-	for _, v := range kvs {
+	for k, v := range kvs {
 		service := &spec.Service{}
-		if err := yaml.Unmarshal([]byte(v), service); err != nil {
+		if err := inf.decode(k, []byte(v), service); err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
 		}
@@ -261,6 +480,10 @@ func (inf *meshInformer) stopSyncOneKey(key string) {
 		syncer.Close()
 		delete(inf.syncers, key)
 	}
+	if f, exists := inf.fanouts[key]; exists {
+		f.stop()
+		delete(inf.fanouts, key)
+	}
 }
 
 func serviceSpecSyncerKey(serviceName string, gjsonPath GJSONPath) string {
@@ -268,22 +491,27 @@ func serviceSpecSyncerKey(serviceName string, gjsonPath GJSONPath) string {
 }
 
 // OnPartOfServiceSpec watches one service's spec by given gjsonPath.
-func (inf *meshInformer) OnPartOfServiceSpec(serviceName string, gjsonPath GJSONPath, fn ServiceSpecFunc) error {
+func (inf *meshInformer) OnPartOfServiceSpec(serviceName string, gjsonPath GJSONPath, fn ServiceSpecFunc, opts ...WatchOption) error {
+	if err := ValidateGJSONPath(gjsonPath); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
 	storeKey := layout.ServiceSpecKey(serviceName)
 	syncerKey := serviceSpecSyncerKey(serviceName, gjsonPath)
 
 	specFunc := func(event Event, value string) bool {
 		serviceSpec := &spec.Service{}
 		if event.EventType != EventDelete {
-			if err := yaml.Unmarshal([]byte(value), serviceSpec); err != nil {
+			if err := inf.decode(storeKey, []byte(value), serviceSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
 				return true
 			}
 		}
-		return fn(event, serviceSpec)
+		return options.callback(func() bool { return fn(event, serviceSpec) })
 	}
 
-	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc)
+	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc, opts)
 }
 
 func (inf *meshInformer) StopWatchServiceSpec(serviceName string, gjsonPath GJSONPath) {
@@ -292,85 +520,109 @@ func (inf *meshInformer) StopWatchServiceSpec(serviceName string, gjsonPath GJSO
 }
 
 // OnPartOfServiceInstanceSpec watches one service's instance spec by given gjsonPath.
-func (inf *meshInformer) OnPartOfServiceInstanceSpec(serviceName, instanceID string, gjsonPath GJSONPath, fn ServicesInstanceSpecFunc) error {
+func (inf *meshInformer) OnPartOfServiceInstanceSpec(serviceName, instanceID string, gjsonPath GJSONPath, fn ServicesInstanceSpecFunc, opts ...WatchOption) error {
+	if err := ValidateGJSONPath(gjsonPath); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
 	storeKey := layout.ServiceInstanceSpecKey(serviceName, instanceID)
 	syncerKey := fmt.Sprintf("service-instance-spec-%s-%s-%s", serviceName, instanceID, gjsonPath)
 
 	specFunc := func(event Event, value string) bool {
 		instanceSpec := &spec.ServiceInstanceSpec{}
 		if event.EventType != EventDelete {
-			if err := yaml.Unmarshal([]byte(value), instanceSpec); err != nil {
+			if err := inf.decode(storeKey, []byte(value), instanceSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
 				return true
 			}
 		}
-		return fn(event, instanceSpec)
+		return options.callback(func() bool { return fn(event, instanceSpec) })
 	}
 
-	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc)
+	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc, opts)
 }
 
 // OnPartOfServiceInstanceStatus watches one service instance status spec by given gjsonPath.
-func (inf *meshInformer) OnPartOfServiceInstanceStatus(serviceName, instanceID string, gjsonPath GJSONPath, fn ServiceInstanceStatusFunc) error {
+func (inf *meshInformer) OnPartOfServiceInstanceStatus(serviceName, instanceID string, gjsonPath GJSONPath, fn ServiceInstanceStatusFunc, opts ...WatchOption) error {
+	if err := ValidateGJSONPath(gjsonPath); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
 	storeKey := layout.ServiceInstanceStatusKey(serviceName, instanceID)
 	syncerKey := fmt.Sprintf("service-instance-status-%s-%s-%s", serviceName, instanceID, gjsonPath)
 
 	specFunc := func(event Event, value string) bool {
 		instanceStatus := &spec.ServiceInstanceStatus{}
 		if event.EventType != EventDelete {
-			if err := yaml.Unmarshal([]byte(value), instanceStatus); err != nil {
+			if err := inf.decode(storeKey, []byte(value), instanceStatus); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
 				return true
 			}
 		}
-		return fn(event, instanceStatus)
+		return options.callback(func() bool { return fn(event, instanceStatus) })
 	}
 
-	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc)
+	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc, opts)
 }
 
 // OnPartOfTenantSpec watches one tenant status spec by given gjsonPath.
-func (inf *meshInformer) OnPartOfTenantSpec(tenant string, gjsonPath GJSONPath, fn TenantSpecFunc) error {
+func (inf *meshInformer) OnPartOfTenantSpec(tenant string, gjsonPath GJSONPath, fn TenantSpecFunc, opts ...WatchOption) error {
+	if err := ValidateGJSONPath(gjsonPath); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
 	storeKey := layout.TenantSpecKey(tenant)
 	syncerKey := fmt.Sprintf("tenant-%s", tenant)
 
 	specFunc := func(event Event, value string) bool {
 		tenantSpec := &spec.Tenant{}
 		if event.EventType != EventDelete {
-			if err := yaml.Unmarshal([]byte(value), tenantSpec); err != nil {
+			if err := inf.decode(storeKey, []byte(value), tenantSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
 				return true
 			}
 		}
-		return fn(event, tenantSpec)
+		return options.callback(func() bool { return fn(event, tenantSpec) })
 	}
 
-	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc)
+	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc, opts)
 }
 
 // OnPartOfIngressSpec watches one ingress status spec by given gjsonPath.
-func (inf *meshInformer) OnPartOfIngressSpec(ingress string, gjsonPath GJSONPath, fn IngressSpecFunc) error {
+func (inf *meshInformer) OnPartOfIngressSpec(ingress string, gjsonPath GJSONPath, fn IngressSpecFunc, opts ...WatchOption) error {
+	if err := ValidateGJSONPath(gjsonPath); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
 	storeKey := layout.IngressSpecKey(ingress)
 	syncerKey := fmt.Sprintf("ingress-%s", ingress)
 
 	specFunc := func(event Event, value string) bool {
 		ingressSpec := &spec.Ingress{}
 		if event.EventType != EventDelete {
-			if err := yaml.Unmarshal([]byte(value), ingressSpec); err != nil {
+			if err := inf.decode(storeKey, []byte(value), ingressSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
 				return true
 			}
 		}
-		return fn(event, ingressSpec)
+		return options.callback(func() bool { return fn(event, ingressSpec) })
 	}
 
-	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc)
+	return inf.onSpecPart(storeKey, syncerKey, gjsonPath, specFunc, opts)
 }
 
 // OnAllServiceSpecs watches all service specs
-func (inf *meshInformer) OnAllServiceSpecs(fn ServiceSpecsFunc) error {
+func (inf *meshInformer) OnAllServiceSpecs(fn ServiceSpecsFunc, opts ...WatchOption) error {
 	storeKey := layout.ServiceSpecPrefix()
 	syncerKey := "prefix-service"
+	options := newWatchOptions(opts)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
 
 	specsFunc := func(kvs map[string]string) bool {
 		inf.mutex.RLock()
@@ -386,26 +638,43 @@ func (inf *meshInformer) OnAllServiceSpecs(fn ServiceSpecsFunc) error {
 		services := make(map[string]*spec.Service)
 		for k, v := range kvs {
 			service := &spec.Service{}
-			if err := yaml.Unmarshal([]byte(v), service); err != nil {
+			if err := inf.decode(k, []byte(v), service); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
+				continue
+			}
+			if !options.matchName(service.Name) {
 				continue
 			}
 			if len(tenant) == 0 || gs[service.Name] || service.RegisterTenant == tenant {
-				services[k] = service
+				services[options.nameKey(k, service.Name)] = service
 			}
 		}
 
-		return fn(services)
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(services) {
+			return true
+		}
+
+		return options.callback(func() bool { return fn(services) })
 	}
 
-	return inf.onSpecs(storeKey, syncerKey, specsFunc)
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
 }
 
 func serviceInstanceSpecSyncerKey(serviceName string) string {
 	return fmt.Sprintf("prefix-service-instance-spec-%s", serviceName)
 }
 
-func (inf *meshInformer) onServiceInstanceSpecs(storeKey, syncerKey string, fn ServiceInstanceSpecsFunc) error {
+func (inf *meshInformer) onServiceInstanceSpecs(storeKey, syncerKey string, fn ServiceInstanceSpecsFunc, opts []WatchOption) error {
+	options := newWatchOptions(opts)
+	all := storeKey == layout.AllServiceInstanceSpecPrefix()
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
+
 	specsFunc := func(kvs map[string]string) bool {
 		inf.mutex.RLock()
 		gs := inf.globalServices
@@ -420,33 +689,44 @@ func (inf *meshInformer) onServiceInstanceSpecs(storeKey, syncerKey string, fn S
 		instanceSpecs := make(map[string]*spec.ServiceInstanceSpec)
 		for k, v := range kvs {
 			instanceSpec := &spec.ServiceInstanceSpec{}
-			if err := yaml.Unmarshal([]byte(v), instanceSpec); err != nil {
+			if err := inf.decode(k, []byte(v), instanceSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
+				continue
+			}
+			if !options.matchName(instanceSpec.ServiceName) {
 				continue
 			}
 			if len(tenant) == 0 || gs[instanceSpec.ServiceName] || s2t[instanceSpec.ServiceName] == tenant {
-				instanceSpecs[k] = instanceSpec
+				instanceSpecs[options.instanceKey(k, all, instanceSpec.ServiceName, instanceSpec.InstanceID)] = instanceSpec
 			}
 		}
 
-		return fn(instanceSpecs)
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(instanceSpecs) {
+			return true
+		}
+
+		return options.callback(func() bool { return fn(instanceSpecs) })
 	}
 
-	return inf.onSpecs(storeKey, syncerKey, specsFunc)
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
 }
 
 // OnServiceInstanceSpecs watches all instance specs of a service.
-func (inf *meshInformer) OnServiceInstanceSpecs(serviceName string, fn ServiceInstanceSpecsFunc) error {
+func (inf *meshInformer) OnServiceInstanceSpecs(serviceName string, fn ServiceInstanceSpecsFunc, opts ...WatchOption) error {
 	storeKey := layout.ServiceInstanceSpecPrefix(serviceName)
 	syncerKey := serviceInstanceSpecSyncerKey(serviceName)
-	return inf.onServiceInstanceSpecs(storeKey, syncerKey, fn)
+	return inf.onServiceInstanceSpecs(storeKey, syncerKey, fn, opts)
 }
 
 // OnAllServiceInstanceSpecs watches instance specs of all services.
-func (inf *meshInformer) OnAllServiceInstanceSpecs(fn ServiceInstanceSpecsFunc) error {
+func (inf *meshInformer) OnAllServiceInstanceSpecs(fn ServiceInstanceSpecsFunc, opts ...WatchOption) error {
 	storeKey := layout.AllServiceInstanceSpecPrefix()
 	syncerKey := "prefix-service-instance"
-	return inf.onServiceInstanceSpecs(storeKey, syncerKey, fn)
+	return inf.onServiceInstanceSpecs(storeKey, syncerKey, fn, opts)
 }
 
 func (inf *meshInformer) StopWatchServiceInstanceSpec(serviceName string) {
@@ -454,7 +734,19 @@ func (inf *meshInformer) StopWatchServiceInstanceSpec(serviceName string) {
 	inf.stopSyncOneKey(syncerKey)
 }
 
-func (inf *meshInformer) onServiceInstanceStatuses(storeKey, syncerKey string, fn ServiceInstanceStatusesFunc) error {
+func (inf *meshInformer) onServiceInstanceStatuses(storeKey, syncerKey string, fn ServiceInstanceStatusesFunc, opts []WatchOption) error {
+	options := newWatchOptions(opts)
+	ignoredPaths := options.ignoredPaths
+	all := storeKey == layout.AllServiceInstanceStatusPrefix()
+
+	var (
+		informed bool
+		last     map[string]string
+	)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
+
 	specsFunc := func(kvs map[string]string) bool {
 		inf.mutex.RLock()
 		gs := inf.globalServices
@@ -469,82 +761,229 @@ func (inf *meshInformer) onServiceInstanceStatuses(storeKey, syncerKey string, f
 		instanceStatuses := make(map[string]*spec.ServiceInstanceStatus)
 		for k, v := range kvs {
 			instanceStatus := &spec.ServiceInstanceStatus{}
-			if err := yaml.Unmarshal([]byte(v), instanceStatus); err != nil {
+			if err := inf.decode(k, []byte(v), instanceStatus); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
+				continue
+			}
+			if !options.matchName(instanceStatus.ServiceName) {
 				continue
 			}
 			if len(tenant) == 0 || gs[instanceStatus.ServiceName] || s2t[instanceStatus.ServiceName] == tenant {
-				instanceStatuses[k] = instanceStatus
+				instanceStatuses[options.instanceKey(k, all, instanceStatus.ServiceName, instanceStatus.InstanceID)] = instanceStatus
+			}
+		}
+
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(instanceStatuses) {
+			return true
+		}
+
+		if len(ignoredPaths) > 0 {
+			current := make(map[string]string, len(instanceStatuses))
+			for k, instanceStatus := range instanceStatuses {
+				significant, err := stripPaths(instanceStatus, ignoredPaths)
+				if err != nil {
+					logger.Errorf("BUG: strip paths %s of %s failed: %v", ignoredPaths, k, err)
+					return options.callback(func() bool { return fn(instanceStatuses) })
+				}
+				current[k] = significant
 			}
+
+			if informed && reflect.DeepEqual(last, current) {
+				return true
+			}
+			informed, last = true, current
 		}
 
-		return fn(instanceStatuses)
+		return options.callback(func() bool { return fn(instanceStatuses) })
 	}
 
-	return inf.onSpecs(storeKey, syncerKey, specsFunc)
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
 }
 
 // OnServiceInstanceStatuses watches instance statuses of a service
-func (inf *meshInformer) OnServiceInstanceStatuses(serviceName string, fn ServiceInstanceStatusesFunc) error {
+func (inf *meshInformer) OnServiceInstanceStatuses(serviceName string, fn ServiceInstanceStatusesFunc, opts ...WatchOption) error {
 	storeKey := layout.ServiceInstanceStatusPrefix(serviceName)
 	syncerKey := fmt.Sprintf("prefix-service-instance-status-%s", serviceName)
-	return inf.onServiceInstanceStatuses(storeKey, syncerKey, fn)
+	return inf.onServiceInstanceStatuses(storeKey, syncerKey, fn, opts)
 }
 
 // OnAllServiceInstanceStatuses watches instance statuses of all services
-func (inf *meshInformer) OnAllServiceInstanceStatuses(fn ServiceInstanceStatusesFunc) error {
+func (inf *meshInformer) OnAllServiceInstanceStatuses(fn ServiceInstanceStatusesFunc, opts ...WatchOption) error {
 	storeKey := layout.AllServiceInstanceStatusPrefix()
 	syncerKey := "prefix-service-instance-status"
-	return inf.onServiceInstanceStatuses(storeKey, syncerKey, fn)
+	return inf.onServiceInstanceStatuses(storeKey, syncerKey, fn, opts)
 }
 
 // OnAllTenantSpecs watches all tenant specs
-func (inf *meshInformer) OnAllTenantSpecs(fn TenantSpecsFunc) error {
+func (inf *meshInformer) OnAllTenantSpecs(fn TenantSpecsFunc, opts ...WatchOption) error {
 	storeKey := layout.TenantPrefix()
 	syncerKey := "prefix-tenant"
+	options := newWatchOptions(opts)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
 
 	specsFunc := func(kvs map[string]string) bool {
 		tenants := make(map[string]*spec.Tenant)
 		for k, v := range kvs {
 			tenantSpec := &spec.Tenant{}
-			if err := yaml.Unmarshal([]byte(v), tenantSpec); err != nil {
+			if err := inf.decode(k, []byte(v), tenantSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
 				continue
 			}
-			tenants[k] = tenantSpec
+			if !options.matchName(tenantSpec.Name) {
+				continue
+			}
+			tenants[options.nameKey(k, tenantSpec.Name)] = tenantSpec
 		}
 
-		return fn(tenants)
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(tenants) {
+			return true
+		}
+
+		return options.callback(func() bool { return fn(tenants) })
 	}
 
-	return inf.onSpecs(storeKey, syncerKey, specsFunc)
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
+}
+
+// OnTenantServiceCount watches the service counts of all tenants, the callback
+// is called only when any count changes, including adding and deleting tenants.
+func (inf *meshInformer) OnTenantServiceCount(fn TenantServiceCountFunc, opts ...WatchOption) error {
+	options := newWatchOptions(opts)
+	storeKey := layout.TenantPrefix()
+	syncerKey := "tenant-service-count"
+
+	var (
+		informed bool
+		last     map[string]int
+	)
+
+	specsFunc := func(kvs map[string]string) bool {
+		counts := make(map[string]int, len(kvs))
+		for k, v := range kvs {
+			tenantSpec := &spec.Tenant{}
+			if err := inf.decode(k, []byte(v), tenantSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			counts[tenantSpec.Name] = len(tenantSpec.Services)
+		}
+
+		if informed && reflect.DeepEqual(last, counts) {
+			return true
+		}
+		informed, last = true, counts
+
+		return options.callback(func() bool { return fn(counts) })
+	}
+
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
+}
+
+// OnServiceTenantChange watches the tenants of all services, the callback is called only
+// when a service moves to another tenant, in the order of service names. The services
+// created or deleted are not informed, neither are the ones in the first snapshot.
+func (inf *meshInformer) OnServiceTenantChange(fn ServiceTenantChangeFunc, opts ...WatchOption) error {
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceSpecPrefix()
+	syncerKey := "service-tenant-change"
+
+	var (
+		informed bool
+		last     map[string]string
+	)
+
+	specsFunc := func(kvs map[string]string) bool {
+		tenants := make(map[string]string, len(kvs))
+		for k, v := range kvs {
+			serviceSpec := &spec.Service{}
+			if err := inf.decode(k, []byte(v), serviceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			tenants[serviceSpec.Name] = serviceSpec.RegisterTenant
+		}
+
+		previous := last
+		last = tenants
+		if !informed {
+			informed = true
+			return true
+		}
+
+		names := make([]string, 0, len(tenants))
+		for name, tenant := range tenants {
+			if oldTenant, ok := previous[name]; ok && oldTenant != tenant {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			name := name
+			if !options.callback(func() bool { return fn(name, previous[name], tenants[name]) }) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
 }
 
 // OnAllIngressSpecs watches all ingress specs
-func (inf *meshInformer) OnAllIngressSpecs(fn IngressSpecsFunc) error {
+func (inf *meshInformer) OnAllIngressSpecs(fn IngressSpecsFunc, opts ...WatchOption) error {
 	storeKey := layout.IngressPrefix()
 	syncerKey := "prefix-ingress"
+	options := newWatchOptions(opts)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
 
 	specsFunc := func(kvs map[string]string) bool {
 		ingresss := make(map[string]*spec.Ingress)
 		for k, v := range kvs {
 			ingressSpec := &spec.Ingress{}
-			if err := yaml.Unmarshal([]byte(v), ingressSpec); err != nil {
+			if err := inf.decode(k, []byte(v), ingressSpec); err != nil {
 				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
 				continue
 			}
-			ingresss[k] = ingressSpec
+			if !options.matchName(ingressSpec.Name) {
+				continue
+			}
+			ingresss[options.nameKey(k, ingressSpec.Name)] = ingressSpec
+		}
+
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(ingresss) {
+			return true
 		}
 
-		return fn(ingresss)
+		return options.callback(func() bool { return fn(ingresss) })
 	}
 
-	return inf.onSpecs(storeKey, syncerKey, specsFunc)
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
 }
 
-func (inf *meshInformer) comparePart(path GJSONPath, old, new string) bool {
-	if path == AllParts {
-		return old == new
+// comparePart reports if all parts of the paths are the same in old and new yaml.
+func (inf *meshInformer) comparePart(paths GJSONPathSet, old, new string) bool {
+	for _, path := range paths {
+		if path == AllParts {
+			return old == new
+		}
 	}
 
 	oldJSON, err := yamljsontool.YAMLToJSON([]byte(old))
@@ -559,76 +998,193 @@ func (inf *meshInformer) comparePart(path GJSONPath, old, new string) bool {
 		return true
 	}
 
-	return gjson.Get(string(oldJSON), string(path)) == gjson.Get(string(newJSON), string(path))
+	for _, path := range paths {
+		oldPart := gjson.GetBytes(oldJSON, string(path))
+		newPart := gjson.GetBytes(newJSON, string(path))
+		if oldPart.Raw != newPart.Raw {
+			return false
+		}
+	}
+
+	return true
 }
 
 // TODO: gjsonPath is useless now, need to be removed
 // also need to rename this function and all its caller functions
 // as they are not accurate anymore
-func (inf *meshInformer) onSpecPart(storeKey, syncerKey string, gjsonPath GJSONPath, fn specHandleFunc) error {
-	inf.mutex.Lock()
-	defer inf.mutex.Unlock()
+func (inf *meshInformer) onSpecPart(storeKey, syncerKey string, gjsonPath GJSONPath, fn specHandleFunc, opts []WatchOption) error {
+	options := newWatchOptions(opts)
+	cb := &fanoutCallback{options: options, specFn: fn}
+
+	start := func(syncer storage.Syncer, f *fanout) error {
+		ch, err := syncer.SyncRaw(storeKey)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return fmt.Errorf("sync key %s: %w", storeKey, ErrNilChannel)
+		}
 
-	if inf.closed {
-		return ErrClosed
-	}
+		if f != nil {
+			fn, options = f.onSpec, &watchOptions{rateLimit: options.rateLimit}
+		}
+		go inf.sync(ch, syncerKey, fn, options)
 
-	if _, ok := inf.syncers[syncerKey]; ok {
-		logger.Infof("sync key: %s already", syncerKey)
-		return ErrAlreadyWatched
+		return nil
 	}
 
-	syncer, err := inf.store.Syncer()
-	if err != nil {
-		return err
+	return inf.watch(syncerKey, cb, start)
+}
+
+func (inf *meshInformer) onSpecs(storePrefix, syncerKey string, fn specsHandleFunc, opts []WatchOption) error {
+	options := newWatchOptions(opts)
+	if options.skipInitialSnapshot {
+		fn = skipInitialSnapshot(fn)
 	}
+	cb := &fanoutCallback{options: options, specsFn: fn}
 
-	ch, err := syncer.SyncRaw(storeKey)
-	if err != nil {
-		return err
+	start := func(syncer storage.Syncer, f *fanout) error {
+		if options.revision != nil {
+			return inf.startRevisionedPrefix(syncer, storePrefix, syncerKey, fn, options)
+		}
+
+		ch, err := syncer.SyncPrefix(storePrefix)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return fmt.Errorf("sync prefix %s: %w", storePrefix, ErrNilChannel)
+		}
+
+		if f != nil {
+			fn, options = f.onSpecs, &watchOptions{batchWindow: options.batchWindow, rateLimit: options.rateLimit}
+		}
+		go inf.syncPrefix(ch, syncerKey, fn, options)
+
+		return nil
 	}
 
-	inf.syncers[syncerKey] = syncer
+	return inf.watch(syncerKey, cb, start)
+}
 
-	go inf.sync(ch, syncerKey, fn)
+// watch creates the syncer of the key and starts it by the start function, the fanout
+// is passed if the watch is shared. A shared watch of an existing shared syncer joins
+// its fanout instead.
+func (inf *meshInformer) watch(syncerKey string, cb *fanoutCallback,
+	start func(syncer storage.Syncer, f *fanout) error) error {
 
-	return nil
+	for {
+		f, err := inf.startOrGetFanout(syncerKey, cb, start)
+		if err != nil || f == nil {
+			return err
+		}
+
+		// NOTE: Join the fanout without holding the lock of informer,
+		// as the latest data is informed to the callback at once.
+		if f.add(cb) {
+			return nil
+		}
+	}
 }
 
-func (inf *meshInformer) onSpecs(storePrefix, syncerKey string, fn specsHandleFunc) error {
+// startOrGetFanout returns the fanout to join if the shared syncer of the key exists,
+// otherwise it starts the syncer with the callback and returns nil.
+func (inf *meshInformer) startOrGetFanout(syncerKey string, cb *fanoutCallback,
+	start func(syncer storage.Syncer, f *fanout) error) (*fanout, error) {
+
 	inf.mutex.Lock()
 	defer inf.mutex.Unlock()
 
 	if inf.closed {
-		return ErrClosed
+		return nil, ErrClosed
 	}
 
-	if _, exists := inf.syncers[syncerKey]; exists {
-		logger.Infof("sync prefix:%s already", syncerKey)
-		return ErrAlreadyWatched
+	if _, ok := inf.syncers[syncerKey]; ok {
+		if f := inf.fanouts[syncerKey]; cb.options.shared && f != nil {
+			return f, nil
+		}
+		logger.Infof("sync key: %s already", syncerKey)
+		return nil, ErrAlreadyWatched
 	}
 
 	syncer, err := inf.store.Syncer()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	syncer.SetStartRevision(cb.options.startRevision)
+	syncer.SetChannelBuffer(inf.channelBuffer)
 
-	ch, err := syncer.SyncPrefix(storePrefix)
-	if err != nil {
-		return err
+	var f *fanout
+	if cb.options.shared {
+		f = newFanout(inf, syncerKey)
+		f.callbacks = append(f.callbacks, cb)
+	}
+
+	if err = start(syncer, f); err != nil {
+		syncer.Close()
+		return nil, err
 	}
 
 	inf.syncers[syncerKey] = syncer
+	if f != nil {
+		inf.fanouts[syncerKey] = f
+	}
+
+	return nil, nil
+}
 
-	go inf.syncPrefix(ch, syncerKey, fn)
+// WatchStatus returns the statuses of all watches, sorted by syncer key.
+func (inf *meshInformer) WatchStatus() []*WatchStatus {
+	inf.mutex.RLock()
+	defer inf.mutex.RUnlock()
+
+	statuses := make([]*WatchStatus, 0, len(inf.syncers))
+	for key, syncer := range inf.syncers {
+		statuses = append(statuses, &WatchStatus{
+			SyncerKey:     key,
+			Reestablished: syncer.ReestablishedCount(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].SyncerKey < statuses[j].SyncerKey
+	})
+
+	return statuses
+}
+
+// Metrics returns the metrics snapshot of the informer.
+func (inf *meshInformer) Metrics() *Metrics {
+	metrics := &Metrics{}
+	for _, status := range inf.WatchStatus() {
+		metrics.Watches++
+		metrics.Reestablished += status.Reestablished
+	}
+
+	metrics.DecodeLatencies = make(map[string]*DecodeLatency)
+	for resource, ds := range inf.decodeSamplers {
+		if ds.Count() == 0 {
+			continue
+		}
+		metrics.DecodeLatencies[resource] = &DecodeLatency{
+			Count: ds.Count(),
+			P50:   ds.P50(),
+			P95:   ds.P95(),
+			P99:   ds.P99(),
+		}
+	}
 
-	return nil
+	return metrics
 }
 
 func (inf *meshInformer) Close() {
 	inf.mutex.Lock()
 	defer inf.mutex.Unlock()
 
+	if inf.closed {
+		return
+	}
+	close(inf.done)
+
 	for _, syncer := range inf.syncers {
 		syncer.Close()
 	}
@@ -636,7 +1192,52 @@ func (inf *meshInformer) Close() {
 	inf.closed = true
 }
 
-func (inf *meshInformer) sync(ch <-chan *mvccpb.KeyValue, syncerKey string, fn specHandleFunc) {
+// decode decodes the value of the key, and records the latency per resource type.
+func (inf *meshInformer) decode(key string, data []byte, v interface{}) error {
+	startTime := time.Now()
+	err := storage.Decode(key, data, v)
+
+	var resource string
+	switch v.(type) {
+	case *spec.Service:
+		resource = ResourceService
+	case *spec.ServiceInstanceSpec:
+		resource = ResourceServiceInstanceSpec
+	case *spec.ServiceInstanceStatus:
+		resource = ResourceServiceInstanceStatus
+	case *spec.Tenant:
+		resource = ResourceTenant
+	case *spec.Ingress:
+		resource = ResourceIngress
+	}
+	if ds := inf.decodeSamplers[resource]; ds != nil {
+		ds.Update(time.Since(startTime))
+	}
+
+	return err
+}
+
+// invoke calls the callback, and recovers from its panic if required.
+// The returning boolean flag means if the stuff continues to be watched.
+func (inf *meshInformer) invoke(syncerKey string, options *watchOptions, fn func() bool) (continued bool) {
+	if options.recover || options.isolateCallback {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Errorf("recover from panic of callback of %s: %v, stack trace: \n%s\n",
+					syncerKey, err, debug.Stack())
+				continued = true
+			}
+		}()
+	}
+
+	return fn()
+}
+
+func (inf *meshInformer) sync(ch <-chan *mvccpb.KeyValue, syncerKey string, fn specHandleFunc, options *watchOptions) {
+	if options.rateLimit != nil {
+		ch = rateLimitRaw(ch, options.rateLimit)
+	}
+
 	for kv := range ch {
 		var (
 			event Event
@@ -651,15 +1252,22 @@ func (inf *meshInformer) sync(ch <-chan *mvccpb.KeyValue, syncerKey string, fn s
 			value = string(kv.Value)
 		}
 
-		if !fn(event, value) {
+		if !inf.invoke(syncerKey, options, func() bool { return fn(event, value) }) {
 			inf.stopSyncOneKey(syncerKey)
 		}
 	}
 }
 
-func (inf *meshInformer) syncPrefix(ch <-chan map[string]string, syncerKey string, fn specsHandleFunc) {
+func (inf *meshInformer) syncPrefix(ch <-chan map[string]string, syncerKey string, fn specsHandleFunc, options *watchOptions) {
+	if options.batchWindow > 0 {
+		ch = batchPrefix(ch, options.batchWindow)
+	}
+	if options.rateLimit != nil {
+		ch = rateLimitPrefix(ch, options.rateLimit)
+	}
+
 	for kvs := range ch {
-		if !fn(kvs) {
+		if !inf.invoke(syncerKey, options, func() bool { return fn(kvs) }) {
 			inf.stopSyncOneKey(syncerKey)
 		}
 	}
@@ -0,0 +1,2006 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// mockSyncer is a syncer whose data is pushed by tests.
+type mockSyncer struct {
+	mutex         sync.Mutex
+	startRevision int64
+	channelBuffer int
+	reestablished uint64
+	rawCh         chan *mvccpb.KeyValue
+	prefixCh      chan map[string]string
+	snapshotCh    chan *cluster.PrefixSnapshot
+	closed        bool
+}
+
+func (ms *mockSyncer) SetStartRevision(revision int64) {
+	ms.startRevision = revision
+}
+
+func (ms *mockSyncer) SetChannelBuffer(size int) {
+	ms.channelBuffer = size
+}
+
+func (ms *mockSyncer) ReestablishedCount() uint64 {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.reestablished
+}
+
+func (ms *mockSyncer) reestablish() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.reestablished++
+}
+
+func (ms *mockSyncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
+	return ms.rawCh, nil
+}
+
+func (ms *mockSyncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
+	return ms.prefixCh, nil
+}
+
+func (ms *mockSyncer) SyncPrefixWithRevision(prefix string) (<-chan *cluster.PrefixSnapshot, error) {
+	return ms.snapshotCh, nil
+}
+
+func (ms *mockSyncer) SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error) {
+	return make(chan map[string]*mvccpb.KeyValue), nil
+}
+
+func (ms *mockSyncer) Close() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.closed = true
+}
+
+func (ms *mockSyncer) isClosed() bool {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.closed
+}
+
+// mockStorage is a storage whose syncers are created by tests.
+type mockStorage struct {
+	storage.Storage
+	syncers chan *mockSyncer
+}
+
+func newMockStorage() *mockStorage {
+	return &mockStorage{syncers: make(chan *mockSyncer, 10)}
+}
+
+func (ms *mockStorage) newSyncer() *mockSyncer {
+	syncer := &mockSyncer{
+		rawCh:      make(chan *mvccpb.KeyValue, 10),
+		prefixCh:   make(chan map[string]string, 10),
+		snapshotCh: make(chan *cluster.PrefixSnapshot, 10),
+	}
+	ms.syncers <- syncer
+	return syncer
+}
+
+func (ms *mockStorage) Syncer() (storage.Syncer, error) {
+	return <-ms.syncers, nil
+}
+
+func serviceYAML(name, tenant string) string {
+	buff, _ := yaml.Marshal(&spec.Service{Name: name, RegisterTenant: tenant})
+	return string(buff)
+}
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	os.Exit(m.Run())
+}
+
+func TestInformerRecover(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan string, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		for _, s := range services {
+			if s.Name == "bad" {
+				panic("bad service")
+			}
+			received <- s.Name
+		}
+		return true
+	}, WithRecover())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	syncer.prefixCh <- map[string]string{"/bad": serviceYAML("bad", "")}
+	syncer.prefixCh <- map[string]string{"/good": serviceYAML("good", "")}
+
+	select {
+	case name := <-received:
+		if name != "good" {
+			t.Errorf("expect service good, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("events after the panic should be delivered")
+	}
+	if syncer.isClosed() {
+		t.Errorf("watch should keep alive after the panic")
+	}
+}
+
+func TestInformerWatchStatus(t *testing.T) {
+	store := newMockStorage()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	services := store.newSyncer()
+	err := inf.OnAllServiceSpecs(func(map[string]*spec.Service) bool { return true })
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+	store.newSyncer()
+	err = inf.OnAllTenantSpecs(func(map[string]*spec.Tenant) bool { return true })
+	if err != nil {
+		t.Fatalf("watch tenant specs failed: %v", err)
+	}
+
+	if metrics := inf.Metrics(); metrics.Watches != 2 || metrics.Reestablished != 0 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+
+	services.reestablish()
+	services.reestablish()
+
+	statuses := inf.WatchStatus()
+	if len(statuses) != 2 {
+		t.Fatalf("expect 2 watch statuses, got %d", len(statuses))
+	}
+	for _, status := range statuses {
+		expected := uint64(0)
+		if status.SyncerKey == "prefix-service" {
+			expected = 2
+		}
+		if status.Reestablished != expected {
+			t.Errorf("watch %s should be re-established %d times, got %d",
+				status.SyncerKey, expected, status.Reestablished)
+		}
+	}
+	if metrics := inf.Metrics(); metrics.Reestablished != 2 {
+		t.Errorf("total re-established count should be 2, got %d", metrics.Reestablished)
+	}
+}
+
+func TestInformerChannelBuffer(t *testing.T) {
+	store := newMockStorage()
+	inf := NewInformer(store, "")
+
+	syncer := store.newSyncer()
+	err := inf.OnAllServiceSpecs(func(map[string]*spec.Service) bool { return true })
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+	if syncer.channelBuffer != 0 {
+		t.Errorf("default buffer should be left to the storage, got %d", syncer.channelBuffer)
+	}
+	inf.Close()
+
+	inf = NewInformer(store, "", WithChannelBuffer(1024))
+	defer inf.Close()
+
+	prefixSyncer := store.newSyncer()
+	err = inf.OnAllServiceSpecs(func(map[string]*spec.Service) bool { return true })
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+	rawSyncer := store.newSyncer()
+	err = inf.OnPartOfServiceSpec("order", AllParts, func(Event, *spec.Service) bool { return true })
+	if err != nil {
+		t.Fatalf("watch service spec failed: %v", err)
+	}
+
+	for _, s := range []*mockSyncer{prefixSyncer, rawSyncer} {
+		if s.channelBuffer != 1024 {
+			t.Errorf("expect buffer 1024, got %d", s.channelBuffer)
+		}
+	}
+}
+
+func TestInformerOnStaleInstances(t *testing.T) {
+	store := newMockStorage()
+	specs := store.newSyncer()
+	statuses := store.newSyncer()
+	inf := NewInformer(store, "")
+
+	received := make(chan []*spec.ServiceInstanceSpec, 100)
+	err := inf.OnStaleInstances("order", 100*time.Millisecond, func(stale []*spec.ServiceInstanceSpec) bool {
+		received <- stale
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch stale instances failed: %v", err)
+	}
+
+	now := time.Now()
+	specYAML := func(id string, maintenanceUntil string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceSpec{
+			ServiceName:      "order",
+			InstanceID:       id,
+			MaintenanceUntil: maintenanceUntil,
+		})
+		return string(buff)
+	}
+	statusYAML := func(id string, heartbeat time.Time) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceStatus{
+			ServiceName:       "order",
+			InstanceID:        id,
+			LastHeartbeatTime: heartbeat.Format(time.RFC3339),
+		})
+		return string(buff)
+	}
+
+	// ins-3 in maintenance is not stale though its heartbeat is.
+	specs.prefixCh <- map[string]string{
+		"/ins-1": specYAML("ins-1", ""),
+		"/ins-2": specYAML("ins-2", ""),
+		"/ins-3": specYAML("ins-3", now.Add(time.Hour).Format(time.RFC3339)),
+	}
+	statuses.prefixCh <- map[string]string{
+		"/ins-1": statusYAML("ins-1", now.Add(time.Hour)),
+		"/ins-2": statusYAML("ins-2", now.Add(-time.Minute)),
+		"/ins-3": statusYAML("ins-3", now.Add(-time.Minute)),
+	}
+
+	select {
+	case stale := <-received:
+		if len(stale) != 1 || stale[0].InstanceID != "ins-2" {
+			t.Errorf("expect stale instance ins-2, got %v", stale)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stale instance should be reported")
+	}
+
+	// the stale instances are reported periodically.
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("stale instance should be reported periodically")
+	}
+
+	inf.Close()
+	time.Sleep(100 * time.Millisecond)
+	for len(received) > 0 {
+		<-received
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(received) != 0 {
+		t.Errorf("stale instances should not be reported after closing")
+	}
+	if !specs.isClosed() || !statuses.isClosed() {
+		t.Errorf("syncers should be closed after closing")
+	}
+}
+
+func TestInformerOnPartsOfServiceSpec(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan *spec.Service, 10)
+	paths := GJSONPathSet{ServiceCanary, ServiceLoadBalance}
+	err := inf.OnPartsOfServiceSpec("order", paths, func(event Event, s *spec.Service) bool {
+		received <- s
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch parts of service spec failed: %v", err)
+	}
+
+	revision := int64(0)
+	put := func(s *spec.Service) {
+		buff, _ := yaml.Marshal(s)
+		revision++
+		syncer.rawCh <- &mvccpb.KeyValue{Value: buff, ModRevision: revision}
+	}
+	expect := func(tenant string) {
+		select {
+		case s := <-received:
+			if s.RegisterTenant != tenant {
+				t.Errorf("expect service of tenant %s, got %s", tenant, s.RegisterTenant)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect service of tenant %s, got nothing", tenant)
+		}
+	}
+
+	put(&spec.Service{Name: "order", RegisterTenant: "t1"})
+	expect("t1")
+
+	// change outside the paths.
+	put(&spec.Service{Name: "order", RegisterTenant: "t2"})
+
+	put(&spec.Service{Name: "order", RegisterTenant: "t3",
+		LoadBalance: &spec.LoadBalance{Policy: "roundRobin"}})
+	expect("t3")
+
+	put(&spec.Service{Name: "order", RegisterTenant: "t4",
+		LoadBalance: &spec.LoadBalance{Policy: "roundRobin"},
+		Canary:      &spec.Canary{}})
+	expect("t4")
+
+	put(&spec.Service{Name: "order", RegisterTenant: "t5",
+		LoadBalance: &spec.LoadBalance{Policy: "roundRobin"},
+		Canary:      &spec.Canary{}})
+
+	select {
+	case s := <-received:
+		t.Errorf("change outside the paths should not be informed, got tenant %s", s.RegisterTenant)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInformerDecodeLatency(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	if latencies := inf.Metrics().DecodeLatencies; len(latencies) != 0 {
+		t.Errorf("no latency should be recorded before decoding, got %v", latencies)
+	}
+
+	received := make(chan struct{}, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		received <- struct{}{}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", ""),
+		"/delivery": serviceYAML("delivery", ""),
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("service specs should be informed")
+	}
+
+	latencies := inf.Metrics().DecodeLatencies
+	if len(latencies) != 1 || latencies[ResourceService] == nil {
+		t.Fatalf("expect latency of services only, got %v", latencies)
+	}
+	if count := latencies[ResourceService].Count; count != 2 {
+		t.Errorf("expect 2 observations, got %v", count)
+	}
+}
+
+func TestInformerIgnoredPaths(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]*spec.ServiceInstanceStatus, 10)
+	err := inf.OnServiceInstanceStatuses("order", func(statuses map[string]*spec.ServiceInstanceStatus) bool {
+		received <- statuses
+		return true
+	}, WithIgnoredPaths(ServiceInstanceServerHeartbeatTime))
+	if err != nil {
+		t.Fatalf("watch service instance statuses failed: %v", err)
+	}
+
+	now := time.Now()
+	statusYAML := func(id string, last, server time.Duration) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceStatus{
+			ServiceName:         "order",
+			InstanceID:          id,
+			LastHeartbeatTime:   now.Add(last).Format(time.RFC3339),
+			ServerHeartbeatTime: now.Add(server).Format(time.RFC3339),
+		})
+		return string(buff)
+	}
+	expect := func(count int) {
+		select {
+		case statuses := <-received:
+			if len(statuses) != count {
+				t.Errorf("expect %d statuses, got %d", count, len(statuses))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %d statuses, got nothing", count)
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{"/ins-1": statusYAML("ins-1", 0, 0)}
+	expect(1)
+
+	// only the ignored heartbeat time changes.
+	syncer.prefixCh <- map[string]string{"/ins-1": statusYAML("ins-1", 0, time.Second)}
+	select {
+	case <-received:
+		t.Errorf("change within ignored paths should not be informed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a field outside the ignored paths changes.
+	syncer.prefixCh <- map[string]string{"/ins-1": statusYAML("ins-1", time.Second, 2*time.Second)}
+	expect(1)
+
+	// new instance.
+	syncer.prefixCh <- map[string]string{
+		"/ins-1": statusYAML("ins-1", time.Second, 3*time.Second),
+		"/ins-2": statusYAML("ins-2", time.Second, 3*time.Second),
+	}
+	expect(2)
+}
+
+func TestStripPaths(t *testing.T) {
+	status := &spec.ServiceInstanceStatus{
+		ServiceName:         "order",
+		InstanceID:          "ins-1",
+		LastHeartbeatTime:   "2021-01-01T00:00:00Z",
+		ServerHeartbeatTime: "2021-01-01T00:00:01Z",
+	}
+
+	got, err := stripPaths(status, append(HeartbeatPaths, "no.such.path"))
+	if err != nil {
+		t.Fatalf("strip paths failed: %v", err)
+	}
+	if expected := `{"instanceID":"ins-1","serviceName":"order"}`; got != expected {
+		t.Errorf("expect %s, got %s", expected, got)
+	}
+}
+
+func TestInformerOnAllDeletions(t *testing.T) {
+	store := newMockStorage()
+	resourceTypes := []string{ResourceService, ResourceServiceInstanceSpec,
+		ResourceTenant, ResourceIngress, ResourceCustomResource}
+	syncers := make([]*mockSyncer, len(resourceTypes))
+	for i := range syncers {
+		syncers[i] = store.newSyncer()
+	}
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	type deletion struct {
+		resourceType, key, prevValue string
+	}
+	received := make(chan deletion, 10)
+	err := inf.OnAllDeletions(func(resourceType, key, prevValue string) bool {
+		received <- deletion{resourceType, key, prevValue}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch all deletions failed: %v", err)
+	}
+
+	for i, resourceType := range resourceTypes {
+		key := "/" + resourceType
+		syncers[i].prefixCh <- map[string]string{key: "value of " + resourceType, "/other": "other"}
+		syncers[i].prefixCh <- map[string]string{"/other": "other"}
+
+		select {
+		case d := <-received:
+			expected := deletion{resourceType, key, "value of " + resourceType}
+			if d != expected {
+				t.Errorf("expect deletion %v, got %v", expected, d)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("deletion of %s should be informed", resourceType)
+		}
+	}
+
+	// updates and creations are not informed.
+	syncers[0].prefixCh <- map[string]string{"/other": "updated", "/new": "new"}
+	select {
+	case d := <-received:
+		t.Errorf("only deletions should be informed, got %v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInformerOnPartOfServiceSpecPatch(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	type change struct {
+		eventType string
+		patch     string
+	}
+	received := make(chan change, 10)
+	err := inf.OnPartOfServiceSpecPatch("order", func(event Event, patch []byte) bool {
+		received <- change{event.EventType, string(patch)}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch service spec patch failed: %v", err)
+	}
+
+	expect := func(expected change) {
+		select {
+		case c := <-received:
+			if c != expected {
+				t.Errorf("expect %v, got %v", expected, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %v, got nothing", expected)
+		}
+	}
+
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte("name: order\nregisterTenant: t1\n")}
+	expect(change{EventUpdate, `[{"op":"add","path":"","value":{"name":"order","registerTenant":"t1"}}]`})
+
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte("name: order\nregisterTenant: t2\n")}
+	expect(change{EventUpdate, `[{"op":"replace","path":"/registerTenant","value":"t2"}]`})
+
+	// nothing changes.
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte("registerTenant: t2\nname: order\n")}
+
+	syncer.rawCh <- nil
+	expect(change{EventDelete, `[]`})
+
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte("name: order\n")}
+	expect(change{EventUpdate, `[{"op":"add","path":"","value":{"name":"order"}}]`})
+}
+
+func TestInformerWithLogicalKeys(t *testing.T) {
+	store := newMockStorage()
+	services := store.newSyncer()
+	instances := store.newSyncer()
+	statuses := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan []string, 10)
+	keysOf := func(m interface{}) []string {
+		keys := []string{}
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	err := inf.OnAllServiceSpecs(func(m map[string]*spec.Service) bool {
+		received <- keysOf(m)
+		return true
+	}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+	err = inf.OnServiceInstanceSpecs("order", func(m map[string]*spec.ServiceInstanceSpec) bool {
+		received <- keysOf(m)
+		return true
+	}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service instance specs failed: %v", err)
+	}
+	err = inf.OnAllServiceInstanceStatuses(func(m map[string]*spec.ServiceInstanceStatus) bool {
+		received <- keysOf(m)
+		return true
+	}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service instance statuses failed: %v", err)
+	}
+
+	expect := func(expected ...string) {
+		select {
+		case keys := <-received:
+			if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("expect keys %v, got %v", expected, keys)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect keys %v, got nothing", expected)
+		}
+	}
+
+	services.prefixCh <- map[string]string{
+		"/mesh/service-spec/order":    serviceYAML("order", ""),
+		"/mesh/service-spec/delivery": serviceYAML("delivery", ""),
+	}
+	expect("delivery", "order")
+
+	instanceYAML := func(service, id string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceSpec{ServiceName: service, InstanceID: id})
+		return string(buff)
+	}
+	instances.prefixCh <- map[string]string{
+		"/mesh/service-instances/spec/order/ins-1": instanceYAML("order", "ins-1"),
+		"/mesh/service-instances/spec/order/ins-2": instanceYAML("order", "ins-2"),
+	}
+	expect("ins-1", "ins-2")
+
+	statusYAML := func(service, id string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceStatus{ServiceName: service, InstanceID: id})
+		return string(buff)
+	}
+	statuses.prefixCh <- map[string]string{
+		"/mesh/service-instances/status/order/ins-1":    statusYAML("order", "ins-1"),
+		"/mesh/service-instances/status/delivery/ins-1": statusYAML("delivery", "ins-1"),
+	}
+	expect("delivery/ins-1", "order/ins-1")
+}
+
+func TestValidateGJSONPath(t *testing.T) {
+	valid := []GJSONPath{
+		AllParts,
+		ServiceResilience,
+		ServiceCircuitBreaker,
+		`labels.app\.kubernetes\.io`,
+		`rules.#(host=="a.(b").paths`,
+		"rules|@reverse",
+		"rules.#.host",
+	}
+	for _, p := range valid {
+		if err := ValidateGJSONPath(p); err != nil {
+			t.Errorf("path %q should be valid: %v", p, err)
+		}
+	}
+
+	invalid := []GJSONPath{
+		"resilience..circuitBreaker",
+		".resilience",
+		"resilience.",
+		`resilience\`,
+		`rules.#(host=="a"`,
+		"rules)",
+	}
+	for _, p := range invalid {
+		if err := ValidateGJSONPath(p); err == nil {
+			t.Errorf("path %q should be invalid", p)
+		}
+	}
+
+	// no syncer is created for invalid paths.
+	inf := NewInformer(newMockStorage(), "")
+	defer inf.Close()
+	fn := func(event Event, s *spec.Service) bool { return true }
+	if err := inf.OnPartOfServiceSpec("order", "resilience..circuitBreaker", fn); err == nil {
+		t.Errorf("watch with invalid path should fail")
+	}
+	if err := inf.OnPartsOfServiceSpec("order", GJSONPathSet{ServiceCanary, "canary."}, fn); err == nil {
+		t.Errorf("watch with invalid paths should fail")
+	}
+}
+
+func TestInformerOnAllServiceSpecsWithDelta(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	type event struct {
+		keys  []string
+		delta Delta
+	}
+	received := make(chan event, 10)
+	err := inf.OnAllServiceSpecsWithDelta(func(snapshot map[string]*spec.Service, delta *Delta) bool {
+		keys := []string{}
+		for k := range snapshot {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		received <- event{keys, *delta}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch service specs with delta failed: %v", err)
+	}
+
+	expect := func(keys []string, delta Delta) {
+		select {
+		case e := <-received:
+			if !reflect.DeepEqual(e.keys, keys) {
+				t.Errorf("expect snapshot keys %v, got %v", keys, e.keys)
+			}
+			if !reflect.DeepEqual(e.delta, delta) {
+				t.Errorf("expect delta %+v, got %+v", delta, e.delta)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect delta %+v, got nothing", delta)
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t1"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+	expect([]string{"/delivery", "/order"}, Delta{Created: []string{"/delivery", "/order"}})
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t2"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+	expect([]string{"/delivery", "/order"}, Delta{Updated: []string{"/order"}})
+
+	// nothing changes.
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t2"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "t2"),
+		"/payment": serviceYAML("payment", "t1"),
+	}
+	expect([]string{"/order", "/payment"}, Delta{Created: []string{"/payment"}, Deleted: []string{"/delivery"}})
+}
+
+func TestInformerOnComputed(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	now := time.Now()
+	healthyCount := func(kvs map[string]string) interface{} {
+		count := 0
+		for k, v := range kvs {
+			status := &spec.ServiceInstanceStatus{}
+			if err := storage.Decode(k, []byte(v), status); err == nil && status.IsHealthy(now, time.Minute) {
+				count++
+			}
+		}
+		return count
+	}
+
+	received := make(chan interface{}, 10)
+	sources := []WatchSpec{{Prefix: layout.ServiceInstanceStatusPrefix("order")}}
+	err := inf.OnComputed(sources, healthyCount, func(value interface{}) bool {
+		received <- value
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch computed value failed: %v", err)
+	}
+
+	statusYAML := func(id string, heartbeat time.Time) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceStatus{
+			ServiceName:       "order",
+			InstanceID:        id,
+			LastHeartbeatTime: heartbeat.Format(time.RFC3339),
+		})
+		return string(buff)
+	}
+	key := func(id string) string {
+		return layout.ServiceInstanceStatusKey("order", id)
+	}
+	expect := func(count int) {
+		select {
+		case value := <-received:
+			if value != count {
+				t.Errorf("expect %d healthy instances, got %v", count, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %d healthy instances, got nothing", count)
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{key("ins-1"): statusYAML("ins-1", now)}
+	expect(1)
+
+	// a stale instance doesn't change the count.
+	syncer.prefixCh <- map[string]string{
+		key("ins-1"): statusYAML("ins-1", now),
+		key("ins-2"): statusYAML("ins-2", now.Add(-time.Hour)),
+	}
+	select {
+	case value := <-received:
+		t.Errorf("unchanged count should not be informed, got %v", value)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syncer.prefixCh <- map[string]string{
+		key("ins-1"): statusYAML("ins-1", now),
+		key("ins-2"): statusYAML("ins-2", now),
+	}
+	expect(2)
+
+	if err = inf.OnComputed(nil, healthyCount, func(interface{}) bool { return true }); err == nil {
+		t.Errorf("watch without sources should fail")
+	}
+}
+
+func TestInformerDecodeErrorThreshold(t *testing.T) {
+	store := newMockStorage()
+	stoppedSyncer := store.newSyncer()
+	keptSyncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	type exceeded struct {
+		syncerKey string
+		failures  int
+	}
+	exceededCh := make(chan exceeded, 10)
+	handler := func(syncerKey string, failures int, lastErr error) {
+		if lastErr == nil {
+			t.Errorf("last error should not be nil")
+		}
+		exceededCh <- exceeded{syncerKey: syncerKey, failures: failures}
+	}
+
+	received := make(chan map[string]*spec.Service, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		received <- services
+		return true
+	}, WithDecodeErrorThreshold(DecodeErrorThreshold{
+		MaxFailures: 2,
+		Handler:     handler,
+		StopWatch:   true,
+	}))
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	err = inf.OnAllTenantSpecs(func(tenants map[string]*spec.Tenant) bool {
+		return true
+	}, WithDecodeErrorThreshold(DecodeErrorThreshold{
+		MaxFailures: 2,
+		Handler:     handler,
+	}))
+	if err != nil {
+		t.Fatalf("watch tenant specs failed: %v", err)
+	}
+
+	corrupt := map[string]string{
+		"/order":   serviceYAML("order", "tenant"),
+		"/corrupt": "name: [",
+	}
+
+	// failures within the threshold are skipped silently.
+	for i := 0; i < 2; i++ {
+		stoppedSyncer.prefixCh <- corrupt
+		select {
+		case services := <-received:
+			if len(services) != 1 {
+				t.Errorf("expect 1 valid service, got %d", len(services))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("services within the threshold should be informed")
+		}
+	}
+
+	stoppedSyncer.prefixCh <- corrupt
+	select {
+	case e := <-exceededCh:
+		if e.syncerKey != "prefix-service" || e.failures != 3 {
+			t.Errorf("unexpected exceeded event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("threshold should be triggered")
+	}
+	select {
+	case <-received:
+		t.Errorf("services exceeding the threshold should not be informed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !stoppedSyncer.isClosed() {
+		t.Errorf("watch should be stopped")
+	}
+
+	for i := 0; i < 6; i++ {
+		keptSyncer.prefixCh <- map[string]string{"/corrupt": "name: ["}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-exceededCh:
+			if e.syncerKey != "prefix-tenant" || e.failures != 3 {
+				t.Errorf("unexpected exceeded event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("threshold should be triggered for every window")
+		}
+	}
+	if keptSyncer.isClosed() {
+		t.Errorf("watch should be kept without StopWatch")
+	}
+}
+
+func TestInformerWithNameFilter(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]*spec.Service, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		received <- services
+		return true
+	}, WithNameFilter(regexp.MustCompile("^gateway-")), WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	expect := func(names ...string) {
+		select {
+		case services := <-received:
+			if len(services) != len(names) {
+				t.Errorf("expect services %v, got %v", names, services)
+			}
+			for _, name := range names {
+				if services[name] == nil {
+					t.Errorf("expect service %s, got %v", name, services)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect services %v, got nothing", names)
+		}
+	}
+	expectNothing := func() {
+		select {
+		case services := <-received:
+			t.Errorf("unchanged filtered services should not be informed, got %v", services)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/gateway-a": serviceYAML("gateway-a", "tenant"),
+		"/order":     serviceYAML("order", "tenant"),
+	}
+	expect("gateway-a")
+
+	// only the non-matching service changes.
+	syncer.prefixCh <- map[string]string{
+		"/gateway-a": serviceYAML("gateway-a", "tenant"),
+		"/order":     serviceYAML("order", "tenant-2"),
+		"/payment":   serviceYAML("payment", "tenant"),
+	}
+	expectNothing()
+
+	syncer.prefixCh <- map[string]string{
+		"/gateway-a": serviceYAML("gateway-a", "tenant-2"),
+		"/gateway-b": serviceYAML("gateway-b", "tenant"),
+		"/order":     serviceYAML("order", "tenant-2"),
+	}
+	expect("gateway-a", "gateway-b")
+
+	syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", "tenant-2")}
+	expect()
+}
+
+func TestInformerOnTenantServiceCount(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]int, 10)
+	err := inf.OnTenantServiceCount(func(counts map[string]int) bool {
+		received <- counts
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch tenant service count failed: %v", err)
+	}
+
+	tenantYAML := func(name string, services ...string) string {
+		buff, _ := yaml.Marshal(&spec.Tenant{Name: name, Services: services})
+		return string(buff)
+	}
+	expect := func(counts map[string]int) {
+		select {
+		case got := <-received:
+			if !reflect.DeepEqual(got, counts) {
+				t.Errorf("expect counts %v, got %v", counts, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect counts %v, got nothing", counts)
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/shop": tenantYAML("shop", "order"),
+		"/pay":  tenantYAML("pay"),
+	}
+	expect(map[string]int{"shop": 1, "pay": 0})
+
+	// the services are replaced but the count is the same.
+	syncer.prefixCh <- map[string]string{
+		"/shop": tenantYAML("shop", "delivery"),
+		"/pay":  tenantYAML("pay"),
+	}
+	select {
+	case counts := <-received:
+		t.Errorf("unchanged counts should not be informed, got %v", counts)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/shop": tenantYAML("shop", "delivery", "order"),
+		"/pay":  tenantYAML("pay"),
+	}
+	expect(map[string]int{"shop": 2, "pay": 0})
+
+	syncer.prefixCh <- map[string]string{
+		"/shop": tenantYAML("shop", "order"),
+	}
+	expect(map[string]int{"shop": 1})
+}
+
+func TestInformerSharedWatch(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received1 := make(chan string, 10)
+	received2 := make(chan string, 10)
+	watch := func(received chan string) error {
+		return inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+			received <- serviceSpec.RegisterTenant
+			return true
+		}, WithSharedWatch())
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, received := range []chan string{received1, received2} {
+		wg.Add(1)
+		go func(received chan string) {
+			defer wg.Done()
+			errs <- watch(received)
+		}(received)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("shared watch failed: %v", err)
+		}
+	}
+
+	if len(store.syncers) != 0 {
+		t.Fatalf("shared watches should not create another syncer")
+	}
+	if statuses := inf.WatchStatus(); len(statuses) != 1 {
+		t.Fatalf("expect 1 watch, got %v", statuses)
+	}
+	f := inf.(*meshInformer).fanouts[serviceSpecSyncerKey("order", AllParts)]
+	f.mutex.Lock()
+	callbacks := len(f.callbacks)
+	f.mutex.Unlock()
+	if callbacks != 2 {
+		t.Fatalf("expect 2 callbacks, got %d", callbacks)
+	}
+
+	expect := func(received chan string, tenant string) {
+		select {
+		case got := <-received:
+			if got != tenant {
+				t.Errorf("expect tenant %s, got %s", tenant, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect tenant %s, got nothing", tenant)
+		}
+	}
+
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte(serviceYAML("order", "t1"))}
+	expect(received1, "t1")
+	expect(received2, "t1")
+
+	// the joining callback is informed the latest spec at once.
+	received3 := make(chan string, 10)
+	if err := watch(received3); err != nil {
+		t.Fatalf("shared watch failed: %v", err)
+	}
+	expect(received3, "t1")
+
+	err := inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		return true
+	})
+	if err != ErrAlreadyWatched {
+		t.Errorf("expect ErrAlreadyWatched for non-shared watch, got %v", err)
+	}
+}
+
+func TestInformerWithBatchWindow(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]*spec.Service, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		received <- services
+		return true
+	}, WithBatchWindow(200*time.Millisecond), WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t1"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t2"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+	// delivery is deleted within the batch.
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "t3"),
+		"/payment": serviceYAML("payment", "t1"),
+	}
+
+	select {
+	case services := <-received:
+		expected := map[string]string{"order": "t3", "payment": "t1"}
+		if len(services) != len(expected) {
+			t.Errorf("expect the last snapshot %v, got %v", expected, services)
+		}
+		for name, tenant := range expected {
+			if services[name] == nil || services[name].RegisterTenant != tenant {
+				t.Errorf("expect service %s of tenant %s, got %+v", name, tenant, services[name])
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect the last snapshot, got nothing")
+	}
+
+	select {
+	case services := <-received:
+		t.Errorf("the burst should be delivered once, got %v", services)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the delivery after the window starts a new batch.
+	syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", "t4")}
+	select {
+	case services := <-received:
+		if len(services) != 1 || services["order"].RegisterTenant != "t4" {
+			t.Errorf("expect only the new delivery, got %v", services)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect the new delivery, got nothing")
+	}
+}
+
+func TestInformerNilChannel(t *testing.T) {
+	store := newMockStorage()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	nilSyncer := &mockSyncer{}
+	store.syncers <- nilSyncer
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		return true
+	})
+	if !errors.Is(err, ErrNilChannel) {
+		t.Fatalf("expect ErrNilChannel, got %v", err)
+	}
+	if !nilSyncer.isClosed() {
+		t.Errorf("syncer returning nil channel should be closed")
+	}
+	if statuses := inf.WatchStatus(); len(statuses) != 0 {
+		t.Errorf("failed watch should not be registered, got %v", statuses)
+	}
+
+	nilSyncer = &mockSyncer{}
+	store.syncers <- nilSyncer
+	err = inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		return true
+	})
+	if !errors.Is(err, ErrNilChannel) {
+		t.Fatalf("expect ErrNilChannel, got %v", err)
+	}
+
+	// the failed watch could be watched again.
+	syncer := store.newSyncer()
+	received := make(chan string, 1)
+	err = inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		received <- serviceSpec.RegisterTenant
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch again failed: %v", err)
+	}
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte(serviceYAML("order", "t1"))}
+	select {
+	case tenant := <-received:
+		if tenant != "t1" {
+			t.Errorf("expect tenant t1, got %s", tenant)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect service spec, got nothing")
+	}
+}
+
+func TestInformerWithSkipInitialSnapshot(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]*spec.Service, 10)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		received <- services
+		return true
+	}, WithSkipInitialSnapshot(), WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	expectNothing := func() {
+		select {
+		case services := <-received:
+			t.Errorf("expect nothing informed, got %v", services)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "t1"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}
+	expectNothing()
+
+	// deletion is not informed.
+	syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", "t1")}
+	expectNothing()
+
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "t1"),
+		"/payment": serviceYAML("payment", "t1"),
+	}
+	select {
+	case services := <-received:
+		if len(services) != 1 || services["payment"] == nil {
+			t.Errorf("expect only the new service payment, got %v", services)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect the new service, got nothing")
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "t2"),
+		"/payment": serviceYAML("payment", "t1"),
+	}
+	select {
+	case services := <-received:
+		if len(services) != 1 || services["order"] == nil || services["order"].RegisterTenant != "t2" {
+			t.Errorf("expect only the changed service order, got %v", services)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect the changed service, got nothing")
+	}
+}
+
+func TestInformerOnServiceTenantChange(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan [3]string, 10)
+	err := inf.OnServiceTenantChange(func(serviceName, oldTenant, newTenant string) bool {
+		received <- [3]string{serviceName, oldTenant, newTenant}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch service tenant change failed: %v", err)
+	}
+
+	expectNothing := func() {
+		select {
+		case change := <-received:
+			t.Errorf("expect nothing informed, got %v", change)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	syncer.prefixCh <- map[string]string{
+		"/order":    serviceYAML("order", "shop"),
+		"/delivery": serviceYAML("delivery", "shop"),
+	}
+	expectNothing()
+
+	// creation, deletion and other changes are not informed.
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "shop"),
+		"/payment": serviceYAML("payment", "shop"),
+	}
+	expectNothing()
+
+	syncer.prefixCh <- map[string]string{
+		"/order":   serviceYAML("order", "logistics"),
+		"/payment": serviceYAML("payment", spec.GlobalTenant),
+	}
+	for _, expected := range [][3]string{
+		{"order", "shop", "logistics"},
+		{"payment", "shop", spec.GlobalTenant},
+	} {
+		select {
+		case change := <-received:
+			if change != expected {
+				t.Errorf("expect change %v, got %v", expected, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect change %v, got nothing", expected)
+		}
+	}
+	expectNothing()
+}
+
+func TestInformerWithIsolateCallback(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	panicked := make(chan string, 10)
+	err := inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		panicked <- serviceSpec.RegisterTenant
+		if serviceSpec.RegisterTenant == "t1" {
+			panic("bad callback")
+		}
+		return true
+	}, WithSharedWatch(), WithIsolateCallback())
+	if err != nil {
+		t.Fatalf("shared watch failed: %v", err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	err = inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		<-block
+		return true
+	}, WithSharedWatch(), WithIsolateCallback())
+	if err != nil {
+		t.Fatalf("shared watch failed: %v", err)
+	}
+
+	received := make(chan string, 10)
+	err = inf.OnPartOfServiceSpec("order", AllParts, func(event Event, serviceSpec *spec.Service) bool {
+		received <- serviceSpec.RegisterTenant
+		return true
+	}, WithSharedWatch())
+	if err != nil {
+		t.Fatalf("shared watch failed: %v", err)
+	}
+
+	expect := func(ch chan string, tenant string) {
+		select {
+		case got := <-ch:
+			if got != tenant {
+				t.Errorf("expect tenant %s, got %s", tenant, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect tenant %s, got nothing", tenant)
+		}
+	}
+
+	// neither the panicking nor the blocked callback affects the others.
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte(serviceYAML("order", "t1"))}
+	expect(received, "t1")
+	expect(panicked, "t1")
+
+	syncer.rawCh <- &mvccpb.KeyValue{Value: []byte(serviceYAML("order", "t2"))}
+	expect(received, "t2")
+	expect(panicked, "t2")
+}
+
+func TestInformerOnServiceSpecPaths(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan string, 10)
+	handler := func(name string) ServiceSpecFunc {
+		return func(event Event, serviceSpec *spec.Service) bool {
+			received <- name
+			return true
+		}
+	}
+	err := inf.OnServiceSpecPaths("order", map[GJSONPath]ServiceSpecFunc{
+		"registerTenant":      handler("tenant"),
+		"sidecar.ingressPort": handler("port"),
+	})
+	if err != nil {
+		t.Fatalf("watch service spec paths failed: %v", err)
+	}
+	if statuses := inf.WatchStatus(); len(statuses) != 1 {
+		t.Errorf("expect 1 watch, got %v", statuses)
+	}
+
+	push := func(tenant string, port int, address string) {
+		buff, _ := yaml.Marshal(&spec.Service{
+			Name:           "order",
+			RegisterTenant: tenant,
+			Sidecar:        &spec.Sidecar{IngressPort: port, Address: address},
+		})
+		syncer.rawCh <- &mvccpb.KeyValue{Value: buff}
+	}
+	expect := func(names ...string) {
+		got := []string{}
+		for range names {
+			select {
+			case name := <-received:
+				got = append(got, name)
+			case <-time.After(time.Second):
+				t.Fatalf("expect handlers %v, got %v", names, got)
+			}
+		}
+		select {
+		case name := <-received:
+			got = append(got, name)
+		case <-time.After(100 * time.Millisecond):
+		}
+		sort.Strings(got)
+		sort.Strings(names)
+		if len(got) != len(names) || (len(names) != 0 && !reflect.DeepEqual(got, names)) {
+			t.Errorf("expect handlers %v, got %v", names, got)
+		}
+	}
+
+	push("t1", 13001, "127.0.0.1")
+	expect("port", "tenant")
+
+	push("t2", 13001, "127.0.0.1")
+	expect("tenant")
+
+	push("t2", 13002, "127.0.0.1")
+	expect("port")
+
+	push("t2", 13002, "127.0.0.2")
+	expect()
+
+	syncer.rawCh <- nil
+	expect("port", "tenant")
+
+	if err = inf.OnServiceSpecPaths("order", map[GJSONPath]ServiceSpecFunc{"sidecar..port": handler("bad")}); err == nil {
+		t.Errorf("invalid path should be rejected")
+	}
+}
+
+func TestInformerOnAllServiceSpecsWithRevision(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	type delivery struct {
+		services map[string]*spec.Service
+		revision int64
+	}
+	received := make(chan delivery, 10)
+	// sharing and batching are ignored by revisioned watches.
+	err := inf.OnAllServiceSpecsWithRevision(func(services map[string]*spec.Service, revision int64) bool {
+		received <- delivery{services: services, revision: revision}
+		return true
+	}, WithSharedWatch(), WithBatchWindow(time.Second), WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs with revision failed: %v", err)
+	}
+
+	syncer.snapshotCh <- &cluster.PrefixSnapshot{Revision: 5, KVs: map[string]string{
+		"/order": serviceYAML("order", "t1"),
+	}}
+	syncer.snapshotCh <- &cluster.PrefixSnapshot{Revision: 7, KVs: map[string]string{
+		"/order":    serviceYAML("order", "t2"),
+		"/delivery": serviceYAML("delivery", "t1"),
+	}}
+	syncer.snapshotCh <- &cluster.PrefixSnapshot{Revision: 9, KVs: map[string]string{
+		"/delivery": serviceYAML("delivery", "t1"),
+	}}
+
+	var last int64
+	for _, expected := range []struct {
+		revision int64
+		services []string
+	}{
+		{5, []string{"order"}},
+		{7, []string{"delivery", "order"}},
+		{9, []string{"delivery"}},
+	} {
+		select {
+		case d := <-received:
+			if d.revision != expected.revision || d.revision <= last {
+				t.Errorf("expect revision %d after %d, got %d", expected.revision, last, d.revision)
+			}
+			last = d.revision
+
+			names := []string{}
+			for name := range d.services {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, expected.services) {
+				t.Errorf("expect services %v at revision %d, got %v", expected.services, d.revision, names)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect the snapshot at revision %d, got nothing", expected.revision)
+		}
+	}
+}
+
+// testCanaryRelease is a sample custom resource kind with known Go struct.
+type testCanaryRelease struct {
+	Kind    string `yaml:"kind"`
+	Service string `yaml:"service"`
+	Weight  int    `yaml:"weight"`
+}
+
+func TestInformerOnTypedCustomResources(t *testing.T) {
+	store := newMockStorage()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	factory := func() interface{} { return &testCanaryRelease{} }
+	fn := func(resources map[string]interface{}) bool { return true }
+
+	err := inf.OnTypedCustomResources("CanaryRelease", func() interface{} { return testCanaryRelease{} }, fn)
+	if err == nil {
+		t.Errorf("factory returning non-pointer should fail")
+	}
+	if err = inf.OnTypedCustomResources("CanaryRelease", nil, fn); err == nil {
+		t.Errorf("nil factory should fail")
+	}
+
+	syncer := store.newSyncer()
+	received := make(chan map[string]interface{}, 10)
+	err = inf.OnTypedCustomResources("CanaryRelease", factory, func(resources map[string]interface{}) bool {
+		received <- resources
+		return true
+	}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch typed custom resources failed: %v", err)
+	}
+
+	syncer.prefixCh <- map[string]string{
+		layout.CustomResourceKey("CanaryRelease", "order-v2"):    "kind: CanaryRelease\nservice: order\nweight: 20\n",
+		layout.CustomResourceKey("CanaryRelease", "delivery-v2"): "kind: CanaryRelease\nservice: delivery\nweight: 50\n",
+	}
+
+	select {
+	case resources := <-received:
+		expected := map[string]interface{}{
+			"order-v2":    &testCanaryRelease{Kind: "CanaryRelease", Service: "order", Weight: 20},
+			"delivery-v2": &testCanaryRelease{Kind: "CanaryRelease", Service: "delivery", Weight: 50},
+		}
+		if !reflect.DeepEqual(resources, expected) {
+			t.Errorf("expect typed resources %v, got %v", expected, resources)
+		}
+		// every resource is decoded into its own value.
+		if resources["order-v2"] == resources["delivery-v2"] {
+			t.Errorf("resources should not share the value")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect typed resources, got nothing")
+	}
+}
+
+func TestInformerWithMaxEvents(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	var mutex sync.Mutex
+	deliveries := 0
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		deliveries++
+		return true
+	}, WithMaxEvents(2))
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", fmt.Sprintf("t%d", i))}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !syncer.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !syncer.isClosed() {
+		t.Fatalf("syncer should be stopped after max events")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if deliveries != 2 {
+		t.Errorf("expect exactly 2 deliveries, got %d", deliveries)
+	}
+}
+
+func TestInformerWithMaxEventsSkipsFiltered(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	tenants := make(chan string, 10)
+	err := inf.OnAllServiceSpecsWithDelta(func(snapshot map[string]*spec.Service, delta *Delta) bool {
+		tenants <- snapshot["/order"].RegisterTenant
+		return true
+	}, WithMaxEvents(2))
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	// the unchanged snapshots are filtered out without calling the callback.
+	for _, tenant := range []string{"t0", "t0", "t0", "t1", "t2"} {
+		syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", tenant)}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !syncer.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !syncer.isClosed() {
+		t.Fatalf("syncer should be stopped after max events")
+	}
+
+	if len(tenants) != 2 {
+		t.Fatalf("expect exactly 2 invocations, got %d", len(tenants))
+	}
+	if first, second := <-tenants, <-tenants; first != "t0" || second != "t1" {
+		t.Errorf("expect tenants t0 and t1, got %s and %s", first, second)
+	}
+}
+
+func TestInformerSharedWatchWithMaxEvents(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	bounded, unbounded := make(chan string, 10), make(chan string, 10)
+	watch := func(ch chan string, opts ...WatchOption) {
+		err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+			ch <- services["/order"].RegisterTenant
+			return true
+		}, append(opts, WithSharedWatch())...)
+		if err != nil {
+			t.Fatalf("watch service specs failed: %v", err)
+		}
+	}
+	watch(bounded, WithMaxEvents(1))
+	watch(unbounded)
+
+	for i := 0; i < 3; i++ {
+		syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", fmt.Sprintf("t%d", i))}
+		if tenant := <-unbounded; tenant != fmt.Sprintf("t%d", i) {
+			t.Errorf("expect tenant t%d, got %s", i, tenant)
+		}
+	}
+
+	if len(bounded) != 1 {
+		t.Errorf("expect exactly 1 delivery to the bounded callback, got %d", len(bounded))
+	}
+	if syncer.isClosed() {
+		t.Errorf("shared syncer should be kept for the other callback")
+	}
+}
+
+func TestInformerWithRateLimit(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	var (
+		mutex      sync.Mutex
+		deliveries int
+		latest     string
+	)
+	err := inf.OnAllServiceSpecs(func(services map[string]*spec.Service) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		deliveries++
+		latest = services["order"].RegisterTenant
+		return true
+	}, WithRateLimit(10, 1), WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch service specs failed: %v", err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		syncer.prefixCh <- map[string]string{"/order": serviceYAML("order", fmt.Sprintf("t%d", i))}
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+
+	// wait for the coalesced latest data.
+	time.Sleep(300 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// one for the burst, one per 100ms after it, and one for the latest.
+	limit := 2 + int(elapsed.Seconds()*10)
+	if deliveries > limit {
+		t.Errorf("expect at most %d deliveries in %v, got %d", limit, elapsed, deliveries)
+	}
+	if deliveries < 2 {
+		t.Errorf("expect throttled deliveries rather than a single one, got %d", deliveries)
+	}
+	if latest != "t29" {
+		t.Errorf("expect the latest tenant t29 to be delivered, got %s", latest)
+	}
+}
+
+func TestInformerOnZombieInstances(t *testing.T) {
+	store := newMockStorage()
+	specs := store.newSyncer()
+	statuses := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	if err := inf.OnZombieInstances(0, nil); err == nil {
+		t.Errorf("zero grace period should fail")
+	}
+
+	gracePeriod := 200 * time.Millisecond
+	received := make(chan []*spec.ServiceInstanceSpec, 100)
+	err := inf.OnZombieInstances(gracePeriod, func(zombies []*spec.ServiceInstanceSpec) bool {
+		received <- zombies
+		return true
+	})
+	if err != nil {
+		t.Fatalf("watch zombie instances failed: %v", err)
+	}
+
+	specYAML := func(service, id string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceSpec{ServiceName: service, InstanceID: id})
+		return string(buff)
+	}
+	statusYAML := func(service, id string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceStatus{ServiceName: service, InstanceID: id})
+		return string(buff)
+	}
+
+	start := time.Now()
+	specs.prefixCh <- map[string]string{
+		"/order/ins-1":    specYAML("order", "ins-1"),
+		"/order/ins-2":    specYAML("order", "ins-2"),
+		"/delivery/ins-1": specYAML("delivery", "ins-1"),
+	}
+	statuses.prefixCh <- map[string]string{
+		"/order/ins-2":    statusYAML("order", "ins-2"),
+		"/delivery/ins-1": statusYAML("delivery", "ins-1"),
+	}
+	// the instance having reported its status is not a zombie after the status is gone.
+	statuses.prefixCh <- map[string]string{
+		"/order/ins-2": statusYAML("order", "ins-2"),
+	}
+
+	select {
+	case zombies := <-received:
+		if elapsed := time.Since(start); elapsed < gracePeriod {
+			t.Errorf("zombie instances should be reported after the grace period, got after %v", elapsed)
+		}
+		if len(zombies) != 1 || zombies[0].ServiceName != "order" || zombies[0].InstanceID != "ins-1" {
+			t.Errorf("expect zombie instance order/ins-1, got %v", zombies)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("zombie instance should be reported")
+	}
+
+	// the zombie comes up at last.
+	statuses.prefixCh <- map[string]string{
+		"/order/ins-1": statusYAML("order", "ins-1"),
+		"/order/ins-2": statusYAML("order", "ins-2"),
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case zombies := <-received:
+			if len(zombies) == 0 {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("expect no zombie instance after its status reported")
+		}
+	}
+}
+
+func TestInformerOnValidationFailures(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	received := make(chan map[string]*spec.ValidationFailure, 10)
+	err := inf.OnValidationFailures(func(failures map[string]*spec.ValidationFailure) bool {
+		received <- failures
+		return true
+	}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch validation failures failed: %v", err)
+	}
+
+	syncer.prefixCh <- map[string]string{
+		layout.ValidationFailureKey("Service", "order", "10.0.0.1"): "kind: Service\nname: order\nsource: 10.0.0.1\nmessage: validate failed\ncount: 2\ntime: \"2021-01-01T00:00:00Z\"\n",
+		layout.ValidationFailureKey("Tenant", "t1", ""):             "kind: Tenant\nname: t1\nmessage: validate failed\ncount: 1\ntime: \"2021-01-01T00:00:01Z\"\n",
+	}
+
+	select {
+	case failures := <-received:
+		if len(failures) != 2 {
+			t.Fatalf("expect 2 validation failures, got %v", failures)
+		}
+		if f := failures["Service/order/10.0.0.1"]; f == nil || f.Kind != "Service" || f.Name != "order" ||
+			f.Source != "10.0.0.1" || f.Count != 2 {
+			t.Errorf("unexpected validation failure of order: %+v", f)
+		}
+		if f := failures["Tenant/t1/"]; f == nil || f.Kind != "Tenant" || f.Name != "t1" {
+			t.Errorf("unexpected validation failure of t1: %+v", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect validation failures, got nothing")
+	}
+}
+
+func TestInformerOnServiceInstanceSpecsMulti(t *testing.T) {
+	store := newMockStorage()
+	orderSyncer := store.newSyncer()
+	deliverySyncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	if err := inf.OnServiceInstanceSpecsMulti(nil, nil); err == nil {
+		t.Errorf("empty service names should fail")
+	}
+
+	type delivery struct {
+		serviceName string
+		specs       map[string]*spec.ServiceInstanceSpec
+	}
+	received := make(chan delivery, 10)
+	err := inf.OnServiceInstanceSpecsMulti([]string{"order", "delivery", "order"},
+		func(serviceName string, specs map[string]*spec.ServiceInstanceSpec) bool {
+			received <- delivery{serviceName: serviceName, specs: specs}
+			return len(specs) > 0
+		}, WithLogicalKeys())
+	if err != nil {
+		t.Fatalf("watch instance specs of multiple services failed: %v", err)
+	}
+
+	instanceYAML := func(serviceName, instanceID string) string {
+		buff, _ := yaml.Marshal(&spec.ServiceInstanceSpec{ServiceName: serviceName, InstanceID: instanceID})
+		return string(buff)
+	}
+	receive := func(serviceName string, instanceIDs ...string) {
+		select {
+		case d := <-received:
+			if d.serviceName != serviceName || len(d.specs) != len(instanceIDs) {
+				t.Fatalf("expect instances %v of %s, got %s: %v", instanceIDs, serviceName, d.serviceName, d.specs)
+			}
+			for _, id := range instanceIDs {
+				if instance := d.specs[id]; instance == nil || instance.ServiceName != serviceName {
+					t.Errorf("expect instance %s of %s, got %+v", id, serviceName, instance)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect instances of %s, got nothing", serviceName)
+		}
+	}
+
+	deliverySyncer.prefixCh <- map[string]string{
+		layout.ServiceInstanceSpecKey("delivery", "ins-1"): instanceYAML("delivery", "ins-1"),
+	}
+	receive("delivery", "ins-1")
+
+	orderSyncer.prefixCh <- map[string]string{
+		layout.ServiceInstanceSpecKey("order", "ins-1"): instanceYAML("order", "ins-1"),
+		layout.ServiceInstanceSpecKey("order", "ins-2"): instanceYAML("order", "ins-2"),
+	}
+	receive("order", "ins-1", "ins-2")
+
+	// returning false stops the watches of all services.
+	orderSyncer.prefixCh <- map[string]string{}
+	receive("order")
+
+	deadline := time.Now().Add(time.Second)
+	for !(orderSyncer.isClosed() && deliverySyncer.isClosed()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !orderSyncer.isClosed() || !deliverySyncer.isClosed() {
+		t.Errorf("all syncers should be stopped after the callback returns false")
+	}
+}
+
+func TestInformerSharedWatchOnServiceInstanceSpecsMulti(t *testing.T) {
+	store := newMockStorage()
+	syncer := store.newSyncer()
+	inf := NewInformer(store, "")
+	defer inf.Close()
+
+	watch := func(received chan string, continued bool) error {
+		return inf.OnServiceInstanceSpecsMulti([]string{"order"},
+			func(serviceName string, specs map[string]*spec.ServiceInstanceSpec) bool {
+				received <- serviceName
+				return continued
+			}, WithSharedWatch())
+	}
+	expect := func(received chan string) {
+		select {
+		case serviceName := <-received:
+			if serviceName != "order" {
+				t.Errorf("expect service order, got %s", serviceName)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect instances of order, got nothing")
+		}
+	}
+
+	received1 := make(chan string, 10)
+	if err := watch(received1, true); err != nil {
+		t.Fatalf("watch instance specs of multiple services failed: %v", err)
+	}
+	syncer.prefixCh <- map[string]string{layout.ServiceInstanceSpecKey("order", "ins-1"): "serviceName: order\ninstanceID: ins-1\n"}
+	expect(received1)
+
+	// the joining callback is informed synchronously without deadlock.
+	received2 := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() { done <- watch(received2, false) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("join shared watch failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("joining shared watch should not deadlock")
+	}
+	expect(received2)
+
+	// stopping the joining callback keeps the shared watch for others.
+	syncer.prefixCh <- map[string]string{layout.ServiceInstanceSpecKey("order", "ins-2"): "serviceName: order\ninstanceID: ins-2\n"}
+	expect(received1)
+	if syncer.isClosed() {
+		t.Errorf("shared syncer should not be stopped by one callback")
+	}
+}
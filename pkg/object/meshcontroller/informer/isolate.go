@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// isolatedCallback runs a callback of a shared watch in its own goroutine. Only the
+// latest pending delivery is kept, so a slow callback skips the intermediate data
+// instead of blocking the others.
+type isolatedCallback struct {
+	mutex   sync.Mutex
+	pending func() bool
+	notify  chan struct{}
+	stopped int32
+}
+
+// WithIsolateCallback makes the callback of a shared watch run in its own goroutine
+// recovering from panics, so a slow or panicking callback can't affect the others
+// sharing the syncer. A slow callback is informed the latest data only, skipping the
+// intermediate ones. For a non-shared watch, it's the same as WithRecover.
+func WithIsolateCallback() WatchOption {
+	return func(o *watchOptions) {
+		o.isolateCallback = true
+	}
+}
+
+// deliverIsolated schedules the latest data to the isolated callback, it reports
+// false if the callback has stopped. It's called with the lock of the fanout held.
+func (f *fanout) deliverIsolated(cb *fanoutCallback) bool {
+	if cb.isolated == nil {
+		cb.isolated = &isolatedCallback{notify: make(chan struct{}, 1)}
+		go f.runIsolated(cb)
+	}
+
+	ic := cb.isolated
+	if atomic.LoadInt32(&ic.stopped) == 1 {
+		return false
+	}
+
+	event, value, kvs := f.lastEvent, f.lastValue, f.lastKVs
+	fn := func() bool {
+		if cb.specsFn != nil {
+			return cb.specsFn(kvs)
+		}
+		return cb.specFn(event, value)
+	}
+
+	ic.mutex.Lock()
+	ic.pending = fn
+	ic.mutex.Unlock()
+
+	select {
+	case ic.notify <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// runIsolated runs the pending deliveries of the callback until it stops,
+// or the fanout or the informer stops.
+func (f *fanout) runIsolated(cb *fanoutCallback) {
+	ic := cb.isolated
+	for {
+		select {
+		case <-ic.notify:
+			ic.mutex.Lock()
+			fn := ic.pending
+			ic.pending = nil
+			ic.mutex.Unlock()
+
+			if fn == nil {
+				continue
+			}
+			if !f.inf.invoke(f.syncerKey, cb.options, fn) {
+				atomic.StoreInt32(&ic.stopped, 1)
+				return
+			}
+		case <-f.done:
+			return
+		case <-f.inf.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"sync/atomic"
+)
+
+// WithMaxEvents makes the watch stop after n invocations of the callback, for one-shot
+// and bounded consumers. The deliveries the watch filters out without calling the
+// callback, e.g. the watched parts are unchanged, don't count. Non-positive n means
+// no limit.
+func WithMaxEvents(n int) WatchOption {
+	return func(o *watchOptions) {
+		o.maxEvents = n
+	}
+}
+
+// withoutMaxEvents returns the options for the inner watches of a composite watch,
+// the max events is applied to the callback of the composite watch only.
+func withoutMaxEvents(opts []WatchOption) []WatchOption {
+	return append(opts[:len(opts):len(opts)], WithMaxEvents(0))
+}
+
+// callback wraps the invocation of the user callback and counts it, it reports false
+// to stop the watch once the max events is reached.
+func (o *watchOptions) callback(fn func() bool) bool {
+	if o.maxEvents <= 0 {
+		return fn()
+	}
+	if o.reachMaxEvents() {
+		return false
+	}
+
+	// NOTE: Count before calling, so a panicking invocation counts too.
+	events := atomic.AddUint64(&o.events, 1)
+	return fn() && events < uint64(o.maxEvents)
+}
+
+// reachMaxEvents reports whether the max events has been reached.
+func (o *watchOptions) reachMaxEvents() bool {
+	return o.maxEvents > 0 && atomic.LoadUint64(&o.events) >= uint64(o.maxEvents)
+}
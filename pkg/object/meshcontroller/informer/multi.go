@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// ServiceInstanceSpecsMultiFunc is the callback function type for instance specs
+	// of one of the watched services, tagged with the service name.
+	ServiceInstanceSpecsMultiFunc func(serviceName string, specs map[string]*spec.ServiceInstanceSpec) bool
+
+	// serviceInstanceSpecsMultiWatcher delivers instance specs of several services
+	// to one callback, with one syncer per service.
+	serviceInstanceSpecsMultiWatcher struct {
+		mutex      sync.Mutex
+		inf        *meshInformer
+		fn         ServiceInstanceSpecsMultiFunc
+		options    *watchOptions
+		syncerKeys []string
+		stopped    bool
+		// shared watches are shared with other callbacks, they are not stopped
+		// by the watcher, but the callbacks stop at their next deliveries.
+		shared bool
+	}
+)
+
+// OnServiceInstanceSpecsMulti watches instance specs of the services, the changes of
+// any service are informed to fn with the service name. The callback is never called
+// concurrently, and returning false stops the watches of all the services.
+func (inf *meshInformer) OnServiceInstanceSpecsMulti(serviceNames []string, fn ServiceInstanceSpecsMultiFunc, opts ...WatchOption) error {
+	if len(serviceNames) == 0 {
+		return fmt.Errorf("empty service names")
+	}
+
+	options := newWatchOptions(opts)
+	w := &serviceInstanceSpecsMultiWatcher{inf: inf, fn: fn, options: options, shared: options.shared}
+
+	// NOTE: Don't hold the lock to start watches, the joining callback of a shared
+	// watch is informed synchronously.
+	watched := map[string]bool{}
+	for _, serviceName := range serviceNames {
+		if watched[serviceName] {
+			continue
+		}
+		watched[serviceName] = true
+
+		serviceName := serviceName
+		storeKey := layout.ServiceInstanceSpecPrefix(serviceName)
+		syncerKey := fmt.Sprintf("multi-service-instance-spec-%s", serviceName)
+		specsFunc := func(specs map[string]*spec.ServiceInstanceSpec) bool {
+			return w.inform(serviceName, specs)
+		}
+		if err := inf.onServiceInstanceSpecs(storeKey, syncerKey, specsFunc, withoutMaxEvents(opts)); err != nil {
+			w.stop()
+			return err
+		}
+		if !w.addSyncerKey(syncerKey) {
+			// the callback stopped the watches before all of them start.
+			if !w.shared {
+				go inf.stopSyncOneKey(syncerKey)
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// addSyncerKey adds the key of the started syncer,
+// it returns false if the watcher has been stopped.
+func (w *serviceInstanceSpecsMultiWatcher) addSyncerKey(syncerKey string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return false
+	}
+	w.syncerKeys = append(w.syncerKeys, syncerKey)
+	return true
+}
+
+func (w *serviceInstanceSpecsMultiWatcher) inform(serviceName string, specs map[string]*spec.ServiceInstanceSpec) bool {
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		return false
+	}
+	continued := w.options.callback(func() bool { return w.fn(serviceName, specs) })
+	w.mutex.Unlock()
+
+	if !continued {
+		w.stop()
+	}
+	return continued
+}
+
+// stop stops the syncers of all services asynchronously,
+// since it could be called in the callback of the syncers.
+func (w *serviceInstanceSpecsMultiWatcher) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	if w.shared {
+		return
+	}
+
+	syncerKeys := w.syncerKeys
+	go func() {
+		for _, syncerKey := range syncerKeys {
+			w.inf.stopSyncOneKey(syncerKey)
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"reflect"
+	"regexp"
+)
+
+// filteredDeduper skips the filtered values equal to the last informed ones,
+// it's only used in the goroutine of the watch.
+type filteredDeduper struct {
+	informed bool
+	last     interface{}
+}
+
+// WithNameFilter makes the prefix watches only deliver the resources whose names match
+// the regex, and skip the callbacks when the filtered resources are unchanged. Service
+// instance specs and statuses are filtered by the names of their services.
+func WithNameFilter(filter *regexp.Regexp) WatchOption {
+	return func(o *watchOptions) {
+		o.nameFilter = filter
+	}
+}
+
+// matchName reports if the name matches the name filter, all names match without filter.
+func (o *watchOptions) matchName(name string) bool {
+	return o.nameFilter == nil || o.nameFilter.MatchString(name)
+}
+
+// newFilteredDeduper returns nil if no name filter is set,
+// and all methods of nil deduper are no-op.
+func (o *watchOptions) newFilteredDeduper() *filteredDeduper {
+	if o.nameFilter == nil {
+		return nil
+	}
+	return &filteredDeduper{}
+}
+
+// unchanged reports if the value equals to the last informed one, and records it otherwise.
+func (d *filteredDeduper) unchanged(value interface{}) bool {
+	if d == nil {
+		return false
+	}
+
+	if d.informed && reflect.DeepEqual(d.last, value) {
+		return true
+	}
+	d.informed, d.last = true, value
+
+	return false
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// GJSONPathSet is a set of inform paths, the watched region is the union of them.
+type GJSONPathSet []GJSONPath
+
+// String returns the paths joined by comma, which is used in syncer keys.
+func (ps GJSONPathSet) String() string {
+	paths := make([]string, len(ps))
+	for i, p := range ps {
+		paths[i] = string(p)
+	}
+	return strings.Join(paths, ",")
+}
+
+// ValidateGJSONPath validates the syntax of the path, AllParts is valid.
+// It rejects empty components (e.g. "resilience..circuitBreaker"), dangling
+// escapes and unbalanced parentheses of queries.
+func ValidateGJSONPath(path GJSONPath) error {
+	return spec.ValidateGJSONPath(path)
+}
+
+// validate validates all paths of the set.
+func (ps GJSONPathSet) validate() error {
+	for _, p := range ps {
+		if err := ValidateGJSONPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HeartbeatPaths are the paths of heartbeat times in service instance status.
+var HeartbeatPaths = GJSONPathSet{ServiceInstanceLastHeartbeatTime, ServiceInstanceServerHeartbeatTime}
+
+// OnPartsOfServiceSpec watches one service's spec, the callback is called only
+// when any part of the paths changes.
+func (inf *meshInformer) OnPartsOfServiceSpec(serviceName string, paths GJSONPathSet, fn ServiceSpecFunc, opts ...WatchOption) error {
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceSpecKey(serviceName)
+	syncerKey := fmt.Sprintf("service-spec-parts-%s-%s", serviceName, paths)
+
+	specFunc := func(event Event, value string) bool {
+		serviceSpec := &spec.Service{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), serviceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+		return options.callback(func() bool { return fn(event, serviceSpec) })
+	}
+
+	return inf.onSpecParts(storeKey, syncerKey, paths, nil, specFunc, opts)
+}
+
+// OnServiceSpecPaths watches one service's spec by one syncer, and calls the handlers of
+// the changed paths in the order of paths. The first value and deletion are informed to
+// all handlers. A handler returning false is removed, and the watch stops after all
+// handlers are removed.
+func (inf *meshInformer) OnServiceSpecPaths(serviceName string, handlers map[GJSONPath]ServiceSpecFunc, opts ...WatchOption) error {
+	if len(handlers) == 0 {
+		return fmt.Errorf("no handler")
+	}
+
+	paths := make(GJSONPathSet, 0, len(handlers))
+	for path := range handlers {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceSpecKey(serviceName)
+	syncerKey := fmt.Sprintf("service-spec-paths-%s-%s", serviceName, paths)
+
+	active := make(map[GJSONPath]ServiceSpecFunc, len(handlers))
+	for path, fn := range handlers {
+		active[path] = fn
+	}
+
+	var (
+		informed bool
+		last     string
+	)
+
+	specFunc := func(event Event, value string) bool {
+		serviceSpec := &spec.Service{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), serviceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+
+		for _, path := range paths {
+			fn := active[path]
+			if fn == nil {
+				continue
+			}
+			changed := !informed || event.EventType == EventDelete ||
+				!inf.comparePart(GJSONPathSet{path}, last, value)
+			if changed && !options.callback(func() bool { return fn(event, serviceSpec) }) {
+				delete(active, path)
+			}
+		}
+
+		informed, last = event.EventType != EventDelete, value
+
+		return len(active) != 0
+	}
+
+	return inf.onSpecPart(storeKey, syncerKey, AllParts, specFunc, opts)
+}
+
+// OnPartsOfServiceInstanceSpec watches one service's instance spec, the callback is
+// called only when any part of the paths changes.
+func (inf *meshInformer) OnPartsOfServiceInstanceSpec(serviceName, instanceID string, paths GJSONPathSet, fn ServicesInstanceSpecFunc, opts ...WatchOption) error {
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceInstanceSpecKey(serviceName, instanceID)
+	syncerKey := fmt.Sprintf("service-instance-spec-parts-%s-%s-%s", serviceName, instanceID, paths)
+
+	specFunc := func(event Event, value string) bool {
+		instanceSpec := &spec.ServiceInstanceSpec{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), instanceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+		return options.callback(func() bool { return fn(event, instanceSpec) })
+	}
+
+	return inf.onSpecParts(storeKey, syncerKey, paths, nil, specFunc, opts)
+}
+
+// OnPartsOfServiceInstanceStatus watches one service instance status, the callback is
+// called only when any part of the paths changes.
+func (inf *meshInformer) OnPartsOfServiceInstanceStatus(serviceName, instanceID string, paths GJSONPathSet, fn ServiceInstanceStatusFunc, opts ...WatchOption) error {
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceInstanceStatusKey(serviceName, instanceID)
+	syncerKey := fmt.Sprintf("service-instance-status-parts-%s-%s-%s", serviceName, instanceID, paths)
+
+	// NOTE: Statuses may be stored by a binary codec, so they are
+	// transformed to yaml before comparing.
+	toYAML := func(value string) (string, error) {
+		instanceStatus := &spec.ServiceInstanceStatus{}
+		if err := inf.decode(storeKey, []byte(value), instanceStatus); err != nil {
+			return "", err
+		}
+		buff, err := yaml.Marshal(instanceStatus)
+		if err != nil {
+			return "", err
+		}
+		return string(buff), nil
+	}
+
+	specFunc := func(event Event, value string) bool {
+		instanceStatus := &spec.ServiceInstanceStatus{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), instanceStatus); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+		return options.callback(func() bool { return fn(event, instanceStatus) })
+	}
+
+	return inf.onSpecParts(storeKey, syncerKey, paths, toYAML, specFunc, opts)
+}
+
+// OnPartsOfTenantSpec watches one tenant spec, the callback is called only
+// when any part of the paths changes.
+func (inf *meshInformer) OnPartsOfTenantSpec(tenant string, paths GJSONPathSet, fn TenantSpecFunc, opts ...WatchOption) error {
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.TenantSpecKey(tenant)
+	syncerKey := fmt.Sprintf("tenant-parts-%s-%s", tenant, paths)
+
+	specFunc := func(event Event, value string) bool {
+		tenantSpec := &spec.Tenant{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), tenantSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+		return options.callback(func() bool { return fn(event, tenantSpec) })
+	}
+
+	return inf.onSpecParts(storeKey, syncerKey, paths, nil, specFunc, opts)
+}
+
+// OnPartsOfIngressSpec watches one ingress spec, the callback is called only
+// when any part of the paths changes.
+func (inf *meshInformer) OnPartsOfIngressSpec(ingress string, paths GJSONPathSet, fn IngressSpecFunc, opts ...WatchOption) error {
+	if err := paths.validate(); err != nil {
+		return err
+	}
+
+	options := newWatchOptions(opts)
+	storeKey := layout.IngressSpecKey(ingress)
+	syncerKey := fmt.Sprintf("ingress-parts-%s-%s", ingress, paths)
+
+	specFunc := func(event Event, value string) bool {
+		ingressSpec := &spec.Ingress{}
+		if event.EventType != EventDelete {
+			if err := inf.decode(storeKey, []byte(value), ingressSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", value, err)
+				return true
+			}
+		}
+		return options.callback(func() bool { return fn(event, ingressSpec) })
+	}
+
+	return inf.onSpecParts(storeKey, syncerKey, paths, nil, specFunc, opts)
+}
+
+// onSpecParts watches the key, and calls fn only when any part of the paths changes.
+// The first value and deletion are always informed. toYAML transforms the stored
+// value to yaml for comparing, nil means the value is already yaml.
+func (inf *meshInformer) onSpecParts(storeKey, syncerKey string, paths GJSONPathSet,
+	toYAML func(value string) (string, error), fn specHandleFunc, opts []WatchOption) error {
+
+	var (
+		informed bool
+		last     string
+	)
+
+	partsFunc := func(event Event, value string) bool {
+		if event.EventType == EventDelete {
+			informed = false
+			return fn(event, value)
+		}
+
+		current := value
+		if toYAML != nil {
+			v, err := toYAML(value)
+			if err != nil {
+				logger.Errorf("BUG: transform %s to yaml failed: %v", value, err)
+				return true
+			}
+			current = v
+		}
+
+		if informed && inf.comparePart(paths, last, current) {
+			return true
+		}
+		informed, last = true, current
+
+		return fn(event, value)
+	}
+
+	return inf.onSpecPart(storeKey, syncerKey, AllParts, partsFunc, opts)
+}
+
+// stripPaths returns the json of v without the paths, whose object keys are sorted,
+// so the results of the same content are always equal.
+func stripPaths(v interface{}, paths GJSONPathSet) (string, error) {
+	buff, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	buff, err = yamljsontool.YAMLToJSON(buff)
+	if err != nil {
+		return "", err
+	}
+
+	var obj interface{}
+	if err = json.Unmarshal(buff, &obj); err != nil {
+		return "", err
+	}
+
+	for _, path := range paths {
+		keys := strings.Split(string(path), ".")
+		m, ok := obj.(map[string]interface{})
+		for _, key := range keys[:len(keys)-1] {
+			if !ok {
+				break
+			}
+			m, ok = m[key].(map[string]interface{})
+		}
+		if ok {
+			delete(m, keys[len(keys)-1])
+		}
+	}
+
+	buff, err = json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(buff), nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"gomodules.xyz/jsonpatch/v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// PatchFunc is the callback function type for the changes in RFC 6902 JSON patch.
+type PatchFunc func(event Event, patch []byte) bool
+
+// emptyPatch is the patch without any operation.
+var emptyPatch = []byte("[]")
+
+// OnPartOfServiceSpecPatch watches one service's spec, and informs the changes as
+// JSON patches against the last informed value. The first value is informed as
+// adding the whole document, and the deletion is informed with an empty patch.
+func (inf *meshInformer) OnPartOfServiceSpecPatch(serviceName string, fn PatchFunc, opts ...WatchOption) error {
+	options := newWatchOptions(opts)
+	storeKey := layout.ServiceSpecKey(serviceName)
+	syncerKey := fmt.Sprintf("service-spec-patch-%s", serviceName)
+
+	var last []byte
+	specFunc := func(event Event, value string) bool {
+		if event.EventType == EventDelete {
+			last = nil
+			return options.callback(func() bool { return fn(event, emptyPatch) })
+		}
+
+		current, err := yamljsontool.YAMLToJSON([]byte(value))
+		if err != nil {
+			logger.Errorf("BUG: transform yaml %s to json failed: %v", value, err)
+			return true
+		}
+
+		patch, err := createPatch(last, current)
+		if err != nil {
+			logger.Errorf("BUG: create patch from %s to %s failed: %v", last, current, err)
+			return true
+		}
+		if patch == nil {
+			return true
+		}
+		last = current
+
+		return options.callback(func() bool { return fn(event, patch) })
+	}
+
+	return inf.onSpecPart(storeKey, syncerKey, AllParts, specFunc, opts)
+}
+
+// createPatch creates the JSON patch from old to new, the operations are sorted
+// by their paths. Nil old means the whole new document is added, and it returns
+// nil if nothing changes.
+func createPatch(old, new []byte) ([]byte, error) {
+	var operations []jsonpatch.Operation
+	if old == nil {
+		var doc interface{}
+		if err := json.Unmarshal(new, &doc); err != nil {
+			return nil, err
+		}
+		operations = []jsonpatch.Operation{jsonpatch.NewOperation("add", "", doc)}
+	} else {
+		var err error
+		operations, err = jsonpatch.CreatePatch(old, new)
+		if err != nil {
+			return nil, err
+		}
+		if len(operations) == 0 {
+			return nil, nil
+		}
+		sort.Sort(jsonpatch.ByPath(operations))
+	}
+
+	return json.Marshal(operations)
+}
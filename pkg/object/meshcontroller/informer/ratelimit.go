@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+type (
+	// rateLimit is the token bucket limit of deliveries.
+	rateLimit struct {
+		rate  float64
+		burst int
+	}
+
+	// tokenBucket is a token bucket whose tokens could be reserved in advance.
+	tokenBucket struct {
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+)
+
+// WithRateLimit caps the deliveries of the watch to rate per second, with bursts of
+// up to burst deliveries. The data arriving beyond the rate is coalesced into the
+// latest one, which is delivered as soon as the rate allows, so the latest data is
+// never lost. Unlike debouncing, it caps the sustained throughput under write storms.
+// Non-positive rate means no limit, and burst is at least 1. It's ignored by the
+// watches with revision.
+func WithRateLimit(rate float64, burst int) WatchOption {
+	return func(o *watchOptions) {
+		if rate <= 0 {
+			o.rateLimit = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		o.rateLimit = &rateLimit{rate: rate, burst: burst}
+	}
+}
+
+func newTokenBucket(limit *rateLimit) *tokenBucket {
+	return &tokenBucket{
+		rate:   limit.rate,
+		burst:  float64(limit.burst),
+		tokens: float64(limit.burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token, and returns how long to wait before the token is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitPrefix delivers the maps of ch within the rate limit, the maps arriving
+// while waiting for the token are coalesced into the latest one. The returning
+// channel is closed after ch is closed and the latest map is sent.
+func rateLimitPrefix(ch <-chan map[string]string, limit *rateLimit) <-chan map[string]string {
+	limitedCh := make(chan map[string]string)
+
+	go func() {
+		defer close(limitedCh)
+
+		bucket := newTokenBucket(limit)
+		for kvs := range ch {
+			closed := false
+			if wait := bucket.reserve(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+			coalesce:
+				for {
+					select {
+					case latest, ok := <-ch:
+						if !ok {
+							timer.Stop()
+							closed = true
+							break coalesce
+						}
+						kvs = latest
+					case <-timer.C:
+						break coalesce
+					}
+				}
+			}
+
+			limitedCh <- kvs
+			if closed {
+				return
+			}
+		}
+	}()
+
+	return limitedCh
+}
+
+// rateLimitRaw is like rateLimitPrefix, but for the key values of one key.
+func rateLimitRaw(ch <-chan *mvccpb.KeyValue, limit *rateLimit) <-chan *mvccpb.KeyValue {
+	limitedCh := make(chan *mvccpb.KeyValue)
+
+	go func() {
+		defer close(limitedCh)
+
+		bucket := newTokenBucket(limit)
+		for kv := range ch {
+			closed := false
+			if wait := bucket.reserve(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+			coalesce:
+				for {
+					select {
+					case latest, ok := <-ch:
+						if !ok {
+							timer.Stop()
+							closed = true
+							break coalesce
+						}
+						kv = latest
+					case <-timer.C:
+						break coalesce
+					}
+				}
+			}
+
+			limitedCh <- kv
+			if closed {
+				return
+			}
+		}
+	}()
+
+	return limitedCh
+}
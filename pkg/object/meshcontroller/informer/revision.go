@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+type (
+	// ServiceSpecsRevisionFunc is the callback function type for service specs with revision.
+	ServiceSpecsRevisionFunc func(snapshot map[string]*spec.Service, revision int64) bool
+
+	// ServiceInstanceSpecsRevisionFunc is the callback function type for service instance specs with revision.
+	ServiceInstanceSpecsRevisionFunc func(snapshot map[string]*spec.ServiceInstanceSpec, revision int64) bool
+
+	// ServiceInstanceStatusesRevisionFunc is the callback function type for service instance statuses with revision.
+	ServiceInstanceStatusesRevisionFunc func(snapshot map[string]*spec.ServiceInstanceStatus, revision int64) bool
+
+	// TenantSpecsRevisionFunc is the callback function type for tenant specs with revision.
+	TenantSpecsRevisionFunc func(snapshot map[string]*spec.Tenant, revision int64) bool
+
+	// IngressSpecsRevisionFunc is the callback function type for ingress specs with revision.
+	IngressSpecsRevisionFunc func(snapshot map[string]*spec.Ingress, revision int64) bool
+)
+
+// withRevision makes the prefix watch sync snapshots along with their revisions,
+// and set the revision of each snapshot to r before informing it. Sharing and
+// batching are turned off, since the merged or shared data has no single revision.
+func withRevision(r *int64) WatchOption {
+	return func(o *watchOptions) {
+		o.revision = r
+		o.shared = false
+		o.batchWindow = 0
+	}
+}
+
+// OnAllServiceSpecsWithRevision watches all service specs like OnAllServiceSpecs,
+// and informs the store revision at which the snapshot was taken along with it.
+// WithSharedWatch and WithBatchWindow are ignored.
+func (inf *meshInformer) OnAllServiceSpecsWithRevision(fn ServiceSpecsRevisionFunc, opts ...WatchOption) error {
+	var revision int64
+	return inf.OnAllServiceSpecs(func(snapshot map[string]*spec.Service) bool {
+		return fn(snapshot, revision)
+	}, append(opts, withRevision(&revision))...)
+}
+
+// OnAllServiceInstanceSpecsWithRevision watches instance specs of all services like
+// OnAllServiceInstanceSpecs, and informs the revision along with the snapshot.
+func (inf *meshInformer) OnAllServiceInstanceSpecsWithRevision(fn ServiceInstanceSpecsRevisionFunc, opts ...WatchOption) error {
+	var revision int64
+	return inf.OnAllServiceInstanceSpecs(func(snapshot map[string]*spec.ServiceInstanceSpec) bool {
+		return fn(snapshot, revision)
+	}, append(opts, withRevision(&revision))...)
+}
+
+// OnAllServiceInstanceStatusesWithRevision watches instance statuses of all services
+// like OnAllServiceInstanceStatuses, and informs the revision along with the snapshot.
+func (inf *meshInformer) OnAllServiceInstanceStatusesWithRevision(fn ServiceInstanceStatusesRevisionFunc, opts ...WatchOption) error {
+	var revision int64
+	return inf.OnAllServiceInstanceStatuses(func(snapshot map[string]*spec.ServiceInstanceStatus) bool {
+		return fn(snapshot, revision)
+	}, append(opts, withRevision(&revision))...)
+}
+
+// OnAllTenantSpecsWithRevision watches all tenant specs like OnAllTenantSpecs,
+// and informs the revision along with the snapshot.
+func (inf *meshInformer) OnAllTenantSpecsWithRevision(fn TenantSpecsRevisionFunc, opts ...WatchOption) error {
+	var revision int64
+	return inf.OnAllTenantSpecs(func(snapshot map[string]*spec.Tenant) bool {
+		return fn(snapshot, revision)
+	}, append(opts, withRevision(&revision))...)
+}
+
+// OnAllIngressSpecsWithRevision watches all ingress specs like OnAllIngressSpecs,
+// and informs the revision along with the snapshot.
+func (inf *meshInformer) OnAllIngressSpecsWithRevision(fn IngressSpecsRevisionFunc, opts ...WatchOption) error {
+	var revision int64
+	return inf.OnAllIngressSpecs(func(snapshot map[string]*spec.Ingress) bool {
+		return fn(snapshot, revision)
+	}, append(opts, withRevision(&revision))...)
+}
+
+func (inf *meshInformer) startRevisionedPrefix(syncer storage.Syncer, storePrefix, syncerKey string,
+	fn specsHandleFunc, options *watchOptions) error {
+
+	ch, err := syncer.SyncPrefixWithRevision(storePrefix)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return fmt.Errorf("sync prefix %s: %w", storePrefix, ErrNilChannel)
+	}
+
+	go inf.syncRevisionedPrefix(ch, syncerKey, fn, options)
+
+	return nil
+}
+
+// syncRevisionedPrefix sets the revision right before informing each snapshot
+// in the same goroutine, so the callback always sees the matching revision.
+func (inf *meshInformer) syncRevisionedPrefix(ch <-chan *cluster.PrefixSnapshot, syncerKey string,
+	fn specsHandleFunc, options *watchOptions) {
+
+	for snapshot := range ch {
+		*options.revision = snapshot.Revision
+		if !inf.invoke(syncerKey, options, func() bool { return fn(snapshot.KVs) }) {
+			inf.stopSyncOneKey(syncerKey)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+// WithSkipInitialSnapshot makes the prefix watches record the initial snapshot without
+// calling the callback, and then call it only with the entries created or changed since
+// the last snapshot, so the callback only acts on the new things. Deletions are not
+// informed, and the callback is skipped if nothing is created or changed.
+func WithSkipInitialSnapshot() WatchOption {
+	return func(o *watchOptions) {
+		o.skipInitialSnapshot = true
+	}
+}
+
+// skipInitialSnapshot wraps fn to skip the initial snapshot and call it with
+// only the created or changed entries. It's only used in the goroutine of the watch.
+func skipInitialSnapshot(fn specsHandleFunc) specsHandleFunc {
+	var (
+		informed bool
+		last     map[string]string
+	)
+
+	return func(kvs map[string]string) bool {
+		if !informed {
+			informed, last = true, kvs
+			return true
+		}
+
+		changed := map[string]string{}
+		for k, v := range kvs {
+			if old, ok := last[k]; !ok || old != v {
+				changed[k] = v
+			}
+		}
+		last = kvs
+
+		if len(changed) == 0 {
+			return true
+		}
+
+		return fn(changed)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// StaleInstancesFunc is the callback function type for stale service instances.
+	StaleInstancesFunc func(stale []*spec.ServiceInstanceSpec) bool
+
+	// staleInstancesWatcher joins instance specs with statuses of a service
+	// to find out instances which haven't heartbeated for a while.
+	staleInstancesWatcher struct {
+		mutex      sync.Mutex
+		inf        *meshInformer
+		staleAfter time.Duration
+		fn         StaleInstancesFunc
+		options    *watchOptions
+
+		specSyncerKey   string
+		statusSyncerKey string
+
+		specs    map[string]*spec.ServiceInstanceSpec
+		statuses map[string]*spec.ServiceInstanceStatus
+		// last is the instance IDs of the last informed stale instances.
+		last    string
+		stopped bool
+		done    chan struct{}
+	}
+)
+
+// OnStaleInstances watches instances of the service which haven't heartbeated within
+// staleAfter, the stale instances are informed on status changes and periodically.
+// An instance without status is considered as stale too, and the instances in
+// maintenance are never stale.
+func (inf *meshInformer) OnStaleInstances(serviceName string, staleAfter time.Duration, fn StaleInstancesFunc, opts ...WatchOption) error {
+	if staleAfter <= 0 {
+		return fmt.Errorf("invalid stale duration: %v", staleAfter)
+	}
+
+	w := &staleInstancesWatcher{
+		inf:             inf,
+		staleAfter:      staleAfter,
+		fn:              fn,
+		options:         newWatchOptions(opts),
+		specSyncerKey:   fmt.Sprintf("stale-service-instance-spec-%s", serviceName),
+		statusSyncerKey: fmt.Sprintf("stale-service-instance-status-%s", serviceName),
+		done:            make(chan struct{}),
+	}
+
+	err := inf.onServiceInstanceSpecs(layout.ServiceInstanceSpecPrefix(serviceName),
+		w.specSyncerKey, w.updateSpecs, withoutMaxEvents(opts))
+	if err != nil {
+		return err
+	}
+
+	err = inf.onServiceInstanceStatuses(layout.ServiceInstanceStatusPrefix(serviceName),
+		w.statusSyncerKey, w.updateStatuses, withoutMaxEvents(opts))
+	if err != nil {
+		inf.stopSyncOneKey(w.specSyncerKey)
+		return err
+	}
+
+	go w.run()
+
+	return nil
+}
+
+func (w *staleInstancesWatcher) run() {
+	ticker := time.NewTicker(w.staleAfter / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.inf.done:
+			return
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			continued := w.inform(true)
+			w.mutex.Unlock()
+			if !continued {
+				w.stop()
+			}
+		}
+	}
+}
+
+func (w *staleInstancesWatcher) updateSpecs(specs map[string]*spec.ServiceInstanceSpec) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.specs = make(map[string]*spec.ServiceInstanceSpec, len(specs))
+	for _, s := range specs {
+		w.specs[s.InstanceID] = s
+	}
+
+	return w.informOrStop()
+}
+
+func (w *staleInstancesWatcher) updateStatuses(statuses map[string]*spec.ServiceInstanceStatus) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.statuses = make(map[string]*spec.ServiceInstanceStatus, len(statuses))
+	for _, s := range statuses {
+		w.statuses[s.InstanceID] = s
+	}
+
+	return w.informOrStop()
+}
+
+// informOrStop informs the stale instances, and stops the whole watch
+// if the callback doesn't want to continue.
+func (w *staleInstancesWatcher) informOrStop() bool {
+	if w.inform(false) {
+		return true
+	}
+
+	go w.stop()
+	return false
+}
+
+// inform calls the callback with the stale instances, it must be called with the lock.
+// The stale instances are informed if they are changed, or the inform is periodic and
+// there are stale instances.
+func (w *staleInstancesWatcher) inform(periodic bool) bool {
+	// wait for the data of both specs and statuses.
+	if w.stopped || w.specs == nil || w.statuses == nil {
+		return true
+	}
+
+	now := time.Now()
+	stale := []*spec.ServiceInstanceSpec{}
+	for id, instance := range w.specs {
+		// NOTE: Leave the instances in maintenance to the operators.
+		if instance.InMaintenance(now) {
+			continue
+		}
+		status := w.statuses[id]
+		if status == nil || !status.IsHealthy(now, w.staleAfter) {
+			stale = append(stale, instance)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].InstanceID < stale[j].InstanceID
+	})
+
+	ids := ""
+	for _, instance := range stale {
+		ids += instance.InstanceID + ","
+	}
+	if ids == w.last && (!periodic || len(stale) == 0) {
+		return true
+	}
+	w.last = ids
+
+	return w.inf.invoke(w.statusSyncerKey, w.options, func() bool {
+		return w.options.callback(func() bool { return w.fn(stale) })
+	})
+}
+
+func (w *staleInstancesWatcher) stop() {
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		return
+	}
+	w.stopped = true
+	close(w.done)
+	w.mutex.Unlock()
+
+	w.inf.stopSyncOneKey(w.specSyncerKey)
+	w.inf.stopSyncOneKey(w.statusSyncerKey)
+}
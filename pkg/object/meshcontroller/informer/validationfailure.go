@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"strings"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// ValidationFailuresFunc is the callback function type for the records of writes
+// rejected by the validation, which is keyed by the store keys or the kind/name/source
+// with logical keys.
+type ValidationFailuresFunc func(failures map[string]*spec.ValidationFailure) bool
+
+// OnValidationFailures watches the records of writes rejected by the validation
+// across the mesh, e.g. to catch tooling submitting invalid specs repeatedly.
+// The name filter applies to the names of the rejected resources.
+func (inf *meshInformer) OnValidationFailures(fn ValidationFailuresFunc, opts ...WatchOption) error {
+	storeKey := layout.ValidationFailurePrefix()
+	syncerKey := "prefix-validation-failure"
+	options := newWatchOptions(opts)
+
+	decodeErrors := options.newDecodeErrorTracker(syncerKey)
+	deduper := options.newFilteredDeduper()
+
+	specsFunc := func(kvs map[string]string) bool {
+		failures := make(map[string]*spec.ValidationFailure)
+		for k, v := range kvs {
+			failure := &spec.ValidationFailure{}
+			if err := inf.decode(k, []byte(v), failure); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				decodeErrors.record(err)
+				continue
+			}
+			if !options.matchName(failure.Name) {
+				continue
+			}
+			failures[options.nameKey(k, strings.TrimPrefix(k, storeKey))] = failure
+		}
+
+		if !decodeErrors.check() {
+			return false
+		}
+		if deduper.unchanged(failures) {
+			return true
+		}
+
+		return options.callback(func() bool { return fn(failures) })
+	}
+
+	return inf.onSpecs(storeKey, syncerKey, specsFunc, opts)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package informer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// ZombieInstancesFunc is the callback function type for zombie service instances.
+	ZombieInstancesFunc func(zombies []*spec.ServiceInstanceSpec) bool
+
+	// zombieInstancesWatcher joins instance specs with statuses of all services
+	// to find out instances which never report their statuses.
+	zombieInstancesWatcher struct {
+		mutex       sync.Mutex
+		inf         *meshInformer
+		gracePeriod time.Duration
+		fn          ZombieInstancesFunc
+		options     *watchOptions
+
+		specSyncerKey   string
+		statusSyncerKey string
+
+		specs    map[string]*spec.ServiceInstanceSpec
+		statuses map[string]bool
+		// firstSeen is when the instances are seen without status at the first time.
+		firstSeen map[string]time.Time
+		// reported is the instances having reported their statuses,
+		// they are never zombies even if their statuses are gone.
+		reported map[string]bool
+		// last is the keys of the last informed zombie instances.
+		last    string
+		stopped bool
+		done    chan struct{}
+	}
+)
+
+// OnZombieInstances watches instances of all services which never report their statuses
+// within gracePeriod since they are seen, e.g. the sidecar never comes up. Unlike stale
+// instances, an instance having reported its status is never a zombie. The zombie
+// instances are informed on changes and periodically.
+func (inf *meshInformer) OnZombieInstances(gracePeriod time.Duration, fn ZombieInstancesFunc, opts ...WatchOption) error {
+	if gracePeriod <= 0 {
+		return fmt.Errorf("invalid grace period: %v", gracePeriod)
+	}
+
+	w := &zombieInstancesWatcher{
+		inf:             inf,
+		gracePeriod:     gracePeriod,
+		fn:              fn,
+		options:         newWatchOptions(opts),
+		specSyncerKey:   "zombie-service-instance-spec",
+		statusSyncerKey: "zombie-service-instance-status",
+		firstSeen:       map[string]time.Time{},
+		reported:        map[string]bool{},
+		done:            make(chan struct{}),
+	}
+
+	err := inf.onServiceInstanceSpecs(layout.AllServiceInstanceSpecPrefix(),
+		w.specSyncerKey, w.updateSpecs, withoutMaxEvents(opts))
+	if err != nil {
+		return err
+	}
+
+	err = inf.onServiceInstanceStatuses(layout.AllServiceInstanceStatusPrefix(),
+		w.statusSyncerKey, w.updateStatuses, withoutMaxEvents(opts))
+	if err != nil {
+		inf.stopSyncOneKey(w.specSyncerKey)
+		return err
+	}
+
+	go w.run()
+
+	return nil
+}
+
+func zombieInstanceKey(serviceName, instanceID string) string {
+	return serviceName + "/" + instanceID
+}
+
+func (w *zombieInstancesWatcher) run() {
+	ticker := time.NewTicker(w.gracePeriod / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.inf.done:
+			return
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			continued := w.inform(true)
+			w.mutex.Unlock()
+			if !continued {
+				w.stop()
+			}
+		}
+	}
+}
+
+func (w *zombieInstancesWatcher) updateSpecs(specs map[string]*spec.ServiceInstanceSpec) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.specs = make(map[string]*spec.ServiceInstanceSpec, len(specs))
+	for _, s := range specs {
+		w.specs[zombieInstanceKey(s.ServiceName, s.InstanceID)] = s
+	}
+
+	return w.informOrStop()
+}
+
+func (w *zombieInstancesWatcher) updateStatuses(statuses map[string]*spec.ServiceInstanceStatus) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.statuses = make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		key := zombieInstanceKey(s.ServiceName, s.InstanceID)
+		w.statuses[key] = true
+		w.reported[key] = true
+	}
+
+	return w.informOrStop()
+}
+
+// informOrStop informs the zombie instances, and stops the whole watch
+// if the callback doesn't want to continue.
+func (w *zombieInstancesWatcher) informOrStop() bool {
+	if w.inform(false) {
+		return true
+	}
+
+	go w.stop()
+	return false
+}
+
+// inform calls the callback with the zombie instances, it must be called with the lock.
+// The zombie instances are informed if they are changed, or the inform is periodic and
+// there are zombie instances.
+func (w *zombieInstancesWatcher) inform(periodic bool) bool {
+	// wait for the data of both specs and statuses.
+	if w.stopped || w.specs == nil || w.statuses == nil {
+		return true
+	}
+
+	now := time.Now()
+	for key := range w.firstSeen {
+		if w.specs[key] == nil || w.reported[key] {
+			delete(w.firstSeen, key)
+		}
+	}
+	for key := range w.reported {
+		if w.specs[key] == nil && !w.statuses[key] {
+			delete(w.reported, key)
+		}
+	}
+
+	zombies := []*spec.ServiceInstanceSpec{}
+	for key, instance := range w.specs {
+		if w.reported[key] {
+			continue
+		}
+		firstSeen, ok := w.firstSeen[key]
+		if !ok {
+			w.firstSeen[key] = now
+			continue
+		}
+		if now.Sub(firstSeen) >= w.gracePeriod {
+			zombies = append(zombies, instance)
+		}
+	}
+	sort.Slice(zombies, func(i, j int) bool {
+		return zombieInstanceKey(zombies[i].ServiceName, zombies[i].InstanceID) <
+			zombieInstanceKey(zombies[j].ServiceName, zombies[j].InstanceID)
+	})
+
+	keys := ""
+	for _, instance := range zombies {
+		keys += zombieInstanceKey(instance.ServiceName, instance.InstanceID) + ","
+	}
+	if keys == w.last && (!periodic || len(zombies) == 0) {
+		return true
+	}
+	w.last = keys
+
+	return w.inf.invoke(w.statusSyncerKey, w.options, func() bool {
+		return w.options.callback(func() bool { return w.fn(zombies) })
+	})
+}
+
+func (w *zombieInstancesWatcher) stop() {
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		return
+	}
+	w.stopped = true
+	close(w.done)
+	w.mutex.Unlock()
+
+	w.inf.stopSyncOneKey(w.specSyncerKey)
+	w.inf.stopSyncOneKey(w.statusSyncerKey)
+}
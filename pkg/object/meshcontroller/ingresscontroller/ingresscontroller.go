@@ -100,6 +100,13 @@ func New(superSpec *supervisor.Spec) *IngressController {
 		logger.Errorf("watch service instance failed: %v", err)
 	}
 
+	// NOTE: Only the readiness changes matter, the heartbeats are ignored.
+	err = ic.informer.OnAllServiceInstanceStatuses(ic.handleServiceInstanceStatuses, informer.WithIgnoredPaths(
+		informer.ServiceInstanceLastHeartbeatTime, informer.ServiceInstanceServerHeartbeatTime))
+	if err != nil && err != informer.ErrAlreadyWatched {
+		logger.Errorf("watch service instance status failed: %v", err)
+	}
+
 	return ic
 }
 
@@ -148,6 +155,21 @@ func (ic *IngressController) handleServiceInstances(serviceInstances map[string]
 	return
 }
 
+func (ic *IngressController) handleServiceInstanceStatuses(statuses map[string]*spec.ServiceInstanceStatus) (continueWatch bool) {
+	continueWatch = true
+
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("%s: handleServiceInstanceStatus recover from: %v, stack trace:\n%s\n",
+				ic.superSpec.Name(), err, debug.Stack())
+		}
+	}()
+
+	ic.reloadTraffic()
+
+	return
+}
+
 func (ic *IngressController) reloadTraffic() {
 	ic.mutex.Lock()
 	defer ic.mutex.Unlock()
@@ -193,19 +215,10 @@ func (ic *IngressController) _reloadHTTPPipelines() {
 			continue
 		}
 
-		instanceSpecs := ic.service.ListServiceInstanceSpecs(serviceSpec.Name)
+		instanceSpecs := ic.service.ListReadyInstances(serviceSpec.Name)
 		if len(instanceSpecs) == 0 {
 			continue
 		}
-		upInstance := 0
-		for _, instanceSpec := range instanceSpecs {
-			if instanceSpec.Status == spec.ServiceStatusUp {
-				upInstance++
-			}
-		}
-		if upInstance == 0 {
-			continue
-		}
 
 		// FIXME: What if the instance address is always 127.0.0.1.
 		superSpec, err := serviceSpec.IngressPipelineSpec(instanceSpecs)
@@ -277,4 +290,5 @@ func (ic *IngressController) Close() {
 
 	ic.informer.Close()
 	ic.tc.Clean(ic.namespace)
+	ic.service.Close()
 }
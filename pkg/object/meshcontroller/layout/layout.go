@@ -45,6 +45,36 @@ const (
 	customResource           = "/mesh/custom-resources/%s/%s/" // +kind +name
 
 	globalCanaryHeaders = "/mesh/canary-headers"
+
+	leader = "/mesh/leaders/%s" // +task
+
+	canaryCohortPrefix = "/mesh/canary-cohorts/%s/"      // +cohort
+	canaryCohortMember = "/mesh/canary-cohorts/%s/%s/%s" // +cohort +serviceName +instanceID
+
+	scheduledChangePrefix = "/mesh/scheduled-changes/"
+	scheduledChange       = "/mesh/scheduled-changes/%s" // +id
+
+	instanceTemplate = "/mesh/instance-templates/%s" // +serviceName
+
+	serviceSpecHistoryPrefix = "/mesh/service-spec-history/%s/"      // +serviceName
+	serviceSpecHistory       = "/mesh/service-spec-history/%s/%020d" // +serviceName +revision
+
+	consistencySentinel = "/mesh/consistency-sentinel"
+
+	layoutVersion = "/mesh/layout-version"
+
+	validationFailurePrefix = "/mesh/validation-failures/"
+	validationFailure       = "/mesh/validation-failures/%s/%s/%s" // +kind +name +source
+)
+
+const (
+	// BaselineVersion is the version of the key layout before versioning,
+	// the store without the version key is in it.
+	BaselineVersion = 1
+
+	// Version is the version of the current key layout, it must be increased
+	// with a migration whenever the layout changes.
+	Version = 1
 )
 
 // ServiceSpecPrefix returns the prefix of service.
@@ -136,3 +166,65 @@ func CustomResourcePrefix(kind string) string {
 func CustomResourceKey(kind, name string) string {
 	return fmt.Sprintf(customResource, kind, name)
 }
+
+// LeaderKey returns the key of the leader of the controller task.
+func LeaderKey(task string) string {
+	return fmt.Sprintf(leader, task)
+}
+
+// CanaryCohortPrefix returns the prefix of the members of the canary cohort.
+func CanaryCohortPrefix(cohort string) string {
+	return fmt.Sprintf(canaryCohortPrefix, cohort)
+}
+
+// CanaryCohortMemberKey returns the key of the instance in the canary cohort.
+func CanaryCohortMemberKey(cohort, serviceName, instanceID string) string {
+	return fmt.Sprintf(canaryCohortMember, cohort, serviceName, instanceID)
+}
+
+// ScheduledChangePrefix returns the prefix of scheduled spec changes.
+func ScheduledChangePrefix() string {
+	return scheduledChangePrefix
+}
+
+// ScheduledChangeKey returns the key of the scheduled spec change.
+func ScheduledChangeKey(id string) string {
+	return fmt.Sprintf(scheduledChange, id)
+}
+
+// InstanceTemplateKey returns the key of the instance template of the service.
+func InstanceTemplateKey(serviceName string) string {
+	return fmt.Sprintf(instanceTemplate, serviceName)
+}
+
+// ServiceSpecHistoryPrefix returns the prefix of the prior versions of the service spec.
+func ServiceSpecHistoryPrefix(serviceName string) string {
+	return fmt.Sprintf(serviceSpecHistoryPrefix, serviceName)
+}
+
+// ServiceSpecHistoryKey returns the key of the prior version of the service spec,
+// the keys sort by the revisions.
+func ServiceSpecHistoryKey(serviceName string, revision int64) string {
+	return fmt.Sprintf(serviceSpecHistory, serviceName, revision)
+}
+
+// ConsistencySentinelKey returns the key read to verify the consistency of the store.
+func ConsistencySentinelKey() string {
+	return consistencySentinel
+}
+
+// VersionKey returns the key of the version of the key layout of the store.
+func VersionKey() string {
+	return layoutVersion
+}
+
+// ValidationFailurePrefix returns the prefix of the records of rejected writes.
+func ValidationFailurePrefix() string {
+	return validationFailurePrefix
+}
+
+// ValidationFailureKey returns the key of the record of the rejected writes
+// of the resource from the source.
+func ValidationFailureKey(kind, name, source string) string {
+	return fmt.Sprintf(validationFailure, kind, name, source)
+}
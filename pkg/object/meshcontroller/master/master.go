@@ -18,11 +18,10 @@
 package master
 
 import (
+	"math"
 	"runtime/debug"
 	"time"
 
-	"gopkg.in/yaml.v2"
-
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
@@ -35,6 +34,9 @@ import (
 const (
 	defaultCleanInterval       time.Duration = 10 * time.Minute
 	defaultDeadRecordExistTime time.Duration = 20 * time.Minute
+	// defaultValidationFailureExistTime is how long the record of rejected writes
+	// is kept since the last rejection.
+	defaultValidationFailureExistTime time.Duration = 24 * time.Hour
 )
 
 type (
@@ -44,6 +46,8 @@ type (
 		superSpec           *supervisor.Spec
 		spec                *spec.Admin
 		maxHeartbeatTimeout time.Duration
+		// layoutVersionInitialized is accessed by the heartbeat checking routine only.
+		layoutVersionInitialized bool
 
 		registrySyncer *registrySyncer
 		store          storage.Storage
@@ -108,6 +112,8 @@ func (m *Master) checkHeartbeat(watchInterval time.Duration) {
 			return
 		case <-time.After(watchInterval):
 			if m.needHandle() {
+				m.initLayoutVersion()
+				m.processScheduledChanges()
 				func() {
 					defer func() {
 						if err := recover(); err != nil {
@@ -124,6 +130,29 @@ func (m *Master) checkHeartbeat(watchInterval time.Duration) {
 	}
 }
 
+// initLayoutVersion writes the layout version into the fresh store once.
+func (m *Master) initLayoutVersion() {
+	if m.layoutVersionInitialized {
+		return
+	}
+	if err := m.service.InitLayoutVersion(); err != nil {
+		logger.Errorf("init layout version failed: %v", err)
+		return
+	}
+	m.layoutVersionInitialized = true
+}
+
+// processScheduledChanges applies the scheduled changes due now.
+func (m *Master) processScheduledChanges() {
+	n, err := m.service.ProcessScheduledChanges(time.Now())
+	if err != nil {
+		logger.Errorf("process scheduled changes failed: %v", err)
+	}
+	if n > 0 {
+		logger.Infof("applied %d scheduled changes", n)
+	}
+}
+
 func (m *Master) clean() {
 	for {
 		select {
@@ -139,6 +168,7 @@ func (m *Master) clean() {
 						}
 					}()
 					m.cleanDeadInstances()
+					m.cleanValidationFailures()
 				}()
 			} else {
 				logger.Infof("not the cluster leader, do nothing")
@@ -158,6 +188,10 @@ func (m *Master) scanInstances() (failedInstances []*spec.ServiceInstanceSpec,
 		if !m.isMeshRegistryName(_spec.RegistryName) {
 			continue
 		}
+		// NOTE: Leave the instances in maintenance to the operators.
+		if _spec.InMaintenance(now) {
+			continue
+		}
 
 		var status *spec.ServiceInstanceStatus
 		for _, s := range statuses {
@@ -166,12 +200,21 @@ func (m *Master) scanInstances() (failedInstances []*spec.ServiceInstanceSpec,
 			}
 		}
 		if status != nil {
-			lastHeartbeatTime, err := time.Parse(time.RFC3339, status.LastHeartbeatTime)
-			if err != nil {
-				logger.Errorf("BUG: parse last heartbeat time %s failed: %v", status.LastHeartbeatTime, err)
-				continue
+			var gap time.Duration
+			if status.Phase == spec.ServiceInstancePhasePending {
+				// NOTE: The instance has not reported its first heartbeat yet,
+				// give it the heartbeat timeout since its registry time.
+				gap = pendingSince(_spec, now)
+				if gap <= m.maxHeartbeatTimeout {
+					continue
+				}
+			} else {
+				if _, err := status.LastHeartbeat(); err != nil {
+					logger.Errorf("BUG: %v", err)
+					continue
+				}
+				gap = status.StaleSince(now)
 			}
-			gap := now.Sub(lastHeartbeatTime)
 			if gap > m.maxHeartbeatTimeout {
 				// This instance record's time gap is beyond our tolerance, needs to be clean immediately.
 				// For freeing storage space
@@ -183,7 +226,8 @@ func (m *Master) scanInstances() (failedInstances []*spec.ServiceInstanceSpec,
 					failedInstances = append(failedInstances, _spec)
 				}
 			} else {
-				if _spec.Status == spec.ServiceStatusOutOfService {
+				// NOTE: The drained instances stay out of service until undrained.
+				if _spec.Status == spec.ServiceStatusOutOfService && !_spec.Drained {
 					logger.Infof("%s/%s heartbeat recovered, make it UP", _spec.ServiceName, _spec.InstanceID)
 					rebornInstances = append(rebornInstances, _spec)
 				}
@@ -197,6 +241,16 @@ func (m *Master) scanInstances() (failedInstances []*spec.ServiceInstanceSpec,
 	return
 }
 
+// pendingSince returns how long the pending instance has been registered until now.
+// An invalid registry time is treated as pending forever.
+func pendingSince(instance *spec.ServiceInstanceSpec, now time.Time) time.Duration {
+	registryTime, err := time.Parse(time.RFC3339, instance.RegistryTime)
+	if err != nil {
+		return time.Duration(math.MaxInt64)
+	}
+	return now.Sub(registryTime)
+}
+
 func (m *Master) checkInstancesHeartbeat() {
 	failedInstances, rebornInstances, _ := m.scanInstances()
 	m.handleFailedInstances(failedInstances)
@@ -218,6 +272,17 @@ func (m *Master) cleanDeadInstances() {
 	}
 }
 
+func (m *Master) cleanValidationFailures() {
+	n, err := m.service.PruneValidationFailures(time.Now().Add(-defaultValidationFailureExistTime))
+	if err != nil {
+		logger.Errorf("prune validation failures failed: %v", err)
+		return
+	}
+	if n > 0 {
+		logger.Infof("pruned %d validation failures", n)
+	}
+}
+
 func (m *Master) isMeshRegistryName(registryName string) bool {
 	// NOTE: Empty registry name means it is an internal mesh service by default.
 	switch registryName {
@@ -240,7 +305,7 @@ func (m *Master) updateInstanceStatus(instances []*spec.ServiceInstanceSpec, sta
 	for _, _spec := range instances {
 		_spec.Status = status
 
-		buff, err := yaml.Marshal(_spec)
+		buff, err := spec.Encode(_spec)
 		if err != nil {
 			logger.Errorf("BUG: marshal %#v to yaml failed: %v", _spec, err)
 			continue
@@ -257,6 +322,8 @@ func (m *Master) updateInstanceStatus(instances []*spec.ServiceInstanceSpec, sta
 // Close closes the master
 func (m *Master) Close() {
 	close(m.done)
+	m.registrySyncer.close()
+	m.service.Close()
 }
 
 // Status returns the status of master.
@@ -114,12 +114,12 @@ func (rs *registrySyncer) handleEvent(event *serviceregistry.RegistryEvent) {
 			}
 			_, exists := event.Replace[instance.Key()]
 			if !exists {
-				rs.service.DeleteServiceInstanceSpec(oldInstance.ServiceName, oldInstance.InstanceID)
+				rs.deleteInstance(oldInstance.ServiceName, oldInstance.InstanceID)
 			}
 		}
 
 		for _, instance := range event.Replace {
-			rs.service.PutServiceInstanceSpec(rs.externalToMeshInstance(instance))
+			rs.putInstance(rs.externalToMeshInstance(instance))
 		}
 
 		return
@@ -129,10 +129,25 @@ func (rs *registrySyncer) handleEvent(event *serviceregistry.RegistryEvent) {
 	event.Apply = rs.filterExternalInstances(event.Apply, rs.externalRegistryName())
 
 	for _, instance := range event.Delete {
-		rs.service.DeleteServiceInstanceSpec(instance.ServiceName, instance.InstanceID)
+		rs.deleteInstance(instance.ServiceName, instance.InstanceID)
 	}
 	for _, instance := range event.Apply {
-		rs.service.PutServiceInstanceSpec(rs.externalToMeshInstance(instance))
+		rs.putInstance(rs.externalToMeshInstance(instance))
+	}
+}
+
+func (rs *registrySyncer) putInstance(instance *spec.ServiceInstanceSpec) {
+	err := rs.service.PutServiceInstanceSpec(instance)
+	if err != nil {
+		logger.Errorf("put service instance %s/%s failed: %v",
+			instance.ServiceName, instance.InstanceID, err)
+	}
+}
+
+func (rs *registrySyncer) deleteInstance(serviceName, instanceID string) {
+	err := rs.service.DeleteServiceInstanceSpec(serviceName, instanceID)
+	if err != nil {
+		logger.Errorf("delete service instance %s/%s failed: %v", serviceName, instanceID, err)
 	}
 }
 
@@ -242,4 +257,7 @@ func (rs *registrySyncer) close() {
 	if rs.informer != nil {
 		rs.informer.Close()
 	}
+	if rs.service != nil {
+		rs.service.Close()
+	}
 }
@@ -22,8 +22,10 @@ import (
 	"github.com/megaease/easegress/pkg/object/meshcontroller/api"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/ingresscontroller"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/label"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/master"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/worker"
 	"github.com/megaease/easegress/pkg/supervisor"
 )
@@ -91,6 +93,12 @@ func (mc *MeshController) Inherit(superSpec *supervisor.Spec, previousGeneration
 }
 
 func (mc *MeshController) reload() {
+	statusCodec := storage.YAMLCodec
+	if mc.spec.StatusCodec == spec.StatusCodecProtobuf {
+		statusCodec = spec.StatusProtobufCodec
+	}
+	storage.RegisterCodec(layout.AllServiceInstanceStatusPrefix(), statusCodec)
+
 	mc.api = api.New(mc.superSpec)
 	meshRole := mc.superSpec.Super().Options().Labels[label.KeyRole]
 	serviceName := mc.superSpec.Super().Options().Labels[label.KeyServiceName]
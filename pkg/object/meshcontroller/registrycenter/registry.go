@@ -168,8 +168,11 @@ func (rcs *Server) register(ins *spec.ServiceInstanceSpec, ingressReady ReadyFun
 
 				ins.Status = spec.ServiceStatusUp
 				ins.RegistryTime = time.Now().Format(time.RFC3339)
+				if err := rcs.service.PutServiceInstanceSpec(ins); err != nil {
+					logger.Errorf("registry service: %s instanceID: %s failed: %v", ins.ServiceName, ins.InstanceID, err)
+					return
+				}
 				rcs.registered = true
-				rcs.service.PutServiceInstanceSpec(ins)
 				logger.Infof("registry SUCC service: %s instanceID: %s registry try times: %d", ins.ServiceName, ins.InstanceID, tryTimes)
 			}
 
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// StatusAggregate is the service level aggregate of its instance statuses.
+type StatusAggregate struct {
+	ServiceName string `yaml:"serviceName"`
+
+	// Instances is the count of all instance statuses, and it equals to
+	// Pending + Healthy + Unhealthy.
+	Instances int `yaml:"instances"`
+	Pending   int `yaml:"pending"`
+	Healthy   int `yaml:"healthy"`
+	Unhealthy int `yaml:"unhealthy"`
+
+	// The percentiles of how long the instances have not reported their heartbeats,
+	// pending instances and invalid heartbeat times are excluded.
+	StalenessP50 time.Duration `yaml:"stalenessP50"`
+	StalenessP95 time.Duration `yaml:"stalenessP95"`
+	StalenessMax time.Duration `yaml:"stalenessMax"`
+}
+
+// ComputeServiceStatusAggregate computes the aggregate over the current instance
+// statuses of the service, from one read of its status prefix.
+func (s *Service) ComputeServiceStatusAggregate(serviceName string) *StatusAggregate {
+	kvs, err := s.store.GetRawPrefix(layout.ServiceInstanceStatusPrefix(serviceName))
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	statuses := make([]*spec.ServiceInstanceStatus, 0, len(kvs))
+	for k, v := range kvs {
+		status := &spec.ServiceInstanceStatus{}
+		if err = storage.Decode(k, v.Value, status); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	return aggregateStatuses(serviceName, statuses, time.Now(), s.heartbeatTimeout())
+}
+
+func aggregateStatuses(serviceName string, statuses []*spec.ServiceInstanceStatus,
+	now time.Time, timeout time.Duration) *StatusAggregate {
+	aggregate := &StatusAggregate{ServiceName: serviceName, Instances: len(statuses)}
+
+	stalenesses := make([]time.Duration, 0, len(statuses))
+	for _, status := range statuses {
+		if status.Phase == spec.ServiceInstancePhasePending {
+			aggregate.Pending++
+			continue
+		}
+
+		if status.IsHealthy(now, timeout) {
+			aggregate.Healthy++
+		} else {
+			aggregate.Unhealthy++
+		}
+
+		if _, err := status.LastHeartbeat(); err == nil {
+			stalenesses = append(stalenesses, status.StaleSince(now))
+		}
+	}
+
+	if len(stalenesses) == 0 {
+		return aggregate
+	}
+
+	sort.Slice(stalenesses, func(i, j int) bool { return stalenesses[i] < stalenesses[j] })
+	aggregate.StalenessP50 = percentile(stalenesses, 0.50)
+	aggregate.StalenessP95 = percentile(stalenesses, 0.95)
+	aggregate.StalenessMax = stalenesses[len(stalenesses)-1]
+
+	return aggregate
+}
+
+// percentile returns the p percentile of the sorted durations by the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
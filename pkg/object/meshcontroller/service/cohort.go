@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// AddInstanceToCohort adds the service instance to the canary cohort, the instance
+// spec must exist. Adding an existing member is a no-op, so its join time is kept.
+func (s *Service) AddInstanceToCohort(cohort, serviceName, instanceID string) error {
+	instanceKV, err := s.store.GetRaw(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+	if err != nil {
+		return err
+	}
+	if instanceKV == nil {
+		return fmt.Errorf("service instance %s/%s not found", serviceName, instanceID)
+	}
+
+	member := &spec.CanaryCohortMember{
+		Cohort:      cohort,
+		ServiceName: serviceName,
+		InstanceID:  instanceID,
+		JoinTime:    time.Now().Format(time.RFC3339),
+	}
+	key := layout.CanaryCohortMemberKey(cohort, serviceName, instanceID)
+	put, err := s.store.CompareAndPut(key, *marshalToString(member), 0)
+	if err != nil {
+		return err
+	}
+
+	if put {
+		s.recordEvent(eventKindCanaryCohort, cohort, EventTypeNormal, EventReasonUpdated,
+			fmt.Sprintf("added %s/%s", serviceName, instanceID))
+	}
+
+	return nil
+}
+
+// RemoveInstanceFromCohort removes the service instance from the canary cohort,
+// removing a non-member is a no-op.
+func (s *Service) RemoveInstanceFromCohort(cohort, serviceName, instanceID string) error {
+	key := layout.CanaryCohortMemberKey(cohort, serviceName, instanceID)
+	kv, err := s.store.GetRaw(key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return nil
+	}
+
+	if err = s.store.Delete(key); err != nil {
+		return err
+	}
+
+	s.recordEvent(eventKindCanaryCohort, cohort, EventTypeNormal, EventReasonUpdated,
+		fmt.Sprintf("removed %s/%s", serviceName, instanceID))
+
+	return nil
+}
+
+// ListCohortInstances lists the members of the canary cohort,
+// sorted by their service names and instance IDs.
+func (s *Service) ListCohortInstances(cohort string) []*spec.CanaryCohortMember {
+	kvs, err := s.store.GetRawPrefix(layout.CanaryCohortPrefix(cohort))
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	members := []*spec.CanaryCohortMember{}
+	for _, v := range kvs {
+		member := &spec.CanaryCohortMember{}
+		if err = spec.Decode(v.Value, member); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].ServiceName != members[j].ServiceName {
+			return members[i].ServiceName < members[j].ServiceName
+		}
+		return members[i].InstanceID < members[j].InstanceID
+	})
+
+	return members
+}
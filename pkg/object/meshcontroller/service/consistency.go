@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// consistencyCheckReads is the count of reads compared by VerifyConsistency.
+const consistencyCheckReads = 3
+
+// VerifyConsistency reads the sentinel key several times with linearizable consistency,
+// and returns ErrInconsistentStore if the reads go back in time, which signals the
+// reads are served by etcd members with different views, e.g. in a split brain.
+// The store revision and the mod revision of the sentinel must never decrease,
+// and the sentinel can't be modified after the revision it's read at.
+func (s *Service) VerifyConsistency() error {
+	key := layout.ConsistencySentinelKey()
+
+	var lastRevision, lastModRevision int64
+	for i := 0; i < consistencyCheckReads; i++ {
+		kvs, revision, err := s.store.GetRawMultiWithRevision([]string{key}, nil)
+		if err != nil {
+			return err
+		}
+
+		if revision < lastRevision {
+			return fmt.Errorf("%w: store revision went back from %d to %d at read %d",
+				ErrInconsistentStore, lastRevision, revision, i+1)
+		}
+
+		var modRevision int64
+		if kv := kvs[key]; kv != nil {
+			modRevision = kv.ModRevision
+		}
+		if modRevision > revision {
+			return fmt.Errorf("%w: sentinel modified at revision %d after read revision %d at read %d",
+				ErrInconsistentStore, modRevision, revision, i+1)
+		}
+		// NOTE: The sentinel could be deleted only if the store revision advances.
+		deleted := modRevision == 0 && revision > lastRevision
+		if modRevision < lastModRevision && !deleted {
+			return fmt.Errorf("%w: sentinel revision went back from %d to %d at read %d",
+				ErrInconsistentStore, lastModRevision, modRevision, i+1)
+		}
+		lastRevision, lastModRevision = revision, modRevision
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+var (
+	// reconcileInterval is the min interval between two reconciles.
+	reconcileInterval = 10 * time.Millisecond
+	// reconcileBaseDelay is the delay of requeuing a resource after its first failure,
+	// the delay doubles on every following failure.
+	reconcileBaseDelay = 100 * time.Millisecond
+	// reconcileMaxDelay is the max delay of requeuing a failed resource.
+	reconcileMaxDelay = time.Minute
+)
+
+type (
+	// Reconciler reconciles the changed custom resource.
+	Reconciler interface {
+		// Reconcile drives the world to the state of the custom resource,
+		// the resource is requeued with backoff if it returns error.
+		Reconcile(cr *spec.CustomResource) error
+	}
+
+	// Deleter is the optional interface of Reconciler to clean up deleted resources.
+	Deleter interface {
+		// Delete cleans up the state derived from the deleted custom resource,
+		// which is the last seen one. It is requeued with backoff if it returns error.
+		Delete(cr *spec.CustomResource) error
+	}
+
+	crController struct {
+		service    *Service
+		kind       string
+		reconciler Reconciler
+
+		revisions map[string]int64
+		resources map[string]*spec.CustomResource
+		// deleted holds the deleted resources until they are cleaned up.
+		deleted  map[string]*spec.CustomResource
+		failures map[string]int
+
+		queue  []string
+		queued map[string]bool
+
+		requeue chan string
+		last    time.Time
+	}
+)
+
+// RunCustomResourceController watches custom resources of the kind and calls the
+// reconciler for every changed resource, until the context is canceled. The deleted
+// resources are passed to Delete if the reconciler is also a Deleter.
+// Failed reconciles are requeued with exponential backoff.
+func (s *Service) RunCustomResourceController(ctx context.Context, kind string, reconciler Reconciler) error {
+	c := &crController{
+		service:    s,
+		kind:       kind,
+		reconciler: reconciler,
+		revisions:  make(map[string]int64),
+		resources:  make(map[string]*spec.CustomResource),
+		deleted:    make(map[string]*spec.CustomResource),
+		failures:   make(map[string]int),
+		queued:     make(map[string]bool),
+		requeue:    make(chan string, 10),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	snapshots := make(chan map[string]*mvccpb.KeyValue, 10)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- s.watchRawPrefix(ctx, layout.CustomResourcePrefix(kind), func(m map[string]*mvccpb.KeyValue) {
+			select {
+			case snapshots <- m:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	for {
+		if len(c.queue) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-watchErr:
+				return err
+			case m := <-snapshots:
+				c.update(m)
+			case key := <-c.requeue:
+				c.enqueue(key)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watchErr:
+			return err
+		case m := <-snapshots:
+			c.update(m)
+		case key := <-c.requeue:
+			c.enqueue(key)
+		default:
+			c.reconcileNext(ctx)
+		}
+	}
+}
+
+// update enqueues the resources changed in the snapshot, and the ones
+// missing in the snapshot as deleted if the reconciler is a Deleter.
+func (c *crController) update(m map[string]*mvccpb.KeyValue) {
+	_, deleter := c.reconciler.(Deleter)
+	for key, resource := range c.resources {
+		if _, ok := m[key]; !ok {
+			delete(c.resources, key)
+			delete(c.revisions, key)
+			delete(c.failures, key)
+			if deleter {
+				c.deleted[key] = resource
+				c.enqueue(key)
+			}
+		}
+	}
+
+	for key, kv := range m {
+		if c.revisions[key] == kv.ModRevision {
+			continue
+		}
+
+		resource := &spec.CustomResource{}
+		if err := yaml.Unmarshal(kv.Value, resource); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+			c.service.recordEvent(c.kind, path.Base(key), EventTypeWarning,
+				EventReasonValidationFailed, err.Error())
+			continue
+		}
+
+		c.revisions[key] = kv.ModRevision
+		c.resources[key] = resource
+		// NOTE: The recreated resource is reconciled instead of deleted.
+		delete(c.deleted, key)
+		delete(c.failures, key)
+		c.enqueue(key)
+	}
+}
+
+func (c *crController) enqueue(key string) {
+	if c.queued[key] {
+		return
+	}
+	_, exists := c.resources[key]
+	_, deleted := c.deleted[key]
+	if !exists && !deleted {
+		return
+	}
+
+	c.queued[key] = true
+	c.queue = append(c.queue, key)
+}
+
+func (c *crController) reconcileNext(ctx context.Context) {
+	key := c.queue[0]
+	c.queue = c.queue[1:]
+	delete(c.queued, key)
+
+	resource, deleted := c.resources[key], false
+	if resource == nil {
+		resource, deleted = c.deleted[key], true
+	}
+	if resource == nil {
+		return
+	}
+
+	if wait := reconcileInterval - time.Since(c.last); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+	c.last = time.Now()
+
+	var err error
+	if deleted {
+		if deleter, ok := c.reconciler.(Deleter); ok {
+			err = deleter.Delete(resource)
+		}
+	} else {
+		err = c.reconciler.Reconcile(resource)
+	}
+	if err == nil {
+		delete(c.failures, key)
+		if deleted {
+			delete(c.deleted, key)
+		}
+		return
+	}
+
+	c.failures[key]++
+	delay := c.backoff(c.failures[key])
+	c.service.recordEvent(c.kind, resource.Name(), EventTypeWarning, EventReasonReconcileFailed, err.Error())
+	logger.Warnf("reconcile custom resource %s/%s failed (requeue after %v): %v",
+		c.kind, resource.Name(), delay, err)
+
+	time.AfterFunc(delay, func() {
+		select {
+		case c.requeue <- key:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (c *crController) backoff(failures int) time.Duration {
+	delay := reconcileBaseDelay
+	for i := 1; i < failures && delay < reconcileMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconcileMaxDelay {
+		delay = reconcileMaxDelay
+	}
+
+	return delay
+}
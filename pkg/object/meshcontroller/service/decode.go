@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// parallelDecodeThreshold is the min count of service specs to decode in parallel,
+// fewer specs are decoded serially as it's cheaper than spawning goroutines.
+var parallelDecodeThreshold = 64
+
+// decodeServiceSpecs decodes the service specs sorted by their keys,
+// the invalid ones are skipped.
+func decodeServiceSpecs(kvs map[string]*mvccpb.KeyValue) []*spec.Service {
+	values := sortedValues(kvs)
+
+	workers := runtime.GOMAXPROCS(0)
+	if len(values) < parallelDecodeThreshold || workers == 1 {
+		return decodeServiceSpecsSerial(values)
+	}
+
+	return decodeServiceSpecsParallel(values, workers)
+}
+
+func sortedValues(kvs map[string]*mvccpb.KeyValue) []*mvccpb.KeyValue {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]*mvccpb.KeyValue, len(keys))
+	for i, k := range keys {
+		values[i] = kvs[k]
+	}
+
+	return values
+}
+
+func decodeServiceSpec(kv *mvccpb.KeyValue) *spec.Service {
+	serviceSpec := &spec.Service{}
+	if err := spec.Decode(kv.Value, serviceSpec); err != nil {
+		logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kv, err)
+		return nil
+	}
+
+	return serviceSpec
+}
+
+func decodeServiceSpecsSerial(values []*mvccpb.KeyValue) []*spec.Service {
+	services := make([]*spec.Service, 0, len(values))
+	for _, v := range values {
+		if serviceSpec := decodeServiceSpec(v); serviceSpec != nil {
+			services = append(services, serviceSpec)
+		}
+	}
+
+	return services
+}
+
+// decodeServiceSpecsParallel splits the values into chunks decoded by the workers,
+// every worker writes its own part of the result, so the order is preserved.
+func decodeServiceSpecsParallel(values []*mvccpb.KeyValue, workers int) []*spec.Service {
+	decoded := make([]*spec.Service, len(values))
+	chunk := (len(values) + workers - 1) / workers
+
+	wg := &sync.WaitGroup{}
+	for start := 0; start < len(values); start += chunk {
+		end := start + chunk
+		if end > len(values) {
+			end = len(values)
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				decoded[i] = decodeServiceSpec(values[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	services := make([]*spec.Service, 0, len(decoded))
+	for _, serviceSpec := range decoded {
+		if serviceSpec != nil {
+			services = append(services, serviceSpec)
+		}
+	}
+
+	return services
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+const (
+	// DriftStatusMissing means the instance is UP in spec but never reports its status.
+	DriftStatusMissing = "StatusMissing"
+	// DriftHeartbeatStale means the instance is UP in spec but its heartbeat is stale.
+	DriftHeartbeatStale = "HeartbeatStale"
+	// DriftHeartbeatAlive means the instance is out of service in spec but still heartbeats.
+	DriftHeartbeatAlive = "HeartbeatAlive"
+	// DriftSpecMissing means the instance reports its status without a spec.
+	DriftSpecMissing = "SpecMissing"
+)
+
+// DriftReport is the report of an instance whose spec and status disagree.
+type DriftReport struct {
+	ServiceName string `yaml:"serviceName"`
+	InstanceID  string `yaml:"instanceID"`
+	// SpecStatus is the status declared in the instance spec,
+	// empty if the spec is missing.
+	SpecStatus        string `yaml:"specStatus"`
+	LastHeartbeatTime string `yaml:"lastHeartbeatTime"`
+	Reason            string `yaml:"reason"`
+	Message           string `yaml:"message"`
+}
+
+// InstanceDrift compares the instance specs of the service with their statuses,
+// and reports the instances disagreeing, sorted by instance ID.
+func (s *Service) InstanceDrift(serviceName string) []DriftReport {
+	specPrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	statusPrefix := layout.ServiceInstanceStatusPrefix(serviceName)
+
+	kvs, err := s.store.GetRawMulti(nil, []string{specPrefix, statusPrefix})
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	instances := map[string]*spec.ServiceInstanceSpec{}
+	statuses := map[string]*spec.ServiceInstanceStatus{}
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, specPrefix):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			instances[instance.InstanceID] = instance
+		case strings.HasPrefix(k, statusPrefix):
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			statuses[status.InstanceID] = status
+		}
+	}
+
+	now := time.Now()
+	timeout := s.heartbeatTimeout()
+	reports := []DriftReport{}
+	for id, instance := range instances {
+		report := DriftReport{
+			ServiceName: serviceName,
+			InstanceID:  id,
+			SpecStatus:  instance.Status,
+		}
+
+		status := statuses[id]
+		if status != nil {
+			report.LastHeartbeatTime = status.LastHeartbeatTime
+		}
+
+		switch {
+		case instance.Status == spec.ServiceStatusUp && status == nil:
+			report.Reason = DriftStatusMissing
+			report.Message = "instance is UP but has never reported its status"
+		case instance.Status == spec.ServiceStatusUp && !status.IsHealthy(now, timeout):
+			report.Reason = DriftHeartbeatStale
+			report.Message = fmt.Sprintf("instance is UP but its heartbeat is stale for %v",
+				status.StaleSince(now))
+		case instance.Status == spec.ServiceStatusOutOfService && status != nil && status.IsHealthy(now, timeout):
+			report.Reason = DriftHeartbeatAlive
+			report.Message = "instance is OUT_OF_SERVICE but still heartbeats"
+		default:
+			continue
+		}
+
+		reports = append(reports, report)
+	}
+
+	for id, status := range statuses {
+		if instances[id] != nil {
+			continue
+		}
+		reports = append(reports, DriftReport{
+			ServiceName:       serviceName,
+			InstanceID:        id,
+			LastHeartbeatTime: status.LastHeartbeatTime,
+			Reason:            DriftSpecMissing,
+			Message:           "instance reports its status without a spec",
+		})
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].InstanceID < reports[j].InstanceID
+	})
+
+	return reports
+}
+
+// PruneServiceInstanceSpecs deletes the instance specs of the service which registered
+// earlier than olderThan ago and have no recent status, along with their statuses, in
+// one transaction. The instances without valid registry time or in maintenance are kept.
+// It returns the count of pruned instances.
+func (s *Service) PruneServiceInstanceSpecs(serviceName string, olderThan time.Duration) (int, error) {
+	specPrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	statusPrefix := layout.ServiceInstanceStatusPrefix(serviceName)
+
+	kvs, err := s.store.GetRawMulti(nil, []string{specPrefix, statusPrefix})
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	timeout := s.heartbeatTimeout()
+	deletions := map[string]*string{}
+	pruned := []string{}
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, specPrefix) {
+			continue
+		}
+
+		instance := &spec.ServiceInstanceSpec{}
+		if err = spec.Decode(v.Value, instance); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+
+		if instance.InMaintenance(now) {
+			continue
+		}
+
+		registryTime, err := time.Parse(time.RFC3339, instance.RegistryTime)
+		if err != nil || now.Sub(registryTime) < olderThan {
+			continue
+		}
+
+		statusKey := layout.ServiceInstanceStatusKey(serviceName, instance.InstanceID)
+		if statusKV := kvs[statusKey]; statusKV != nil {
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(statusKey, statusKV.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", statusKV, err)
+			} else if status.IsHealthy(now, timeout) {
+				continue
+			}
+			deletions[statusKey] = nil
+		}
+
+		deletions[k] = nil
+		pruned = append(pruned, instance.InstanceID)
+	}
+
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	if err = s.store.PutAndDelete(deletions); err != nil {
+		return 0, err
+	}
+
+	for _, id := range pruned {
+		s.recordEvent(eventKindServiceInstance, serviceName+"/"+id, EventTypeNormal,
+			EventReasonDeleted, fmt.Sprintf("pruned stale registration %s", id))
+	}
+
+	return len(pruned), nil
+}
+
+// heartbeatTimeout returns the max tolerated gap of heartbeats,
+// which is the same as the one of the master.
+func (s *Service) heartbeatTimeout() time.Duration {
+	interval := s.spec.HeartbeatInterval
+	if interval == "" {
+		interval = spec.HeartbeatInterval
+	}
+
+	heartbeat, err := time.ParseDuration(interval)
+	if err != nil {
+		logger.Errorf("BUG: parse heartbeat interval %s to duration failed: %v", interval, err)
+		heartbeat, _ = time.ParseDuration(spec.HeartbeatInterval)
+	}
+
+	return heartbeat * 2
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// IsEgressAllowed returns whether the service from may call the service to by the
+// egress allowlist of from. A service without allowlist may call any service, while
+// an unknown service may call nothing.
+func (s *Service) IsEgressAllowed(from, to string) bool {
+	serviceSpec := s.GetServiceSpec(from)
+	if serviceSpec == nil {
+		return false
+	}
+	if len(serviceSpec.EgressAllowlist) == 0 {
+		return true
+	}
+
+	for _, allowed := range serviceSpec.EgressAllowlist {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateEgressAllowlist validates all services in the egress allowlist of the service exist.
+func (s *Service) ValidateEgressAllowlist(serviceSpec *spec.Service) error {
+	if len(serviceSpec.EgressAllowlist) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(serviceSpec.EgressAllowlist))
+	for _, name := range serviceSpec.EgressAllowlist {
+		keys = append(keys, layout.ServiceSpecKey(name))
+	}
+	kvs, err := s.store.GetRawMulti(keys, nil)
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	for _, name := range serviceSpec.EgressAllowlist {
+		if kvs[layout.ServiceSpecKey(name)] == nil {
+			return fmt.Errorf("service %s in egress allowlist of %s not found", name, serviceSpec.Name)
+		}
+	}
+	return nil
+}
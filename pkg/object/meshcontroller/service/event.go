@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+)
+
+const (
+	// EventTypeNormal is the type of events for normal operations.
+	EventTypeNormal = "Normal"
+	// EventTypeWarning is the type of events for failures.
+	EventTypeWarning = "Warning"
+
+	// EventReasonCreated is the reason of creating a resource.
+	EventReasonCreated = "Created"
+	// EventReasonUpdated is the reason of updating a resource.
+	EventReasonUpdated = "Updated"
+	// EventReasonDeleted is the reason of deleting a resource.
+	EventReasonDeleted = "Deleted"
+	// EventReasonValidationFailed is the reason of an invalid resource.
+	EventReasonValidationFailed = "ValidationFailed"
+	// EventReasonReconcileFailed is the reason of failing to reconcile a custom resource.
+	EventReasonReconcileFailed = "ReconcileFailed"
+
+	// Kinds of the built-in resources in events, kinds of custom resources are their own.
+	eventKindService            = "Service"
+	eventKindServiceInstance    = "ServiceInstance"
+	eventKindTenant             = "Tenant"
+	eventKindIngress            = "Ingress"
+	eventKindCustomResourceKind = "CustomResourceKind"
+	eventKindCanaryCohort       = "CanaryCohort"
+)
+
+// EventRecorder records events of resources in the Kubernetes style.
+type EventRecorder interface {
+	Event(kind, name, eventType, reason, message string)
+}
+
+// SetEventRecorder sets the recorder of events, nil disables recording, which is the default.
+func (s *Service) SetEventRecorder(recorder EventRecorder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recorder = recorder
+}
+
+func (s *Service) eventRecorder() EventRecorder {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.recorder
+}
+
+func (s *Service) recordEvent(kind, name, eventType, reason, message string) {
+	if recorder := s.eventRecorder(); recorder != nil {
+		recorder.Event(kind, name, eventType, reason, message)
+	}
+}
+
+// putAndRecord puts the value of the resource and records the event of creating or updating it.
+func (s *Service) putAndRecord(kind, name, key, value string) error {
+	reason := EventReasonUpdated
+	// NOTE: Only check the existence when recording, to save a round trip.
+	if s.eventRecorder() != nil {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			reason = EventReasonCreated
+		}
+	}
+
+	if err := s.store.Put(key, value); err != nil {
+		return err
+	}
+
+	s.recordEvent(kind, name, EventTypeNormal, reason, fmt.Sprintf("%s %s", reason, name))
+	return nil
+}
+
+// deleteAndRecord deletes the resource and records the event of deleting it.
+func (s *Service) deleteAndRecord(kind, name, key string) error {
+	if err := s.store.Delete(key); err != nil {
+		return err
+	}
+
+	s.recordEvent(kind, name, EventTypeNormal, EventReasonDeleted, fmt.Sprintf("%s %s", EventReasonDeleted, name))
+	return nil
+}
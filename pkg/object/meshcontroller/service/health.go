@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// HealthVerdict is the health verdict of a service.
+type HealthVerdict string
+
+const (
+	// HealthHealthy means all UP instances of the service and its dependencies are healthy.
+	HealthHealthy HealthVerdict = "Healthy"
+	// HealthDegraded means some UP instances of the service are unhealthy,
+	// or any dependency is not healthy.
+	HealthDegraded HealthVerdict = "Degraded"
+	// HealthUnhealthy means the service has no healthy UP instance.
+	HealthUnhealthy HealthVerdict = "Unhealthy"
+	// HealthUnknown means the service is not found.
+	HealthUnknown HealthVerdict = "Unknown"
+)
+
+// healthRollup computes health verdicts from a snapshot of services,
+// instance specs and statuses.
+type healthRollup struct {
+	now     time.Time
+	timeout time.Duration
+
+	services  map[string]*spec.Service
+	instances map[string][]*spec.ServiceInstanceSpec
+	statuses  map[string]map[string]*spec.ServiceInstanceStatus
+
+	// own is the verdict of services without their dependencies.
+	own map[string]HealthVerdict
+}
+
+// ServiceHealthRollup returns the health verdict of the service combining its own
+// instance health with the health of its dependencies, transitively. The service is
+// degraded if any dependency is not healthy, missing dependencies are not healthy.
+// Dependency cycles are broken by skipping the services already being visited.
+func (s *Service) ServiceHealthRollup(serviceName string) HealthVerdict {
+	kvs, err := s.store.GetRawMulti(nil, []string{
+		layout.ServiceSpecPrefix(),
+		layout.AllServiceInstanceSpecPrefix(),
+		layout.AllServiceInstanceStatusPrefix(),
+	})
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	h := &healthRollup{
+		now:       time.Now(),
+		timeout:   s.heartbeatTimeout(),
+		services:  map[string]*spec.Service{},
+		instances: map[string][]*spec.ServiceInstanceSpec{},
+		statuses:  map[string]map[string]*spec.ServiceInstanceStatus{},
+		own:       map[string]HealthVerdict{},
+	}
+
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, layout.ServiceSpecPrefix()):
+			service := &spec.Service{}
+			if err = spec.Decode(v.Value, service); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			h.services[service.Name] = service
+		case strings.HasPrefix(k, layout.AllServiceInstanceSpecPrefix()):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			h.instances[instance.ServiceName] = append(h.instances[instance.ServiceName], instance)
+		case strings.HasPrefix(k, layout.AllServiceInstanceStatusPrefix()):
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			if h.statuses[status.ServiceName] == nil {
+				h.statuses[status.ServiceName] = map[string]*spec.ServiceInstanceStatus{}
+			}
+			h.statuses[status.ServiceName][status.InstanceID] = status
+		}
+	}
+
+	return h.rollup(serviceName, map[string]bool{})
+}
+
+// rollup returns the verdict of the service with its dependencies,
+// visiting holds the services on the current dependency path.
+func (h *healthRollup) rollup(serviceName string, visiting map[string]bool) HealthVerdict {
+	service := h.services[serviceName]
+	if service == nil {
+		return HealthUnknown
+	}
+
+	verdict := h.ownVerdict(serviceName)
+	if verdict == HealthUnhealthy {
+		return verdict
+	}
+
+	visiting[serviceName] = true
+	defer delete(visiting, serviceName)
+
+	for _, dependency := range service.Dependencies {
+		if visiting[dependency] {
+			continue
+		}
+		if h.rollup(dependency, visiting) != HealthHealthy {
+			verdict = HealthDegraded
+		}
+	}
+
+	return verdict
+}
+
+// ownVerdict returns the verdict of the service by its UP instances only.
+func (h *healthRollup) ownVerdict(serviceName string) HealthVerdict {
+	if verdict, ok := h.own[serviceName]; ok {
+		return verdict
+	}
+
+	up, healthy := 0, 0
+	for _, instance := range h.instances[serviceName] {
+		if instance.Status != spec.ServiceStatusUp {
+			continue
+		}
+		up++
+		status := h.statuses[serviceName][instance.InstanceID]
+		if status != nil && status.IsHealthy(h.now, h.timeout) {
+			healthy++
+		}
+	}
+
+	verdict := HealthDegraded
+	switch {
+	case healthy == 0:
+		verdict = HealthUnhealthy
+	case healthy == up:
+		verdict = HealthHealthy
+	}
+
+	h.own[serviceName] = verdict
+	return verdict
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// ServiceSpecVersion is a prior version of the service spec.
+type ServiceSpecVersion struct {
+	// Revision is the mod revision of the version in store.
+	Revision int64 `yaml:"revision"`
+	// ReplacedAt is the time the version was replaced in RFC3339.
+	ReplacedAt string        `yaml:"replacedAt"`
+	Spec       *spec.Service `yaml:"spec"`
+}
+
+// GetServiceSpecHistory returns the prior versions of the service spec, from the newest to
+// the oldest. Zero limit means all the versions kept, which are bounded by the history depth.
+func (s *Service) GetServiceSpecHistory(serviceName string, limit int) ([]*ServiceSpecVersion, error) {
+	kvs, err := s.store.GetRawPrefix(layout.ServiceSpecHistoryPrefix(serviceName))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	versions := []*ServiceSpecVersion{}
+	for _, k := range keys {
+		if limit > 0 && len(versions) >= limit {
+			break
+		}
+
+		version := &ServiceSpecVersion{}
+		if err = spec.Decode(kvs[k].Value, version); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kvs[k], err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// GetServiceSpecAtRevision gets the service spec at the revision of the store, which is
+// kept by the store itself until compaction, unlike the bounded history. It returns nil if
+// the service doesn't exist at the revision, and an error wrapping storage.ErrCompacted if
+// the revision has been compacted.
+func (s *Service) GetServiceSpecAtRevision(serviceName string, revision int64) (*spec.Service, error) {
+	kv, err := s.store.GetRawAtRevision(layout.ServiceSpecKey(serviceName), revision)
+	if errors.Is(err, storage.ErrCompacted) {
+		return nil, fmt.Errorf("get service %s at revision %d: %w", serviceName, revision, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, nil
+	}
+
+	serviceSpec := &spec.Service{}
+	if err = spec.Decode(kv.Value, serviceSpec); err != nil {
+		return nil, fmt.Errorf("decode service %s at revision %d failed: %v", serviceName, revision, err)
+	}
+
+	return serviceSpec, nil
+}
+
+// putServiceSpecWithHistory writes the service spec, along with its prior version into the
+// history, and trims the history to its depth, in one transaction.
+func (s *Service) putServiceSpecWithHistory(serviceName, value string) error {
+	key := layout.ServiceSpecKey(serviceName)
+	historyPrefix := layout.ServiceSpecHistoryPrefix(serviceName)
+
+	kvs, err := s.store.GetRawMulti([]string{key}, []string{historyPrefix})
+	if err != nil {
+		return err
+	}
+
+	prior := kvs[key]
+	delete(kvs, key)
+
+	updates := map[string]*string{key: &value}
+	if prior != nil && string(prior.Value) != value {
+		priorSpec := &spec.Service{}
+		if err = spec.Decode(prior.Value, priorSpec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", prior, err)
+		} else {
+			version := &ServiceSpecVersion{
+				Revision:   prior.ModRevision,
+				ReplacedAt: time.Now().Format(time.RFC3339),
+				Spec:       priorSpec,
+			}
+			historyKey := layout.ServiceSpecHistoryKey(serviceName, prior.ModRevision)
+			updates[historyKey] = marshalToString(version)
+			kvs[historyKey] = nil
+		}
+	}
+
+	depth := s.spec.ServiceSpecHistoryDepth
+	if depth <= 0 {
+		depth = spec.DefaultServiceSpecHistoryDepth
+	}
+	if len(kvs) > depth {
+		keys := make([]string, 0, len(kvs))
+		for k := range kvs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys[:len(keys)-depth] {
+			updates[k] = nil
+		}
+	}
+
+	if err = s.store.PutAndDelete(updates); err != nil {
+		return err
+	}
+
+	reason := EventReasonUpdated
+	if prior == nil {
+		reason = EventReasonCreated
+	}
+	s.recordEvent(eventKindService, serviceName, EventTypeNormal, reason, fmt.Sprintf("%s %s", reason, serviceName))
+
+	return nil
+}
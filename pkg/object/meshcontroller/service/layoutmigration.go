@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// layoutMigrationBatchSize is the max count of keys rewritten in one transaction.
+const layoutMigrationBatchSize = 64
+
+// layoutMigration migrates the keys from a layout version to the next one.
+type layoutMigration struct {
+	// prefixes are the prefixes of the keys to migrate in the old layout.
+	prefixes []string
+	// rename returns the key in the new layout, or the same key to keep it.
+	rename func(key string) string
+}
+
+// layoutMigrations are the migrations keyed by the versions they migrate from.
+var layoutMigrations = map[int]*layoutMigration{}
+
+// GetLayoutVersion returns the version of the key layout of the store,
+// the store without version is in the layout.BaselineVersion.
+func (s *Service) GetLayoutVersion() (int, error) {
+	value, err := s.store.Get(layout.VersionKey())
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return layout.BaselineVersion, nil
+	}
+
+	version, err := strconv.Atoi(*value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid layout version %s: %v", *value, err)
+	}
+	return version, nil
+}
+
+// InitLayoutVersion writes the current layout version into a fresh store which has
+// no mesh resources yet. The store with resources but without the version is left
+// in the baseline version, which must be migrated by MigrateLayout.
+func (s *Service) InitLayoutVersion() error {
+	kvs, err := s.store.GetRawMulti([]string{layout.VersionKey()}, []string{
+		layout.ServiceSpecPrefix(),
+		layout.AllServiceInstanceSpecPrefix(),
+		layout.TenantPrefix(),
+		layout.IngressPrefix(),
+		layout.CustomResourceKindPrefix(),
+		layout.AllCustomResourcePrefix(),
+	})
+	if err != nil {
+		return err
+	}
+	if len(kvs) != 0 {
+		return nil
+	}
+
+	_, err = s.store.CompareAndPut(layout.VersionKey(), strconv.Itoa(layout.Version), 0)
+	return err
+}
+
+// MigrateLayout rewrites the keys of the store from the layout version from to the
+// version to, one version after another. The keys of each version are rewritten in
+// batches, and the layout version of the store is updated after every version, so
+// an interrupted migration could be resumed from the stored version.
+func (s *Service) MigrateLayout(from, to int) error {
+	if from > to {
+		return fmt.Errorf("can't migrate layout backward from version %d to %d", from, to)
+	}
+
+	current, err := s.GetLayoutVersion()
+	if err != nil {
+		return err
+	}
+	if current != from {
+		return fmt.Errorf("layout version of the store is %d, not %d", current, from)
+	}
+
+	for version := from; version < to; version++ {
+		migration := layoutMigrations[version]
+		if migration == nil {
+			return fmt.Errorf("no layout migration from version %d", version)
+		}
+		if err = s.migrateLayoutVersion(version, migration); err != nil {
+			return fmt.Errorf("migrate layout from version %d failed: %v", version, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLayoutVersion applies the migration of the version, the version key is updated
+// in the last batch.
+func (s *Service) migrateLayoutVersion(version int, migration *layoutMigration) error {
+	kvs, err := s.store.GetRawMulti(nil, migration.prefixes)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		if migration.rename(k) != k {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for start := 0; ; start += layoutMigrationBatchSize {
+		end := start + layoutMigrationBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make(map[string]*string, 2*(end-start)+1)
+		for _, k := range keys[start:end] {
+			value := string(kvs[k].Value)
+			batch[k] = nil
+			batch[migration.rename(k)] = &value
+		}
+		if end == len(keys) {
+			next := strconv.Itoa(version + 1)
+			batch[layout.VersionKey()] = &next
+		}
+
+		if err = s.store.PutAndDelete(batch); err != nil {
+			return err
+		}
+		if end == len(keys) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// ErrNotLeader is the error when renewing the leadership of a task not led by the service.
+var ErrNotLeader = fmt.Errorf("not leader")
+
+// TryBecomeLeader claims the leadership of the singleton controller task by creating
+// its leader key under a new lease with the ttl, so only one claimer wins. The caller
+// must renew the leadership by RenewLeadership within the ttl, otherwise it expires
+// and others could claim it. It reports true if the service is the leader now.
+// The leadership already held is kept alive once, and claimed again if it has expired.
+func (s *Service) TryBecomeLeader(task string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	leaseID, led := s.leaderLeases[task]
+	s.mutex.Unlock()
+	if led {
+		if err := s.store.KeepAliveLeaseOnce(leaseID); err == nil {
+			return true, nil
+		}
+		s.dropLeadership(task, leaseID)
+	}
+
+	leaseID, err := s.store.PutIfAbsentUnderNewLease(layout.LeaderKey(task), s.memberName(), ttl)
+	if err != nil {
+		return false, err
+	}
+	if leaseID == 0 {
+		return false, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.leaderLeases == nil {
+		s.leaderLeases = make(map[string]int64)
+	}
+	s.leaderLeases[task] = leaseID
+
+	return true, nil
+}
+
+// RenewLeadership keeps the leadership of the task alive for another ttl. It returns
+// ErrNotLeader if the service doesn't lead the task or the leadership has expired.
+func (s *Service) RenewLeadership(task string) error {
+	s.mutex.Lock()
+	leaseID, led := s.leaderLeases[task]
+	s.mutex.Unlock()
+	if !led {
+		return ErrNotLeader
+	}
+
+	if err := s.store.KeepAliveLeaseOnce(leaseID); err != nil {
+		s.dropLeadership(task, leaseID)
+		return fmt.Errorf("%w: renew leadership of %s failed: %v", ErrNotLeader, task, err)
+	}
+
+	return nil
+}
+
+// ResignLeadership gives up the leadership of the task, so others could claim it
+// immediately. It is a no-op if the service doesn't lead the task.
+func (s *Service) ResignLeadership(task string) error {
+	s.mutex.Lock()
+	leaseID, led := s.leaderLeases[task]
+	s.mutex.Unlock()
+	if !led {
+		return nil
+	}
+
+	if err := s.store.RevokeLease(leaseID); err != nil {
+		return err
+	}
+	s.dropLeadership(task, leaseID)
+
+	return nil
+}
+
+// dropLeadership forgets the leadership of the task if it's still the lease.
+func (s *Service) dropLeadership(task string, leaseID int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.leaderLeases[task] == leaseID {
+		delete(s.leaderLeases, task)
+	}
+}
+
+// memberName returns the name of the cluster member running the service.
+func (s *Service) memberName() string {
+	if s.superSpec == nil || s.superSpec.Super() == nil {
+		return ""
+	}
+	return s.superSpec.Super().Options().Name
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// SetInstanceMaintenance puts the service instance in maintenance until the given time,
+// so the automated eviction and draining leave it alone. Zero time ends the maintenance.
+func (s *Service) SetInstanceMaintenance(serviceName, instanceID string, until time.Time) error {
+	key := layout.ServiceInstanceSpecKey(serviceName, instanceID)
+
+	maintenanceUntil := ""
+	if !until.IsZero() {
+		maintenanceUntil = until.Format(time.RFC3339)
+	}
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return fmt.Errorf("service instance %s/%s not found", serviceName, instanceID)
+		}
+
+		instance := &spec.ServiceInstanceSpec{}
+		if err = spec.Decode(kv.Value, instance); err != nil {
+			return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+		}
+		if instance.MaintenanceUntil == maintenanceUntil {
+			return nil
+		}
+		instance.MaintenanceUntil = maintenanceUntil
+
+		put, err := s.store.CompareAndPut(key, *marshalToString(instance), kv.ModRevision)
+		if err != nil {
+			return err
+		}
+		if put {
+			message := fmt.Sprintf("maintenance of %s ended", instanceID)
+			if maintenanceUntil != "" {
+				message = fmt.Sprintf("maintenance of %s until %s", instanceID, maintenanceUntil)
+			}
+			s.recordEvent(eventKindServiceInstance, serviceName+"/"+instanceID,
+				EventTypeNormal, EventReasonUpdated, message)
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
+// IsInstanceInMaintenance returns whether the service instance is in maintenance now,
+// a missing instance is not in maintenance.
+func (s *Service) IsInstanceInMaintenance(serviceName, instanceID string) bool {
+	instance := s.GetServiceInstanceSpec(serviceName, instanceID)
+	return instance != nil && instance.InMaintenance(time.Now())
+}
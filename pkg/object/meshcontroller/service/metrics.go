@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+const (
+	metricServices          = "easegress_mesh_services"
+	metricServiceInstances  = "easegress_mesh_service_instances"
+	metricInstancesByStatus = "easegress_mesh_instances_by_status"
+	metricTenants           = "easegress_mesh_tenants"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the gauges of the mesh topology in Prometheus text format, which
+// are the count of services, instances per service, instances per status and tenants.
+// All of them are computed from one read of the store.
+func (s *Service) WriteMetrics(w io.Writer) error {
+	servicePrefix := layout.ServiceSpecPrefix()
+	instancePrefix := layout.AllServiceInstanceSpecPrefix()
+	tenantPrefix := layout.TenantPrefix()
+
+	kvs, err := s.store.GetRawMulti(nil, []string{servicePrefix, instancePrefix, tenantPrefix})
+	if err != nil {
+		return err
+	}
+
+	services, tenants := 0, 0
+	serviceInstances := map[string]int{}
+	statusInstances := map[string]int{}
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, servicePrefix):
+			services++
+		case strings.HasPrefix(k, tenantPrefix):
+			tenants++
+		case strings.HasPrefix(k, instancePrefix):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			serviceInstances[instance.ServiceName]++
+			statusInstances[instance.Status]++
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	writeGauge(bw, metricServices, "The count of services.", "", map[string]int{"": services})
+	writeGauge(bw, metricServiceInstances, "The count of instances per service.", "service", serviceInstances)
+	writeGauge(bw, metricInstancesByStatus, "The count of instances per status.", "status", statusInstances)
+	writeGauge(bw, metricTenants, "The count of tenants.", "", map[string]int{"": tenants})
+
+	return bw.Flush()
+}
+
+// writeGauge writes the gauge with its samples sorted by the label values,
+// the sample of empty label name is written without labels.
+func writeGauge(w *bufio.Writer, name, help, label string, samples map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+	values := make([]string, 0, len(samples))
+	for value := range samples {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		if label == "" {
+			fmt.Fprintf(w, "%s %d\n", name, samples[value])
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, metricLabelEscaper.Replace(value), samples[value])
+	}
+}
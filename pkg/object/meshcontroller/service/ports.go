@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+const (
+	// PortTypeIngress is the type of sidecar ingress port.
+	PortTypeIngress = "ingress"
+	// PortTypeEgress is the type of sidecar egress port.
+	PortTypeEgress = "egress"
+)
+
+type (
+	// PortConflict is a sidecar port used more than once on one host.
+	PortConflict struct {
+		Host  string     `yaml:"host"`
+		Port  int        `yaml:"port"`
+		Users []PortUser `yaml:"users"`
+	}
+
+	// PortUser is an instance whose sidecar uses the port.
+	PortUser struct {
+		ServiceName string `yaml:"serviceName"`
+		InstanceID  string `yaml:"instanceID"`
+		PortType    string `yaml:"portType"`
+	}
+)
+
+// DetectPortConflicts scans all instance specs, and reports the sidecar ingress and
+// egress ports used more than once on the same host, sorted by host and port.
+// The sidecar ports of an instance are the ones of its service spec, the instances
+// whose service specs are missing are skipped.
+func (s *Service) DetectPortConflicts() []PortConflict {
+	servicePrefix := layout.ServiceSpecPrefix()
+	instancePrefix := layout.AllServiceInstanceSpecPrefix()
+
+	kvs, err := s.store.GetRawMulti(nil, []string{servicePrefix, instancePrefix})
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	sidecars := map[string]*spec.Sidecar{}
+	instances := []*spec.ServiceInstanceSpec{}
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, servicePrefix):
+			serviceSpec := &spec.Service{}
+			if err = spec.Decode(v.Value, serviceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			sidecars[serviceSpec.Name] = serviceSpec.Sidecar
+		case strings.HasPrefix(k, instancePrefix):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			instances = append(instances, instance)
+		}
+	}
+
+	type hostPort struct {
+		host string
+		port int
+	}
+	users := map[hostPort][]PortUser{}
+	for _, instance := range instances {
+		sidecar := sidecars[instance.ServiceName]
+		if sidecar == nil || instance.IP == "" {
+			continue
+		}
+
+		for portType, port := range map[string]int{
+			PortTypeIngress: sidecar.IngressPort,
+			PortTypeEgress:  sidecar.EgressPort,
+		} {
+			if port == 0 {
+				continue
+			}
+			hp := hostPort{host: instance.IP, port: port}
+			users[hp] = append(users[hp], PortUser{
+				ServiceName: instance.ServiceName,
+				InstanceID:  instance.InstanceID,
+				PortType:    portType,
+			})
+		}
+	}
+
+	conflicts := []PortConflict{}
+	for hp, u := range users {
+		if len(u) < 2 {
+			continue
+		}
+		sort.Slice(u, func(i, j int) bool {
+			if u[i].ServiceName != u[j].ServiceName {
+				return u[i].ServiceName < u[j].ServiceName
+			}
+			if u[i].InstanceID != u[j].InstanceID {
+				return u[i].InstanceID < u[j].InstanceID
+			}
+			return u[i].PortType < u[j].PortType
+		})
+		conflicts = append(conflicts, PortConflict{Host: hp.host, Port: hp.port, Users: u})
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Host != conflicts[j].Host {
+			return conflicts[i].Host < conflicts[j].Host
+		}
+		return conflicts[i].Port < conflicts[j].Port
+	})
+
+	return conflicts
+}
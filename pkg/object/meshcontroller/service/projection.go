@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"github.com/tidwall/gjson"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// GetServiceSpecProjection gets only the parts of the service spec in the paths, without
+// decoding the whole spec. The result is keyed by the paths, and the parts not existing
+// in the spec are kept with false Exists(), the empty path gets the whole spec. The spec
+// is migrated to the current schema first. It returns nil if the service is not found.
+func (s *Service) GetServiceSpecProjection(serviceName string, paths []spec.GJSONPath) (map[string]gjson.Result, error) {
+	for _, path := range paths {
+		if err := spec.ValidateGJSONPath(path); err != nil {
+			return nil, err
+		}
+	}
+
+	kv, err := s.store.GetRaw(layout.ServiceSpecKey(serviceName))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, nil
+	}
+
+	value, err := spec.Migrate(kv.Value)
+	if err != nil {
+		return nil, fmt.Errorf("migrate service spec %s failed: %v", serviceName, err)
+	}
+
+	jsonBytes, err := yamljsontool.YAMLToJSON(value)
+	if err != nil {
+		return nil, fmt.Errorf("BUG: transform yaml %s to json failed: %v", value, err)
+	}
+
+	result := make(map[string]gjson.Result, len(paths))
+	for _, path := range paths {
+		if path == "" {
+			result[string(path)] = gjson.ParseBytes(jsonBytes)
+			continue
+		}
+		result[string(path)] = gjson.GetBytes(jsonBytes, string(path))
+	}
+
+	return result, nil
+}
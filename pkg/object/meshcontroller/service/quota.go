@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// CheckTenantQuota reports whether the tenant can take the requested usage on top of
+// its current usage within its quota. The usage of the tenant is weighted by instances,
+// that is the count of instances of its current services. A tenant without quota
+// always passes.
+func (s *Service) CheckTenantQuota(tenantName string, requested int) (bool, error) {
+	if requested < 0 {
+		return false, fmt.Errorf("requested usage %d is negative", requested)
+	}
+
+	tenantKey := layout.TenantSpecKey(tenantName)
+	instancePrefix := layout.AllServiceInstanceSpecPrefix()
+	kvs, err := s.store.GetRawMulti([]string{tenantKey}, []string{instancePrefix})
+	if err != nil {
+		return false, err
+	}
+
+	kv := kvs[tenantKey]
+	if kv == nil {
+		return false, fmt.Errorf("tenant %s not found", tenantName)
+	}
+	tenant := &spec.Tenant{}
+	if err = spec.Decode(kv.Value, tenant); err != nil {
+		return false, fmt.Errorf("unmarshal tenant %s failed: %v", tenantName, err)
+	}
+	if tenant.Quota == 0 {
+		return true, nil
+	}
+
+	services := make(map[string]bool, len(tenant.Services))
+	for _, service := range tenant.Services {
+		services[service] = true
+	}
+
+	usage := 0
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, instancePrefix) {
+			continue
+		}
+		instance := &spec.ServiceInstanceSpec{}
+		if err = spec.Decode(v.Value, instance); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		if services[instance.ServiceName] {
+			usage++
+		}
+	}
+
+	return usage+requested <= tenant.Quota, nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/filter/ratelimiter"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// GetServiceRateLimit gets the rate limiter of the service resilience,
+// it returns nil if the service or its rate limiter is not found.
+func (s *Service) GetServiceRateLimit(serviceName string) *ratelimiter.Spec {
+	serviceSpec := s.GetServiceSpec(serviceName)
+	if serviceSpec == nil || serviceSpec.Resilience == nil {
+		return nil
+	}
+
+	return serviceSpec.Resilience.RateLimiter
+}
+
+// PutServiceRateLimit sets the rate limiter of the service resilience atomically,
+// nil rate limiter removes it. The other parts of the service spec are kept.
+func (s *Service) PutServiceRateLimit(serviceName string, rl *ratelimiter.Spec) error {
+	if rl != nil {
+		if err := spec.ValidateRateLimiter(rl); err != nil {
+			return fmt.Errorf("invalid rate limiter of service %s: %v", serviceName, err)
+		}
+	}
+
+	key := layout.ServiceSpecKey(serviceName)
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return fmt.Errorf("service %s not found", serviceName)
+		}
+
+		serviceSpec := &spec.Service{}
+		if err = spec.Decode(kv.Value, serviceSpec); err != nil {
+			return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+		}
+
+		if serviceSpec.Resilience == nil {
+			if rl == nil {
+				return nil
+			}
+			serviceSpec.Resilience = &spec.Resilience{}
+		}
+		serviceSpec.Resilience.RateLimiter = rl
+
+		put, err := s.store.CompareAndPut(key, *marshalToString(serviceSpec), kv.ModRevision)
+		if err != nil {
+			return err
+		}
+		if put {
+			s.recordEvent(eventKindService, serviceName, EventTypeNormal, EventReasonUpdated,
+				fmt.Sprintf("%s rate limiter of %s", EventReasonUpdated, serviceName))
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// GetServiceSpecRaw gets the verbatim stored value of the service spec,
+// it returns empty string and nil if the service is not found.
+func (s *Service) GetServiceSpecRaw(serviceName string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.ServiceSpecKey(serviceName))
+}
+
+// GetServiceInstanceSpecRaw gets the verbatim stored value of the service instance spec.
+func (s *Service) GetServiceInstanceSpecRaw(serviceName, instanceID string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+}
+
+// GetTenantSpecRaw gets the verbatim stored value of the tenant spec.
+func (s *Service) GetTenantSpecRaw(tenantName string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.TenantSpecKey(tenantName))
+}
+
+// GetIngressSpecRaw gets the verbatim stored value of the ingress spec.
+func (s *Service) GetIngressSpecRaw(ingressName string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.IngressSpecKey(ingressName))
+}
+
+// GetGlobalCanaryHeadersRaw gets the verbatim stored value of the global canary headers.
+func (s *Service) GetGlobalCanaryHeadersRaw() (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.GlobalCanaryHeaders())
+}
+
+// GetCustomResourceKindRaw gets the verbatim stored value of the custom resource kind.
+func (s *Service) GetCustomResourceKindRaw(name string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.CustomResourceKindKey(name))
+}
+
+// GetCustomResourceRaw gets the verbatim stored value of the custom resource.
+func (s *Service) GetCustomResourceRaw(kind, name string) (string, *mvccpb.KeyValue) {
+	return s.getRaw(layout.CustomResourceKey(kind, name))
+}
+
+func (s *Service) getRaw(key string) (string, *mvccpb.KeyValue) {
+	kv, err := s.store.GetRaw(key)
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	if kv == nil {
+		return "", nil
+	}
+
+	return string(kv.Value), kv
+}
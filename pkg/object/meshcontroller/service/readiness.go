@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// SetInstanceReady sets the readiness gate of the instance status, other fields
+// of the status are kept.
+func (s *Service) SetInstanceReady(serviceName, instanceID string, ready bool) error {
+	key := layout.ServiceInstanceStatusKey(serviceName, instanceID)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+
+		status := &spec.ServiceInstanceStatus{
+			ServiceName: serviceName,
+			InstanceID:  instanceID,
+		}
+		var revision int64
+		if kv != nil {
+			if err = storage.Decode(key, kv.Value, status); err != nil {
+				return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+			}
+			revision = kv.ModRevision
+		}
+		status.Ready = ready
+
+		buff, err := storage.Encode(key, status)
+		if err != nil {
+			return fmt.Errorf("BUG: marshal %#v failed: %v", status, err)
+		}
+
+		put, err := s.store.CompareAndPut(key, string(buff), revision)
+		if err != nil {
+			return err
+		}
+		if put {
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
+// ListReadyInstances lists the instance specs of the service which are UP, healthy and
+// ready, sorted by instance IDs. The servers of the egress and ingress pipelines are
+// built from it, so the instances not ready to serve yet get no traffic. The instances
+// of external registries have no heartbeats, so they are ready as long as they are UP.
+func (s *Service) ListReadyInstances(serviceName string) []*spec.ServiceInstanceSpec {
+	specPrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	statusPrefix := layout.ServiceInstanceStatusPrefix(serviceName)
+
+	kvs, err := s.store.GetRawMulti(nil, []string{specPrefix, statusPrefix})
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	instances := []*spec.ServiceInstanceSpec{}
+	statuses := map[string]*spec.ServiceInstanceStatus{}
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, specPrefix):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			instances = append(instances, instance)
+		case strings.HasPrefix(k, statusPrefix):
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			statuses[status.InstanceID] = status
+		}
+	}
+
+	now, timeout := time.Now(), s.heartbeatTimeout()
+	ready := []*spec.ServiceInstanceSpec{}
+	for _, instance := range instances {
+		if instance.Status != spec.ServiceStatusUp {
+			continue
+		}
+		if !s.isMeshRegistryName(instance.RegistryName) {
+			ready = append(ready, instance)
+			continue
+		}
+		status := statuses[instance.InstanceID]
+		if status == nil || !status.Ready || !status.IsHealthy(now, timeout) {
+			continue
+		}
+		ready = append(ready, instance)
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].InstanceID < ready[j].InstanceID
+	})
+
+	return ready
+}
+
+// isMeshRegistryName reports whether the instances of the registry are registered
+// by the mesh workers, empty registry name means the mesh by default.
+func (s *Service) isMeshRegistryName(registryName string) bool {
+	return registryName == "" || (s.superSpec != nil && registryName == s.superSpec.Name())
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// ErrReadOnly is the error when writing to the store in read-only mode.
+var ErrReadOnly = fmt.Errorf("service is in read-only mode")
+
+// readOnlyGuard rejects all writes to the store with ErrReadOnly when
+// the service is in read-only mode, reads are passed through.
+// It implements every method explicitly, so a new write method of the
+// storage can't slip through unguarded.
+type readOnlyGuard struct {
+	store storage.Storage
+	s     *Service
+}
+
+var _ storage.Storage = (*readOnlyGuard)(nil)
+
+func newReadOnlyGuard(s *Service, store storage.Storage) storage.Storage {
+	return &readOnlyGuard{store: store, s: s}
+}
+
+// SetReadOnly turns the read-only mode on or off. In read-only mode, all writes
+// are rejected with ErrReadOnly without touching the store. Reads work normally.
+func (s *Service) SetReadOnly(readOnly bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readOnly = readOnly
+}
+
+// ReadOnly returns if the service is in read-only mode.
+func (s *Service) ReadOnly() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.readOnly
+}
+
+func (g *readOnlyGuard) check() error {
+	if g.s.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (g *readOnlyGuard) Put(key, value string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.Put(key, value)
+}
+
+func (g *readOnlyGuard) CompareAndPut(key, value string, modRevision int64) (bool, error) {
+	if err := g.check(); err != nil {
+		return false, err
+	}
+	return g.store.CompareAndPut(key, value, modRevision)
+}
+
+func (g *readOnlyGuard) PutUnderLease(key, value string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.PutUnderLease(key, value)
+}
+
+func (g *readOnlyGuard) PutAndDelete(kvs map[string]*string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.PutAndDelete(kvs)
+}
+
+func (g *readOnlyGuard) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.PutAndDeleteUnderLease(kvs)
+}
+
+func (g *readOnlyGuard) CompareAndPutAndDelete(revisions map[string]int64, kvs map[string]*string) (bool, error) {
+	if err := g.check(); err != nil {
+		return false, err
+	}
+	return g.store.CompareAndPutAndDelete(revisions, kvs)
+}
+
+func (g *readOnlyGuard) PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error) {
+	if err := g.check(); err != nil {
+		return 0, err
+	}
+	return g.store.PutIfAbsentUnderNewLease(key, value, ttl)
+}
+
+func (g *readOnlyGuard) Delete(key string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.Delete(key)
+}
+
+func (g *readOnlyGuard) GetAndDelete(key string) (*string, error) {
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	return g.store.GetAndDelete(key)
+}
+
+func (g *readOnlyGuard) DeletePrefix(prefix string) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.DeletePrefix(prefix)
+}
+
+func (g *readOnlyGuard) KeepAliveLeaseOnce(leaseID int64) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.KeepAliveLeaseOnce(leaseID)
+}
+
+func (g *readOnlyGuard) RevokeLease(leaseID int64) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.store.RevokeLease(leaseID)
+}
+
+func (g *readOnlyGuard) Lock() error {
+	return g.store.Lock()
+}
+
+func (g *readOnlyGuard) Unlock() error {
+	return g.store.Unlock()
+}
+
+func (g *readOnlyGuard) Get(key string) (*string, error) {
+	return g.store.Get(key)
+}
+
+func (g *readOnlyGuard) GetPrefix(prefix string) (map[string]string, error) {
+	return g.store.GetPrefix(prefix)
+}
+
+func (g *readOnlyGuard) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	return g.store.GetRaw(key)
+}
+
+func (g *readOnlyGuard) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	return g.store.GetRawPrefix(prefix)
+}
+
+func (g *readOnlyGuard) GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error) {
+	return g.store.GetRawMulti(keys, prefixes)
+}
+
+func (g *readOnlyGuard) GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error) {
+	return g.store.GetRawMultiWithRevision(keys, prefixes)
+}
+
+func (g *readOnlyGuard) GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error) {
+	return g.store.GetRawAtRevision(key, revision)
+}
+
+func (g *readOnlyGuard) Syncer() (storage.Syncer, error) {
+	return g.store.Syncer()
+}
+
+func (g *readOnlyGuard) Close() error {
+	return g.store.Close()
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+)
+
+// ScheduledChange is a spec change pending to be applied at the given time.
+type ScheduledChange struct {
+	ID string `yaml:"id"`
+	// ApplyAt is the time to apply the change in RFC3339Nano.
+	ApplyAt string     `yaml:"applyAt"`
+	Change  SpecChange `yaml:"change"`
+}
+
+// ScheduleSpecChange validates the change and stores it to be applied at the given
+// time by ProcessScheduledChanges. It returns the ID of the scheduled change.
+func (s *Service) ScheduleSpecChange(at time.Time, change SpecChange) (string, error) {
+	if _, err := change.resolve(); err != nil {
+		return "", err
+	}
+
+	sc := &ScheduledChange{
+		ID:      uuid.NewString(),
+		ApplyAt: at.Format(time.RFC3339Nano),
+		Change:  change,
+	}
+	if err := s.store.Put(layout.ScheduledChangeKey(sc.ID), *marshalToString(sc)); err != nil {
+		return "", err
+	}
+
+	return sc.ID, nil
+}
+
+// CancelScheduledChange cancels the pending change, cancelling a change which
+// is applied or not found is a no-op.
+func (s *Service) CancelScheduledChange(id string) error {
+	return s.store.Delete(layout.ScheduledChangeKey(id))
+}
+
+// ListScheduledChanges lists the pending changes, sorted by their apply times.
+func (s *Service) ListScheduledChanges() ([]*ScheduledChange, error) {
+	changes, _, err := s.listScheduledChanges()
+	return changes, err
+}
+
+// listScheduledChanges lists the pending changes sorted by their apply times,
+// along with the mod revisions of their keys.
+func (s *Service) listScheduledChanges() ([]*ScheduledChange, map[*ScheduledChange]int64, error) {
+	kvs, err := s.store.GetRawPrefix(layout.ScheduledChangePrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := make([]*ScheduledChange, 0, len(kvs))
+	applyAts := make(map[*ScheduledChange]time.Time, len(kvs))
+	revisions := make(map[*ScheduledChange]int64, len(kvs))
+	for _, v := range kvs {
+		// NOTE: ScheduledChange is not a versioned spec, so it skips the migration.
+		sc := &ScheduledChange{}
+		if err = yaml.Unmarshal(v.Value, sc); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, sc.ApplyAt)
+		if err != nil {
+			logger.Errorf("BUG: parse apply time %s of scheduled change %s failed: %v", sc.ApplyAt, sc.ID, err)
+			continue
+		}
+		applyAts[sc] = at
+		revisions[sc] = v.ModRevision
+		changes = append(changes, sc)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		ti, tj := applyAts[changes[i]], applyAts[changes[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return changes[i].ID < changes[j].ID
+	})
+
+	return changes, revisions, nil
+}
+
+// ProcessScheduledChanges applies the changes due at now in the order of their apply
+// times, each change is applied and removed in one transaction, which is guarded by the
+// revision of the scheduled change, so a change cancelled or rescheduled meanwhile is
+// skipped. The invalid changes are removed without applying. It returns the count of
+// applied changes. The master of the leader calls it periodically.
+func (s *Service) ProcessScheduledChanges(now time.Time) (int, error) {
+	changes, revisions, err := s.listScheduledChanges()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, sc := range changes {
+		at, _ := time.Parse(time.RFC3339Nano, sc.ApplyAt)
+		if at.After(now) {
+			break
+		}
+
+		key := layout.ScheduledChangeKey(sc.ID)
+		guard := map[string]int64{key: revisions[sc]}
+		rc, err := sc.Change.resolve()
+		if err != nil {
+			logger.Errorf("drop invalid scheduled change %s: %v", sc.ID, err)
+			if _, err = s.store.CompareAndPutAndDelete(guard, map[string]*string{key: nil}); err != nil {
+				return applied, err
+			}
+			continue
+		}
+
+		kvs := map[string]*string{key: nil}
+		kvs[rc.key] = rc.value
+		put, err := s.store.CompareAndPutAndDelete(guard, kvs)
+		if err != nil {
+			return applied, err
+		}
+		if !put {
+			logger.Infof("skip scheduled change %s changed meanwhile", sc.ID)
+			continue
+		}
+		applied++
+
+		reason := EventReasonUpdated
+		if rc.value == nil {
+			reason = EventReasonDeleted
+		}
+		s.recordEvent(rc.kind, rc.name, EventTypeNormal, reason,
+			fmt.Sprintf("applied scheduled change %s", sc.ID))
+	}
+
+	return applied, nil
+}
@@ -20,7 +20,15 @@ package service
 import (
 	"context"
 	"fmt"
-
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"github.com/tidwall/gjson"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	"gopkg.in/yaml.v2"
 
@@ -30,9 +38,89 @@ import (
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/megaease/easegress/pkg/v"
+)
+
+const (
+	// TenantDeletionReassign reassigns member services to the global tenant.
+	TenantDeletionReassign TenantDeletionPolicy = iota
+	// TenantDeletionDeleteServices deletes member services along with the tenant.
+	TenantDeletionDeleteServices
+)
+
+const (
+	// ConflictSkip keeps the existing service spec and skips the imported one.
+	ConflictSkip ConflictStrategy = iota
+	// ConflictOverwrite overwrites the existing service spec with the imported one.
+	ConflictOverwrite
+	// ConflictFail fails the whole import if any imported service spec exists.
+	ConflictFail
+)
+
+const (
+	// maxCASRetries is the max times of retrying a compare-and-swap write on conflicts.
+	maxCASRetries = 16
+)
+
+var (
+	// ErrTooManyConflicts is the error when a compare-and-swap write keeps conflicting with others.
+	ErrTooManyConflicts = fmt.Errorf("too many conflicts")
+
+	// ErrInstanceAlreadyExists is the error when registering an existing service instance.
+	ErrInstanceAlreadyExists = fmt.Errorf("instance already exists")
+
+	// ErrTenantHasServices is the error when deleting a tenant which services still register to.
+	ErrTenantHasServices = fmt.Errorf("tenant has services")
+
+	// ErrServiceNotFound is the error when the service to operate on doesn't exist.
+	ErrServiceNotFound = fmt.Errorf("service not found")
+
+	// ErrTenantNotFound is the error when the tenant to operate on doesn't exist.
+	ErrTenantNotFound = fmt.Errorf("tenant not found")
+
+	// ErrServiceAlreadyExists is the error when importing an existing service with ConflictFail.
+	ErrServiceAlreadyExists = fmt.Errorf("service already exists")
+
+	// ErrIngressAlreadyExists is the error when creating an existing ingress.
+	ErrIngressAlreadyExists = fmt.Errorf("ingress already exists")
+
+	// ErrCustomResourceAlreadyExists is the error when moving a custom resource to an existing one.
+	ErrCustomResourceAlreadyExists = fmt.Errorf("custom resource already exists")
+
+	// ErrCustomResourceKindNotFound is the error when moving a custom resource to an undefined kind.
+	ErrCustomResourceKindNotFound = fmt.Errorf("custom resource kind not found")
+
+	// ErrConflict is the error when the keys to write are changed by others meanwhile.
+	ErrConflict = fmt.Errorf("conflict with concurrent writes")
+
+	// ErrInconsistentStore is the error when the reads of the store are inconsistent.
+	ErrInconsistentStore = fmt.Errorf("inconsistent store")
 )
 
 type (
+	// TenantDeletionPolicy is the policy of handling member services when force deleting a tenant.
+	TenantDeletionPolicy int
+
+	// ConflictStrategy is the strategy of handling existing service specs when importing.
+	ConflictStrategy int
+
+	// ImportReport is the report of importing service specs.
+	ImportReport struct {
+		Created     []string `yaml:"created"`
+		Skipped     []string `yaml:"skipped"`
+		Overwritten []string `yaml:"overwritten"`
+	}
+
+	// ServiceDetail is the detail of a service read at one point in time.
+	ServiceDetail struct {
+		Spec      *spec.Service
+		Instances []*spec.ServiceInstanceSpec
+		Statuses  []*spec.ServiceInstanceStatus
+		// Ingresses are the ones having paths backed by the service.
+		Ingresses []*spec.Ingress
+	}
+
 	// Service is the business layer between mesh and store.
 	// It is not concurrently safe, the users need to do it by themselves.
 	Service struct {
@@ -40,20 +128,80 @@ type (
 		spec      *spec.Admin
 
 		store storage.Storage
+
+		// mutex protects the fields below.
+		mutex    sync.Mutex
+		syncers  map[storage.Syncer]struct{}
+		closed   bool
+		recorder EventRecorder
+		readOnly bool
+		// leaderLeases is the lease IDs of the tasks led by the service.
+		leaderLeases map[string]int64
 	}
 )
 
 // New creates a service with spec
 func New(superSpec *supervisor.Spec) *Service {
+	adminSpec := superSpec.ObjectSpec().(*spec.Admin)
 	s := &Service{
 		superSpec: superSpec,
-		spec:      superSpec.ObjectSpec().(*spec.Admin),
-		store:     storage.New(superSpec.Name(), superSpec.Super().Cluster()),
+		spec:      adminSpec,
+		syncers:   make(map[storage.Syncer]struct{}),
 	}
+	s.store = newReadOnlyGuard(s, storage.NewWithTimeout(superSpec.Name(),
+		superSpec.Super().Cluster(), adminSpec.StorageTimeoutDuration()))
 
 	return s
 }
 
+// Close closes the service, it stops all watches and closes the store.
+// It is safe to call Close more than once.
+func (s *Service) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	for syncer := range s.syncers {
+		syncer.Close()
+	}
+	s.syncers = nil
+
+	return s.store.Close()
+}
+
+// newSyncer creates a syncer which will be closed when closing the service.
+func (s *Service) newSyncer() (storage.Syncer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, storage.ErrClosed
+	}
+
+	syncer, err := s.store.Syncer()
+	if err != nil {
+		return nil, err
+	}
+	s.syncers[syncer] = struct{}{}
+
+	return syncer, nil
+}
+
+// closeSyncer closes the syncer if it has not been closed by closing the service.
+func (s *Service) closeSyncer(syncer storage.Syncer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.syncers[syncer]; ok {
+		syncer.Close()
+		delete(s.syncers, syncer)
+	}
+}
+
 // Lock locks all store, it will do cluster panic if failed.
 func (s *Service) Lock() {
 	err := s.store.Lock()
@@ -70,17 +218,14 @@ func (s *Service) Unlock() {
 	}
 }
 
-// PutServiceSpec writes the service spec
-func (s *Service) PutServiceSpec(serviceSpec *spec.Service) {
-	buff, err := yaml.Marshal(serviceSpec)
+// PutServiceSpec writes the service spec, the prior version is kept in its history.
+func (s *Service) PutServiceSpec(serviceSpec *spec.Service) error {
+	buff, err := spec.Encode(serviceSpec)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", serviceSpec, err))
 	}
 
-	err = s.store.Put(layout.ServiceSpecKey(serviceSpec.Name), string(buff))
-	if err != nil {
-		api.ClusterPanic(err)
-	}
+	return s.putServiceSpecWithHistory(serviceSpec.Name, string(buff))
 }
 
 // GetServiceSpec gets the service spec by its name
@@ -101,7 +246,7 @@ func (s *Service) GetServiceSpecWithInfo(serviceName string) (*spec.Service, *mv
 	}
 
 	serviceSpec := &spec.Service{}
-	err = yaml.Unmarshal(kv.Value, serviceSpec)
+	err = spec.Decode(kv.Value, serviceSpec)
 	if err != nil {
 		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kv.Value), err))
 	}
@@ -109,6 +254,79 @@ func (s *Service) GetServiceSpecWithInfo(serviceName string) (*spec.Service, *mv
 	return serviceSpec, kv
 }
 
+// GetServiceDetail gets the service spec with its instances, statuses and related
+// ingresses in one transaction, so they are a consistent snapshot.
+// It returns nil if the service is not found.
+func (s *Service) GetServiceDetail(serviceName string) (*ServiceDetail, error) {
+	serviceKey := layout.ServiceSpecKey(serviceName)
+	instancePrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	statusPrefix := layout.ServiceInstanceStatusPrefix(serviceName)
+	ingressPrefix := layout.IngressPrefix()
+
+	kvs, err := s.store.GetRawMulti([]string{serviceKey},
+		[]string{instancePrefix, statusPrefix, ingressPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	kv := kvs[serviceKey]
+	if kv == nil {
+		return nil, nil
+	}
+
+	detail := &ServiceDetail{
+		Spec:      &spec.Service{},
+		Instances: []*spec.ServiceInstanceSpec{},
+		Statuses:  []*spec.ServiceInstanceStatus{},
+		Ingresses: []*spec.Ingress{},
+	}
+	if err = spec.Decode(kv.Value, detail.Spec); err != nil {
+		return nil, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+	}
+
+	for k, v := range kvs {
+		switch {
+		case strings.HasPrefix(k, instancePrefix):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			detail.Instances = append(detail.Instances, instance)
+		case strings.HasPrefix(k, statusPrefix):
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			detail.Statuses = append(detail.Statuses, status)
+		case strings.HasPrefix(k, ingressPrefix):
+			ingress := &spec.Ingress{}
+			if err = spec.Decode(v.Value, ingress); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			if ingressHasBackend(ingress, serviceName) {
+				detail.Ingresses = append(detail.Ingresses, ingress)
+			}
+		}
+	}
+
+	return detail, nil
+}
+
+func ingressHasBackend(ingress *spec.Ingress, serviceName string) bool {
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			if path.Backend == serviceName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // GetGlobalCanaryHeaders gets the global canary headers
 func (s *Service) GetGlobalCanaryHeaders() *spec.GlobalCanaryHeaders {
 	globalCanaryHeaders, _ := s.GetGlobalCanaryHeadersWithInfo()
@@ -136,45 +354,238 @@ func (s *Service) GetGlobalCanaryHeadersWithInfo() (*spec.GlobalCanaryHeaders, *
 }
 
 // PutGlobalCanaryHeaders puts the global canary headers
-func (s *Service) PutGlobalCanaryHeaders(globalCanaryHeaders *spec.GlobalCanaryHeaders) {
-	buff, err := yaml.Marshal(globalCanaryHeaders)
+func (s *Service) PutGlobalCanaryHeaders(globalCanaryHeaders *spec.GlobalCanaryHeaders) error {
+	buff, err := spec.Encode(globalCanaryHeaders)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", globalCanaryHeaders, err))
 	}
 
-	err = s.store.Put(layout.GlobalCanaryHeaders(), string(buff))
-	if err != nil {
-		api.ClusterPanic(err)
-	}
+	return s.store.Put(layout.GlobalCanaryHeaders(), string(buff))
 }
 
 // DeleteServiceSpec deletes service spec by its name
-func (s *Service) DeleteServiceSpec(serviceName string) {
-	err := s.store.Delete(layout.ServiceSpecKey(serviceName))
-	if err != nil {
-		api.ClusterPanic(err)
+func (s *Service) DeleteServiceSpec(serviceName string) error {
+	return s.deleteAndRecord(eventKindService, serviceName, layout.ServiceSpecKey(serviceName))
+}
+
+// DeleteServiceSpecReturning deletes the service spec and returns the deleted one
+// atomically, so the cascade logic can act on it without reading it beforehand.
+// It returns nil if the service doesn't exist.
+func (s *Service) DeleteServiceSpecReturning(serviceName string) (*spec.Service, error) {
+	value, err := s.store.GetAndDelete(layout.ServiceSpecKey(serviceName))
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	s.recordEvent(eventKindService, serviceName, EventTypeNormal, EventReasonDeleted,
+		fmt.Sprintf("%s %s", EventReasonDeleted, serviceName))
+
+	serviceSpec := &spec.Service{}
+	if err = spec.Decode([]byte(*value), serviceSpec); err != nil {
+		return nil, fmt.Errorf("unmarshal deleted service %s failed: %v", serviceName, err)
 	}
+
+	return serviceSpec, nil
 }
 
 // ListServiceSpecs lists services specs
 func (s *Service) ListServiceSpecs() []*spec.Service {
-	services := []*spec.Service{}
+	services, _ := s.ListServiceSpecsWithRevision()
+	return services
+}
+
+// ListServiceSpecsWithRevision lists services specs with the max mod revision of them,
+// callers could compare the revision with the previous one to skip unchanged data.
+// NOTE: Deleting a service spec other than the latest modified one doesn't change
+// the revision, so the count of service specs should be compared too.
+// The services are sorted by their names.
+func (s *Service) ListServiceSpecsWithRevision() ([]*spec.Service, int64) {
 	kvs, err := s.store.GetRawPrefix(layout.ServiceSpecPrefix())
 	if err != nil {
 		api.ClusterPanic(err)
 	}
 
+	var revision int64
 	for _, v := range kvs {
-		serviceSpec := &spec.Service{}
-		err := yaml.Unmarshal(v.Value, serviceSpec)
+		if v.ModRevision > revision {
+			revision = v.ModRevision
+		}
+	}
+
+	return decodeServiceSpecs(kvs), revision
+}
+
+// StreamServiceSpecsChan sends the service specs sorted by their names on the returning
+// channel one by one as they are decoded, so consumers could start working before all
+// specs are decoded. Both channels are closed when done, the error channel carries at
+// most one error, which is the store error or the error of the canceled context.
+func (s *Service) StreamServiceSpecsChan(ctx context.Context) (<-chan *spec.Service, <-chan error) {
+	specCh := make(chan *spec.Service)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(specCh)
+		defer close(errCh)
+
+		kvs, err := s.store.GetRawPrefix(layout.ServiceSpecPrefix())
 		if err != nil {
-			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			errCh <- err
+			return
+		}
+
+		for _, kv := range sortedValues(kvs) {
+			if err = ctx.Err(); err != nil {
+				errCh <- err
+				return
+			}
+
+			serviceSpec := decodeServiceSpec(kv)
+			if serviceSpec == nil {
+				continue
+			}
+
+			select {
+			case specCh <- serviceSpec:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return specCh, errCh
+}
+
+// ImportServiceSpecs imports service specs in one transaction, the existing ones
+// are handled per the strategy. The imported services are added to the services of
+// their tenants in the same transaction, so the tenants must exist. Nothing is written
+// if it returns an error.
+func (s *Service) ImportServiceSpecs(specs []*spec.Service, strategy ConflictStrategy) (*ImportReport, error) {
+	if strategy != ConflictSkip && strategy != ConflictOverwrite && strategy != ConflictFail {
+		return nil, fmt.Errorf("unknown conflict strategy: %d", strategy)
+	}
+
+	for i := 0; i < maxCASRetries; i++ {
+		report, put, err := s.importServiceSpecs(specs, strategy)
+		if err != nil {
+			return nil, err
+		}
+		if !put {
 			continue
 		}
-		services = append(services, serviceSpec)
+
+		for _, name := range report.Created {
+			s.recordEvent(eventKindService, name, EventTypeNormal, EventReasonCreated,
+				fmt.Sprintf("%s %s", EventReasonCreated, name))
+		}
+		for _, name := range report.Overwritten {
+			s.recordEvent(eventKindService, name, EventTypeNormal, EventReasonUpdated,
+				fmt.Sprintf("%s %s", EventReasonUpdated, name))
+		}
+		return report, nil
 	}
 
-	return services
+	return nil, ErrTooManyConflicts
+}
+
+// importServiceSpecs tries importing the service specs once, the returning boolean
+// flag is false if the store has been changed meanwhile.
+func (s *Service) importServiceSpecs(specs []*spec.Service, strategy ConflictStrategy) (*ImportReport, bool, error) {
+	existing, err := s.store.GetRawMulti(nil, []string{layout.ServiceSpecPrefix(), layout.TenantPrefix()})
+	if err != nil {
+		return nil, false, err
+	}
+
+	tenants := map[string]*spec.Tenant{}
+	getTenant := func(name string) (*spec.Tenant, error) {
+		if tenant, ok := tenants[name]; ok {
+			return tenant, nil
+		}
+		kv := existing[layout.TenantSpecKey(name)]
+		if kv == nil {
+			return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+		}
+		tenant := &spec.Tenant{}
+		if err := spec.Decode(kv.Value, tenant); err != nil {
+			return nil, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+		}
+		tenants[name] = tenant
+		return tenant, nil
+	}
+
+	report := &ImportReport{
+		Created:     []string{},
+		Skipped:     []string{},
+		Overwritten: []string{},
+	}
+	kvs := map[string]*string{}
+	revisions := map[string]int64{}
+	for _, serviceSpec := range specs {
+		key := layout.ServiceSpecKey(serviceSpec.Name)
+		if _, ok := revisions[key]; ok {
+			return nil, false, fmt.Errorf("duplicated service %s", serviceSpec.Name)
+		}
+
+		kv := existing[key]
+		if kv == nil {
+			report.Created = append(report.Created, serviceSpec.Name)
+		} else {
+			switch strategy {
+			case ConflictSkip:
+				report.Skipped = append(report.Skipped, serviceSpec.Name)
+				// NOTE: Skipped services are not written, they are recorded
+				// here to find duplications.
+				revisions[key] = kv.ModRevision
+				continue
+			case ConflictOverwrite:
+				report.Overwritten = append(report.Overwritten, serviceSpec.Name)
+			case ConflictFail:
+				return nil, false, fmt.Errorf("%w: %s", ErrServiceAlreadyExists, serviceSpec.Name)
+			}
+
+			oldSpec := &spec.Service{}
+			if err = spec.Decode(kv.Value, oldSpec); err != nil {
+				return nil, false, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+			}
+			if oldSpec.RegisterTenant != serviceSpec.RegisterTenant {
+				// NOTE: The missing old tenant has nothing to clean.
+				if oldTenant, _ := getTenant(oldSpec.RegisterTenant); oldTenant != nil {
+					oldTenant.Services = stringtool.DeleteStrInSlice(oldTenant.Services, serviceSpec.Name)
+				}
+			}
+		}
+
+		tenant, err := getTenant(serviceSpec.RegisterTenant)
+		if err != nil {
+			return nil, false, err
+		}
+		if !stringtool.StrInSlice(serviceSpec.Name, tenant.Services) {
+			tenant.Services = append(tenant.Services, serviceSpec.Name)
+		}
+
+		kvs[key] = marshalToString(serviceSpec)
+		if kv != nil {
+			revisions[key] = kv.ModRevision
+		} else {
+			revisions[key] = 0
+		}
+	}
+
+	if len(kvs) == 0 {
+		return report, true, nil
+	}
+
+	for name, tenant := range tenants {
+		key := layout.TenantSpecKey(name)
+		kvs[key] = marshalToString(tenant)
+		revisions[key] = existing[key].ModRevision
+	}
+
+	put, err := s.store.CompareAndPutAndDelete(revisions, kvs)
+	if err != nil {
+		return nil, false, err
+	}
+	return report, put, nil
 }
 
 // GetTenantSpec gets tenant spec with its name
@@ -183,6 +594,20 @@ func (s *Service) GetTenantSpec(tenantName string) *spec.Tenant {
 	return tenant
 }
 
+// GetTenantSpecWithDefaults gets tenant spec with its name, it returns
+// an empty global tenant if the global tenant is requested but not created yet.
+func (s *Service) GetTenantSpecWithDefaults(tenantName string) *spec.Tenant {
+	tenant := s.GetTenantSpec(tenantName)
+	if tenant == nil && tenantName == spec.GlobalTenant {
+		tenant = &spec.Tenant{
+			Name:     spec.GlobalTenant,
+			Services: []string{},
+		}
+	}
+
+	return tenant
+}
+
 // GetTenantSpecWithInfo gets tenant spec with information
 func (s *Service) GetTenantSpecWithInfo(tenantName string) (*spec.Tenant, *mvccpb.KeyValue) {
 	kvs, err := s.store.GetRaw(layout.TenantSpecKey(tenantName))
@@ -195,7 +620,7 @@ func (s *Service) GetTenantSpecWithInfo(tenantName string) (*spec.Tenant, *mvccp
 	}
 
 	tenant := &spec.Tenant{}
-	err = yaml.Unmarshal(kvs.Value, tenant)
+	err = spec.Decode(kvs.Value, tenant)
 	if err != nil {
 		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kvs.Value), err))
 	}
@@ -204,16 +629,129 @@ func (s *Service) GetTenantSpecWithInfo(tenantName string) (*spec.Tenant, *mvccp
 }
 
 // PutTenantSpec writes the tenant spec.
-func (s *Service) PutTenantSpec(tenantSpec *spec.Tenant) {
-	buff, err := yaml.Marshal(tenantSpec)
+func (s *Service) PutTenantSpec(tenantSpec *spec.Tenant) error {
+	buff, err := spec.Encode(tenantSpec)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", tenantSpec, err))
 	}
 
-	err = s.store.Put(layout.TenantSpecKey(tenantSpec.Name), string(buff))
-	if err != nil {
-		api.ClusterPanic(err)
+	return s.putAndRecord(eventKindTenant, tenantSpec.Name, layout.TenantSpecKey(tenantSpec.Name), string(buff))
+}
+
+// CreateTenantsWithServices creates the tenants with their services in one transaction,
+// assignments maps the tenant names to their services, and the RegisterTenant of the
+// services are set to their tenants. It fails without creating any tenant if any tenant
+// exists or is invalid, any service doesn't exist or registers another tenant, or any
+// service is assigned more than once, including the ones already assigned to existing tenants.
+func (s *Service) CreateTenantsWithServices(assignments map[string][]string) error {
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	// NOTE: Iterate in order to report the same error for the same assignments.
+	names := make([]string, 0, len(assignments))
+	for name := range assignments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	createdAt := time.Now().Format(time.RFC3339)
+	tenants := make(map[string]*spec.Tenant, len(assignments))
+	serviceKeys := []string{}
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("tenant name cannot be empty")
+		}
+		tenant := &spec.Tenant{
+			Name:      name,
+			Services:  assignments[name],
+			CreatedAt: createdAt,
+		}
+		if vr := v.Validate(tenant); !vr.Valid() {
+			return fmt.Errorf("validate tenant %s failed:\n%s", name, vr)
+		}
+		tenants[name] = tenant
+		for _, service := range tenant.Services {
+			serviceKeys = append(serviceKeys, layout.ServiceSpecKey(service))
+		}
+	}
+
+	for i := 0; i < maxCASRetries; i++ {
+		kvs, err := s.store.GetRawMulti(serviceKeys, []string{layout.TenantPrefix()})
+		if err != nil {
+			return err
+		}
+
+		revisions := map[string]int64{}
+		owners := map[string]string{}
+		for k, kv := range kvs {
+			if !strings.HasPrefix(k, layout.TenantPrefix()) {
+				continue
+			}
+			tenant := &spec.Tenant{}
+			if err = spec.Decode(kv.Value, tenant); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kv, err)
+				continue
+			}
+			if _, ok := assignments[tenant.Name]; ok {
+				return fmt.Errorf("tenant %s existed", tenant.Name)
+			}
+			for _, service := range tenant.Services {
+				owners[service] = tenant.Name
+			}
+			// NOTE: The services of the existing tenants must not change meanwhile.
+			revisions[k] = kv.ModRevision
+		}
+
+		changes := make(map[string]*string, len(assignments)+len(serviceKeys))
+		for _, name := range names {
+			for _, serviceName := range assignments[name] {
+				if owner, ok := owners[serviceName]; ok {
+					return fmt.Errorf("service %s is assigned to both tenant %s and %s", serviceName, owner, name)
+				}
+				owners[serviceName] = name
+
+				key := layout.ServiceSpecKey(serviceName)
+				kv := kvs[key]
+				if kv == nil {
+					return fmt.Errorf("%w: %s", ErrServiceNotFound, serviceName)
+				}
+				service := &spec.Service{}
+				if err = spec.Decode(kv.Value, service); err != nil {
+					return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+				}
+				if service.RegisterTenant != "" && service.RegisterTenant != name {
+					return fmt.Errorf("service %s registers tenant %s rather than %s",
+						serviceName, service.RegisterTenant, name)
+				}
+				if service.RegisterTenant != name {
+					service.RegisterTenant = name
+					changes[key] = marshalToString(service)
+				}
+				revisions[key] = kv.ModRevision
+			}
+
+			key := layout.TenantSpecKey(name)
+			changes[key] = marshalToString(tenants[name])
+			revisions[key] = 0
+		}
+
+		put, err := s.store.CompareAndPutAndDelete(revisions, changes)
+		if err != nil {
+			return err
+		}
+		if !put {
+			continue
+		}
+
+		for _, name := range names {
+			s.recordEvent(eventKindTenant, name, EventTypeNormal, EventReasonCreated,
+				fmt.Sprintf("%s %s", EventReasonCreated, name))
+		}
+		return nil
 	}
+
+	return ErrTooManyConflicts
 }
 
 // ListAllServiceInstanceStatuses lists all service instance statuses.
@@ -240,9 +778,9 @@ func (s *Service) listServiceInstanceStatuses(all bool, serviceName string) []*s
 		api.ClusterPanic(err)
 	}
 
-	for _, v := range kvs {
+	for k, v := range kvs {
 		status := &spec.ServiceInstanceStatus{}
-		if err = yaml.Unmarshal(v.Value, status); err != nil {
+		if err = storage.Decode(k, v.Value, status); err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
 		}
@@ -253,16 +791,104 @@ func (s *Service) listServiceInstanceStatuses(all bool, serviceName string) []*s
 	return statuses
 }
 
+// RecordHeartbeat records the heartbeat reported at reportTime on the instance status,
+// it stamps the server-side heartbeat time with the local clock too.
+func (s *Service) RecordHeartbeat(serviceName, instanceID string, reportTime time.Time) error {
+	key := layout.ServiceInstanceStatusKey(serviceName, instanceID)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+
+		status := &spec.ServiceInstanceStatus{
+			ServiceName: serviceName,
+			InstanceID:  instanceID,
+		}
+		var revision int64
+		if kv != nil {
+			if err = storage.Decode(key, kv.Value, status); err != nil {
+				return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+			}
+			revision = kv.ModRevision
+		}
+		status.LastHeartbeatTime = reportTime.Format(time.RFC3339)
+		status.ServerHeartbeatTime = time.Now().Format(time.RFC3339Nano)
+		status.Phase = ""
+
+		buff, err := storage.Encode(key, status)
+		if err != nil {
+			return fmt.Errorf("BUG: marshal %#v failed: %v", status, err)
+		}
+
+		put, err := s.store.CompareAndPut(key, string(buff), revision)
+		if err != nil {
+			return err
+		}
+		if put {
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
 // ListAllServiceInstanceSpecs lists all service instance specs.
 func (s *Service) ListAllServiceInstanceSpecs() []*spec.ServiceInstanceSpec {
 	return s.listServiceInstanceSpecs(true, "")
 }
 
+// ListLiveServiceInstanceSpecs lists service instance specs whose service specs still
+// exist, the orphan instances of deleted services are skipped. The service specs and
+// instance specs are read in one request.
+func (s *Service) ListLiveServiceInstanceSpecs() []*spec.ServiceInstanceSpec {
+	servicePrefix := layout.ServiceSpecPrefix()
+	instancePrefix := layout.AllServiceInstanceSpecPrefix()
+
+	kvs, err := s.store.GetRawMulti(nil, []string{servicePrefix, instancePrefix})
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	specs := []*spec.ServiceInstanceSpec{}
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, instancePrefix) {
+			continue
+		}
+
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = spec.Decode(v.Value, _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		if _, ok := kvs[layout.ServiceSpecKey(_spec.ServiceName)]; !ok {
+			continue
+		}
+
+		specs = append(specs, _spec)
+	}
+
+	return specs
+}
+
 // ListServiceInstanceSpecs lists service instance specs.
 func (s *Service) ListServiceInstanceSpecs(serviceName string) []*spec.ServiceInstanceSpec {
 	return s.listServiceInstanceSpecs(false, serviceName)
 }
 
+// ListPeerInstanceSpecs lists service instance specs of the service except the self instance.
+func (s *Service) ListPeerInstanceSpecs(serviceName, selfInstanceID string) []*spec.ServiceInstanceSpec {
+	peers := []*spec.ServiceInstanceSpec{}
+	for _, instance := range s.listServiceInstanceSpecs(false, serviceName) {
+		if instance.InstanceID != selfInstanceID {
+			peers = append(peers, instance)
+		}
+	}
+
+	return peers
+}
+
 func (s *Service) listServiceInstanceSpecs(all bool, serviceName string) []*spec.ServiceInstanceSpec {
 	specs := []*spec.ServiceInstanceSpec{}
 	var prefix string
@@ -279,7 +905,7 @@ func (s *Service) listServiceInstanceSpecs(all bool, serviceName string) []*spec
 
 	for _, v := range kvs {
 		_spec := &spec.ServiceInstanceSpec{}
-		if err = yaml.Unmarshal(v.Value, _spec); err != nil {
+		if err = spec.Decode(v.Value, _spec); err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
 		}
@@ -290,45 +916,233 @@ func (s *Service) listServiceInstanceSpecs(all bool, serviceName string) []*spec
 	return specs
 }
 
-// GetServiceInstanceSpec gets the service instance spec
-func (s *Service) GetServiceInstanceSpec(serviceName, instanceID string) *spec.ServiceInstanceSpec {
-	value, err := s.store.Get(layout.ServiceInstanceSpecKey(serviceName, instanceID))
-	if err != nil {
-		api.ClusterPanic(err)
+// SelectInstances lists the service instance specs across all services
+// whose labels match every entry of the selector.
+func (s *Service) SelectInstances(selector map[string]string) []*spec.ServiceInstanceSpec {
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, instance := range s.ListAllServiceInstanceSpecs() {
+		if matchLabels(instance.Labels, selector) {
+			specs = append(specs, instance)
+		}
 	}
 
-	if value == nil {
-		return nil
+	return specs
+}
+
+func matchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetServiceInstanceSpec gets the service instance spec
+func (s *Service) GetServiceInstanceSpec(serviceName, instanceID string) *spec.ServiceInstanceSpec {
+	instanceSpec, _ := s.GetServiceInstanceSpecWithInfo(serviceName, instanceID)
+	return instanceSpec
+}
+
+// GetServiceInstanceSpecWithInfo gets the service instance spec with information
+func (s *Service) GetServiceInstanceSpecWithInfo(serviceName, instanceID string) (*spec.ServiceInstanceSpec, *mvccpb.KeyValue) {
+	kv, err := s.store.GetRaw(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	if kv == nil {
+		return nil, nil
 	}
 
 	instanceSpec := &spec.ServiceInstanceSpec{}
-	err = yaml.Unmarshal([]byte(*value), instanceSpec)
+	err = spec.Decode(kv.Value, instanceSpec)
 	if err != nil {
-		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", *value, err))
+		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kv.Value), err))
 	}
 
-	return instanceSpec
+	return instanceSpec, kv
 }
 
 // PutServiceInstanceSpec writes the service instance spec
-func (s *Service) PutServiceInstanceSpec(_spec *spec.ServiceInstanceSpec) {
-	buff, err := yaml.Marshal(_spec)
+func (s *Service) PutServiceInstanceSpec(_spec *spec.ServiceInstanceSpec) error {
+	buff, err := spec.Encode(_spec)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", _spec, err))
 	}
 
-	err = s.store.Put(layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID), string(buff))
+	return s.store.Put(layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID), string(buff))
+}
+
+// RegisterInstanceWithInitialStatus writes the service instance spec along with a pending
+// status in one transaction, so the instance never has a spec without status. The existing
+// status of the instance is kept.
+func (s *Service) RegisterInstanceWithInitialStatus(instanceSpec *spec.ServiceInstanceSpec) error {
+	specKey := layout.ServiceInstanceSpecKey(instanceSpec.ServiceName, instanceSpec.InstanceID)
+	statusKey := layout.ServiceInstanceStatusKey(instanceSpec.ServiceName, instanceSpec.InstanceID)
+
+	status := &spec.ServiceInstanceStatus{
+		ServiceName: instanceSpec.ServiceName,
+		InstanceID:  instanceSpec.InstanceID,
+		Phase:       spec.ServiceInstancePhasePending,
+	}
+	buff, err := storage.Encode(statusKey, status)
 	if err != nil {
-		api.ClusterPanic(err)
+		return fmt.Errorf("BUG: marshal %#v failed: %v", status, err)
 	}
+	statusValue := string(buff)
+
+	for i := 0; i < maxCASRetries; i++ {
+		statusKV, err := s.store.GetRaw(statusKey)
+		if err != nil {
+			return err
+		}
+
+		kvs := map[string]*string{specKey: marshalToString(instanceSpec)}
+		revisions := map[string]int64{}
+		if statusKV == nil {
+			// NOTE: The status may be reported between reading and writing,
+			// so it is only created if still absent.
+			kvs[statusKey] = &statusValue
+			revisions[statusKey] = 0
+		}
+
+		put, err := s.store.CompareAndPutAndDelete(revisions, kvs)
+		if err != nil {
+			return err
+		}
+		if put {
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
+// RegisterServiceInstanceWithLease creates the service instance spec only if it doesn't exist,
+// under a new lease with the ttl. The caller must keep the returning lease alive by
+// KeepAliveServiceInstanceLease, otherwise the instance spec is deleted after the ttl.
+// It returns ErrInstanceAlreadyExists if the instance spec already exists.
+func (s *Service) RegisterServiceInstanceWithLease(instanceSpec *spec.ServiceInstanceSpec, ttl time.Duration) (int64, error) {
+	buff, err := spec.Encode(instanceSpec)
+	if err != nil {
+		return 0, fmt.Errorf("BUG: marshal %#v to yaml failed: %v", instanceSpec, err)
+	}
+
+	key := layout.ServiceInstanceSpecKey(instanceSpec.ServiceName, instanceSpec.InstanceID)
+	leaseID, err := s.store.PutIfAbsentUnderNewLease(key, string(buff), ttl)
+	if err != nil {
+		return 0, err
+	}
+	if leaseID == 0 {
+		return 0, ErrInstanceAlreadyExists
+	}
+
+	return leaseID, nil
+}
+
+// KeepAliveServiceInstanceLease keeps the lease of the registered service instance alive once.
+func (s *Service) KeepAliveServiceInstanceLease(leaseID int64) error {
+	return s.store.KeepAliveLeaseOnce(leaseID)
 }
 
 // DeleteServiceInstanceSpec deletes the service instance spec.
-func (s *Service) DeleteServiceInstanceSpec(serviceName, instanceID string) {
-	err := s.store.Delete(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+func (s *Service) DeleteServiceInstanceSpec(serviceName, instanceID string) error {
+	return s.store.Delete(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+}
+
+// DrainService marks all instances of the service drained and OUT_OF_SERVICE in one
+// transaction, the drained instances are not made UP by the heartbeat checking.
+// The instances in maintenance are untouched.
+func (s *Service) DrainService(serviceName string) error {
+	now := time.Now()
+	return s.updateServiceInstances(serviceName, nil, func(instance *spec.ServiceInstanceSpec, _ *spec.ServiceInstanceStatus) bool {
+		if instance.InMaintenance(now) {
+			return false
+		}
+		if instance.Drained && instance.Status == spec.ServiceStatusOutOfService {
+			return false
+		}
+		instance.Drained, instance.Status = true, spec.ServiceStatusOutOfService
+		return true
+	})
+}
+
+// UndrainService clears the drained mark of the instances of the service in one transaction,
+// the instances with healthy heartbeats are made UP at once, and others are left to the
+// heartbeat checking. The instances out of service for other reasons are untouched.
+func (s *Service) UndrainService(serviceName string) error {
+	now, timeout := time.Now(), s.heartbeatTimeout()
+	statusPrefix := layout.ServiceInstanceStatusPrefix(serviceName)
+	return s.updateServiceInstances(serviceName, &statusPrefix, func(instance *spec.ServiceInstanceSpec, status *spec.ServiceInstanceStatus) bool {
+		if !instance.Drained {
+			return false
+		}
+		instance.Drained = false
+		if status != nil && status.IsHealthy(now, timeout) {
+			instance.Status = spec.ServiceStatusUp
+		}
+		return true
+	})
+}
+
+// updateServiceInstances updates the instance specs of the service in one transaction,
+// update reports whether the instance is changed. The statuses are read along with the
+// specs if statusPrefix is not nil.
+func (s *Service) updateServiceInstances(serviceName string, statusPrefix *string,
+	update func(instance *spec.ServiceInstanceSpec, status *spec.ServiceInstanceStatus) bool) error {
+
+	specPrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	prefixes := []string{specPrefix}
+	if statusPrefix != nil {
+		prefixes = append(prefixes, *statusPrefix)
+	}
+	kvs, err := s.store.GetRawMulti(nil, prefixes)
 	if err != nil {
-		api.ClusterPanic(err)
+		return err
+	}
+
+	instances := map[string]*spec.ServiceInstanceSpec{}
+	statuses := map[string]*spec.ServiceInstanceStatus{}
+	for k, v := range kvs {
+		if strings.HasPrefix(k, specPrefix) {
+			instanceSpec := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instanceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			instances[k] = instanceSpec
+			continue
+		}
+
+		status := &spec.ServiceInstanceStatus{}
+		if err = storage.Decode(k, v.Value, status); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		statuses[status.InstanceID] = status
+	}
+
+	updates := make(map[string]*string, len(instances))
+	for k, instanceSpec := range instances {
+		if !update(instanceSpec, statuses[instanceSpec.InstanceID]) {
+			continue
+		}
+
+		buff, err := spec.Encode(instanceSpec)
+		if err != nil {
+			return fmt.Errorf("BUG: marshal %#v to yaml failed: %v", instanceSpec, err)
+		}
+		value := string(buff)
+		updates[k] = &value
 	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	return s.store.PutAndDelete(updates)
 }
 
 // ListTenantSpecs lists tenant specs
@@ -341,7 +1155,7 @@ func (s *Service) ListTenantSpecs() []*spec.Tenant {
 
 	for _, v := range kvs {
 		tenantSpec := &spec.Tenant{}
-		err := yaml.Unmarshal(v.Value, tenantSpec)
+		err := spec.Decode(v.Value, tenantSpec)
 		if err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
@@ -352,12 +1166,256 @@ func (s *Service) ListTenantSpecs() []*spec.Tenant {
 	return tenants
 }
 
-// DeleteTenantSpec deletes tenant spec
-func (s *Service) DeleteTenantSpec(tenantName string) {
-	err := s.store.Delete(layout.TenantSpecKey(tenantName))
+// ListReferencedTenants lists the distinct tenants registered by the services,
+// sorted by their names. The tenants may be not declared.
+func (s *Service) ListReferencedTenants() []string {
+	referenced := map[string]struct{}{}
+	for _, service := range s.ListServiceSpecs() {
+		if service.RegisterTenant != "" {
+			referenced[service.RegisterTenant] = struct{}{}
+		}
+	}
+
+	tenants := make([]string, 0, len(referenced))
+	for tenant := range referenced {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	return tenants
+}
+
+// ListUndeclaredTenants lists the tenants registered by the services but without
+// tenant specs, sorted by their names. The global tenant is always declared.
+func (s *Service) ListUndeclaredTenants() []string {
+	declared := map[string]bool{spec.GlobalTenant: true}
+	for _, tenant := range s.ListTenantSpecs() {
+		declared[tenant.Name] = true
+	}
+
+	undeclared := []string{}
+	for _, tenant := range s.ListReferencedTenants() {
+		if !declared[tenant] {
+			undeclared = append(undeclared, tenant)
+		}
+	}
+
+	return undeclared
+}
+
+// ReconcileTenantMembership rewrites the services lists of all tenants to match the
+// tenants registered by the services in one transaction, the RegisterTenant of services
+// is authoritative. The global tenant is created if needed, while the services of other
+// undeclared tenants are left to ListUndeclaredTenants.
+func (s *Service) ReconcileTenantMembership() error {
+	servicePrefix, tenantPrefix := layout.ServiceSpecPrefix(), layout.TenantPrefix()
+	kvs, err := s.store.GetRawMulti(nil, []string{servicePrefix, tenantPrefix})
 	if err != nil {
-		api.ClusterPanic(err)
+		return err
+	}
+
+	serviceKVs := map[string]*mvccpb.KeyValue{}
+	tenants := map[string]*spec.Tenant{}
+	for k, v := range kvs {
+		if strings.HasPrefix(k, servicePrefix) {
+			serviceKVs[k] = v
+			continue
+		}
+		tenant := &spec.Tenant{}
+		if err = spec.Decode(v.Value, tenant); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		tenants[tenant.Name] = tenant
+	}
+
+	members := map[string][]string{}
+	for _, service := range decodeServiceSpecs(serviceKVs) {
+		members[service.RegisterTenant] = append(members[service.RegisterTenant], service.Name)
+	}
+	if tenants[spec.GlobalTenant] == nil && len(members[spec.GlobalTenant]) != 0 {
+		tenants[spec.GlobalTenant] = &spec.Tenant{
+			Name:      spec.GlobalTenant,
+			CreatedAt: time.Now().Format(time.RFC3339),
+		}
+	}
+
+	updates := map[string]*string{}
+	reconciled := []string{}
+	for name, tenant := range tenants {
+		services := append([]string{}, members[name]...)
+		sort.Strings(services)
+		current := append([]string{}, tenant.Services...)
+		sort.Strings(current)
+
+		key := layout.TenantSpecKey(name)
+		if kvs[key] != nil && reflect.DeepEqual(current, services) {
+			continue
+		}
+
+		tenant.Services = services
+		updates[key] = marshalToString(tenant)
+		reconciled = append(reconciled, name)
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	if err = s.store.PutAndDelete(updates); err != nil {
+		return err
+	}
+
+	for _, name := range reconciled {
+		s.recordEvent(eventKindTenant, name, EventTypeNormal, EventReasonUpdated,
+			fmt.Sprintf("reconciled services of %s", name))
+	}
+
+	return nil
+}
+
+// DeleteTenantSpec deletes tenant spec, it returns ErrTenantHasServices
+// if any service still registers to the tenant. The check and the deletion
+// are in one transaction, so no service is orphaned by registering meanwhile.
+func (s *Service) DeleteTenantSpec(tenantName string) error {
+	return s.deleteTenantSpec(tenantName, func(members []*spec.Service, _ *mvccpb.KeyValue,
+		_ map[string]*string, _ map[string]int64) error {
+
+		if len(members) != 0 {
+			return ErrTenantHasServices
+		}
+		return nil
+	})
+}
+
+// DeleteTenantSpecForce deletes tenant spec even if services still register to it,
+// the member services are reassigned to the global tenant or deleted per the policy.
+func (s *Service) DeleteTenantSpecForce(tenantName string, policy TenantDeletionPolicy) error {
+	switch policy {
+	case TenantDeletionReassign:
+		if tenantName == spec.GlobalTenant {
+			return fmt.Errorf("can't reassign services of the global tenant")
+		}
+	case TenantDeletionDeleteServices:
+	default:
+		return fmt.Errorf("unknown tenant deletion policy: %d", policy)
+	}
+
+	return s.deleteTenantSpec(tenantName, func(members []*spec.Service, globalKV *mvccpb.KeyValue,
+		changes map[string]*string, revisions map[string]int64) error {
+
+		if policy == TenantDeletionDeleteServices {
+			for _, service := range members {
+				changes[layout.ServiceSpecKey(service.Name)] = nil
+			}
+			return nil
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		global := &spec.Tenant{Name: spec.GlobalTenant, Services: []string{}}
+		if globalKV != nil {
+			if err := spec.Decode(globalKV.Value, global); err != nil {
+				return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", globalKV.Value, err)
+			}
+		}
+		if global.CreatedAt == "" {
+			global.CreatedAt = time.Now().Format(time.RFC3339)
+		}
+		for _, service := range members {
+			service.RegisterTenant = spec.GlobalTenant
+			if !stringtool.StrInSlice(service.Name, global.Services) {
+				global.Services = append(global.Services, service.Name)
+			}
+			changes[layout.ServiceSpecKey(service.Name)] = marshalToString(service)
+		}
+
+		key := layout.TenantSpecKey(spec.GlobalTenant)
+		changes[key] = marshalToString(global)
+		if globalKV != nil {
+			revisions[key] = globalKV.ModRevision
+		} else {
+			revisions[key] = 0
+		}
+		return nil
+	})
+}
+
+// deleteTenantSpec deletes the tenant spec in one transaction along with the changes
+// made by handle for the member services, the services registering to the tenant
+// including the ones only listed by the tenant spec. globalKV is the raw global tenant
+// spec, nil if absent. The transaction is retried if the tenant or any service changes.
+func (s *Service) deleteTenantSpec(tenantName string, handle func(members []*spec.Service,
+	globalKV *mvccpb.KeyValue, changes map[string]*string, revisions map[string]int64) error) error {
+
+	tenantKey := layout.TenantSpecKey(tenantName)
+	globalKey := layout.TenantSpecKey(spec.GlobalTenant)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kvs, err := s.store.GetRawMulti([]string{tenantKey, globalKey}, []string{layout.ServiceSpecPrefix()})
+		if err != nil {
+			return err
+		}
+
+		tenantKV := kvs[tenantKey]
+		if tenantKV == nil {
+			return nil
+		}
+		tenant := &spec.Tenant{}
+		if err = spec.Decode(tenantKV.Value, tenant); err != nil {
+			return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", tenantKV.Value, err)
+		}
+
+		changes := map[string]*string{tenantKey: nil}
+		revisions := map[string]int64{tenantKey: tenantKV.ModRevision}
+		members := []*spec.Service{}
+		for k, kv := range kvs {
+			if !strings.HasPrefix(k, layout.ServiceSpecPrefix()) {
+				continue
+			}
+			// NOTE: The registering of new services updates the tenant spec,
+			// and the existing services must not change their tenants meanwhile.
+			revisions[k] = kv.ModRevision
+
+			service := &spec.Service{}
+			if err = spec.Decode(kv.Value, service); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kv, err)
+				continue
+			}
+			if service.RegisterTenant == tenantName || stringtool.StrInSlice(service.Name, tenant.Services) {
+				members = append(members, service)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+
+		if err = handle(members, kvs[globalKey], changes, revisions); err != nil {
+			return err
+		}
+
+		put, err := s.store.CompareAndPutAndDelete(revisions, changes)
+		if err != nil {
+			return err
+		}
+		if !put {
+			continue
+		}
+
+		s.recordEvent(eventKindTenant, tenantName, EventTypeNormal, EventReasonDeleted,
+			fmt.Sprintf("%s %s", EventReasonDeleted, tenantName))
+		return nil
 	}
+
+	return ErrTooManyConflicts
+}
+
+func marshalToString(v interface{}) *string {
+	buff, err := spec.Encode(v)
+	if err != nil {
+		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", v, err))
+	}
+	value := string(buff)
+	return &value
 }
 
 // GetIngressSpec gets the ingress spec
@@ -378,7 +1436,7 @@ func (s *Service) GetIngressSpecWithInfo(ingressName string) (*spec.Ingress, *mv
 	}
 
 	ingress := &spec.Ingress{}
-	err = yaml.Unmarshal(kvs.Value, ingress)
+	err = spec.Decode(kvs.Value, ingress)
 	if err != nil {
 		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kvs.Value), err))
 	}
@@ -386,17 +1444,68 @@ func (s *Service) GetIngressSpecWithInfo(ingressName string) (*spec.Ingress, *mv
 	return ingress, kvs
 }
 
-// PutIngressSpec writes the ingress spec
-func (s *Service) PutIngressSpec(ingressSpec *spec.Ingress) {
-	buff, err := yaml.Marshal(ingressSpec)
+// GetIngressWithBackends gets the ingress spec along with the specs of its backend services
+// keyed by service names, the backends are fetched in one read. The names of the backends
+// not found are returned in the order they are referenced. It returns nil ingress if the
+// ingress is not found.
+func (s *Service) GetIngressWithBackends(ingressName string) (*spec.Ingress, map[string]*spec.Service, []string, error) {
+	kv, err := s.store.GetRaw(layout.IngressSpecKey(ingressName))
 	if err != nil {
-		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", ingressSpec, err))
+		return nil, nil, nil, err
+	}
+	if kv == nil {
+		return nil, nil, nil, nil
+	}
+
+	ingress := &spec.Ingress{}
+	if err = spec.Decode(kv.Value, ingress); err != nil {
+		return nil, nil, nil, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
 	}
 
-	err = s.store.Put(layout.IngressSpecKey(ingressSpec.Name), string(buff))
+	names := []string{}
+	referenced := map[string]bool{}
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			if !referenced[path.Backend] {
+				referenced[path.Backend] = true
+				names = append(names, path.Backend)
+			}
+		}
+	}
+
+	backends := make(map[string]*spec.Service, len(names))
+	if len(names) != 0 {
+		keys := make([]string, len(names))
+		for i, name := range names {
+			keys[i] = layout.ServiceSpecKey(name)
+		}
+		kvs, err := s.store.GetRawMulti(keys, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, service := range decodeServiceSpecs(kvs) {
+			backends[service.Name] = service
+		}
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		if backends[name] == nil {
+			missing = append(missing, name)
+		}
+	}
+
+	return ingress, backends, missing, nil
+}
+
+// PutIngressSpec writes the ingress spec
+func (s *Service) PutIngressSpec(ingressSpec *spec.Ingress) error {
+	buff, err := spec.Encode(ingressSpec)
 	if err != nil {
-		api.ClusterPanic(err)
+		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", ingressSpec, err))
 	}
+
+	return s.putAndRecord(eventKindIngress, ingressSpec.Name, layout.IngressSpecKey(ingressSpec.Name), string(buff))
 }
 
 // ListIngressSpecs lists the ingress specs
@@ -409,7 +1518,7 @@ func (s *Service) ListIngressSpecs() []*spec.Ingress {
 
 	for _, v := range kvs {
 		ingressSpec := &spec.Ingress{}
-		err := yaml.Unmarshal(v.Value, ingressSpec)
+		err := spec.Decode(v.Value, ingressSpec)
 		if err != nil {
 			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
 			continue
@@ -421,11 +1530,8 @@ func (s *Service) ListIngressSpecs() []*spec.Ingress {
 }
 
 // DeleteIngressSpec deletes the ingress spec
-func (s *Service) DeleteIngressSpec(ingressName string) {
-	err := s.store.Delete(layout.IngressSpecKey(ingressName))
-	if err != nil {
-		api.ClusterPanic(err)
-	}
+func (s *Service) DeleteIngressSpec(ingressName string) error {
+	return s.deleteAndRecord(eventKindIngress, ingressName, layout.IngressSpecKey(ingressName))
 }
 
 // ListCustomResourceKinds lists custom resource kinds
@@ -450,11 +1556,52 @@ func (s *Service) ListCustomResourceKinds() []*spec.CustomResourceKind {
 }
 
 // DeleteCustomResourceKind deletes a custom resource kind
-func (s *Service) DeleteCustomResourceKind(kind string) {
-	err := s.store.Delete(layout.CustomResourceKindKey(kind))
+func (s *Service) DeleteCustomResourceKind(kind string) error {
+	return s.deleteAndRecord(eventKindCustomResourceKind, kind, layout.CustomResourceKindKey(kind))
+}
+
+// DeleteCustomResourceKindCascade deletes the custom resource kind along with
+// all its resources in one transaction, it returns the count of deleted resources.
+func (s *Service) DeleteCustomResourceKindCascade(kind string) (int, error) {
+	return s.deleteCustomResourcesByKind(kind, true)
+}
+
+// DeleteCustomResourcesByKind deletes all resources of the kind in one transaction,
+// regardless of their finalizers. It returns the count of deleted resources.
+func (s *Service) DeleteCustomResourcesByKind(kind string) (int, error) {
+	return s.deleteCustomResourcesByKind(kind, false)
+}
+
+func (s *Service) deleteCustomResourcesByKind(kind string, withKind bool) (int, error) {
+	kvs, err := s.store.GetRawPrefix(layout.CustomResourcePrefix(kind))
 	if err != nil {
-		api.ClusterPanic(err)
+		return 0, err
+	}
+
+	deletions := make(map[string]*string, len(kvs)+1)
+	for k := range kvs {
+		deletions[k] = nil
+	}
+	if withKind {
+		deletions[layout.CustomResourceKindKey(kind)] = nil
+	}
+	if len(deletions) == 0 {
+		return 0, nil
 	}
+
+	if err = s.store.PutAndDelete(deletions); err != nil {
+		return 0, err
+	}
+
+	if withKind {
+		s.recordEvent(eventKindCustomResourceKind, kind, EventTypeNormal, EventReasonDeleted,
+			fmt.Sprintf("%s %s with %d resources", EventReasonDeleted, kind, len(kvs)))
+	} else if len(kvs) > 0 {
+		s.recordEvent(eventKindCustomResourceKind, kind, EventTypeNormal, EventReasonDeleted,
+			fmt.Sprintf("%s %d resources of %s", EventReasonDeleted, len(kvs), kind))
+	}
+
+	return len(kvs), nil
 }
 
 // GetCustomResourceKind gets custom resource kind with its name
@@ -478,16 +1625,13 @@ func (s *Service) GetCustomResourceKind(name string) *spec.CustomResourceKind {
 }
 
 // PutCustomResourceKind writes the custom resource kind to storage.
-func (s *Service) PutCustomResourceKind(kind *spec.CustomResourceKind) {
-	buff, err := yaml.Marshal(kind)
+func (s *Service) PutCustomResourceKind(kind *spec.CustomResourceKind) error {
+	buff, err := spec.Encode(kind)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", kind, err))
 	}
 
-	err = s.store.Put(layout.CustomResourceKindKey(kind.Name), string(buff))
-	if err != nil {
-		api.ClusterPanic(err)
-	}
+	return s.putAndRecord(eventKindCustomResourceKind, kind.Name, layout.CustomResourceKindKey(kind.Name), string(buff))
 }
 
 // ListCustomResources lists custom resources of specified kind.
@@ -516,75 +1660,426 @@ func (s *Service) ListCustomResources(kind string) []*spec.CustomResource {
 	return resources
 }
 
-// DeleteCustomResource deletes a custom resource
-func (s *Service) DeleteCustomResource(kind, name string) {
-	err := s.store.Delete(layout.CustomResourceKey(kind, name))
-	if err != nil {
-		api.ClusterPanic(err)
+// ListCustomResourcesSorted lists custom resources of specified kind sorted by the value
+// of the field in sortBy, and truncates them to limit, zero limit means no truncation.
+// Numbers are compared numerically and others by their strings, the resources missing
+// the field are sorted last. Ties are broken by resource names.
+func (s *Service) ListCustomResourcesSorted(kind string, sortBy spec.GJSONPath, limit int) ([]*spec.CustomResource, error) {
+	if err := spec.ValidateGJSONPath(sortBy); err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid limit %d", limit)
 	}
+
+	resources := s.ListCustomResources(kind)
+	fields := make(map[*spec.CustomResource]gjson.Result, len(resources))
+	for _, resource := range resources {
+		buff, err := yaml.Marshal(resource)
+		if err != nil {
+			return nil, fmt.Errorf("BUG: marshal %#v to yaml failed: %v", resource, err)
+		}
+		jsonBytes, err := yamljsontool.YAMLToJSON(buff)
+		if err != nil {
+			return nil, fmt.Errorf("BUG: transform yaml %s to json failed: %v", buff, err)
+		}
+		fields[resource] = gjson.GetBytes(jsonBytes, string(sortBy))
+	}
+
+	sort.SliceStable(resources, func(i, j int) bool {
+		fi, fj := fields[resources[i]], fields[resources[j]]
+		switch {
+		case fi.Exists() != fj.Exists():
+			return fi.Exists()
+		case fi.Type == gjson.Number && fj.Type == gjson.Number && fi.Num != fj.Num:
+			return fi.Num < fj.Num
+		case fi.Type != gjson.Number || fj.Type != gjson.Number:
+			if fi.String() != fj.String() {
+				return fi.String() < fj.String()
+			}
+		}
+		return resources[i].Name() < resources[j].Name()
+	})
+
+	if limit > 0 && len(resources) > limit {
+		resources = resources[:limit]
+	}
+
+	return resources, nil
+}
+
+// fieldPathRegexp matches the dotted path of plain keys, e.g. status.replicas,
+// which is read and written the same way.
+var fieldPathRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// IncrementCustomResourceField increments the numeric field of the custom resource
+// by delta atomically, and returns the new value. fieldPath is a dotted path of plain
+// keys, e.g. status.replicas, a missing field is treated as zero.
+func (s *Service) IncrementCustomResourceField(kind, name, fieldPath string, delta int64) (int64, error) {
+	if !fieldPathRegexp.MatchString(fieldPath) {
+		return 0, fmt.Errorf("invalid field path %s: must be dotted plain keys", fieldPath)
+	}
+
+	key := layout.CustomResourceKey(kind, name)
+	path := strings.Split(fieldPath, ".")
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return 0, err
+		}
+		if kv == nil {
+			return 0, fmt.Errorf("custom resource %s/%s not found", kind, name)
+		}
+
+		jsonBytes, err := yamljsontool.YAMLToJSON(kv.Value)
+		if err != nil {
+			return 0, fmt.Errorf("BUG: transform yaml %s to json failed: %v", kv.Value, err)
+		}
+
+		var value int64
+		field := gjson.GetBytes(jsonBytes, fieldPath)
+		if field.Exists() {
+			if field.Type != gjson.Number {
+				return 0, fmt.Errorf("field %s of custom resource %s/%s is not a number", fieldPath, kind, name)
+			}
+			value = field.Int()
+		}
+		value += delta
+
+		resource := spec.CustomResource{}
+		if err = yaml.Unmarshal(kv.Value, &resource); err != nil {
+			return 0, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+		}
+		if err = setMapField(resource, path, value); err != nil {
+			return 0, fmt.Errorf("set field %s of custom resource %s/%s failed: %v", fieldPath, kind, name, err)
+		}
+
+		buff, err := yaml.Marshal(resource)
+		if err != nil {
+			return 0, fmt.Errorf("BUG: marshal %#v to yaml failed: %v", resource, err)
+		}
+
+		put, err := s.store.CompareAndPut(key, string(buff), kv.ModRevision)
+		if err != nil {
+			return 0, err
+		}
+		if put {
+			return value, nil
+		}
+	}
+
+	return 0, ErrTooManyConflicts
+}
+
+// setMapField sets the field in the path of the map decoded from yaml,
+// the missing intermediate maps are created.
+func setMapField(m map[string]interface{}, path []string, value interface{}) error {
+	var current interface{} = m
+	for i, name := range path {
+		last := i == len(path)-1
+
+		switch v := current.(type) {
+		case map[string]interface{}:
+			if last {
+				v[name] = value
+				return nil
+			}
+			if v[name] == nil {
+				v[name] = map[interface{}]interface{}{}
+			}
+			current = v[name]
+		case map[interface{}]interface{}:
+			if last {
+				v[name] = value
+				return nil
+			}
+			if v[name] == nil {
+				v[name] = map[interface{}]interface{}{}
+			}
+			current = v[name]
+		default:
+			return fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+	}
+
+	return nil
+}
+
+// DeleteCustomResource deletes a custom resource, if finalizers remain,
+// it only sets the deletion timestamp and the resource is deleted when
+// the last finalizer is removed.
+func (s *Service) DeleteCustomResource(kind, name string) error {
+	key := layout.CustomResourceKey(kind, name)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			api.ClusterPanic(err)
+		}
+		if kv == nil {
+			return nil
+		}
+
+		resource := spec.CustomResource{}
+		if err = yaml.Unmarshal(kv.Value, &resource); err != nil {
+			panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kv.Value), err))
+		}
+
+		if len(resource.Finalizers()) == 0 {
+			return s.deleteAndRecord(kind, name, key)
+		}
+		if resource.DeletionTimestamp() != "" {
+			return nil
+		}
+
+		resource.SetDeletionTimestamp(time.Now().Format(time.RFC3339))
+		put, err := s.store.CompareAndPut(key, *marshalToString(resource), kv.ModRevision)
+		if err != nil {
+			return err
+		}
+		if put {
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
+// RemoveCustomResourceFinalizer removes the finalizer from the custom resource,
+// the resource is deleted if it is being deleted and no finalizers remain.
+func (s *Service) RemoveCustomResourceFinalizer(kind, name, finalizer string) error {
+	key := layout.CustomResourceKey(kind, name)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return fmt.Errorf("custom resource %s/%s not found", kind, name)
+		}
+
+		resource := spec.CustomResource{}
+		if err = yaml.Unmarshal(kv.Value, &resource); err != nil {
+			return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+		}
+
+		finalizers := resource.Finalizers()
+		remaining := make([]string, 0, len(finalizers))
+		for _, f := range finalizers {
+			if f != finalizer {
+				remaining = append(remaining, f)
+			}
+		}
+		if len(remaining) == len(finalizers) {
+			return nil
+		}
+
+		if len(remaining) == 0 && resource.DeletionTimestamp() != "" {
+			return s.deleteAndRecord(kind, name, key)
+		}
+
+		resource.SetFinalizers(remaining)
+		put, err := s.store.CompareAndPut(key, *marshalToString(resource), kv.ModRevision)
+		if err != nil {
+			return err
+		}
+		if put {
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
 }
 
 // GetCustomResource gets custom resource with its kind & name
 func (s *Service) GetCustomResource(kind, name string) *spec.CustomResource {
-	kvs, err := s.store.GetRaw(layout.CustomResourceKey(kind, name))
+	resource, _ := s.GetCustomResourceWithInfo(kind, name)
+	return resource
+}
+
+// GetCustomResourceWithInfo gets custom resource with its kind & name, and its raw KeyValue
+func (s *Service) GetCustomResourceWithInfo(kind, name string) (*spec.CustomResource, *mvccpb.KeyValue) {
+	kv, err := s.store.GetRaw(layout.CustomResourceKey(kind, name))
 	if err != nil {
 		api.ClusterPanic(err)
 	}
 
-	if kvs == nil {
-		return nil
+	if kv == nil {
+		return nil, nil
 	}
 
 	resource := &spec.CustomResource{}
-	err = yaml.Unmarshal(kvs.Value, resource)
+	err = yaml.Unmarshal(kv.Value, resource)
 	if err != nil {
-		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kvs.Value), err))
+		panic(fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", string(kv.Value), err))
 	}
 
-	return resource
+	return resource, kv
 }
 
 // PutCustomResource writes the custom resource kind to storage.
-func (s *Service) PutCustomResource(obj *spec.CustomResource) {
+func (s *Service) PutCustomResource(obj *spec.CustomResource) error {
 	buff, err := yaml.Marshal(obj)
 	if err != nil {
 		panic(fmt.Errorf("BUG: marshal %#v to yaml failed: %v", obj, err))
 	}
 
-	err = s.store.Put(layout.CustomResourceKey(obj.Kind(), obj.Name()), string(buff))
+	return s.putAndRecord(obj.Kind(), obj.Name(), layout.CustomResourceKey(obj.Kind(), obj.Name()), string(buff))
+}
+
+// MoveCustomResource renames the custom resource or moves it to another kind,
+// the new one is created and the old one is deleted in one transaction.
+// It returns ErrCustomResourceAlreadyExists if the target exists, and
+// ErrCustomResourceKindNotFound if the target kind is undefined.
+func (s *Service) MoveCustomResource(oldKind, oldName, newKind, newName string) error {
+	if newKind == "" || newName == "" {
+		return fmt.Errorf("kind and name of the target cannot be empty")
+	}
+
+	if layout.CustomResourceKey(oldKind, oldName) == layout.CustomResourceKey(newKind, newName) {
+		return nil
+	}
+
+	for i := 0; i < maxCASRetries; i++ {
+		put, err := s.moveCustomResource(oldKind, oldName, newKind, newName)
+		if err != nil {
+			return err
+		}
+		if !put {
+			continue
+		}
+
+		s.recordEvent(oldKind, oldName, EventTypeNormal, EventReasonDeleted,
+			fmt.Sprintf("moved to %s/%s", newKind, newName))
+		s.recordEvent(newKind, newName, EventTypeNormal, EventReasonCreated,
+			fmt.Sprintf("moved from %s/%s", oldKind, oldName))
+		return nil
+	}
+
+	return ErrTooManyConflicts
+}
+
+// moveCustomResource tries moving the custom resource once, the returning boolean
+// flag is false if any of the keys has been changed meanwhile.
+func (s *Service) moveCustomResource(oldKind, oldName, newKind, newName string) (bool, error) {
+	oldKey := layout.CustomResourceKey(oldKind, oldName)
+	newKey := layout.CustomResourceKey(newKind, newName)
+	kindKey := layout.CustomResourceKindKey(newKind)
+
+	kvs, err := s.store.GetRawMulti([]string{oldKey, newKey, kindKey}, nil)
 	if err != nil {
-		api.ClusterPanic(err)
+		return false, err
+	}
+
+	kv := kvs[oldKey]
+	if kv == nil {
+		return false, fmt.Errorf("custom resource %s/%s not found", oldKind, oldName)
+	}
+	if kvs[newKey] != nil {
+		return false, fmt.Errorf("%w: %s/%s", ErrCustomResourceAlreadyExists, newKind, newName)
+	}
+	if kvs[kindKey] == nil {
+		return false, fmt.Errorf("%w: %s", ErrCustomResourceKindNotFound, newKind)
+	}
+
+	resource := spec.CustomResource{}
+	if err = yaml.Unmarshal(kv.Value, &resource); err != nil {
+		return false, fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
 	}
+	resource["kind"], resource["name"] = newKind, newName
+
+	revisions := map[string]int64{
+		oldKey:  kv.ModRevision,
+		newKey:  0,
+		kindKey: kvs[kindKey].ModRevision,
+	}
+	return s.store.CompareAndPutAndDelete(revisions, map[string]*string{
+		oldKey: nil,
+		newKey: marshalToString(resource),
+	})
 }
 
 // WatchCustomResource watches custom resources of the specified kind
 func (s *Service) WatchCustomResource(ctx context.Context, kind string, onChange func([]*spec.CustomResource)) error {
-	syncer, err := s.store.Syncer()
+	return s.watchRawPrefix(ctx, layout.CustomResourcePrefix(kind), func(m map[string]*mvccpb.KeyValue) {
+		resources := make([]*spec.CustomResource, 0, len(m))
+		for _, v := range m {
+			resource := &spec.CustomResource{}
+			err := yaml.Unmarshal(v.Value, resource)
+			if err == nil {
+				resources = append(resources, resource)
+			}
+		}
+		onChange(resources)
+	})
+}
+
+// WatchServiceInstanceStatuses watches instance statuses of the service,
+// the current statuses are delivered at the beginning.
+func (s *Service) WatchServiceInstanceStatuses(ctx context.Context, serviceName string,
+	onChange func([]*spec.ServiceInstanceStatus)) error {
+	return s.watchRawPrefix(ctx, layout.ServiceInstanceStatusPrefix(serviceName), func(m map[string]*mvccpb.KeyValue) {
+		statuses := make([]*spec.ServiceInstanceStatus, 0, len(m))
+		for k, v := range m {
+			status := &spec.ServiceInstanceStatus{}
+			if err := storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+		onChange(statuses)
+	})
+}
+
+// WatchAllServiceSpecs watches service specs keyed by their names until the context
+// is done, the current specs are delivered at the beginning. Only services registered
+// to tenantFilter are delivered, empty tenantFilter means all services.
+func (s *Service) WatchAllServiceSpecs(ctx context.Context, tenantFilter string,
+	onChange func(map[string]*spec.Service)) error {
+	return s.watchRawPrefix(ctx, layout.ServiceSpecPrefix(), func(m map[string]*mvccpb.KeyValue) {
+		services := make(map[string]*spec.Service, len(m))
+		for _, v := range m {
+			serviceSpec := &spec.Service{}
+			if err := spec.Decode(v.Value, serviceSpec); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				continue
+			}
+			if tenantFilter != "" && serviceSpec.RegisterTenant != tenantFilter {
+				continue
+			}
+			services[serviceSpec.Name] = serviceSpec
+		}
+		onChange(services)
+	})
+}
+
+// watchRawPrefix watches the prefix until the context is done or the service is closed.
+func (s *Service) watchRawPrefix(ctx context.Context, prefix string, onChange func(map[string]*mvccpb.KeyValue)) error {
+	syncer, err := s.newSyncer()
 	if err != nil {
 		return err
 	}
 
-	prefix := layout.CustomResourcePrefix(kind)
 	ch, err := syncer.SyncRawPrefix(prefix)
 	if err != nil {
+		s.closeSyncer(syncer)
 		return err
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			syncer.Close()
+			s.closeSyncer(syncer)
 			return nil
-		case m := <-ch:
-			resources := make([]*spec.CustomResource, 0, len(m))
-			for _, v := range m {
-				resource := &spec.CustomResource{}
-				err = yaml.Unmarshal(v.Value, resource)
-				if err == nil {
-					resources = append(resources, resource)
-				}
+		case m, ok := <-ch:
+			if !ok {
+				// the service has been closed
+				return nil
 			}
-			onChange(resources)
+			onChange(m)
 		}
 	}
 }
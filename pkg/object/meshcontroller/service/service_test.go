@@ -0,0 +1,3817 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/filter/ratelimiter"
+	"github.com/megaease/easegress/pkg/filter/retryer"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+	"github.com/megaease/easegress/pkg/util/urlrule"
+)
+
+// mockStorage is an in-memory storage for testing.
+type mockStorage struct {
+	mutex    sync.Mutex
+	revision int64
+	kvs      map[string]*mvccpb.KeyValue
+	// history is all versions of the keys, the deletions are the ones with nil values.
+	history   map[string][]*mvccpb.KeyValue
+	compacted int64
+	leases    map[int64]*mockLease
+	// lastLeaseID is increased for every new lease, ids are never reused like etcd.
+	lastLeaseID int64
+	closed      bool
+	syncer      *mockSyncer
+}
+
+// mockLease is a lease whose keys are deleted lazily after the deadline.
+type mockLease struct {
+	ttl      time.Duration
+	deadline time.Time
+	keys     []string
+}
+
+// mockSyncer is a syncer whose data is pushed by tests.
+type mockSyncer struct {
+	rawPrefixCh chan map[string]*mvccpb.KeyValue
+	done        chan struct{}
+}
+
+func newMockSyncer() *mockSyncer {
+	return &mockSyncer{
+		rawPrefixCh: make(chan map[string]*mvccpb.KeyValue, 10),
+		done:        make(chan struct{}),
+	}
+}
+
+func (ms *mockSyncer) SetStartRevision(revision int64) {}
+
+func (ms *mockSyncer) SetChannelBuffer(size int) {}
+
+func (ms *mockSyncer) ReestablishedCount() uint64 { return 0 }
+
+func (ms *mockSyncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
+	return nil, fmt.Errorf("sync raw is not supported")
+}
+
+func (ms *mockSyncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
+	return nil, fmt.Errorf("sync prefix is not supported")
+}
+
+func (ms *mockSyncer) SyncPrefixWithRevision(prefix string) (<-chan *cluster.PrefixSnapshot, error) {
+	return nil, fmt.Errorf("sync prefix with revision is not supported")
+}
+
+func (ms *mockSyncer) SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error) {
+	return ms.rawPrefixCh, nil
+}
+
+func (ms *mockSyncer) Close() {
+	close(ms.done)
+}
+
+func newMockStorage() *mockStorage {
+	return &mockStorage{
+		kvs:     make(map[string]*mvccpb.KeyValue),
+		history: make(map[string][]*mvccpb.KeyValue),
+		leases:  make(map[int64]*mockLease),
+	}
+}
+
+func (ms *mockStorage) Lock() error   { return nil }
+func (ms *mockStorage) Unlock() error { return nil }
+
+func (ms *mockStorage) Get(key string) (*string, error) {
+	kv, _ := ms.GetRaw(key)
+	if kv == nil {
+		return nil, nil
+	}
+	value := string(kv.Value)
+	return &value, nil
+}
+
+func (ms *mockStorage) GetPrefix(prefix string) (map[string]string, error) {
+	kvs, _ := ms.GetRawPrefix(prefix)
+	result := make(map[string]string, len(kvs))
+	for k, v := range kvs {
+		result[k] = string(v.Value)
+	}
+	return result, nil
+}
+
+func (ms *mockStorage) expireLeases() {
+	now := time.Now()
+	for id, lease := range ms.leases {
+		if now.After(lease.deadline) {
+			for _, key := range lease.keys {
+				ms.remove(key)
+			}
+			delete(ms.leases, id)
+		}
+	}
+}
+
+func (ms *mockStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.expireLeases()
+	return ms.kvs[key], nil
+}
+
+func (ms *mockStorage) GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if revision < ms.compacted {
+		return nil, storage.ErrCompacted
+	}
+	if revision > ms.revision {
+		return nil, fmt.Errorf("required revision is a future revision")
+	}
+
+	var result *mvccpb.KeyValue
+	for _, kv := range ms.history[key] {
+		if kv.ModRevision > revision {
+			break
+		}
+		result = kv
+	}
+	if result == nil || result.Value == nil {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func (ms *mockStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.expireLeases()
+
+	result := make(map[string]*mvccpb.KeyValue)
+	for k, v := range ms.kvs {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (ms *mockStorage) GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error) {
+	kvs, _, err := ms.GetRawMultiWithRevision(keys, prefixes)
+	return kvs, err
+}
+
+func (ms *mockStorage) GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	result := make(map[string]*mvccpb.KeyValue)
+	for _, key := range keys {
+		if kv := ms.kvs[key]; kv != nil {
+			result[key] = kv
+		}
+	}
+	for k, v := range ms.kvs {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(k, prefix) {
+				result[k] = v
+			}
+		}
+	}
+	return result, ms.revision, nil
+}
+
+func (ms *mockStorage) put(key, value string) {
+	ms.revision++
+	kv := &mvccpb.KeyValue{
+		Key:         []byte(key),
+		Value:       []byte(value),
+		ModRevision: ms.revision,
+	}
+	if old := ms.kvs[key]; old != nil {
+		kv.CreateRevision = old.CreateRevision
+		kv.Version = old.Version + 1
+	} else {
+		kv.CreateRevision = ms.revision
+		kv.Version = 1
+	}
+	ms.kvs[key] = kv
+	ms.history[key] = append(ms.history[key], kv)
+}
+
+func (ms *mockStorage) remove(key string) {
+	if ms.kvs[key] == nil {
+		return
+	}
+	ms.revision++
+	delete(ms.kvs, key)
+	ms.history[key] = append(ms.history[key], &mvccpb.KeyValue{Key: []byte(key), ModRevision: ms.revision})
+}
+
+// compact discards the history before the revision like etcd.
+func (ms *mockStorage) compact(revision int64) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.compacted = revision
+}
+
+func (ms *mockStorage) Put(key, value string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.put(key, value)
+	return nil
+}
+
+func (ms *mockStorage) CompareAndPut(key, value string, modRevision int64) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var current int64
+	if kv := ms.kvs[key]; kv != nil {
+		current = kv.ModRevision
+	}
+	if current != modRevision {
+		return false, nil
+	}
+	ms.put(key, value)
+	return true, nil
+}
+
+func (ms *mockStorage) PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.expireLeases()
+
+	if ms.kvs[key] != nil {
+		return 0, nil
+	}
+	ms.put(key, value)
+
+	ms.lastLeaseID++
+	id := ms.lastLeaseID
+	ms.leases[id] = &mockLease{ttl: ttl, deadline: time.Now().Add(ttl), keys: []string{key}}
+	return id, nil
+}
+
+func (ms *mockStorage) KeepAliveLeaseOnce(leaseID int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.expireLeases()
+
+	lease := ms.leases[leaseID]
+	if lease == nil {
+		return fmt.Errorf("lease %d not found", leaseID)
+	}
+	lease.deadline = time.Now().Add(lease.ttl)
+	return nil
+}
+
+func (ms *mockStorage) RevokeLease(leaseID int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if lease := ms.leases[leaseID]; lease != nil {
+		for _, key := range lease.keys {
+			ms.remove(key)
+		}
+		delete(ms.leases, leaseID)
+	}
+	return nil
+}
+
+func (ms *mockStorage) PutUnderLease(key, value string) error {
+	return ms.Put(key, value)
+}
+
+func (ms *mockStorage) PutAndDelete(kvs map[string]*string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for k, v := range kvs {
+		if v == nil {
+			ms.remove(k)
+		} else {
+			ms.put(k, *v)
+		}
+	}
+	return nil
+}
+
+func (ms *mockStorage) CompareAndPutAndDelete(revisions map[string]int64, kvs map[string]*string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for key, revision := range revisions {
+		var current int64
+		if kv := ms.kvs[key]; kv != nil {
+			current = kv.ModRevision
+		}
+		if current != revision {
+			return false, nil
+		}
+	}
+	for k, v := range kvs {
+		if v == nil {
+			ms.remove(k)
+		} else {
+			ms.put(k, *v)
+		}
+	}
+	return true, nil
+}
+
+func (ms *mockStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	return ms.PutAndDelete(kvs)
+}
+
+func (ms *mockStorage) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.remove(key)
+	return nil
+}
+
+func (ms *mockStorage) GetAndDelete(key string) (*string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	kv := ms.kvs[key]
+	if kv == nil {
+		return nil, nil
+	}
+	ms.remove(key)
+	value := string(kv.Value)
+	return &value, nil
+}
+
+func (ms *mockStorage) DeletePrefix(prefix string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for k := range ms.kvs {
+		if strings.HasPrefix(k, prefix) {
+			ms.remove(k)
+		}
+	}
+	return nil
+}
+
+func (ms *mockStorage) Syncer() (storage.Syncer, error) {
+	if ms.syncer == nil {
+		return nil, fmt.Errorf("syncer is not supported")
+	}
+	return ms.syncer, nil
+}
+
+func (ms *mockStorage) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.closed = true
+	return nil
+}
+
+func newTestService() (*Service, *mockStorage) {
+	store := newMockStorage()
+	s := &Service{
+		spec:    &spec.Admin{},
+		syncers: make(map[storage.Syncer]struct{}),
+	}
+	s.store = newReadOnlyGuard(s, store)
+	return s, store
+}
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	os.Exit(m.Run())
+}
+
+func TestDrainServiceInMaintenance(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order",
+		InstanceID:  "ins-1",
+		Status:      spec.ServiceStatusUp,
+	})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName:      "order",
+		InstanceID:       "ins-2",
+		Status:           spec.ServiceStatusUp,
+		MaintenanceUntil: time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+
+	if err := s.DrainService("order"); err != nil {
+		t.Fatalf("drain service failed: %v", err)
+	}
+
+	if instance := s.GetServiceInstanceSpec("order", "ins-1"); !instance.Drained ||
+		instance.Status != spec.ServiceStatusOutOfService {
+		t.Errorf("instance ins-1 should be drained: %#v", instance)
+	}
+	if instance := s.GetServiceInstanceSpec("order", "ins-2"); instance.Drained ||
+		instance.Status != spec.ServiceStatusUp {
+		t.Errorf("instance ins-2 in maintenance should be untouched: %#v", instance)
+	}
+}
+
+func TestDrainService(t *testing.T) {
+	s, store := newTestService()
+
+	for _, id := range []string{"ins-1", "ins-2"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName: "order",
+			InstanceID:  id,
+			IP:          "127.0.0.1",
+			Port:        8080,
+			Labels:      map[string]string{"version": "v1"},
+			Status:      spec.ServiceStatusUp,
+		})
+	}
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "delivery",
+		InstanceID:  "ins-1",
+		Status:      spec.ServiceStatusUp,
+	})
+
+	if err := s.DrainService("order"); err != nil {
+		t.Fatalf("drain service failed: %v", err)
+	}
+
+	for _, instance := range s.ListServiceInstanceSpecs("order") {
+		if instance.Status != spec.ServiceStatusOutOfService {
+			t.Errorf("instance %s should be drained", instance.InstanceID)
+		}
+		if instance.IP != "127.0.0.1" || instance.Port != 8080 || instance.Labels["version"] != "v1" {
+			t.Errorf("fields of instance %s should be untouched: %#v", instance.InstanceID, instance)
+		}
+	}
+
+	value, _ := store.Get(layout.ServiceInstanceSpecKey("delivery", "ins-1"))
+	other := &spec.ServiceInstanceSpec{}
+	yaml.Unmarshal([]byte(*value), other)
+	if other.Status != spec.ServiceStatusUp {
+		t.Errorf("instance of other service should not be drained")
+	}
+
+	for _, instance := range s.ListServiceInstanceSpecs("order") {
+		if !instance.Drained {
+			t.Errorf("instance %s should be marked drained", instance.InstanceID)
+		}
+	}
+
+	// ins-1 is healthy, ins-2 is stale, and ins-3 is out of service for other reasons.
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order",
+		InstanceID:  "ins-3",
+		Status:      spec.ServiceStatusOutOfService,
+	})
+	for id, heartbeat := range map[string]time.Time{
+		"ins-1": time.Now(),
+		"ins-2": time.Now().Add(-time.Hour),
+		"ins-3": time.Now(),
+	} {
+		status := &spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: id, LastHeartbeatTime: heartbeat.Format(time.RFC3339)}
+		store.Put(layout.ServiceInstanceStatusKey("order", id), *marshalToString(status))
+	}
+
+	if err := s.UndrainService("order"); err != nil {
+		t.Fatalf("undrain service failed: %v", err)
+	}
+	expected := map[string]string{
+		"ins-1": spec.ServiceStatusUp,
+		"ins-2": spec.ServiceStatusOutOfService,
+		"ins-3": spec.ServiceStatusOutOfService,
+	}
+	for _, instance := range s.ListServiceInstanceSpecs("order") {
+		if instance.Drained {
+			t.Errorf("drained mark of instance %s should be cleared", instance.InstanceID)
+		}
+		if instance.Status != expected[instance.InstanceID] {
+			t.Errorf("expect instance %s %s after undrain, got %s", instance.InstanceID,
+				expected[instance.InstanceID], instance.Status)
+		}
+	}
+}
+
+func TestServiceClose(t *testing.T) {
+	s, store := newTestService()
+
+	var closer io.Closer = s
+	if err := closer.Close(); err != nil {
+		t.Fatalf("close service failed: %v", err)
+	}
+	if !store.closed {
+		t.Errorf("store should be closed")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("close service twice failed: %v", err)
+	}
+
+	err := s.WatchCustomResource(context.Background(), "kind", func([]*spec.CustomResource) {})
+	if err == nil {
+		t.Errorf("watch should fail after closing")
+	}
+}
+
+func TestWatchServiceInstanceStatuses(t *testing.T) {
+	s, store := newTestService()
+	store.syncer = newMockSyncer()
+
+	status := &spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: "ins-1"}
+	buff, _ := yaml.Marshal(status)
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.ServiceInstanceStatusKey("order", "ins-1"): {Value: buff},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan []*spec.ServiceInstanceStatus, 10)
+	done := make(chan error)
+	go func() {
+		done <- s.WatchServiceInstanceStatuses(ctx, "order", func(statuses []*spec.ServiceInstanceStatus) {
+			received <- statuses
+		})
+	}()
+
+	select {
+	case statuses := <-received:
+		if len(statuses) != 1 || statuses[0].InstanceID != "ins-1" {
+			t.Errorf("unexpected statuses: %v", statuses)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("statuses should be delivered")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch should stop after canceling")
+	}
+
+	select {
+	case <-store.syncer.done:
+	default:
+		t.Errorf("syncer should be closed after canceling")
+	}
+}
+
+func TestWatchAllServiceSpecs(t *testing.T) {
+	s, store := newTestService()
+	store.syncer = newMockSyncer()
+
+	kvs := func(services ...*spec.Service) map[string]*mvccpb.KeyValue {
+		m := map[string]*mvccpb.KeyValue{}
+		for _, service := range services {
+			buff, _ := yaml.Marshal(service)
+			m[layout.ServiceSpecKey(service.Name)] = &mvccpb.KeyValue{Value: buff}
+		}
+		return m
+	}
+	store.syncer.rawPrefixCh <- kvs(
+		&spec.Service{Name: "order", RegisterTenant: "shop"},
+		&spec.Service{Name: "gateway", RegisterTenant: spec.GlobalTenant},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan map[string]*spec.Service, 10)
+	done := make(chan error)
+	go func() {
+		done <- s.WatchAllServiceSpecs(ctx, "shop", func(services map[string]*spec.Service) {
+			received <- services
+		})
+	}()
+
+	expect := func(names ...string) {
+		select {
+		case services := <-received:
+			if len(services) != len(names) {
+				t.Fatalf("expect services %v, got %v", names, services)
+			}
+			for _, name := range names {
+				if services[name] == nil {
+					t.Errorf("expect services %v, got %v", names, services)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("services should be delivered")
+		}
+	}
+
+	expect("order")
+	store.syncer.rawPrefixCh <- kvs(
+		&spec.Service{Name: "order", RegisterTenant: "shop"},
+		&spec.Service{Name: "delivery", RegisterTenant: "shop"},
+		&spec.Service{Name: "gateway", RegisterTenant: spec.GlobalTenant},
+	)
+	expect("order", "delivery")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch should stop after canceling")
+	}
+
+	store.syncer.rawPrefixCh <- kvs(&spec.Service{Name: "payment", RegisterTenant: "shop"})
+	select {
+	case services := <-received:
+		t.Errorf("nothing should be delivered after canceling, got %v", services)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIncrementCustomResourceField(t *testing.T) {
+	s, _ := newTestService()
+	s.PutCustomResource(&spec.CustomResource{
+		"kind": "deployment",
+		"name": "order",
+		"status": map[string]interface{}{
+			"generation": 1,
+		},
+	})
+
+	const workers, times = 8, 20
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				for {
+					_, err := s.IncrementCustomResourceField("deployment", "order", "status.generation", 2)
+					if err == nil {
+						break
+					}
+					if err != ErrTooManyConflicts {
+						t.Errorf("increment failed: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := s.IncrementCustomResourceField("deployment", "order", "status.generation", 0)
+	if err != nil {
+		t.Fatalf("increment failed: %v", err)
+	}
+	if expected := int64(1 + workers*times*2); value != expected {
+		t.Errorf("generation should be %d, got %d", expected, value)
+	}
+
+	// missing field is treated as zero.
+	value, err = s.IncrementCustomResourceField("deployment", "order", "status.replicas", 3)
+	if err != nil || value != 3 {
+		t.Errorf("increment missing field should get 3, got %d, %v", value, err)
+	}
+
+	if _, err = s.IncrementCustomResourceField("deployment", "order", "name", 1); err == nil {
+		t.Errorf("increment non-numeric field should fail")
+	}
+
+	// GJSON syntax can't be written back to the same field.
+	for _, path := range []string{"status.gen*", "status|generation", "status.#", `status\.generation`, "", "status..generation"} {
+		if _, err = s.IncrementCustomResourceField("deployment", "order", path, 1); err == nil {
+			t.Errorf("increment field %q should fail", path)
+		}
+	}
+}
+
+func TestSelectInstances(t *testing.T) {
+	s, _ := newTestService()
+
+	instances := []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "ins-1", Labels: map[string]string{"cohort": "canary", "zone": "a"}},
+		{ServiceName: "order", InstanceID: "ins-2", Labels: map[string]string{"cohort": "stable", "zone": "a"}},
+		{ServiceName: "delivery", InstanceID: "ins-1", Labels: map[string]string{"cohort": "canary", "zone": "b"}},
+		{ServiceName: "delivery", InstanceID: "ins-2"},
+	}
+	for _, instance := range instances {
+		s.PutServiceInstanceSpec(instance)
+	}
+
+	ids := func(specs []*spec.ServiceInstanceSpec) map[string]bool {
+		result := map[string]bool{}
+		for _, instance := range specs {
+			result[instance.ServiceName+"/"+instance.InstanceID] = true
+		}
+		return result
+	}
+
+	got := ids(s.SelectInstances(map[string]string{"cohort": "canary"}))
+	if len(got) != 2 || !got["order/ins-1"] || !got["delivery/ins-1"] {
+		t.Errorf("unexpected canary instances: %v", got)
+	}
+
+	got = ids(s.SelectInstances(map[string]string{"cohort": "canary", "zone": "a"}))
+	if len(got) != 1 || !got["order/ins-1"] {
+		t.Errorf("unexpected canary instances in zone a: %v", got)
+	}
+
+	if got = ids(s.SelectInstances(map[string]string{"cohort": "none"})); len(got) != 0 {
+		t.Errorf("no instances should match: %v", got)
+	}
+
+	if got = ids(s.SelectInstances(nil)); len(got) != len(instances) {
+		t.Errorf("empty selector should match all instances: %v", got)
+	}
+}
+
+func TestListLiveServiceInstanceSpecs(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery"})
+	for _, instance := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "ins-1"},
+		{ServiceName: "order", InstanceID: "ins-2"},
+		{ServiceName: "delivery", InstanceID: "ins-1"},
+		// orphan instances of services without specs.
+		{ServiceName: "payment", InstanceID: "ins-1"},
+		{ServiceName: "order-v2", InstanceID: "ins-1"},
+	} {
+		s.PutServiceInstanceSpec(instance)
+	}
+	s.DeleteServiceSpec("delivery")
+
+	if got := len(s.ListAllServiceInstanceSpecs()); got != 5 {
+		t.Errorf("expect all 5 instances including orphans, got %d", got)
+	}
+
+	got := map[string]bool{}
+	for _, instance := range s.ListLiveServiceInstanceSpecs() {
+		got[instance.ServiceName+"/"+instance.InstanceID] = true
+	}
+	if len(got) != 2 || !got["order/ins-1"] || !got["order/ins-2"] {
+		t.Errorf("expect only live instances of order, got %v", got)
+	}
+}
+
+func TestDeleteTenantSpec(t *testing.T) {
+	s, store := newTestService()
+
+	s.PutTenantSpec(&spec.Tenant{Name: spec.GlobalTenant, Services: []string{"gateway"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"order", "delivery"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "empty"})
+	s.PutServiceSpec(&spec.Service{Name: "gateway", RegisterTenant: spec.GlobalTenant})
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "shop"})
+
+	if err := s.DeleteTenantSpec("shop"); err != ErrTenantHasServices {
+		t.Errorf("deleting tenant with services should be blocked, got: %v", err)
+	}
+	if s.GetTenantSpec("shop") == nil {
+		t.Fatalf("tenant with services should not be deleted")
+	}
+
+	if err := s.DeleteTenantSpec("empty"); err != nil {
+		t.Errorf("delete empty tenant failed: %v", err)
+	}
+	if s.GetTenantSpec("empty") != nil {
+		t.Errorf("empty tenant should be deleted")
+	}
+
+	if err := s.DeleteTenantSpecForce("shop", TenantDeletionReassign); err != nil {
+		t.Fatalf("force delete tenant failed: %v", err)
+	}
+	if s.GetTenantSpec("shop") != nil {
+		t.Errorf("tenant should be deleted")
+	}
+	for _, name := range []string{"order", "delivery"} {
+		if service := s.GetServiceSpec(name); service == nil || service.RegisterTenant != spec.GlobalTenant {
+			t.Errorf("service %s should be reassigned to the global tenant: %+v", name, service)
+		}
+	}
+	global := s.GetTenantSpec(spec.GlobalTenant)
+	if len(global.Services) != 3 {
+		t.Errorf("global tenant should have 3 services, got %v", global.Services)
+	}
+
+	s.PutTenantSpec(&spec.Tenant{Name: "temp", Services: []string{"temp-service"}})
+	s.PutServiceSpec(&spec.Service{Name: "temp-service", RegisterTenant: "temp"})
+	if err := s.DeleteTenantSpecForce("temp", TenantDeletionDeleteServices); err != nil {
+		t.Fatalf("force delete tenant failed: %v", err)
+	}
+	if s.GetTenantSpec("temp") != nil || s.GetServiceSpec("temp-service") != nil {
+		t.Errorf("tenant and its services should be deleted")
+	}
+	if value, _ := store.Get(layout.ServiceSpecKey("order")); value == nil {
+		t.Errorf("services of other tenants should not be deleted")
+	}
+}
+
+func TestDeleteTenantSpecRacing(t *testing.T) {
+	s, store := newTestService()
+	racing := &racingStorage{mockStorage: store}
+	s.store = newReadOnlyGuard(s, racing)
+
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{}})
+
+	// a service registers to the tenant between the check and the deletion.
+	racing.beforeWrite = func() {
+		s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+		s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"order"}})
+	}
+	if err := s.DeleteTenantSpec("shop"); err != ErrTenantHasServices {
+		t.Errorf("deleting tenant with services should be blocked, got: %v", err)
+	}
+	if s.GetTenantSpec("shop") == nil {
+		t.Fatalf("tenant with services should not be deleted")
+	}
+
+	// the global tenant is edited concurrently while reassigning.
+	s.PutTenantSpec(&spec.Tenant{Name: spec.GlobalTenant, Services: []string{}})
+	racing.beforeWrite = func() {
+		s.PutTenantSpec(&spec.Tenant{Name: spec.GlobalTenant, Services: []string{"gateway"}})
+	}
+	if err := s.DeleteTenantSpecForce("shop", TenantDeletionReassign); err != nil {
+		t.Fatalf("force delete tenant failed: %v", err)
+	}
+	global := s.GetTenantSpec(spec.GlobalTenant)
+	if expected := []string{"gateway", "order"}; !reflect.DeepEqual(global.Services, expected) {
+		t.Errorf("expect global services %v, got %v", expected, global.Services)
+	}
+	if service := s.GetServiceSpec("order"); service.RegisterTenant != spec.GlobalTenant {
+		t.Errorf("service should be reassigned to the global tenant: %+v", service)
+	}
+}
+
+func TestGetTenantSpecWithDefaults(t *testing.T) {
+	s, _ := newTestService()
+
+	if s.GetTenantSpec(spec.GlobalTenant) != nil {
+		t.Fatalf("global tenant should not exist in a fresh store")
+	}
+	global := s.GetTenantSpecWithDefaults(spec.GlobalTenant)
+	if global == nil || global.Name != spec.GlobalTenant || len(global.Services) != 0 {
+		t.Errorf("expect an empty global tenant, got %+v", global)
+	}
+	if s.GetTenantSpecWithDefaults("shop") != nil {
+		t.Errorf("only the global tenant should be synthesized")
+	}
+
+	s.PutTenantSpec(&spec.Tenant{Name: spec.GlobalTenant, Services: []string{"gateway"}})
+	global = s.GetTenantSpecWithDefaults(spec.GlobalTenant)
+	if len(global.Services) != 1 || global.Services[0] != "gateway" {
+		t.Errorf("expect the stored global tenant, got %+v", global)
+	}
+}
+
+func TestListServiceSpecsWithRevision(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery"})
+
+	services, revision := s.ListServiceSpecsWithRevision()
+	if len(services) != 2 || revision == 0 {
+		t.Fatalf("unexpected services %v and revision %d", services, revision)
+	}
+
+	if _, r := s.ListServiceSpecsWithRevision(); r != revision {
+		t.Errorf("revision should be stable without writes, got %d and %d", revision, r)
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	if _, r := s.ListServiceSpecsWithRevision(); r <= revision {
+		t.Errorf("revision should increase after a write, got %d and %d", revision, r)
+	}
+}
+
+func TestImportServiceSpecs(t *testing.T) {
+	newService := func() *Service {
+		s, _ := newTestService()
+		s.PutTenantSpec(&spec.Tenant{Name: "old", Services: []string{"order", "delivery"}})
+		s.PutTenantSpec(&spec.Tenant{Name: "new", Services: []string{}})
+		s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "old"})
+		s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "old"})
+		return s
+	}
+	specs := []*spec.Service{
+		{Name: "order", RegisterTenant: "new"},
+		{Name: "payment", RegisterTenant: "new"},
+	}
+
+	s := newService()
+	report, err := s.ImportServiceSpecs(specs, ConflictSkip)
+	if err != nil {
+		t.Fatalf("import with skip failed: %v", err)
+	}
+	want := &ImportReport{Created: []string{"payment"}, Skipped: []string{"order"}, Overwritten: []string{}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("want report %+v, got %+v", want, report)
+	}
+	if tenant := s.GetServiceSpec("order").RegisterTenant; tenant != "old" {
+		t.Errorf("skipped service should be kept, got tenant %s", tenant)
+	}
+	if s.GetServiceSpec("payment") == nil {
+		t.Errorf("service payment should be created")
+	}
+	if services := s.GetTenantSpec("new").Services; !reflect.DeepEqual(services, []string{"payment"}) {
+		t.Errorf("created service should join its tenant, got %v", services)
+	}
+
+	s = newService()
+	report, err = s.ImportServiceSpecs(specs, ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("import with overwrite failed: %v", err)
+	}
+	want = &ImportReport{Created: []string{"payment"}, Skipped: []string{}, Overwritten: []string{"order"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("want report %+v, got %+v", want, report)
+	}
+	if tenant := s.GetServiceSpec("order").RegisterTenant; tenant != "new" {
+		t.Errorf("service order should be overwritten, got tenant %s", tenant)
+	}
+	if tenant := s.GetServiceSpec("delivery").RegisterTenant; tenant != "old" {
+		t.Errorf("service delivery should be untouched, got tenant %s", tenant)
+	}
+	if services := s.GetTenantSpec("old").Services; !reflect.DeepEqual(services, []string{"delivery"}) {
+		t.Errorf("overwritten service should leave its old tenant, got %v", services)
+	}
+	if services := s.GetTenantSpec("new").Services; !reflect.DeepEqual(services, []string{"order", "payment"}) {
+		t.Errorf("overwritten service should join its new tenant, got %v", services)
+	}
+
+	s = newService()
+	_, err = s.ImportServiceSpecs(specs, ConflictFail)
+	if !errors.Is(err, ErrServiceAlreadyExists) {
+		t.Fatalf("want ErrServiceAlreadyExists, got %v", err)
+	}
+	if s.GetServiceSpec("payment") != nil {
+		t.Errorf("nothing should be written on failure")
+	}
+
+	_, err = s.ImportServiceSpecs(append(specs[1:], specs[1]), ConflictOverwrite)
+	if err == nil {
+		t.Errorf("duplicated services should fail")
+	}
+
+	_, err = s.ImportServiceSpecs([]*spec.Service{{Name: "payment", RegisterTenant: "missing"}}, ConflictFail)
+	if !errors.Is(err, ErrTenantNotFound) {
+		t.Errorf("want ErrTenantNotFound, got %v", err)
+	}
+	if s.GetServiceSpec("payment") != nil {
+		t.Errorf("service of missing tenant should not be written")
+	}
+}
+
+type countingReconciler struct {
+	mutex          sync.Mutex
+	calls          map[string]int
+	failures       map[string]int
+	deletes        map[string]int
+	deleteFailures map[string]int
+}
+
+func (r *countingReconciler) Reconcile(cr *spec.CustomResource) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name := cr.Name()
+	r.calls[name]++
+	if r.calls[name] <= r.failures[name] {
+		return fmt.Errorf("reconcile %s failed", name)
+	}
+	return nil
+}
+
+func (r *countingReconciler) Delete(cr *spec.CustomResource) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name := cr.Name()
+	r.deletes[name]++
+	if r.deletes[name] <= r.deleteFailures[name] {
+		return fmt.Errorf("delete %s failed", name)
+	}
+	return nil
+}
+
+func (r *countingReconciler) callsOf(name string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.calls[name]
+}
+
+func (r *countingReconciler) deletesOf(name string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.deletes[name]
+}
+
+func TestRunCustomResourceController(t *testing.T) {
+	oldDelay := reconcileBaseDelay
+	reconcileBaseDelay = 10 * time.Millisecond
+	defer func() { reconcileBaseDelay = oldDelay }()
+
+	s, store := newTestService()
+	store.syncer = newMockSyncer()
+
+	kv := func(name string, revision int64) *mvccpb.KeyValue {
+		buff, _ := yaml.Marshal(&spec.CustomResource{"kind": "deployment", "name": name})
+		return &mvccpb.KeyValue{Value: buff, ModRevision: revision}
+	}
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.CustomResourceKey("deployment", "good"): kv("good", 1),
+		layout.CustomResourceKey("deployment", "bad"):  kv("bad", 2),
+	}
+
+	reconciler := &countingReconciler{
+		calls:          map[string]int{},
+		failures:       map[string]int{"bad": 2},
+		deletes:        map[string]int{},
+		deleteFailures: map[string]int{"good": 1},
+	}
+	recorder := &mockRecorder{}
+	s.SetEventRecorder(recorder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.RunCustomResourceController(ctx, "deployment", reconciler)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for reconciler.callsOf("bad") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failing reconcile should be retried, got %d calls", reconciler.callsOf("bad"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// unchanged resources are not reconciled again.
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.CustomResourceKey("deployment", "good"): kv("good", 1),
+		layout.CustomResourceKey("deployment", "bad"):  kv("bad", 2),
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if calls := reconciler.callsOf("bad"); calls != 3 {
+		t.Errorf("reconcile should stop retrying after success, got %d calls", calls)
+	}
+	if calls := reconciler.callsOf("good"); calls != 1 {
+		t.Errorf("succeeding reconcile should not be retried, got %d calls", calls)
+	}
+	for _, e := range recorder.list() {
+		if e != "deployment/bad Warning ReconcileFailed" {
+			t.Errorf("unexpected event %s", e)
+		}
+	}
+	if n := len(recorder.list()); n != 2 {
+		t.Errorf("want 2 reconcile failed events, got %d", n)
+	}
+
+	// deleted resources are cleaned up, and retried on failure.
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.CustomResourceKey("deployment", "bad"): kv("bad", 2),
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for reconciler.deletesOf("good") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failing delete should be retried, got %d calls", reconciler.deletesOf("good"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if deletes := reconciler.deletesOf("good"); deletes != 2 {
+		t.Errorf("delete should stop retrying after success, got %d calls", deletes)
+	}
+	if deletes := reconciler.deletesOf("bad"); deletes != 0 {
+		t.Errorf("existing resource should not be deleted, got %d calls", deletes)
+	}
+	if calls := reconciler.callsOf("good"); calls != 1 {
+		t.Errorf("deleted resource should not be reconciled, got %d calls", calls)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("controller failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("controller should stop after canceling")
+	}
+}
+
+// reconcileOnlyReconciler implements Reconciler only, without Deleter.
+type reconcileOnlyReconciler struct {
+	reconciled chan string
+}
+
+func (r *reconcileOnlyReconciler) Reconcile(cr *spec.CustomResource) error {
+	r.reconciled <- cr.Name()
+	return nil
+}
+
+func TestRunCustomResourceControllerWithoutDeleter(t *testing.T) {
+	s, store := newTestService()
+	store.syncer = newMockSyncer()
+
+	kv := func(name string, revision int64) *mvccpb.KeyValue {
+		buff, _ := yaml.Marshal(&spec.CustomResource{"kind": "deployment", "name": name})
+		return &mvccpb.KeyValue{Value: buff, ModRevision: revision}
+	}
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.CustomResourceKey("deployment", "a"): kv("a", 1),
+	}
+
+	reconciler := &reconcileOnlyReconciler{reconciled: make(chan string, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.RunCustomResourceController(ctx, "deployment", reconciler)
+	}()
+
+	select {
+	case name := <-reconciler.reconciled:
+		if name != "a" {
+			t.Errorf("expect resource a reconciled, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resource should be reconciled")
+	}
+
+	// the deletions are skipped without Deleter.
+	store.syncer.rawPrefixCh <- map[string]*mvccpb.KeyValue{
+		layout.CustomResourceKey("deployment", "b"): kv("b", 2),
+	}
+	select {
+	case name := <-reconciler.reconciled:
+		if name != "b" {
+			t.Errorf("expect resource b reconciled, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resource should be reconciled")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("controller failed: %v", err)
+	}
+}
+
+type mockRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *mockRecorder) Event(kind, name, eventType, reason, message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, fmt.Sprintf("%s/%s %s %s", kind, name, eventType, reason))
+}
+
+func (r *mockRecorder) list() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.events...)
+}
+
+func TestEventRecorder(t *testing.T) {
+	s, _ := newTestService()
+
+	// no events are recorded without recorder.
+	s.PutServiceSpec(&spec.Service{Name: "order"})
+
+	recorder := &mockRecorder{}
+	s.SetEventRecorder(recorder)
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutTenantSpec(&spec.Tenant{Name: "shop"})
+	s.DeleteServiceSpec("order")
+
+	want := []string{
+		"Service/order Normal Updated",
+		"Tenant/shop Normal Created",
+		"Service/order Normal Deleted",
+	}
+	if got := recorder.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want events %v, got %v", want, got)
+	}
+}
+
+func TestGetServiceInstanceSpecWithInfo(t *testing.T) {
+	s, store := newTestService()
+
+	if instance, kv := s.GetServiceInstanceSpecWithInfo("order", "ins-1"); instance != nil || kv != nil {
+		t.Errorf("missing instance should return nil")
+	}
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1", Port: 8080})
+	instance, kv := s.GetServiceInstanceSpecWithInfo("order", "ins-1")
+	if instance == nil || instance.Port != 8080 || kv == nil {
+		t.Fatalf("unexpected instance %+v and kv %v", instance, kv)
+	}
+
+	raw, _ := store.GetRaw(layout.ServiceInstanceSpecKey("order", "ins-1"))
+	if kv.ModRevision != raw.ModRevision {
+		t.Errorf("revision should be %d, got %d", raw.ModRevision, kv.ModRevision)
+	}
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1", Port: 8081})
+	_, kv2 := s.GetServiceInstanceSpecWithInfo("order", "ins-1")
+	if kv2.ModRevision <= kv.ModRevision {
+		t.Errorf("revision should increase after a write, got %d and %d", kv.ModRevision, kv2.ModRevision)
+	}
+}
+
+func TestGetServiceDetail(t *testing.T) {
+	s, store := newTestService()
+
+	if detail, err := s.GetServiceDetail("order"); detail != nil || err != nil {
+		t.Errorf("missing service should return nil, got %v, %v", detail, err)
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "v0"})
+	s.PutServiceSpec(&spec.Service{Name: "order-v2"})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1"})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order-v2", InstanceID: "ins-1"})
+	store.Put(layout.ServiceInstanceStatusKey("order", "ins-1"),
+		*marshalToString(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: "ins-1"}))
+	s.PutIngressSpec(&spec.Ingress{Name: "front", Rules: []*spec.IngressRule{
+		{Paths: []*spec.IngressPath{{Path: "/order", Backend: "order"}}},
+	}})
+	s.PutIngressSpec(&spec.Ingress{Name: "other", Rules: []*spec.IngressRule{
+		{Paths: []*spec.IngressPath{{Path: "/order-v2", Backend: "order-v2"}}},
+	}})
+
+	detail, err := s.GetServiceDetail("order")
+	if err != nil {
+		t.Fatalf("get service detail failed: %v", err)
+	}
+	if detail.Spec.Name != "order" || len(detail.Instances) != 1 || len(detail.Statuses) != 1 {
+		t.Errorf("unexpected service detail: %+v", detail)
+	}
+	if len(detail.Ingresses) != 1 || detail.Ingresses[0].Name != "front" {
+		t.Errorf("unexpected ingresses: %v", detail.Ingresses)
+	}
+
+	// the spec and instances are always read at the same point in time.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 100; i++ {
+			version := fmt.Sprintf("v%d", i)
+			service := marshalToString(&spec.Service{Name: "order", RegisterTenant: version})
+			instance := marshalToString(&spec.ServiceInstanceSpec{
+				ServiceName: "order",
+				InstanceID:  "ins-1",
+				Labels:      map[string]string{"version": version},
+			})
+			store.PutAndDelete(map[string]*string{
+				layout.ServiceSpecKey("order"):                  service,
+				layout.ServiceInstanceSpecKey("order", "ins-1"): instance,
+			})
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		detail, err := s.GetServiceDetail("order")
+		if err != nil {
+			t.Fatalf("get service detail failed: %v", err)
+		}
+		version := detail.Instances[0].Labels["version"]
+		if version != "" && version != detail.Spec.RegisterTenant {
+			t.Fatalf("inconsistent detail: spec %s, instance %s", detail.Spec.RegisterTenant, version)
+		}
+	}
+}
+
+func TestRegisterServiceInstanceWithLease(t *testing.T) {
+	s, _ := newTestService()
+
+	instance := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1", Port: 8080}
+	leaseID, err := s.RegisterServiceInstanceWithLease(instance, 100*time.Millisecond)
+	if err != nil || leaseID == 0 {
+		t.Fatalf("register instance failed: %d, %v", leaseID, err)
+	}
+
+	collision := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1", Port: 9090}
+	if _, err = s.RegisterServiceInstanceWithLease(collision, time.Second); err != ErrInstanceAlreadyExists {
+		t.Errorf("register existing instance should fail, got: %v", err)
+	}
+	if got := s.GetServiceInstanceSpec("order", "ins-1"); got == nil || got.Port != 8080 {
+		t.Errorf("existing instance should not be overwritten: %+v", got)
+	}
+
+	// keeping alive extends the lease.
+	time.Sleep(60 * time.Millisecond)
+	if err = s.KeepAliveServiceInstanceLease(leaseID); err != nil {
+		t.Fatalf("keep alive failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if s.GetServiceInstanceSpec("order", "ins-1") == nil {
+		t.Errorf("instance should be alive after keeping alive")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if s.GetServiceInstanceSpec("order", "ins-1") != nil {
+		t.Errorf("instance should be deleted after the ttl")
+	}
+
+	if _, err = s.RegisterServiceInstanceWithLease(collision, time.Second); err != nil {
+		t.Errorf("register expired instance failed: %v", err)
+	}
+}
+
+func TestInstanceDrift(t *testing.T) {
+	s, store := newTestService()
+
+	now := time.Now()
+	putInstance := func(id, status string) {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id, Status: status})
+	}
+	putStatus := func(id string, heartbeat time.Time) {
+		status := &spec.ServiceInstanceStatus{
+			ServiceName:       "order",
+			InstanceID:        id,
+			LastHeartbeatTime: heartbeat.Format(time.RFC3339),
+		}
+		store.Put(layout.ServiceInstanceStatusKey("order", id), *marshalToString(status))
+	}
+
+	putInstance("up-healthy", spec.ServiceStatusUp)
+	putStatus("up-healthy", now)
+	putInstance("down-stale", spec.ServiceStatusOutOfService)
+	putStatus("down-stale", now.Add(-time.Hour))
+	putInstance("up-no-status", spec.ServiceStatusUp)
+	putInstance("up-stale", spec.ServiceStatusUp)
+	putStatus("up-stale", now.Add(-time.Hour))
+	putInstance("down-healthy", spec.ServiceStatusOutOfService)
+	putStatus("down-healthy", now)
+	putStatus("no-spec", now)
+
+	// instances of other services are not reported.
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "delivery", InstanceID: "x", Status: spec.ServiceStatusUp})
+
+	reports := s.InstanceDrift("order")
+	got := map[string]string{}
+	for _, r := range reports {
+		got[r.InstanceID] = r.Reason
+	}
+	want := map[string]string{
+		"down-healthy": DriftHeartbeatAlive,
+		"no-spec":      DriftSpecMissing,
+		"up-no-status": DriftStatusMissing,
+		"up-stale":     DriftHeartbeatStale,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want drifts %v, got %v", want, got)
+	}
+	if len(reports) != 4 || reports[0].InstanceID != "down-healthy" {
+		t.Errorf("reports should be sorted by instance ID: %+v", reports)
+	}
+}
+
+func TestApplyTransaction(t *testing.T) {
+	s, _ := newTestService()
+	s.PutServiceSpec(&spec.Service{Name: "legacy", RegisterTenant: "shop"})
+
+	newServiceSpec := func(name string) *spec.Service {
+		return &spec.Service{
+			Name:           name,
+			RegisterTenant: "shop",
+			Sidecar: &spec.Sidecar{
+				DiscoveryType:   "eureka",
+				Address:         "127.0.0.1",
+				IngressPort:     13001,
+				IngressProtocol: "http",
+				EgressPort:      13002,
+				EgressProtocol:  "http",
+			},
+		}
+	}
+	instance := &spec.ServiceInstanceSpec{
+		RegistryName: "mesh",
+		ServiceName:  "order",
+		InstanceID:   "ins-1",
+		IP:           "127.0.0.1",
+		Port:         8080,
+	}
+
+	// the invalid service spec fails the whole transaction.
+	invalid := newServiceSpec("delivery")
+	invalid.Sidecar = nil
+	err := s.ApplyTransaction([]SpecChange{
+		{Service: newServiceSpec("order")},
+		{ServiceInstance: instance},
+		{Tenant: &spec.Tenant{Name: "shop", Services: []string{"order", "delivery"}}},
+		{Service: &spec.Service{Name: "legacy"}, Delete: true},
+		{Service: invalid},
+	})
+	if err == nil {
+		t.Fatalf("transaction with an invalid change should fail")
+	}
+	if s.GetServiceSpec("order") != nil || s.GetServiceInstanceSpec("order", "ins-1") != nil ||
+		s.GetTenantSpec("shop") != nil || s.GetServiceSpec("legacy") == nil {
+		t.Fatalf("nothing should be applied on failure")
+	}
+
+	for _, changes := range [][]SpecChange{
+		{{}},
+		{{Service: newServiceSpec("order"), Tenant: &spec.Tenant{Name: "shop"}}},
+		{{Service: newServiceSpec("order")}, {Service: newServiceSpec("order")}},
+	} {
+		if err := s.ApplyTransaction(changes); err == nil {
+			t.Errorf("transaction %+v should fail", changes)
+		}
+	}
+
+	err = s.ApplyTransaction([]SpecChange{
+		{Service: newServiceSpec("order")},
+		{ServiceInstance: instance},
+		{Tenant: &spec.Tenant{Name: "shop", Services: []string{"order"}}},
+		{Service: &spec.Service{Name: "legacy"}, Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("apply transaction failed: %v", err)
+	}
+	if s.GetServiceSpec("order") == nil || s.GetServiceInstanceSpec("order", "ins-1") == nil ||
+		s.GetTenantSpec("shop") == nil || s.GetServiceSpec("legacy") != nil {
+		t.Errorf("all changes should be applied")
+	}
+}
+
+func TestCreateServiceWithIngress(t *testing.T) {
+	s, store := newTestService()
+
+	newServiceSpec := func(name string) *spec.Service {
+		return &spec.Service{
+			Name:           name,
+			RegisterTenant: "shop",
+			Sidecar: &spec.Sidecar{
+				DiscoveryType:   "eureka",
+				Address:         "127.0.0.1",
+				IngressPort:     13001,
+				IngressProtocol: "http",
+				EgressPort:      13002,
+				EgressProtocol:  "http",
+			},
+		}
+	}
+	newIngressSpec := func(name, backend string) *spec.Ingress {
+		return &spec.Ingress{
+			Name: name,
+			Rules: []*spec.IngressRule{{
+				Host:  "megaease.com",
+				Paths: []*spec.IngressPath{{Path: "/order", Backend: backend}},
+			}},
+		}
+	}
+	assertNothingCreated := func() {
+		t.Helper()
+		if s.GetServiceSpec("order") != nil || s.GetIngressSpec("order-ingress") != nil {
+			t.Errorf("nothing should be created on failure")
+		}
+	}
+
+	// the ingress doesn't route to the service.
+	err := s.CreateServiceWithIngress(newServiceSpec("order"), newIngressSpec("order-ingress", "delivery"))
+	if err == nil {
+		t.Errorf("ingress not referencing the service should fail")
+	}
+	assertNothingCreated()
+
+	// the invalid service fails the ingress too.
+	invalid := newServiceSpec("order")
+	invalid.Sidecar = nil
+	if err := s.CreateServiceWithIngress(invalid, newIngressSpec("order-ingress", "order")); err == nil {
+		t.Errorf("invalid service should fail")
+	}
+	assertNothingCreated()
+
+	// the tenant of the service doesn't exist.
+	err = s.CreateServiceWithIngress(newServiceSpec("order"), newIngressSpec("order-ingress", "order"))
+	if !errors.Is(err, ErrTenantNotFound) {
+		t.Errorf("expect ErrTenantNotFound, got %v", err)
+	}
+	assertNothingCreated()
+
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"payment"}})
+
+	// the tenant changes meanwhile.
+	racing := &racingStorage{mockStorage: store}
+	racing.beforeWrite = func() {
+		store.Put(layout.TenantSpecKey("shop"), *marshalToString(&spec.Tenant{
+			Name: "shop", Services: []string{"payment", "delivery"},
+		}))
+	}
+	s.store = newReadOnlyGuard(s, racing)
+	err = s.CreateServiceWithIngress(newServiceSpec("order"), newIngressSpec("order-ingress", "order"))
+	if err != nil {
+		t.Fatalf("create service with ingress failed: %v", err)
+	}
+	if s.GetServiceSpec("order") == nil || s.GetIngressSpec("order-ingress") == nil {
+		t.Fatalf("both service and ingress should be created")
+	}
+	tenant := s.GetTenantSpec("shop")
+	if !reflect.DeepEqual(tenant.Services, []string{"payment", "delivery", "order"}) {
+		t.Errorf("service should be added to the latest tenant, got %v", tenant.Services)
+	}
+
+	err = s.CreateServiceWithIngress(newServiceSpec("order"), newIngressSpec("another-ingress", "order"))
+	if !errors.Is(err, ErrServiceAlreadyExists) {
+		t.Errorf("expect ErrServiceAlreadyExists, got %v", err)
+	}
+	err = s.CreateServiceWithIngress(newServiceSpec("delivery"), newIngressSpec("order-ingress", "delivery"))
+	if !errors.Is(err, ErrIngressAlreadyExists) {
+		t.Errorf("expect ErrIngressAlreadyExists, got %v", err)
+	}
+	if s.GetServiceSpec("delivery") != nil || s.GetIngressSpec("another-ingress") != nil {
+		t.Errorf("nothing should be created on conflict")
+	}
+}
+
+func TestRecordHeartbeat(t *testing.T) {
+	s, store := newTestService()
+
+	// the client clock is far behind the server one.
+	reportTime := time.Now().Add(-time.Hour)
+	clientTime := reportTime.Format(time.RFC3339)
+	status := &spec.ServiceInstanceStatus{
+		ServiceName: "order",
+		InstanceID:  "ins-1",
+		Phase:       spec.ServiceInstancePhasePending,
+	}
+	key := layout.ServiceInstanceStatusKey("order", "ins-1")
+	store.Put(key, *marshalToString(status))
+
+	getStatus := func() *spec.ServiceInstanceStatus {
+		statuses := s.ListAllServiceInstanceStatuses()
+		if len(statuses) != 1 {
+			t.Fatalf("expect 1 status, got %d", len(statuses))
+		}
+		return statuses[0]
+	}
+
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		if err := s.RecordHeartbeat("order", "ins-1", reportTime); err != nil {
+			t.Fatalf("record heartbeat failed: %v", err)
+		}
+
+		status := getStatus()
+		if status.LastHeartbeatTime != clientTime {
+			t.Errorf("client heartbeat time should be recorded, got %s", status.LastHeartbeatTime)
+		}
+		if status.Phase != "" {
+			t.Errorf("pending phase should be cleared, got %s", status.Phase)
+		}
+		heartbeat, err := status.LastHeartbeat()
+		if err != nil {
+			t.Fatalf("parse heartbeat failed: %v", err)
+		}
+		if !heartbeat.After(last) {
+			t.Errorf("server heartbeat time should advance, got %v after %v", heartbeat, last)
+		}
+		last = heartbeat
+
+		if !status.IsHealthy(time.Now(), time.Second) {
+			t.Errorf("staleness should be computed by the server heartbeat time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the status is created if missing.
+	if err := s.RecordHeartbeat("order", "ins-2", time.Now()); err != nil {
+		t.Fatalf("record heartbeat failed: %v", err)
+	}
+	if len(s.ListAllServiceInstanceStatuses()) != 2 {
+		t.Errorf("status of ins-2 should be created")
+	}
+}
+
+func TestListReadyInstances(t *testing.T) {
+	s, store := newTestService()
+
+	for _, instance := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "ready", Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "not-ready", Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "stale", Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "down", Status: spec.ServiceStatusOutOfService},
+		{ServiceName: "order", InstanceID: "no-status", Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "external", Status: spec.ServiceStatusUp, RegistryName: "consul"},
+		{ServiceName: "order", InstanceID: "external-down", Status: spec.ServiceStatusOutOfService, RegistryName: "consul"},
+		{ServiceName: "order-v2", InstanceID: "ready", Status: spec.ServiceStatusUp},
+	} {
+		s.PutServiceInstanceSpec(instance)
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	for _, status := range []*spec.ServiceInstanceStatus{
+		{ServiceName: "order", InstanceID: "ready", LastHeartbeatTime: now, Ready: true},
+		// healthy but not ready, e.g. warming caches.
+		{ServiceName: "order", InstanceID: "not-ready", LastHeartbeatTime: now},
+		{ServiceName: "order", InstanceID: "stale", LastHeartbeatTime: time.Now().Add(-time.Hour).Format(time.RFC3339), Ready: true},
+		{ServiceName: "order", InstanceID: "down", LastHeartbeatTime: now, Ready: true},
+		{ServiceName: "order-v2", InstanceID: "ready", LastHeartbeatTime: now, Ready: true},
+	} {
+		store.Put(layout.ServiceInstanceStatusKey(status.ServiceName, status.InstanceID), *marshalToString(status))
+	}
+
+	ids := func() []string {
+		result := []string{}
+		for _, instance := range s.ListReadyInstances("order") {
+			result = append(result, instance.ServiceName+"/"+instance.InstanceID)
+		}
+		return result
+	}
+
+	// the UP instances of external registries have no heartbeats, and are ready.
+	if got := ids(); !reflect.DeepEqual(got, []string{"order/external", "order/ready"}) {
+		t.Errorf("expect only the ready instances, got %v", got)
+	}
+
+	if err := s.SetInstanceReady("order", "not-ready", true); err != nil {
+		t.Fatalf("set instance ready failed: %v", err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"order/external", "order/not-ready", "order/ready"}) {
+		t.Errorf("expect the instance ready after setting, got %v", got)
+	}
+
+	if err := s.SetInstanceReady("order", "ready", false); err != nil {
+		t.Fatalf("set instance not ready failed: %v", err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"order/external", "order/not-ready"}) {
+		t.Errorf("expect the instance excluded after unsetting, got %v", got)
+	}
+
+	// other fields of the status are kept.
+	for _, status := range s.ListAllServiceInstanceStatuses() {
+		if status.InstanceID == "ready" && status.ServiceName == "order" && status.LastHeartbeatTime != now {
+			t.Errorf("heartbeat time should be kept, got %s", status.LastHeartbeatTime)
+		}
+	}
+}
+
+func TestCustomResourceFinalizers(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutCustomResource(&spec.CustomResource{
+		"kind":       "dns",
+		"name":       "record",
+		"finalizers": []string{"dns-controller", "audit"},
+	})
+
+	s.DeleteCustomResource("dns", "record")
+	resource := s.GetCustomResource("dns", "record")
+	if resource == nil {
+		t.Fatalf("resource should persist while finalizers remain")
+	}
+	if resource.DeletionTimestamp() == "" {
+		t.Errorf("deletion timestamp should be set")
+	}
+
+	if err := s.RemoveCustomResourceFinalizer("dns", "record", "dns-controller"); err != nil {
+		t.Fatalf("remove finalizer failed: %v", err)
+	}
+	resource = s.GetCustomResource("dns", "record")
+	if resource == nil {
+		t.Fatalf("resource should persist while finalizers remain")
+	}
+	if f := resource.Finalizers(); len(f) != 1 || f[0] != "audit" {
+		t.Errorf("unexpected finalizers %v", f)
+	}
+
+	// removing an absent finalizer changes nothing.
+	if err := s.RemoveCustomResourceFinalizer("dns", "record", "dns-controller"); err != nil {
+		t.Fatalf("remove finalizer failed: %v", err)
+	}
+	if err := s.RemoveCustomResourceFinalizer("dns", "record", "audit"); err != nil {
+		t.Fatalf("remove finalizer failed: %v", err)
+	}
+	if s.GetCustomResource("dns", "record") != nil {
+		t.Errorf("resource should be deleted after the last finalizer is removed")
+	}
+
+	// finalizers of a resource not being deleted are just removed.
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "other", "finalizers": []string{"audit"}})
+	if err := s.RemoveCustomResourceFinalizer("dns", "other", "audit"); err != nil {
+		t.Fatalf("remove finalizer failed: %v", err)
+	}
+	resource = s.GetCustomResource("dns", "other")
+	if resource == nil || len(resource.Finalizers()) != 0 {
+		t.Errorf("resource should be kept without finalizers, got %v", resource)
+	}
+	s.DeleteCustomResource("dns", "other")
+	if s.GetCustomResource("dns", "other") != nil {
+		t.Errorf("resource without finalizers should be deleted at once")
+	}
+}
+
+func newServiceSpecKVs(count int) map[string]*mvccpb.KeyValue {
+	kvs := make(map[string]*mvccpb.KeyValue, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("service-%04d", i)
+		service := &spec.Service{
+			Name:           name,
+			RegisterTenant: "shop",
+			Sidecar: &spec.Sidecar{
+				DiscoveryType:   "eureka",
+				Address:         "127.0.0.1",
+				IngressPort:     13001,
+				IngressProtocol: "http",
+				EgressPort:      13002,
+				EgressProtocol:  "http",
+			},
+			LoadBalance: &spec.LoadBalance{Policy: "roundRobin"},
+		}
+		kvs[layout.ServiceSpecKey(name)] = &mvccpb.KeyValue{Value: []byte(*marshalToString(service))}
+	}
+	return kvs
+}
+
+func TestDecodeServiceSpecsParallel(t *testing.T) {
+	kvs := newServiceSpecKVs(500)
+	kvs[layout.ServiceSpecKey("invalid")] = &mvccpb.KeyValue{Value: []byte("name: [")}
+
+	values := sortedValues(kvs)
+	serial := decodeServiceSpecsSerial(values)
+	if len(serial) != 500 {
+		t.Fatalf("expect 500 services, got %d", len(serial))
+	}
+	for i := 1; i < len(serial); i++ {
+		if serial[i-1].Name >= serial[i].Name {
+			t.Fatalf("services should be sorted, got %s before %s", serial[i-1].Name, serial[i].Name)
+		}
+	}
+
+	for _, workers := range []int{2, 3, 8, 1000} {
+		parallel := decodeServiceSpecsParallel(values, workers)
+		if !reflect.DeepEqual(serial, parallel) {
+			t.Errorf("parallel decoding with %d workers differs from the serial one", workers)
+		}
+	}
+
+	if services := decodeServiceSpecs(kvs); !reflect.DeepEqual(serial, services) {
+		t.Errorf("decoded services differ from the serial one")
+	}
+}
+
+func BenchmarkDecodeServiceSpecsSerial(b *testing.B) {
+	values := sortedValues(newServiceSpecKVs(1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeServiceSpecsSerial(values)
+	}
+}
+
+func BenchmarkDecodeServiceSpecsParallel(b *testing.B) {
+	values := sortedValues(newServiceSpecKVs(1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeServiceSpecsParallel(values, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestGetSpecRaw(t *testing.T) {
+	s, store := newTestService()
+
+	serviceYAML := "# order service\nregisterTenant: shop\nname: order\nunknownField: kept\n"
+	store.Put(layout.ServiceSpecKey("order"), serviceYAML)
+	raw, kv := s.GetServiceSpecRaw("order")
+	if raw != serviceYAML || kv == nil || string(kv.Value) != serviceYAML {
+		t.Errorf("expect raw service spec %q, got %q", serviceYAML, raw)
+	}
+	if s.GetServiceSpec("order").Name != "order" {
+		t.Errorf("raw service spec should still be decodable")
+	}
+
+	tenantYAML := "services: []\nname: shop\n"
+	store.Put(layout.TenantSpecKey("shop"), tenantYAML)
+	if raw, _ := s.GetTenantSpecRaw("shop"); raw != tenantYAML {
+		t.Errorf("expect raw tenant spec %q, got %q", tenantYAML, raw)
+	}
+
+	resourceYAML := "name: r1\nkind: k1\nzone: z1\n"
+	store.Put(layout.CustomResourceKey("k1", "r1"), resourceYAML)
+	if raw, _ := s.GetCustomResourceRaw("k1", "r1"); raw != resourceYAML {
+		t.Errorf("expect raw custom resource %q, got %q", resourceYAML, raw)
+	}
+
+	if raw, kv := s.GetIngressSpecRaw("none"); raw != "" || kv != nil {
+		t.Errorf("expect nothing for missing ingress, got %q", raw)
+	}
+}
+
+func TestMoveCustomResource(t *testing.T) {
+	s, store := newTestService()
+
+	s.PutCustomResourceKind(&spec.CustomResourceKind{Name: "dns"})
+	s.PutCustomResourceKind(&spec.CustomResourceKind{Name: "record"})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "a", "ttl": 60})
+	s.PutCustomResource(&spec.CustomResource{"kind": "record", "name": "b"})
+
+	if err := s.MoveCustomResource("dns", "a", "record", "a2"); err != nil {
+		t.Fatalf("move custom resource failed: %v", err)
+	}
+	if s.GetCustomResource("dns", "a") != nil {
+		t.Errorf("old custom resource should be deleted")
+	}
+	moved := s.GetCustomResource("record", "a2")
+	if moved == nil {
+		t.Fatalf("new custom resource should be created")
+	}
+	if moved.Kind() != "record" || moved.Name() != "a2" || (*moved)["ttl"] != 60 {
+		t.Errorf("unexpected moved custom resource %v", moved)
+	}
+
+	err := s.MoveCustomResource("record", "a2", "record", "b")
+	if !errors.Is(err, ErrCustomResourceAlreadyExists) {
+		t.Errorf("expect ErrCustomResourceAlreadyExists, got %v", err)
+	}
+
+	err = s.MoveCustomResource("record", "a2", "undefined", "a3")
+	if !errors.Is(err, ErrCustomResourceKindNotFound) {
+		t.Errorf("expect ErrCustomResourceKindNotFound, got %v", err)
+	}
+	if s.GetCustomResource("record", "a2") == nil || s.GetCustomResource("record", "b") == nil {
+		t.Errorf("rejected moves should change nothing")
+	}
+
+	if err = s.MoveCustomResource("dns", "a", "record", "a4"); err == nil {
+		t.Errorf("moving a missing custom resource should fail")
+	}
+
+	// the target created between reading and writing is not overwritten.
+	racing := &racingStorage{mockStorage: store}
+	racing.beforeWrite = func() {
+		store.Put(layout.CustomResourceKey("record", "a5"), "kind: record\nname: a5\nzone: z2\n")
+	}
+	s.store = newReadOnlyGuard(s, racing)
+	err = s.MoveCustomResource("record", "a2", "record", "a5")
+	if !errors.Is(err, ErrCustomResourceAlreadyExists) {
+		t.Errorf("expect ErrCustomResourceAlreadyExists for the racing target, got %v", err)
+	}
+	if target := s.GetCustomResource("record", "a5"); target == nil || (*target)["zone"] != "z2" {
+		t.Errorf("racing target should be kept, got %v", target)
+	}
+	if s.GetCustomResource("record", "a2") == nil {
+		t.Errorf("source should be kept on conflict")
+	}
+}
+
+func TestListPeerInstanceSpecs(t *testing.T) {
+	s, _ := newTestService()
+
+	for _, id := range []string{"ins-1", "ins-2", "ins-3"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id})
+	}
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "delivery", InstanceID: "ins-4"})
+
+	peers := s.ListPeerInstanceSpecs("order", "ins-2")
+	ids := []string{}
+	for _, peer := range peers {
+		ids = append(ids, peer.InstanceID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"ins-1", "ins-3"}) {
+		t.Errorf("expect peers ins-1 and ins-3, got %v", ids)
+	}
+
+	if peers = s.ListPeerInstanceSpecs("order", "ins-5"); len(peers) != 3 {
+		t.Errorf("expect all 3 instances for an unknown self, got %d", len(peers))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, store := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order"})
+	s.SetReadOnly(true)
+	if !s.ReadOnly() {
+		t.Fatalf("service should be read-only")
+	}
+
+	if err := s.PutServiceSpec(&spec.Service{Name: "delivery"}); err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+	if err := s.DeleteServiceSpec("order"); err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+	if err := s.KeepAliveServiceInstanceLease(1); err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+	if err := s.store.RevokeLease(1); err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+
+	if err := s.RecordHeartbeat("order", "ins-1", time.Now()); err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+	err := s.ApplyTransaction([]SpecChange{{Tenant: &spec.Tenant{Name: "shop"}}})
+	if err != ErrReadOnly {
+		t.Errorf("expect ErrReadOnly, got %v", err)
+	}
+
+	if len(store.kvs) != 1 {
+		t.Errorf("store should not be touched in read-only mode, got %d keys", len(store.kvs))
+	}
+	if s.GetServiceSpec("order") == nil || len(s.ListServiceSpecs()) != 1 {
+		t.Errorf("reads should work in read-only mode")
+	}
+
+	s.SetReadOnly(false)
+	s.PutServiceSpec(&spec.Service{Name: "delivery"})
+	if s.GetServiceSpec("delivery") == nil {
+		t.Errorf("writes should work after leaving read-only mode")
+	}
+}
+
+func TestServiceHealthRollup(t *testing.T) {
+	s, store := newTestService()
+
+	now := time.Now()
+	putService := func(name string, dependencies ...string) {
+		s.PutServiceSpec(&spec.Service{Name: name, Dependencies: dependencies})
+	}
+	putInstance := func(service, id string, heartbeat time.Time) {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: service, InstanceID: id, Status: spec.ServiceStatusUp})
+		status := &spec.ServiceInstanceStatus{
+			ServiceName:       service,
+			InstanceID:        id,
+			LastHeartbeatTime: heartbeat.Format(time.RFC3339),
+		}
+		store.Put(layout.ServiceInstanceStatusKey(service, id), *marshalToString(status))
+	}
+
+	// order -> delivery -> order is a cycle, order -> payment.
+	putService("order", "delivery", "payment")
+	putService("delivery", "order")
+	putService("payment")
+	putInstance("order", "ins-1", now)
+	putInstance("delivery", "ins-1", now)
+	putInstance("payment", "ins-1", now)
+
+	for _, name := range []string{"order", "delivery", "payment"} {
+		if verdict := s.ServiceHealthRollup(name); verdict != HealthHealthy {
+			t.Errorf("expect %s healthy, got %s", name, verdict)
+		}
+	}
+	if verdict := s.ServiceHealthRollup("none"); verdict != HealthUnknown {
+		t.Errorf("expect unknown for missing service, got %s", verdict)
+	}
+
+	// one of two payment instances is stale.
+	putInstance("payment", "ins-2", now.Add(-time.Hour))
+	if verdict := s.ServiceHealthRollup("payment"); verdict != HealthDegraded {
+		t.Errorf("expect payment degraded, got %s", verdict)
+	}
+	if verdict := s.ServiceHealthRollup("order"); verdict != HealthDegraded {
+		t.Errorf("expect order degraded by payment, got %s", verdict)
+	}
+	if verdict := s.ServiceHealthRollup("delivery"); verdict != HealthDegraded {
+		t.Errorf("expect delivery degraded by payment transitively, got %s", verdict)
+	}
+
+	// the service itself has no healthy instance.
+	putInstance("delivery", "ins-1", now.Add(-time.Hour))
+	if verdict := s.ServiceHealthRollup("delivery"); verdict != HealthUnhealthy {
+		t.Errorf("expect delivery unhealthy, got %s", verdict)
+	}
+
+	// missing dependency.
+	putService("shipping", "unknown")
+	putInstance("shipping", "ins-1", now)
+	if verdict := s.ServiceHealthRollup("shipping"); verdict != HealthDegraded {
+		t.Errorf("expect shipping degraded by missing dependency, got %s", verdict)
+	}
+}
+
+func TestPruneServiceInstanceSpecs(t *testing.T) {
+	s, store := newTestService()
+
+	now := time.Now()
+	putInstance := func(id string, registered time.Time) {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName:  "order",
+			InstanceID:   id,
+			RegistryTime: registered.Format(time.RFC3339),
+		})
+	}
+	putStatus := func(id string, heartbeat time.Time) {
+		status := &spec.ServiceInstanceStatus{
+			ServiceName:       "order",
+			InstanceID:        id,
+			LastHeartbeatTime: heartbeat.Format(time.RFC3339),
+		}
+		store.Put(layout.ServiceInstanceStatusKey("order", id), *marshalToString(status))
+	}
+
+	putInstance("old-no-status", now.Add(-2*time.Hour))
+	putInstance("old-stale", now.Add(-2*time.Hour))
+	putStatus("old-stale", now.Add(-time.Hour))
+	putInstance("old-alive", now.Add(-2*time.Hour))
+	putStatus("old-alive", now)
+	putInstance("recent", now)
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "no-registry-time"})
+
+	count, err := s.PruneServiceInstanceSpecs("order", time.Hour)
+	if err != nil {
+		t.Fatalf("prune service instance specs failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expect 2 pruned instances, got %d", count)
+	}
+
+	ids := []string{}
+	for _, instance := range s.ListServiceInstanceSpecs("order") {
+		ids = append(ids, instance.InstanceID)
+	}
+	sort.Strings(ids)
+	if expected := []string{"no-registry-time", "old-alive", "recent"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expect remaining instances %v, got %v", expected, ids)
+	}
+	if _, ok := store.kvs[layout.ServiceInstanceStatusKey("order", "old-stale")]; ok {
+		t.Errorf("status of pruned instance should be deleted")
+	}
+
+	if count, _ = s.PruneServiceInstanceSpecs("order", time.Hour); count != 0 {
+		t.Errorf("expect nothing to prune, got %d", count)
+	}
+}
+
+func TestCreateTenantsWithServices(t *testing.T) {
+	s, store := newTestService()
+
+	s.PutTenantSpec(&spec.Tenant{Name: "existing", Services: []string{"payment"}})
+	for _, service := range []*spec.Service{
+		{Name: "order"},
+		{Name: "delivery"},
+		{Name: "shipping", RegisterTenant: "logistic"},
+		{Name: "payment", RegisterTenant: "existing"},
+		{Name: "stock", RegisterTenant: "existing"},
+	} {
+		s.PutServiceSpec(service)
+	}
+	keys := len(store.kvs)
+
+	err := s.CreateTenantsWithServices(map[string][]string{
+		"shop":     {"order", "delivery"},
+		"logistic": {"delivery"},
+	})
+	if err == nil {
+		t.Errorf("double-assigned service should be rejected")
+	}
+	err = s.CreateTenantsWithServices(map[string][]string{
+		"shop": {"order", "payment"},
+	})
+	if err == nil {
+		t.Errorf("service assigned to existing tenant should be rejected")
+	}
+	err = s.CreateTenantsWithServices(map[string][]string{
+		"shop":     {"order"},
+		"existing": {},
+	})
+	if err == nil {
+		t.Errorf("existing tenant should be rejected")
+	}
+	err = s.CreateTenantsWithServices(map[string][]string{
+		"shop": {"order", "cart"},
+	})
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("expect ErrServiceNotFound for missing service, got %v", err)
+	}
+	err = s.CreateTenantsWithServices(map[string][]string{
+		"shop": {"order", "stock"},
+	})
+	if err == nil {
+		t.Errorf("service registering another tenant should be rejected")
+	}
+	if len(store.kvs) != keys {
+		t.Fatalf("rejected creations should change nothing, got %d keys", len(store.kvs))
+	}
+	revision := store.revision
+
+	err = s.CreateTenantsWithServices(map[string][]string{
+		"shop":     {"order", "delivery"},
+		"logistic": {"shipping"},
+	})
+	if err != nil {
+		t.Fatalf("create tenants with services failed: %v", err)
+	}
+
+	shop := s.GetTenantSpec("shop")
+	if shop == nil || !reflect.DeepEqual(shop.Services, []string{"order", "delivery"}) || shop.CreatedAt == "" {
+		t.Errorf("unexpected tenant shop: %+v", shop)
+	}
+	logistic := s.GetTenantSpec("logistic")
+	if logistic == nil || !reflect.DeepEqual(logistic.Services, []string{"shipping"}) {
+		t.Errorf("unexpected tenant logistic: %+v", logistic)
+	}
+	for name, tenant := range map[string]string{"order": "shop", "delivery": "shop", "shipping": "logistic"} {
+		if service := s.GetServiceSpec(name); service.RegisterTenant != tenant {
+			t.Errorf("service %s should register tenant %s, got %s", name, tenant, service.RegisterTenant)
+		}
+	}
+	// the shipping service registering logistic already is not rewritten.
+	if kv := store.kvs[layout.ServiceSpecKey("shipping")]; kv.ModRevision > revision {
+		t.Errorf("service registering the tenant already should not be rewritten")
+	}
+
+	// the tenants are created only if absent.
+	err = s.CreateTenantsWithServices(map[string][]string{"empty": {}})
+	if err != nil {
+		t.Fatalf("create tenant without services failed: %v", err)
+	}
+	if err = s.CreateTenantsWithServices(map[string][]string{"empty": {}}); err == nil {
+		t.Errorf("creating existing tenant should fail")
+	}
+}
+
+func TestGetCustomResourceWithInfo(t *testing.T) {
+	s, store := newTestService()
+
+	if resource, kv := s.GetCustomResourceWithInfo("dns", "record"); resource != nil || kv != nil {
+		t.Errorf("expect nothing for missing custom resource")
+	}
+
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "record", "ttl": 60})
+	resource, kv := s.GetCustomResourceWithInfo("dns", "record")
+	if resource == nil || kv == nil {
+		t.Fatalf("custom resource should be found")
+	}
+	stored := store.kvs[layout.CustomResourceKey("dns", "record")]
+	if kv.ModRevision != stored.ModRevision || string(kv.Value) != string(stored.Value) {
+		t.Errorf("expect kv %v, got %v", stored, kv)
+	}
+
+	// the revision works for compare-and-put.
+	(*resource)["ttl"] = 120
+	put, err := store.CompareAndPut(layout.CustomResourceKey("dns", "record"), *marshalToString(resource), kv.ModRevision)
+	if err != nil || !put {
+		t.Fatalf("compare and put with the revision failed: %v", err)
+	}
+	if _, newKV := s.GetCustomResourceWithInfo("dns", "record"); newKV.ModRevision <= kv.ModRevision {
+		t.Errorf("revision should increase after writing, got %d", newKV.ModRevision)
+	}
+}
+
+func TestDeleteCustomResourcesByKind(t *testing.T) {
+	s, _ := newTestService()
+
+	for _, kind := range []string{"dns", "dnsx"} {
+		s.PutCustomResourceKind(&spec.CustomResourceKind{Name: kind})
+		for _, name := range []string{"r1", "r2", "r3"} {
+			s.PutCustomResource(&spec.CustomResource{"kind": kind, "name": name})
+		}
+	}
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r4", "finalizers": []string{"audit"}})
+
+	count, err := s.DeleteCustomResourcesByKind("dns")
+	if err != nil {
+		t.Fatalf("delete custom resources by kind failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("expect 4 deleted resources, got %d", count)
+	}
+	if resources := s.ListCustomResources("dns"); len(resources) != 0 {
+		t.Errorf("all resources of dns should be deleted, got %d", len(resources))
+	}
+	if s.GetCustomResourceKind("dns") == nil {
+		t.Errorf("kind should be kept")
+	}
+	if resources := s.ListCustomResources("dnsx"); len(resources) != 3 {
+		t.Errorf("resources of other kinds should be untouched, got %d", len(resources))
+	}
+
+	count, err = s.DeleteCustomResourceKindCascade("dnsx")
+	if err != nil {
+		t.Fatalf("delete custom resource kind cascade failed: %v", err)
+	}
+	if count != 3 || s.GetCustomResourceKind("dnsx") != nil || len(s.ListCustomResources("dnsx")) != 0 {
+		t.Errorf("kind dnsx and its resources should be deleted, got count %d", count)
+	}
+	if s.GetCustomResourceKind("dns") == nil {
+		t.Errorf("other kinds should be untouched")
+	}
+}
+
+func TestServiceRateLimit(t *testing.T) {
+	s, _ := newTestService()
+
+	if err := s.PutServiceRateLimit("order", &ratelimiter.Spec{}); err == nil {
+		t.Errorf("putting rate limiter of missing service should fail")
+	}
+
+	s.PutServiceSpec(&spec.Service{
+		Name:           "order",
+		RegisterTenant: "tenant",
+		Resilience:     &spec.Resilience{Retryer: &retryer.Spec{}},
+	})
+	if rl := s.GetServiceRateLimit("order"); rl != nil {
+		t.Errorf("expect no rate limiter, got %+v", rl)
+	}
+
+	rl := &ratelimiter.Spec{
+		Policies: []*ratelimiter.Policy{{
+			Name:               "default",
+			TimeoutDuration:    "100ms",
+			LimitRefreshPeriod: "10ms",
+			LimitForPeriod:     50,
+		}},
+		DefaultPolicyRef: "default",
+		URLs: []*ratelimiter.URLRule{{
+			URLRule: urlrule.URLRule{URL: urlrule.StringMatch{Prefix: "/orders"}},
+		}},
+	}
+	if err := s.PutServiceRateLimit("order", rl); err != nil {
+		t.Fatalf("put rate limiter failed: %v", err)
+	}
+
+	got := s.GetServiceRateLimit("order")
+	if got == nil || len(got.Policies) != 1 || got.Policies[0].LimitForPeriod != 50 ||
+		got.Policies[0].LimitRefreshPeriod != "10ms" || len(got.URLs) != 1 ||
+		got.URLs[0].URL.Prefix != "/orders" {
+		t.Errorf("rate limiter should be round-tripped, got %+v", got)
+	}
+	if serviceSpec := s.GetServiceSpec("order"); serviceSpec.RegisterTenant != "tenant" ||
+		serviceSpec.Resilience.Retryer == nil {
+		t.Errorf("other parts of service spec should be kept, got %+v", serviceSpec)
+	}
+
+	for _, policy := range []ratelimiter.Policy{
+		{Name: "default", LimitForPeriod: 0},
+		{Name: "default", LimitForPeriod: -1},
+		{Name: "default", LimitForPeriod: 10, TimeoutDuration: "-1s"},
+		{Name: "default", LimitForPeriod: 10, LimitRefreshPeriod: "0s"},
+	} {
+		policy := policy
+		invalid := *rl
+		invalid.Policies = []*ratelimiter.Policy{&policy}
+		if err := s.PutServiceRateLimit("order", &invalid); err == nil {
+			t.Errorf("invalid policy %+v should be rejected", policy)
+		}
+	}
+
+	if err := s.PutServiceRateLimit("order", nil); err != nil {
+		t.Fatalf("remove rate limiter failed: %v", err)
+	}
+	if rl := s.GetServiceRateLimit("order"); rl != nil {
+		t.Errorf("rate limiter should be removed, got %+v", rl)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	s1, store := newTestService()
+	s2 := &Service{spec: &spec.Admin{}, syncers: make(map[storage.Syncer]struct{})}
+	s2.store = newReadOnlyGuard(s2, store)
+
+	const task = "purge-orphans"
+	ttl := 50 * time.Millisecond
+
+	results := make([]bool, 2)
+	wg := &sync.WaitGroup{}
+	for i, s := range []*Service{s1, s2} {
+		wg.Add(1)
+		go func(i int, s *Service) {
+			defer wg.Done()
+			won, err := s.TryBecomeLeader(task, ttl)
+			if err != nil {
+				t.Errorf("try to become leader failed: %v", err)
+			}
+			results[i] = won
+		}(i, s)
+	}
+	wg.Wait()
+
+	if results[0] == results[1] {
+		t.Fatalf("expect exactly one leader, got %v", results)
+	}
+	leader, follower := s1, s2
+	if results[1] {
+		leader, follower = s2, s1
+	}
+
+	if won, _ := leader.TryBecomeLeader(task, ttl); !won {
+		t.Errorf("leader should keep its leadership")
+	}
+	if err := follower.RenewLeadership(task); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expect ErrNotLeader for follower, got %v", err)
+	}
+
+	// renewing keeps the leadership beyond the ttl.
+	for i := 0; i < 3; i++ {
+		time.Sleep(ttl / 2)
+		if err := leader.RenewLeadership(task); err != nil {
+			t.Fatalf("renew leadership failed: %v", err)
+		}
+	}
+	if won, _ := follower.TryBecomeLeader(task, ttl); won {
+		t.Errorf("follower should not become leader while the leadership is renewed")
+	}
+
+	// the leadership expires without renewing.
+	time.Sleep(2 * ttl)
+	if err := leader.RenewLeadership(task); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expect ErrNotLeader after expiring, got %v", err)
+	}
+	if won, _ := follower.TryBecomeLeader(task, ttl); !won {
+		t.Fatalf("follower should become leader after the leadership expires")
+	}
+
+	// resigning frees the leadership immediately.
+	if err := follower.ResignLeadership(task); err != nil {
+		t.Fatalf("resign leadership failed: %v", err)
+	}
+	if won, _ := leader.TryBecomeLeader(task, ttl); !won {
+		t.Errorf("leadership should be claimable after resigning")
+	}
+
+	// the leader never renewing loses the leadership to the follower.
+	time.Sleep(2 * ttl)
+	if won, _ := follower.TryBecomeLeader(task, ttl); !won {
+		t.Fatalf("follower should take over the expired leadership")
+	}
+	if won, _ := leader.TryBecomeLeader(task, ttl); won {
+		t.Errorf("expired leader should not report itself as leader")
+	}
+	if err := leader.RenewLeadership(task); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expect ErrNotLeader for expired leader, got %v", err)
+	}
+}
+
+func TestStreamServiceSpecsChan(t *testing.T) {
+	s, store := newTestService()
+	for i := 0; i < 10; i++ {
+		s.PutServiceSpec(&spec.Service{Name: fmt.Sprintf("service-%02d", i)})
+	}
+	store.Put(layout.ServiceSpecKey("corrupt"), "name: [")
+
+	specCh, errCh := s.StreamServiceSpecsChan(context.Background())
+	names := []string{}
+	for serviceSpec := range specCh {
+		names = append(names, serviceSpec.Name)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("stream service specs failed: %v", err)
+	}
+	if len(names) != 10 || !sort.StringsAreSorted(names) {
+		t.Errorf("expect 10 sorted valid specs, got %v", names)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	specCh, errCh = s.StreamServiceSpecsChan(ctx)
+	received := 0
+	for range specCh {
+		received++
+		if received == 3 {
+			cancel()
+		}
+	}
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	if received >= 10 {
+		t.Errorf("cancellation should stop streaming early, got %d specs", received)
+	}
+}
+
+func TestDetectPortConflicts(t *testing.T) {
+	s, _ := newTestService()
+
+	sidecar := func(ingress, egress int) *spec.Sidecar {
+		return &spec.Sidecar{IngressPort: ingress, EgressPort: egress}
+	}
+	s.PutServiceSpec(&spec.Service{Name: "order", Sidecar: sidecar(13001, 13002)})
+	s.PutServiceSpec(&spec.Service{Name: "payment", Sidecar: sidecar(13001, 13003)})
+	s.PutServiceSpec(&spec.Service{Name: "stock", Sidecar: sidecar(13004, 13002)})
+	s.PutServiceSpec(&spec.Service{Name: "user", Sidecar: sidecar(14001, 14002)})
+
+	for _, instance := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-1", IP: "10.0.0.1"},
+		// ingress port collides with order-1.
+		{ServiceName: "payment", InstanceID: "payment-1", IP: "10.0.0.1"},
+		// egress port collides with order-2.
+		{ServiceName: "order", InstanceID: "order-2", IP: "10.0.0.2"},
+		{ServiceName: "stock", InstanceID: "stock-1", IP: "10.0.0.2"},
+		// same ports on different hosts don't collide.
+		{ServiceName: "user", InstanceID: "user-1", IP: "10.0.0.3"},
+		{ServiceName: "user", InstanceID: "user-2", IP: "10.0.0.4"},
+		{ServiceName: "payment", InstanceID: "payment-2", IP: "10.0.0.5"},
+		// service spec is missing.
+		{ServiceName: "unknown", InstanceID: "unknown-1", IP: "10.0.0.1"},
+	} {
+		s.PutServiceInstanceSpec(instance)
+	}
+
+	expected := []PortConflict{
+		{Host: "10.0.0.1", Port: 13001, Users: []PortUser{
+			{ServiceName: "order", InstanceID: "order-1", PortType: PortTypeIngress},
+			{ServiceName: "payment", InstanceID: "payment-1", PortType: PortTypeIngress},
+		}},
+		{Host: "10.0.0.2", Port: 13002, Users: []PortUser{
+			{ServiceName: "order", InstanceID: "order-2", PortType: PortTypeEgress},
+			{ServiceName: "stock", InstanceID: "stock-1", PortType: PortTypeEgress},
+		}},
+	}
+	if conflicts := s.DetectPortConflicts(); !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("expect conflicts %+v, got %+v", expected, conflicts)
+	}
+
+	s.DeleteServiceInstanceSpec("payment", "payment-1")
+	s.DeleteServiceInstanceSpec("stock", "stock-1")
+	if conflicts := s.DetectPortConflicts(); len(conflicts) != 0 {
+		t.Errorf("expect no conflicts, got %+v", conflicts)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s, store := newTestService()
+
+	s.PutCustomResourceKind(&spec.CustomResourceKind{Name: "dns"})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r1"})
+	s.PutGlobalCanaryHeaders(&spec.GlobalCanaryHeaders{})
+	store.Put(layout.IngressSpecKey("corrupt"), "name: [")
+
+	// the writer registers services along with their tenants atomically.
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("service-%d", i)
+			err := store.PutAndDelete(map[string]*string{
+				layout.TenantSpecKey("tenant-" + name): marshalToString(&spec.Tenant{
+					Name: "tenant-" + name, Services: []string{name}}),
+				layout.ServiceSpecKey(name): marshalToString(&spec.Service{
+					Name: name, RegisterTenant: "tenant-" + name}),
+			})
+			if err != nil {
+				t.Errorf("put and delete failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	var lastRevision int64
+	for writing := true; writing; {
+		select {
+		case <-finished:
+			writing = false
+		default:
+		}
+
+		snapshot, revision, err := s.Snapshot()
+		if err != nil {
+			t.Fatalf("snapshot failed: %v", err)
+		}
+		if revision < lastRevision {
+			t.Errorf("revision should not go backwards: %d < %d", revision, lastRevision)
+		}
+		lastRevision = revision
+
+		if len(snapshot.Services) != len(snapshot.Tenants) {
+			t.Fatalf("snapshot is inconsistent: %d services but %d tenants",
+				len(snapshot.Services), len(snapshot.Tenants))
+		}
+		tenants := map[string]bool{}
+		for _, tenant := range snapshot.Tenants {
+			tenants[tenant.Name] = true
+		}
+		for _, service := range snapshot.Services {
+			if !tenants[service.RegisterTenant] {
+				t.Fatalf("tenant %s of service %s is missing in snapshot", service.RegisterTenant, service.Name)
+			}
+		}
+	}
+	snapshot, revision, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	for _, kv := range store.kvs {
+		if kv.ModRevision > revision {
+			t.Errorf("key %s is modified after the revision %d of snapshot", kv.Key, revision)
+		}
+	}
+	if len(snapshot.CustomResourceKinds) != 1 || len(snapshot.CustomResources) != 1 ||
+		snapshot.GlobalCanaryHeaders == nil || len(snapshot.Ingresses) != 0 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+	if len(snapshot.Services) == 0 || !sort.SliceIsSorted(snapshot.Services, func(i, j int) bool {
+		return layout.ServiceSpecKey(snapshot.Services[i].Name) < layout.ServiceSpecKey(snapshot.Services[j].Name)
+	}) {
+		t.Errorf("services should be sorted by keys")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	src, _ := newTestService()
+
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("service-%03d", i)
+		src.PutServiceSpec(&spec.Service{
+			Name:           name,
+			RegisterTenant: "shop",
+			Sidecar: &spec.Sidecar{
+				DiscoveryType:   "eureka",
+				Address:         "127.0.0.1",
+				IngressPort:     13001,
+				IngressProtocol: "http",
+				EgressPort:      13002,
+				EgressProtocol:  "http",
+			},
+		})
+	}
+	src.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		RegistryName: "mesh",
+		ServiceName:  "service-000",
+		InstanceID:   "ins-1",
+		IP:           "127.0.0.1",
+		Port:         8080,
+	})
+	src.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"service-000"}})
+	src.PutCustomResourceKind(&spec.CustomResourceKind{Name: "dns"})
+	src.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r1", "ttl": 30})
+	src.PutGlobalCanaryHeaders(&spec.GlobalCanaryHeaders{
+		ServiceHeaders: map[string][]string{"service-000": {"X-Canary"}},
+	})
+
+	snapshot, _, err := src.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	dst, dstStore := newTestService()
+	dst.PutServiceSpec(&spec.Service{Name: "stale"})
+	dst.PutServiceSpec(&spec.Service{Name: "service-000"})
+	staleStatusKey := layout.ServiceInstanceStatusKey("stale", "ins-1")
+	dstStore.Put(staleStatusKey, "serviceName: stale\ninstanceID: ins-1\n")
+	if err = dst.Restore(snapshot, WithClearExisting()); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	restored, _, err := dst.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if !reflect.DeepEqual(snapshot, restored) {
+		t.Errorf("restored snapshot should equal to the original one")
+	}
+	if dst.GetServiceSpec("stale") != nil {
+		t.Errorf("existing specs should be cleared")
+	}
+	if _, ok := dstStore.kvs[staleStatusKey]; ok {
+		t.Errorf("existing instance statuses should be cleared")
+	}
+
+	// a failed restoring never leaves the store cleared without the snapshot.
+	partial, partialStore := newTestService()
+	partial.PutServiceSpec(&spec.Service{Name: "stale"})
+	partial.store = newReadOnlyGuard(partial, &failingStorage{mockStorage: partialStore, succeeded: 1})
+	if err = partial.Restore(snapshot, WithClearExisting()); err == nil {
+		t.Fatalf("restore should fail")
+	}
+	if _, ok := partialStore.kvs[layout.ServiceSpecKey("stale")]; !ok {
+		t.Errorf("existing specs should be cleared after the snapshot is written")
+	}
+
+	// the invalid snapshot is not written at all.
+	invalid := &MeshSnapshot{
+		Tenants:  []*spec.Tenant{{Name: "new-tenant"}},
+		Services: []*spec.Service{{Name: "invalid"}},
+	}
+	empty, _ := newTestService()
+	if err = empty.Restore(invalid); err == nil {
+		t.Errorf("invalid snapshot should be rejected")
+	}
+	if empty.GetTenantSpec("new-tenant") != nil {
+		t.Errorf("nothing should be written for invalid snapshot")
+	}
+}
+
+func TestCanaryCohort(t *testing.T) {
+	s, _ := newTestService()
+
+	for _, instance := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "ins-2"},
+		{ServiceName: "order", InstanceID: "ins-1"},
+		{ServiceName: "delivery", InstanceID: "ins-1"},
+	} {
+		s.PutServiceInstanceSpec(instance)
+	}
+
+	if err := s.AddInstanceToCohort("v2", "order", "missing"); err == nil {
+		t.Errorf("adding missing instance should fail")
+	}
+
+	for _, instance := range [][2]string{{"order", "ins-2"}, {"order", "ins-1"}, {"delivery", "ins-1"}} {
+		if err := s.AddInstanceToCohort("v2", instance[0], instance[1]); err != nil {
+			t.Fatalf("add instance to cohort failed: %v", err)
+		}
+	}
+	if err := s.AddInstanceToCohort("v3", "order", "ins-1"); err != nil {
+		t.Fatalf("add instance to cohort failed: %v", err)
+	}
+
+	members := s.ListCohortInstances("v2")
+	joinTime := members[1].JoinTime
+	// adding again is a no-op.
+	if err := s.AddInstanceToCohort("v2", "order", "ins-1"); err != nil {
+		t.Fatalf("add instance to cohort again failed: %v", err)
+	}
+
+	members = s.ListCohortInstances("v2")
+	ids := []string{}
+	for _, member := range members {
+		if member.Cohort != "v2" || member.JoinTime == "" {
+			t.Errorf("unexpected member: %+v", member)
+		}
+		ids = append(ids, member.ServiceName+"/"+member.InstanceID)
+	}
+	if !reflect.DeepEqual(ids, []string{"delivery/ins-1", "order/ins-1", "order/ins-2"}) {
+		t.Errorf("unexpected members: %v", ids)
+	}
+	if members[1].JoinTime != joinTime {
+		t.Errorf("join time should be kept")
+	}
+
+	if err := s.RemoveInstanceFromCohort("v2", "order", "ins-1"); err != nil {
+		t.Fatalf("remove instance from cohort failed: %v", err)
+	}
+	if err := s.RemoveInstanceFromCohort("v2", "order", "missing"); err != nil {
+		t.Errorf("removing non-member should be a no-op, got %v", err)
+	}
+	if members = s.ListCohortInstances("v2"); len(members) != 2 {
+		t.Errorf("expect 2 members, got %d", len(members))
+	}
+	if members = s.ListCohortInstances("v3"); len(members) != 1 {
+		t.Errorf("other cohorts should be untouched, got %d members", len(members))
+	}
+}
+
+func TestGetServiceSpecProjection(t *testing.T) {
+	s, store := newTestService()
+	s.PutServiceSpec(&spec.Service{
+		Name:           "order",
+		RegisterTenant: "shop",
+		LoadBalance:    &spec.LoadBalance{Policy: "roundRobin"},
+		Sidecar:        &spec.Sidecar{IngressPort: 13001},
+	})
+
+	paths := []spec.GJSONPath{"name", "registerTenant", "loadBalance.policy", "unknownField"}
+	projection, err := s.GetServiceSpecProjection("order", paths)
+	if err != nil {
+		t.Fatalf("get service spec projection failed: %v", err)
+	}
+
+	if len(projection) != len(paths) {
+		t.Errorf("expect %d paths, got %v", len(paths), projection)
+	}
+	if projection["name"].String() != "order" || projection["registerTenant"].String() != "shop" ||
+		projection["loadBalance.policy"].String() != "roundRobin" {
+		t.Errorf("unexpected projection: %v", projection)
+	}
+	if projection["unknownField"].Exists() {
+		t.Errorf("missing part should not exist, got %v", projection["unknownField"])
+	}
+	if _, ok := projection["sidecar"]; ok {
+		t.Errorf("part not requested should be absent")
+	}
+
+	if _, err = s.GetServiceSpecProjection("order", []spec.GJSONPath{"sidecar..ingressPort"}); err == nil {
+		t.Errorf("invalid path should be rejected")
+	}
+	if projection, err = s.GetServiceSpecProjection("missing", paths); projection != nil || err != nil {
+		t.Errorf("expect nil projection of missing service, got %v, %v", projection, err)
+	}
+
+	// the values stored in the older schema are projected after migration.
+	store.Put(layout.ServiceSpecKey("legacy"), "name: legacy\nregisterTenant: shop\n")
+	projection, err = s.GetServiceSpecProjection("legacy", []spec.GJSONPath{"apiVersion", "name"})
+	if err != nil {
+		t.Fatalf("get service spec projection failed: %v", err)
+	}
+	if projection["apiVersion"].String() != spec.CurrentAPIVersion || projection["name"].String() != "legacy" {
+		t.Errorf("unexpected projection of legacy spec: %v", projection)
+	}
+}
+
+func TestScheduledSpecChange(t *testing.T) {
+	s, store := newTestService()
+
+	now := time.Now()
+	due, err := s.ScheduleSpecChange(now.Add(-time.Second), SpecChange{
+		Tenant: &spec.Tenant{Name: "shop", Description: "due"},
+	})
+	if err != nil {
+		t.Fatalf("schedule change failed: %v", err)
+	}
+	_, err = s.ScheduleSpecChange(now.Add(time.Hour), SpecChange{
+		Tenant: &spec.Tenant{Name: "shop", Description: "future"},
+	})
+	if err != nil {
+		t.Fatalf("schedule change failed: %v", err)
+	}
+	cancelled, err := s.ScheduleSpecChange(now.Add(-time.Minute), SpecChange{
+		Tenant: &spec.Tenant{Name: "cancelled"},
+	})
+	if err != nil {
+		t.Fatalf("schedule change failed: %v", err)
+	}
+	if _, err = s.ScheduleSpecChange(now, SpecChange{}); err == nil {
+		t.Errorf("invalid change should be rejected")
+	}
+
+	if err = s.CancelScheduledChange(cancelled); err != nil {
+		t.Fatalf("cancel change failed: %v", err)
+	}
+
+	applied, err := s.ProcessScheduledChanges(now)
+	if err != nil {
+		t.Fatalf("process changes failed: %v", err)
+	}
+	if applied != 1 {
+		t.Errorf("expect 1 applied change, got %d", applied)
+	}
+	if tenant := s.GetTenantSpec("shop"); tenant == nil || tenant.Description != "due" {
+		t.Errorf("due change should be applied, got %+v", tenant)
+	}
+	if s.GetTenantSpec("cancelled") != nil {
+		t.Errorf("cancelled change should not be applied")
+	}
+
+	changes, err := s.ListScheduledChanges()
+	if err != nil {
+		t.Fatalf("list changes failed: %v", err)
+	}
+	if len(changes) != 1 || changes[0].ID == due {
+		t.Fatalf("expect only the future change left, got %v", changes)
+	}
+
+	applied, _ = s.ProcessScheduledChanges(now.Add(time.Minute))
+	if applied != 0 || s.GetTenantSpec("shop").Description != "due" {
+		t.Errorf("future change should not be applied before its time")
+	}
+
+	applied, _ = s.ProcessScheduledChanges(now.Add(2 * time.Hour))
+	if applied != 1 || s.GetTenantSpec("shop").Description != "future" {
+		t.Errorf("future change should be applied at its time")
+	}
+
+	// the change cancelled between listing and applying is skipped.
+	racy, err := s.ScheduleSpecChange(now, SpecChange{Tenant: &spec.Tenant{Name: "racy"}})
+	if err != nil {
+		t.Fatalf("schedule change failed: %v", err)
+	}
+	racing := &racingStorage{mockStorage: store}
+	racing.beforeWrite = func() {
+		store.Delete(layout.ScheduledChangeKey(racy))
+	}
+	s.store = newReadOnlyGuard(s, racing)
+	applied, err = s.ProcessScheduledChanges(now.Add(time.Minute))
+	if err != nil || applied != 0 {
+		t.Errorf("expect no applied change, got %d, %v", applied, err)
+	}
+	if s.GetTenantSpec("racy") != nil {
+		t.Errorf("change cancelled meanwhile should not be applied")
+	}
+}
+
+func TestListUndeclaredTenants(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"order"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "unused"})
+	s.PutServiceSpec(&spec.Service{Name: "gateway", RegisterTenant: spec.GlobalTenant})
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "payment", RegisterTenant: "ghost"})
+	s.PutServiceSpec(&spec.Service{Name: "orphan"})
+
+	referenced := s.ListReferencedTenants()
+	if !reflect.DeepEqual(referenced, []string{"ghost", spec.GlobalTenant, "shop"}) {
+		t.Errorf("unexpected referenced tenants: %v", referenced)
+	}
+
+	undeclared := s.ListUndeclaredTenants()
+	if !reflect.DeepEqual(undeclared, []string{"ghost"}) {
+		t.Errorf("expect undeclared tenant ghost, got %v", undeclared)
+	}
+
+	s.PutTenantSpec(&spec.Tenant{Name: "ghost", Services: []string{"payment"}})
+	if undeclared = s.ListUndeclaredTenants(); len(undeclared) != 0 {
+		t.Errorf("expect no undeclared tenant, got %v", undeclared)
+	}
+}
+
+func TestInstanceMaintenance(t *testing.T) {
+	s, _ := newTestService()
+
+	now := time.Now()
+	for _, id := range []string{"maintained", "expired", "stale"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName:  "order",
+			InstanceID:   id,
+			RegistryTime: now.Add(-2 * time.Hour).Format(time.RFC3339),
+		})
+	}
+
+	if err := s.SetInstanceMaintenance("order", "maintained", now.Add(time.Hour)); err != nil {
+		t.Fatalf("set maintenance failed: %v", err)
+	}
+	if err := s.SetInstanceMaintenance("order", "expired", now.Add(-time.Minute)); err != nil {
+		t.Fatalf("set maintenance failed: %v", err)
+	}
+	if err := s.SetInstanceMaintenance("order", "missing", now.Add(time.Hour)); err == nil {
+		t.Errorf("setting maintenance of missing instance should fail")
+	}
+
+	if !s.IsInstanceInMaintenance("order", "maintained") {
+		t.Errorf("instance should be in maintenance")
+	}
+	if s.IsInstanceInMaintenance("order", "expired") || s.IsInstanceInMaintenance("order", "stale") {
+		t.Errorf("instance should not be in maintenance")
+	}
+
+	count, err := s.PruneServiceInstanceSpecs("order", time.Hour)
+	if err != nil {
+		t.Fatalf("prune service instance specs failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expect 2 pruned instances, got %d", count)
+	}
+	if s.GetServiceInstanceSpec("order", "maintained") == nil {
+		t.Fatalf("instance in maintenance should not be pruned")
+	}
+
+	if err = s.SetInstanceMaintenance("order", "maintained", time.Time{}); err != nil {
+		t.Fatalf("end maintenance failed: %v", err)
+	}
+	if s.IsInstanceInMaintenance("order", "maintained") {
+		t.Errorf("maintenance should be ended")
+	}
+	if count, _ = s.PruneServiceInstanceSpecs("order", time.Hour); count != 1 {
+		t.Errorf("instance should be pruned after maintenance, got %d pruned", count)
+	}
+}
+
+func TestListCustomResourcesSorted(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutCustomResourceKind(&spec.CustomResourceKind{Name: "dns"})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r1", "spec": map[string]interface{}{"ttl": 300}})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r2", "spec": map[string]interface{}{"ttl": 30}})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r3"})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r4", "spec": map[string]interface{}{"ttl": 60}})
+	s.PutCustomResource(&spec.CustomResource{"kind": "dns", "name": "r5", "spec": map[string]interface{}{"ttl": 30}})
+
+	names := func(resources []*spec.CustomResource) []string {
+		result := []string{}
+		for _, r := range resources {
+			result = append(result, r.Name())
+		}
+		return result
+	}
+
+	resources, err := s.ListCustomResourcesSorted("dns", "spec.ttl", 0)
+	if err != nil {
+		t.Fatalf("list sorted custom resources failed: %v", err)
+	}
+	if got, expected := names(resources), []string{"r2", "r5", "r4", "r1", "r3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expect order %v, got %v", expected, got)
+	}
+
+	resources, _ = s.ListCustomResourcesSorted("dns", "spec.ttl", 3)
+	if got, expected := names(resources), []string{"r2", "r5", "r4"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expect limited order %v, got %v", expected, got)
+	}
+
+	resources, _ = s.ListCustomResourcesSorted("dns", "name", 2)
+	if got, expected := names(resources), []string{"r1", "r2"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expect order by name %v, got %v", expected, got)
+	}
+
+	if _, err = s.ListCustomResourcesSorted("dns", "spec..ttl", 0); err == nil {
+		t.Errorf("invalid sort path should be rejected")
+	}
+	if _, err = s.ListCustomResourcesSorted("dns", "spec.ttl", -1); err == nil {
+		t.Errorf("negative limit should be rejected")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "shop"})
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"order", "delivery"}})
+	instances := []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "ins-1", Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "ins-2", Status: spec.ServiceStatusUp},
+		{ServiceName: "delivery", InstanceID: "ins-1", Status: spec.ServiceStatusOutOfService},
+	}
+	for _, instance := range instances {
+		s.PutServiceInstanceSpec(instance)
+	}
+
+	buff := &bytes.Buffer{}
+	if err := s.WriteMetrics(buff); err != nil {
+		t.Fatalf("write metrics failed: %v", err)
+	}
+
+	sampleRegexp := regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"\})? (-?[0-9]+)$`)
+	typed := map[string]bool{}
+	samples := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(buff.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 || fields[3] != "gauge" {
+				t.Errorf("invalid type line: %q", line)
+				continue
+			}
+			typed[fields[2]] = true
+			continue
+		}
+
+		m := sampleRegexp.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid sample line: %q", line)
+			continue
+		}
+		if !typed[m[1]] {
+			t.Errorf("sample %q should follow its type line", line)
+		}
+		samples[m[1]+m[2]] = m[3]
+	}
+
+	expected := map[string]string{
+		`easegress_mesh_services`:                                     "2",
+		`easegress_mesh_service_instances{service="order"}`:           "2",
+		`easegress_mesh_service_instances{service="delivery"}`:        "1",
+		`easegress_mesh_instances_by_status{status="UP"}`:             "2",
+		`easegress_mesh_instances_by_status{status="OUT_OF_SERVICE"}`: "1",
+		`easegress_mesh_tenants`:                                      "1",
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("expect samples %v, got %v", expected, samples)
+	}
+}
+
+func TestReconcileTenantMembership(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutTenantSpec(&spec.Tenant{Name: "shop", Services: []string{"order", "payment"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "logistics", Services: []string{"order"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "empty", Services: []string{"ghost"}})
+	s.PutTenantSpec(&spec.Tenant{Name: "consistent", Services: []string{"b", "a"}})
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "payment", RegisterTenant: "logistics"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "logistics"})
+	s.PutServiceSpec(&spec.Service{Name: "gateway", RegisterTenant: spec.GlobalTenant})
+	s.PutServiceSpec(&spec.Service{Name: "a", RegisterTenant: "consistent"})
+	s.PutServiceSpec(&spec.Service{Name: "b", RegisterTenant: "consistent"})
+
+	_, consistentKV := s.GetTenantSpecWithInfo("consistent")
+
+	if err := s.ReconcileTenantMembership(); err != nil {
+		t.Fatalf("reconcile tenant membership failed: %v", err)
+	}
+
+	expected := map[string][]string{
+		"shop":            {"order"},
+		"logistics":       {"delivery", "payment"},
+		"empty":           {},
+		spec.GlobalTenant: {"gateway"},
+		"consistent":      {"b", "a"},
+	}
+	for name, services := range expected {
+		tenant := s.GetTenantSpec(name)
+		if tenant == nil {
+			t.Errorf("tenant %s should exist", name)
+			continue
+		}
+		if !reflect.DeepEqual(tenant.Services, services) {
+			t.Errorf("expect services %v of tenant %s, got %v", services, name, tenant.Services)
+		}
+	}
+
+	if _, kv := s.GetTenantSpecWithInfo("consistent"); kv.ModRevision != consistentKV.ModRevision {
+		t.Errorf("consistent tenant should not be rewritten")
+	}
+
+	_, shopKV := s.GetTenantSpecWithInfo("shop")
+	if err := s.ReconcileTenantMembership(); err != nil {
+		t.Fatalf("reconcile tenant membership failed: %v", err)
+	}
+	if _, kv := s.GetTenantSpecWithInfo("shop"); kv.ModRevision != shopKV.ModRevision {
+		t.Errorf("reconciled tenants should not be rewritten again")
+	}
+}
+
+func TestRegisterInstanceWithInitialStatus(t *testing.T) {
+	s, store := newTestService()
+
+	instance := &spec.ServiceInstanceSpec{
+		ServiceName: "order",
+		InstanceID:  "ins-1",
+		IP:          "127.0.0.1",
+		Port:        8080,
+		Status:      spec.ServiceStatusUp,
+	}
+	if err := s.RegisterInstanceWithInitialStatus(instance); err != nil {
+		t.Fatalf("register instance failed: %v", err)
+	}
+
+	statusKey := layout.ServiceInstanceStatusKey("order", "ins-1")
+	getStatus := func() *spec.ServiceInstanceStatus {
+		kv := store.kvs[statusKey]
+		if kv == nil {
+			return nil
+		}
+		status := &spec.ServiceInstanceStatus{}
+		if err := storage.Decode(statusKey, kv.Value, status); err != nil {
+			t.Fatalf("decode status failed: %v", err)
+		}
+		return status
+	}
+
+	if s.GetServiceInstanceSpec("order", "ins-1") == nil {
+		t.Fatalf("instance spec should be written")
+	}
+	status := getStatus()
+	if status == nil || status.Phase != spec.ServiceInstancePhasePending || status.LastHeartbeatTime != "" {
+		t.Errorf("expect pending status, got %+v", status)
+	}
+
+	// the existing status is kept on registering again.
+	reported := &spec.ServiceInstanceStatus{
+		ServiceName:       "order",
+		InstanceID:        "ins-1",
+		LastHeartbeatTime: time.Now().Format(time.RFC3339),
+	}
+	store.Put(statusKey, *marshalToString(reported))
+	instance.Port = 8081
+	if err := s.RegisterInstanceWithInitialStatus(instance); err != nil {
+		t.Fatalf("register instance failed: %v", err)
+	}
+	if s.GetServiceInstanceSpec("order", "ins-1").Port != 8081 {
+		t.Errorf("instance spec should be updated")
+	}
+	if status = getStatus(); status.Phase != "" || status.LastHeartbeatTime == "" {
+		t.Errorf("existing status should be kept, got %+v", status)
+	}
+
+	// the status reported between reading and writing is not overwritten.
+	racing := &racingStorage{mockStorage: store}
+	racing.beforeWrite = func() {
+		reported.InstanceID = "ins-2"
+		store.Put(layout.ServiceInstanceStatusKey("order", "ins-2"), *marshalToString(reported))
+	}
+	s.store = newReadOnlyGuard(s, racing)
+	instance.InstanceID = "ins-2"
+	if err := s.RegisterInstanceWithInitialStatus(instance); err != nil {
+		t.Fatalf("register instance failed: %v", err)
+	}
+	if s.GetServiceInstanceSpec("order", "ins-2") == nil {
+		t.Errorf("instance spec should be written")
+	}
+	statusKey = layout.ServiceInstanceStatusKey("order", "ins-2")
+	if status = getStatus(); status.Phase != "" || status.LastHeartbeatTime == "" {
+		t.Errorf("reported status should not be overwritten, got %+v", status)
+	}
+}
+
+// failingStorage fails the transactions after the succeeded ones.
+type failingStorage struct {
+	*mockStorage
+	succeeded int
+}
+
+func (fs *failingStorage) PutAndDelete(kvs map[string]*string) error {
+	if fs.succeeded == 0 {
+		return fmt.Errorf("transaction failed")
+	}
+	fs.succeeded--
+	return fs.mockStorage.PutAndDelete(kvs)
+}
+
+// racingStorage calls beforeWrite once before the first transaction.
+type racingStorage struct {
+	*mockStorage
+	beforeWrite func()
+}
+
+func (rs *racingStorage) CompareAndPutAndDelete(revisions map[string]int64, kvs map[string]*string) (bool, error) {
+	if rs.beforeWrite != nil {
+		rs.beforeWrite()
+		rs.beforeWrite = nil
+	}
+	return rs.mockStorage.CompareAndPutAndDelete(revisions, kvs)
+}
+
+func TestRegisterInstanceFromTemplate(t *testing.T) {
+	s, _ := newTestService()
+
+	if _, err := s.RegisterInstanceFromTemplate("order", "ins-1", nil); err == nil {
+		t.Errorf("registering without template should fail")
+	}
+
+	err := s.PutInstanceTemplate(&spec.InstanceTemplate{
+		ServiceName:  "order",
+		RegistryName: "mesh",
+		IP:           "10.0.0.1",
+		Port:         8080,
+		Labels:       map[string]string{"version": "v1", "zone": "a"},
+		Status:       spec.ServiceStatusUp,
+	})
+	if err != nil {
+		t.Fatalf("put instance template failed: %v", err)
+	}
+
+	instance, err := s.RegisterInstanceFromTemplate("order", "ins-1", map[string]interface{}{
+		"ip":     "10.0.0.2",
+		"labels": map[string]interface{}{"version": "v2"},
+	})
+	if err != nil {
+		t.Fatalf("register instance from template failed: %v", err)
+	}
+
+	stored := s.GetServiceInstanceSpec("order", "ins-1")
+	if stored == nil || stored.IP != instance.IP || stored.RegistryTime != instance.RegistryTime {
+		t.Fatalf("expect stored instance %+v, got %+v", instance, stored)
+	}
+	if stored.RegistryName != "mesh" || stored.Port != 8080 || stored.Status != spec.ServiceStatusUp {
+		t.Errorf("template fields should apply, got %+v", stored)
+	}
+	if stored.IP != "10.0.0.2" {
+		t.Errorf("overrides should win, got ip %s", stored.IP)
+	}
+	if expected := map[string]string{"version": "v2", "zone": "a"}; !reflect.DeepEqual(stored.Labels, expected) {
+		t.Errorf("expect labels %v, got %v", expected, stored.Labels)
+	}
+	if stored.ServiceName != "order" || stored.InstanceID != "ins-1" || stored.RegistryTime == "" {
+		t.Errorf("identity and registry time should be set, got %+v", stored)
+	}
+
+	// the merged result is validated.
+	if _, err = s.RegisterInstanceFromTemplate("order", "ins-2", map[string]interface{}{"port": "http"}); err == nil {
+		t.Errorf("invalid merged instance should be rejected")
+	}
+	if _, err = s.RegisterInstanceFromTemplate("order", "ins-2", map[string]interface{}{"unknown": 1}); err == nil {
+		t.Errorf("unknown override field should be rejected")
+	}
+	if s.GetServiceInstanceSpec("order", "ins-2") != nil {
+		t.Errorf("invalid instance should not be written")
+	}
+}
+
+func TestGetIngressWithBackends(t *testing.T) {
+	s, _ := newTestService()
+
+	ingress, backends, missing, err := s.GetIngressWithBackends("missing")
+	if err != nil || ingress != nil || backends != nil || missing != nil {
+		t.Errorf("expect nothing for missing ingress, got %v %v %v %v", ingress, backends, missing, err)
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "shop"})
+	s.PutServiceSpec(&spec.Service{Name: "unreferenced", RegisterTenant: "shop"})
+	s.PutIngressSpec(&spec.Ingress{
+		Name: "shop-ingress",
+		Rules: []*spec.IngressRule{
+			{
+				Host: "shop.example.com",
+				Paths: []*spec.IngressPath{
+					{Path: "/order", Backend: "order"},
+					{Path: "/orders", Backend: "order"},
+					{Path: "/ghost", Backend: "ghost"},
+				},
+			},
+			{Paths: []*spec.IngressPath{{Path: "/delivery", Backend: "delivery"}}},
+		},
+	})
+
+	ingress, backends, missing, err = s.GetIngressWithBackends("shop-ingress")
+	if err != nil {
+		t.Fatalf("get ingress with backends failed: %v", err)
+	}
+	if ingress == nil || ingress.Name != "shop-ingress" || len(ingress.Rules) != 2 {
+		t.Fatalf("unexpected ingress: %+v", ingress)
+	}
+
+	names := []string{}
+	for name, service := range backends {
+		if service.Name != name {
+			t.Errorf("backend %s keyed by %s", service.Name, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if expected := []string{"delivery", "order"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expect backends %v, got %v", expected, names)
+	}
+
+	if !reflect.DeepEqual(missing, []string{"ghost"}) {
+		t.Errorf("expect missing backend ghost, got %v", missing)
+	}
+}
+
+func TestServiceSpecHistory(t *testing.T) {
+	s, _ := newTestService()
+	s.spec.ServiceSpecHistoryDepth = 3
+
+	history, err := s.GetServiceSpecHistory("order", 0)
+	if err != nil || len(history) != 0 {
+		t.Fatalf("expect empty history, got %v %v", history, err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: fmt.Sprintf("t%d", i)})
+	}
+	// writing the same spec doesn't add history.
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "t5"})
+	s.PutServiceSpec(&spec.Service{Name: "delivery", RegisterTenant: "t1"})
+
+	history, err = s.GetServiceSpecHistory("order", 0)
+	if err != nil {
+		t.Fatalf("get service spec history failed: %v", err)
+	}
+	tenants := []string{}
+	for i, version := range history {
+		tenants = append(tenants, version.Spec.RegisterTenant)
+		if version.ReplacedAt == "" {
+			t.Errorf("replaced time should be set")
+		}
+		if i > 0 && version.Revision >= history[i-1].Revision {
+			t.Errorf("history should be sorted from the newest to the oldest")
+		}
+	}
+	if expected := []string{"t4", "t3", "t2"}; !reflect.DeepEqual(tenants, expected) {
+		t.Errorf("expect history %v trimmed to depth, got %v", expected, tenants)
+	}
+
+	history, _ = s.GetServiceSpecHistory("order", 2)
+	if len(history) != 2 || history[0].Spec.RegisterTenant != "t4" {
+		t.Errorf("expect the latest 2 versions, got %v", history)
+	}
+
+	if history, _ = s.GetServiceSpecHistory("delivery", 0); len(history) != 0 {
+		t.Errorf("new service should have no history, got %v", history)
+	}
+}
+
+func TestGetServiceSpecAtRevision(t *testing.T) {
+	s, store := newTestService()
+
+	revision := func() int64 {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return store.revision
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "t1"})
+	rev1 := revision()
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "t2"})
+	rev2 := revision()
+	s.DeleteServiceSpec("order")
+	rev3 := revision()
+
+	for rev, tenant := range map[int64]string{rev1: "t1", rev2: "t2"} {
+		serviceSpec, err := s.GetServiceSpecAtRevision("order", rev)
+		if err != nil {
+			t.Fatalf("get service at revision %d failed: %v", rev, err)
+		}
+		if serviceSpec == nil || serviceSpec.RegisterTenant != tenant {
+			t.Errorf("expect service of tenant %s at revision %d, got %+v", tenant, rev, serviceSpec)
+		}
+	}
+
+	if serviceSpec, err := s.GetServiceSpecAtRevision("order", rev3); err != nil || serviceSpec != nil {
+		t.Errorf("deleted service should be nil at revision %d, got %+v, %v", rev3, serviceSpec, err)
+	}
+	if serviceSpec, err := s.GetServiceSpecAtRevision("order", rev1-1); err != nil || serviceSpec != nil {
+		t.Errorf("service should be nil before creation, got %+v, %v", serviceSpec, err)
+	}
+
+	store.compact(rev2)
+	if _, err := s.GetServiceSpecAtRevision("order", rev1); !errors.Is(err, storage.ErrCompacted) {
+		t.Errorf("expect compacted error at revision %d, got %v", rev1, err)
+	}
+	if serviceSpec, err := s.GetServiceSpecAtRevision("order", rev2); err != nil || serviceSpec == nil {
+		t.Errorf("service at compacted revision should be kept, got %+v, %v", serviceSpec, err)
+	}
+}
+
+func TestComputeServiceStatusAggregate(t *testing.T) {
+	s, store := newTestService()
+
+	putStatus := func(status *spec.ServiceInstanceStatus) {
+		store.Put(layout.ServiceInstanceStatusKey(status.ServiceName, status.InstanceID), *marshalToString(status))
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		putStatus(&spec.ServiceInstanceStatus{
+			ServiceName:       "order",
+			InstanceID:        fmt.Sprintf("ins-%d", i),
+			LastHeartbeatTime: now.Add(-time.Duration(i) * 7 * time.Second).Format(time.RFC3339),
+		})
+	}
+	putStatus(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: "pending", Phase: spec.ServiceInstancePhasePending})
+	putStatus(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: "invalid", LastHeartbeatTime: "invalid"})
+	putStatus(&spec.ServiceInstanceStatus{ServiceName: "delivery", InstanceID: "ins-0", LastHeartbeatTime: now.Format(time.RFC3339)})
+
+	aggregate := s.ComputeServiceStatusAggregate("order")
+	if aggregate.ServiceName != "order" || aggregate.Instances != 12 || aggregate.Pending != 1 ||
+		aggregate.Healthy != 2 || aggregate.Unhealthy != 9 {
+		t.Errorf("unexpected counts: %+v", aggregate)
+	}
+
+	// the heartbeat times are truncated to seconds.
+	for name, c := range map[string]struct {
+		got, expect time.Duration
+	}{
+		"p50": {aggregate.StalenessP50, 28 * time.Second},
+		"p95": {aggregate.StalenessP95, 63 * time.Second},
+		"max": {aggregate.StalenessMax, 63 * time.Second},
+	} {
+		if c.got < c.expect || c.got > c.expect+2*time.Second {
+			t.Errorf("expect %s staleness about %v, got %v", name, c.expect, c.got)
+		}
+	}
+
+	aggregate = s.ComputeServiceStatusAggregate("unknown")
+	if aggregate.Instances != 0 || aggregate.StalenessMax != 0 {
+		t.Errorf("expect empty aggregate, got %+v", aggregate)
+	}
+}
+
+func TestCheckTenantQuota(t *testing.T) {
+	s, store := newTestService()
+
+	putTenant := func(tenant *spec.Tenant) {
+		store.Put(layout.TenantSpecKey(tenant.Name), *marshalToString(tenant))
+	}
+	putInstance := func(serviceName, instanceID string) {
+		instance := &spec.ServiceInstanceSpec{ServiceName: serviceName, InstanceID: instanceID}
+		store.Put(layout.ServiceInstanceSpecKey(serviceName, instanceID), *marshalToString(instance))
+	}
+
+	putTenant(&spec.Tenant{Name: "shop", Services: []string{"order", "delivery"}, Quota: 3})
+	putTenant(&spec.Tenant{Name: "unlimited", Services: []string{"payment"}})
+	putInstance("order", "ins-1")
+	putInstance("order", "ins-2")
+	putInstance("payment", "ins-1")
+	putInstance("payment", "ins-2")
+
+	for _, c := range []struct {
+		tenant    string
+		requested int
+		expected  bool
+	}{
+		{"shop", 0, true},
+		{"shop", 1, true},
+		{"shop", 2, false},
+		{"unlimited", 100, true},
+	} {
+		ok, err := s.CheckTenantQuota(c.tenant, c.requested)
+		if err != nil {
+			t.Fatalf("check quota of tenant %s failed: %v", c.tenant, err)
+		}
+		if ok != c.expected {
+			t.Errorf("expect quota check of tenant %s requesting %d to be %v, got %v",
+				c.tenant, c.requested, c.expected, ok)
+		}
+	}
+
+	// the usage grows with the instances of the tenant only.
+	putInstance("delivery", "ins-1")
+	if ok, _ := s.CheckTenantQuota("shop", 1); ok {
+		t.Errorf("quota check should fail over the limit")
+	}
+
+	if _, err := s.CheckTenantQuota("unknown", 1); err == nil {
+		t.Errorf("quota check of unknown tenant should fail")
+	}
+	if _, err := s.CheckTenantQuota("shop", -1); err == nil {
+		t.Errorf("quota check of negative usage should fail")
+	}
+}
+
+// scriptedStorage serves the reads with the scripted store and sentinel revisions in turn.
+type scriptedStorage struct {
+	*mockStorage
+	revisions    []int64
+	modRevisions []int64
+}
+
+func (ss *scriptedStorage) GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error) {
+	revision, modRevision := ss.revisions[0], ss.modRevisions[0]
+	ss.revisions, ss.modRevisions = ss.revisions[1:], ss.modRevisions[1:]
+
+	kvs := map[string]*mvccpb.KeyValue{}
+	if modRevision > 0 {
+		key := layout.ConsistencySentinelKey()
+		kvs[key] = &mvccpb.KeyValue{Key: []byte(key), ModRevision: modRevision}
+	}
+	return kvs, revision, nil
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	s, store := newTestService()
+	if err := s.VerifyConsistency(); err != nil {
+		t.Errorf("verify consistency of empty store failed: %v", err)
+	}
+	store.Put(layout.ConsistencySentinelKey(), "sentinel")
+	store.Put("/other", "value")
+	if err := s.VerifyConsistency(); err != nil {
+		t.Errorf("verify consistency failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		name         string
+		revisions    []int64
+		modRevisions []int64
+		consistent   bool
+	}{
+		{"advancing", []int64{10, 10, 12}, []int64{5, 5, 11}, true},
+		{"store revision regression", []int64{10, 12, 9}, []int64{5, 5, 5}, false},
+		{"sentinel regression", []int64{10, 10, 10}, []int64{5, 8, 5}, false},
+		{"sentinel deleted", []int64{10, 11, 11}, []int64{5, 0, 0}, true},
+		{"sentinel vanished", []int64{10, 10, 10}, []int64{5, 0, 0}, false},
+		{"sentinel from the future", []int64{10, 10, 10}, []int64{5, 11, 11}, false},
+	} {
+		s.store = newReadOnlyGuard(s, &scriptedStorage{
+			mockStorage:  store,
+			revisions:    c.revisions,
+			modRevisions: c.modRevisions,
+		})
+
+		err := s.VerifyConsistency()
+		if c.consistent && err != nil {
+			t.Errorf("%s: expect consistent, got %v", c.name, err)
+		}
+		if !c.consistent && !errors.Is(err, ErrInconsistentStore) {
+			t.Errorf("%s: expect ErrInconsistentStore, got %v", c.name, err)
+		}
+	}
+}
+
+func TestDeleteServiceSpecReturning(t *testing.T) {
+	s, _ := newTestService()
+
+	existing := &spec.Service{Name: "order", RegisterTenant: "shop"}
+	s.PutServiceSpec(existing)
+
+	deleted, err := s.DeleteServiceSpecReturning("order")
+	if err != nil {
+		t.Fatalf("delete service spec failed: %v", err)
+	}
+	if deleted == nil || deleted.Name != existing.Name || deleted.RegisterTenant != existing.RegisterTenant {
+		t.Errorf("expect the deleted spec %+v, got %+v", existing, deleted)
+	}
+	if s.GetServiceSpec("order") != nil {
+		t.Errorf("service spec should be deleted")
+	}
+
+	deleted, err = s.DeleteServiceSpecReturning("order")
+	if err != nil || deleted != nil {
+		t.Errorf("deleting missing service should return nil, got %+v, %v", deleted, err)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	s, store := newTestService()
+
+	// the simulated old layout keeps service specs under another prefix.
+	const oldPrefix = "/mesh/services/"
+	layoutMigrations[0] = &layoutMigration{
+		prefixes: []string{oldPrefix},
+		rename: func(key string) string {
+			return layout.ServiceSpecKey(strings.TrimPrefix(key, oldPrefix))
+		},
+	}
+	defer delete(layoutMigrations, 0)
+
+	if version, err := s.GetLayoutVersion(); err != nil || version != layout.BaselineVersion {
+		t.Fatalf("expect layout version %d of store without version, got %d, %v", layout.BaselineVersion, version, err)
+	}
+
+	// more keys than a batch.
+	count := layoutMigrationBatchSize + 6
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("service-%d", i)
+		store.Put(oldPrefix+name, *marshalToString(&spec.Service{Name: name, RegisterTenant: "shop"}))
+	}
+	store.Put(layout.VersionKey(), "0")
+
+	if err := s.MigrateLayout(1, 2); err == nil {
+		t.Errorf("migrating from a version other than the stored one should fail")
+	}
+	if err := s.MigrateLayout(1, 0); err == nil {
+		t.Errorf("migrating backward should fail")
+	}
+
+	if err := s.MigrateLayout(0, 1); err != nil {
+		t.Fatalf("migrate layout failed: %v", err)
+	}
+	if version, _ := s.GetLayoutVersion(); version != 1 {
+		t.Errorf("expect layout version 1 after migration, got %d", version)
+	}
+
+	services := s.ListServiceSpecs()
+	if len(services) != count {
+		t.Errorf("expect %d readable services after migration, got %d", count, len(services))
+	}
+	if service := s.GetServiceSpec("service-3"); service == nil || service.RegisterTenant != "shop" {
+		t.Errorf("expect readable service-3, got %+v", service)
+	}
+	if kvs, _ := store.GetRawPrefix(oldPrefix); len(kvs) != 0 {
+		t.Errorf("keys of the old layout should be removed, got %d", len(kvs))
+	}
+
+	if err := s.MigrateLayout(1, 2); err == nil {
+		t.Errorf("migrating without registered migration should fail")
+	}
+}
+
+func TestInitLayoutVersion(t *testing.T) {
+	s, store := newTestService()
+
+	// the store with resources but without version is in the baseline layout.
+	store.Put(layout.TenantSpecKey("shop"), *marshalToString(&spec.Tenant{Name: "shop"}))
+	if err := s.InitLayoutVersion(); err != nil {
+		t.Fatalf("init layout version failed: %v", err)
+	}
+	if value, _ := store.Get(layout.VersionKey()); value != nil {
+		t.Errorf("version of the existing store should not be written, got %s", *value)
+	}
+	if version, _ := s.GetLayoutVersion(); version != layout.BaselineVersion {
+		t.Errorf("expect baseline layout version %d, got %d", layout.BaselineVersion, version)
+	}
+
+	s, store = newTestService()
+	if err := s.InitLayoutVersion(); err != nil {
+		t.Fatalf("init layout version failed: %v", err)
+	}
+	if value, _ := store.Get(layout.VersionKey()); value == nil || *value != strconv.Itoa(layout.Version) {
+		t.Errorf("expect layout version %d written into the fresh store, got %v", layout.Version, value)
+	}
+
+	// the existing version is kept.
+	store.Put(layout.VersionKey(), "0")
+	if err := s.InitLayoutVersion(); err != nil {
+		t.Fatalf("init layout version failed: %v", err)
+	}
+	if version, _ := s.GetLayoutVersion(); version != 0 {
+		t.Errorf("existing layout version should be kept, got %d", version)
+	}
+}
+
+func TestExportImportTenant(t *testing.T) {
+	src, srcStore := newTestService()
+
+	newServiceSpec := func(name, tenant string) *spec.Service {
+		return &spec.Service{
+			Name:           name,
+			RegisterTenant: tenant,
+			Sidecar: &spec.Sidecar{
+				DiscoveryType:   "eureka",
+				Address:         "127.0.0.1",
+				IngressPort:     13001,
+				IngressProtocol: "http",
+				EgressPort:      13002,
+				EgressProtocol:  "http",
+			},
+		}
+	}
+	newIngressSpec := func(name, backend string) *spec.Ingress {
+		return &spec.Ingress{
+			Name:  name,
+			Rules: []*spec.IngressRule{{Paths: []*spec.IngressPath{{Path: "/", Backend: backend}}}},
+		}
+	}
+
+	err := src.ApplyTransaction([]SpecChange{
+		{Tenant: &spec.Tenant{Name: "shop", Services: []string{"order", "delivery"}, Description: "shop"}},
+		{Tenant: &spec.Tenant{Name: "pay", Services: []string{"payment"}}},
+		{Service: newServiceSpec("order", "shop")},
+		{Service: newServiceSpec("delivery", "shop")},
+		{Service: newServiceSpec("payment", "pay")},
+		{ServiceInstance: &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "ins-1", IP: "127.0.0.1", Port: 8080}},
+		{ServiceInstance: &spec.ServiceInstanceSpec{ServiceName: "payment", InstanceID: "ins-1", IP: "127.0.0.1", Port: 8080}},
+		{Ingress: newIngressSpec("shop-ingress", "order")},
+		{Ingress: newIngressSpec("pay-ingress", "payment")},
+		{Ingress: &spec.Ingress{
+			Name: "mixed-ingress",
+			Rules: []*spec.IngressRule{
+				{Host: "shop", Paths: []*spec.IngressPath{{Path: "/order", Backend: "order"}, {Path: "/pay", Backend: "payment"}}},
+				{Host: "pay", Paths: []*spec.IngressPath{{Path: "/", Backend: "payment"}}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("apply transaction failed: %v", err)
+	}
+	for _, status := range []*spec.ServiceInstanceStatus{
+		{ServiceName: "order", InstanceID: "ins-1", LastHeartbeatTime: "2021-01-01T00:00:00Z"},
+		{ServiceName: "payment", InstanceID: "ins-1", LastHeartbeatTime: "2021-01-01T00:00:00Z"},
+	} {
+		srcStore.Put(layout.ServiceInstanceStatusKey(status.ServiceName, status.InstanceID), *marshalToString(status))
+	}
+
+	if _, err = src.ExportTenant("unknown"); err == nil {
+		t.Errorf("exporting unknown tenant should fail")
+	}
+	data, err := src.ExportTenant("shop")
+	if err != nil {
+		t.Fatalf("export tenant failed: %v", err)
+	}
+
+	dst, _ := newTestService()
+	if err = dst.ImportTenant(data); err != nil {
+		t.Fatalf("import tenant failed: %v", err)
+	}
+
+	if tenant := dst.GetTenantSpec("shop"); tenant == nil || tenant.Description != "shop" ||
+		!reflect.DeepEqual(tenant.Services, []string{"order", "delivery"}) {
+		t.Errorf("unexpected imported tenant: %+v", tenant)
+	}
+	if dst.GetServiceSpec("order") == nil || dst.GetServiceSpec("delivery") == nil {
+		t.Errorf("member services should be imported")
+	}
+	if dst.GetServiceInstanceSpec("order", "ins-1") == nil {
+		t.Errorf("instances of member services should be imported")
+	}
+	if statuses := dst.ListAllServiceInstanceStatuses(); len(statuses) != 1 || statuses[0].ServiceName != "order" {
+		t.Errorf("expect the status of order only, got %+v", statuses)
+	}
+	if dst.GetIngressSpec("shop-ingress") == nil {
+		t.Errorf("ingress routing to member services should be imported")
+	}
+	mixed := dst.GetIngressSpec("mixed-ingress")
+	if mixed == nil || len(mixed.Rules) != 1 || len(mixed.Rules[0].Paths) != 1 || mixed.Rules[0].Paths[0].Backend != "order" {
+		t.Errorf("only the paths routing to member services should be imported, got %+v", mixed)
+	}
+
+	// nothing out of the tenant is imported.
+	if dst.GetTenantSpec("pay") != nil || dst.GetServiceSpec("payment") != nil ||
+		dst.GetServiceInstanceSpec("payment", "ins-1") != nil || dst.GetIngressSpec("pay-ingress") != nil {
+		t.Errorf("resources out of the tenant should not be imported")
+	}
+
+	// the exports of both stores are the same after the round trip.
+	exported, err := dst.ExportTenant("shop")
+	if err != nil {
+		t.Fatalf("export imported tenant failed: %v", err)
+	}
+	if string(exported) != string(data) {
+		t.Errorf("expect the same export after round trip:\n%s\ngot:\n%s", data, exported)
+	}
+
+	if err = dst.ImportTenant(data); err == nil {
+		t.Errorf("importing an existing tenant should fail")
+	}
+
+	// any existing resource fails the import without writing anything.
+	another, anotherStore := newTestService()
+	another.PutServiceSpec(newServiceSpec("delivery", "logistic"))
+	if err = another.ImportTenant(data); err == nil {
+		t.Errorf("importing an existing service should fail")
+	}
+	if len(anotherStore.kvs) != 1 || another.GetServiceSpec("delivery").RegisterTenant != "logistic" {
+		t.Errorf("failed import should write nothing")
+	}
+}
+
+func TestEgressAllowlist(t *testing.T) {
+	s, _ := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order", EgressAllowlist: []string{"delivery", "payment"}})
+	s.PutServiceSpec(&spec.Service{Name: "delivery"})
+	s.PutServiceSpec(&spec.Service{Name: "payment"})
+
+	for _, c := range []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"order", "delivery", true},
+		{"order", "payment", true},
+		{"order", "inventory", false},
+		{"delivery", "order", true},
+		{"delivery", "inventory", true},
+		{"unknown", "order", false},
+	} {
+		if allowed := s.IsEgressAllowed(c.from, c.to); allowed != c.allowed {
+			t.Errorf("expect egress from %s to %s allowed to be %v, got %v", c.from, c.to, c.allowed, allowed)
+		}
+	}
+
+	if err := s.ValidateEgressAllowlist(s.GetServiceSpec("order")); err != nil {
+		t.Errorf("validate egress allowlist failed: %v", err)
+	}
+	err := s.ValidateEgressAllowlist(&spec.Service{Name: "order", EgressAllowlist: []string{"delivery", "inventory"}})
+	if err == nil || !strings.Contains(err.Error(), "inventory") {
+		t.Errorf("expect error of missing service inventory, got %v", err)
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	s, store := newTestService()
+	recorder := &mockRecorder{}
+	s.SetEventRecorder(recorder)
+
+	for i := 0; i < 3; i++ {
+		if err := s.ValidateSpec("Service", "order", "10.0.0.1", &spec.Service{Name: "order"}); err == nil {
+			t.Fatalf("service without required fields should be rejected")
+		}
+	}
+
+	failures := 0
+	for k, v := range store.kvs {
+		if !strings.HasPrefix(k, layout.ValidationFailurePrefix()) {
+			continue
+		}
+		failures++
+		failure := &spec.ValidationFailure{}
+		if err := spec.Decode(v.Value, failure); err != nil {
+			t.Fatalf("decode validation failure failed: %v", err)
+		}
+		if failure.Kind != "Service" || failure.Name != "order" || failure.Source != "10.0.0.1" ||
+			failure.Message == "" || failure.Count != 3 || k != layout.ValidationFailureKey("Service", "order", "10.0.0.1") {
+			t.Errorf("unexpected validation failure %s: %+v", k, failure)
+		}
+	}
+	if failures != 1 {
+		t.Errorf("expect 1 validation failure, got %d", failures)
+	}
+	if events := recorder.list(); len(events) != 3 || events[0] != "Service/order Warning ValidationFailed" {
+		t.Errorf("expect the warning events of validation failures, got %v", events)
+	}
+
+	old := &spec.ValidationFailure{
+		Kind:    "Tenant",
+		Message: "validate failed",
+		Count:   1,
+		Time:    time.Now().Add(-time.Hour).Format(time.RFC3339Nano),
+	}
+	oldKey := layout.ValidationFailureKey(old.Kind, old.Name, old.Source)
+	store.Put(oldKey, *marshalToString(old))
+
+	n, err := s.PruneValidationFailures(time.Now().Add(-time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("expect 1 pruned validation failure, got %d, %v", n, err)
+	}
+	if kv, _ := store.GetRaw(oldKey); kv != nil {
+		t.Errorf("old validation failure should be pruned")
+	}
+	if kvs, _ := store.GetRawPrefix(layout.ValidationFailurePrefix()); len(kvs) != 1 {
+		t.Errorf("recent validation failure should be kept, got %d", len(kvs))
+	}
+}
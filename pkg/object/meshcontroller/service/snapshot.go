@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// MeshSnapshot is the specs of the mesh at one revision, all lists are sorted by keys.
+// The instance statuses are runtime data, so they are not included.
+type MeshSnapshot struct {
+	Services            []*spec.Service             `yaml:"services"`
+	ServiceInstances    []*spec.ServiceInstanceSpec `yaml:"serviceInstances"`
+	Tenants             []*spec.Tenant              `yaml:"tenants"`
+	Ingresses           []*spec.Ingress             `yaml:"ingresses"`
+	CustomResourceKinds []*spec.CustomResourceKind  `yaml:"customResourceKinds"`
+	CustomResources     []spec.CustomResource       `yaml:"customResources"`
+	GlobalCanaryHeaders *spec.GlobalCanaryHeaders   `yaml:"globalCanaryHeaders,omitempty"`
+}
+
+// Snapshot reads all specs of the mesh in one transaction, so the references across
+// resources are coherent, unlike listing them one by one. It returns the snapshot with
+// the revision of the store at which it is taken. The invalid specs are skipped.
+func (s *Service) Snapshot() (*MeshSnapshot, int64, error) {
+	prefixes := []string{
+		layout.ServiceSpecPrefix(),
+		layout.AllServiceInstanceSpecPrefix(),
+		layout.TenantPrefix(),
+		layout.IngressPrefix(),
+		layout.CustomResourceKindPrefix(),
+		layout.AllCustomResourcePrefix(),
+	}
+	kvs, revision, err := s.store.GetRawMultiWithRevision([]string{layout.GlobalCanaryHeaders()}, prefixes)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	snapshot := &MeshSnapshot{}
+	for _, k := range keys {
+		v := kvs[k]
+		decode := func(obj interface{}, decodeFunc func([]byte, interface{}) error) bool {
+			if err := decodeFunc(v.Value, obj); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+				return false
+			}
+			return true
+		}
+
+		switch {
+		case k == layout.GlobalCanaryHeaders():
+			headers := &spec.GlobalCanaryHeaders{}
+			if decode(headers, yaml.Unmarshal) {
+				snapshot.GlobalCanaryHeaders = headers
+			}
+		case strings.HasPrefix(k, layout.ServiceSpecPrefix()):
+			serviceSpec := &spec.Service{}
+			if decode(serviceSpec, spec.Decode) {
+				snapshot.Services = append(snapshot.Services, serviceSpec)
+			}
+		case strings.HasPrefix(k, layout.AllServiceInstanceSpecPrefix()):
+			instance := &spec.ServiceInstanceSpec{}
+			if decode(instance, spec.Decode) {
+				snapshot.ServiceInstances = append(snapshot.ServiceInstances, instance)
+			}
+		case strings.HasPrefix(k, layout.TenantPrefix()):
+			tenant := &spec.Tenant{}
+			if decode(tenant, spec.Decode) {
+				snapshot.Tenants = append(snapshot.Tenants, tenant)
+			}
+		case strings.HasPrefix(k, layout.IngressPrefix()):
+			ingress := &spec.Ingress{}
+			if decode(ingress, spec.Decode) {
+				snapshot.Ingresses = append(snapshot.Ingresses, ingress)
+			}
+		case strings.HasPrefix(k, layout.CustomResourceKindPrefix()):
+			kind := &spec.CustomResourceKind{}
+			if decode(kind, yaml.Unmarshal) {
+				snapshot.CustomResourceKinds = append(snapshot.CustomResourceKinds, kind)
+			}
+		case strings.HasPrefix(k, layout.AllCustomResourcePrefix()):
+			resource := spec.CustomResource{}
+			if decode(&resource, yaml.Unmarshal) {
+				snapshot.CustomResources = append(snapshot.CustomResources, resource)
+			}
+		}
+	}
+
+	return snapshot, revision, nil
+}
+
+const (
+	// maxRestoreTxnOps is the max count of operations in one restoring transaction,
+	// it's the default limit of etcd.
+	maxRestoreTxnOps = 128
+	// maxRestoreTxnBytes is the max size of values in one restoring transaction,
+	// it's less than the default request limit (1.5MiB) of etcd.
+	maxRestoreTxnBytes = 1 << 20
+)
+
+type (
+	// RestoreOption is the option of restoring a snapshot.
+	RestoreOption func(*restoreOptions)
+
+	restoreOptions struct {
+		clearExisting bool
+	}
+)
+
+// WithClearExisting makes restoring delete all existing specs and instance statuses
+// not in the snapshot, so the store is the same as the snapshot after restoring.
+func WithClearExisting() RestoreOption {
+	return func(o *restoreOptions) {
+		o.clearExisting = true
+	}
+}
+
+// Restore validates all resources of the snapshot, and then writes them into the store
+// in transactions sized to the limits of etcd. Nothing is written if the validation fails.
+// NOTE: Large snapshots are written in several transactions, so a failed restoring could
+// be partially applied, and restoring again is safe as it's idempotent.
+func (s *Service) Restore(snapshot *MeshSnapshot, opts ...RestoreOption) error {
+	options := &restoreOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	changes := []SpecChange{}
+	for _, service := range snapshot.Services {
+		changes = append(changes, SpecChange{Service: service})
+	}
+	for _, instance := range snapshot.ServiceInstances {
+		changes = append(changes, SpecChange{ServiceInstance: instance})
+	}
+	for _, tenant := range snapshot.Tenants {
+		changes = append(changes, SpecChange{Tenant: tenant})
+	}
+	for _, ingress := range snapshot.Ingresses {
+		changes = append(changes, SpecChange{Ingress: ingress})
+	}
+	for _, kind := range snapshot.CustomResourceKinds {
+		changes = append(changes, SpecChange{CustomResourceKind: kind})
+	}
+	for i := range snapshot.CustomResources {
+		changes = append(changes, SpecChange{CustomResource: &snapshot.CustomResources[i]})
+	}
+
+	kvs := make(map[string]*string, len(changes)+1)
+	keys := make([]string, 0, len(changes)+1)
+	for i := range changes {
+		rc, err := changes[i].resolve()
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %v", err)
+		}
+		if _, ok := kvs[rc.key]; ok {
+			return fmt.Errorf("invalid snapshot: %s %s duplicated", rc.kind, rc.name)
+		}
+		kvs[rc.key] = rc.value
+		keys = append(keys, rc.key)
+	}
+	if snapshot.GlobalCanaryHeaders != nil {
+		kvs[layout.GlobalCanaryHeaders()] = marshalToString(snapshot.GlobalCanaryHeaders)
+		keys = append(keys, layout.GlobalCanaryHeaders())
+	}
+
+	restored := len(keys)
+	if options.clearExisting {
+		existing, err := s.store.GetRawMulti([]string{layout.GlobalCanaryHeaders()}, []string{
+			layout.ServiceSpecPrefix(),
+			layout.AllServiceInstanceSpecPrefix(),
+			layout.AllServiceInstanceStatusPrefix(),
+			layout.TenantPrefix(),
+			layout.IngressPrefix(),
+			layout.CustomResourceKindPrefix(),
+			layout.AllCustomResourcePrefix(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// NOTE: The deletions follow all puts, so a failed restoring never
+		// leaves the store cleared without the snapshot.
+		deleted := []string{}
+		for key := range existing {
+			if _, ok := kvs[key]; !ok {
+				kvs[key] = nil
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		keys = append(keys, deleted...)
+	}
+
+	if err := s.putInChunks(keys, kvs, nil); err != nil {
+		return err
+	}
+
+	logger.Infof("restored %d resources from snapshot", restored)
+
+	return nil
+}
+
+// putInChunks puts the kvs in the order of keys, in transactions sized to the limits of etcd.
+// The keys with nil values are deleted. If revisions is not nil, every chunk is written only
+// if the mod revisions of its keys equal to the ones in revisions (zero means absent),
+// otherwise it returns ErrConflict without writing the chunk.
+func (s *Service) putInChunks(keys []string, kvs map[string]*string, revisions map[string]int64) error {
+	put := func(chunk map[string]*string) error {
+		if revisions == nil {
+			return s.store.PutAndDelete(chunk)
+		}
+
+		chunkRevisions := make(map[string]int64, len(chunk))
+		for key := range chunk {
+			chunkRevisions[key] = revisions[key]
+		}
+		put, err := s.store.CompareAndPutAndDelete(chunkRevisions, chunk)
+		if err != nil {
+			return err
+		}
+		if !put {
+			return ErrConflict
+		}
+		return nil
+	}
+
+	chunk, size := map[string]*string{}, 0
+	for _, key := range keys {
+		value := kvs[key]
+		opSize := len(key)
+		if value != nil {
+			opSize += len(*value)
+		}
+		if len(chunk) > 0 && (len(chunk) >= maxRestoreTxnOps || size+opSize > maxRestoreTxnBytes) {
+			if err := put(chunk); err != nil {
+				return err
+			}
+			chunk, size = map[string]*string{}, 0
+		}
+		chunk[key] = value
+		size += opSize
+	}
+	if len(chunk) > 0 {
+		if err := put(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
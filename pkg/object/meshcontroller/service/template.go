@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/v"
+)
+
+// GetInstanceTemplate gets the instance template of the service.
+func (s *Service) GetInstanceTemplate(serviceName string) *spec.InstanceTemplate {
+	value, err := s.store.Get(layout.InstanceTemplateKey(serviceName))
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+	if value == nil {
+		return nil
+	}
+
+	template := &spec.InstanceTemplate{}
+	if err = spec.Decode([]byte(*value), template); err != nil {
+		logger.Errorf("BUG: unmarshal %s to yaml failed: %v", *value, err)
+		return nil
+	}
+
+	return template
+}
+
+// PutInstanceTemplate writes the instance template of the service.
+func (s *Service) PutInstanceTemplate(template *spec.InstanceTemplate) error {
+	if vr := v.Validate(template); !vr.Valid() {
+		return fmt.Errorf("validate instance template of %s failed:\n%s", template.ServiceName, vr)
+	}
+
+	return s.store.Put(layout.InstanceTemplateKey(template.ServiceName), *marshalToString(template))
+}
+
+// DeleteInstanceTemplate deletes the instance template of the service.
+func (s *Service) DeleteInstanceTemplate(serviceName string) error {
+	return s.store.Delete(layout.InstanceTemplateKey(serviceName))
+}
+
+// RegisterInstanceFromTemplate materializes the instance spec by merging the overrides into
+// the instance template of the service, and writes it after validation. The overrides are
+// keyed by the yaml field names of the instance spec, and the nested maps (e.g. labels) are
+// merged key by key. The service name, instance ID and registry time are always set.
+func (s *Service) RegisterInstanceFromTemplate(serviceName, instanceID string,
+	overrides map[string]interface{}) (*spec.ServiceInstanceSpec, error) {
+
+	template := s.GetInstanceTemplate(serviceName)
+	if template == nil {
+		return nil, fmt.Errorf("instance template of service %s not found", serviceName)
+	}
+
+	merged, err := toJSONMap(template)
+	if err != nil {
+		return nil, err
+	}
+	overridesMap, err := toJSONMap(overrides)
+	if err != nil {
+		return nil, err
+	}
+	mergeMaps(merged, overridesMap)
+
+	merged["serviceName"] = serviceName
+	merged["instanceID"] = instanceID
+	merged["registryTime"] = time.Now().Format(time.RFC3339)
+
+	buff, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("BUG: marshal %#v to yaml failed: %v", merged, err)
+	}
+	instance := &spec.ServiceInstanceSpec{}
+	if err = yaml.UnmarshalStrict(buff, instance); err != nil {
+		return nil, fmt.Errorf("invalid overrides of instance %s/%s: %v", serviceName, instanceID, err)
+	}
+	if vr := v.Validate(instance); !vr.Valid() {
+		return nil, fmt.Errorf("validate instance %s/%s failed:\n%s", serviceName, instanceID, vr)
+	}
+
+	key := layout.ServiceInstanceSpecKey(serviceName, instanceID)
+	if err = s.store.Put(key, *marshalToString(instance)); err != nil {
+		return nil, err
+	}
+
+	s.recordEvent(eventKindServiceInstance, serviceName+"/"+instanceID, EventTypeNormal,
+		EventReasonCreated, fmt.Sprintf("registered %s from template", instanceID))
+
+	return instance, nil
+}
+
+// toJSONMap converts v to the map decoded from its json, so the nested maps are
+// all map[string]interface{}.
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	buff, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("BUG: marshal %#v to yaml failed: %v", v, err)
+	}
+	jsonBytes, err := yamljsontool.YAMLToJSON(buff)
+	if err != nil {
+		return nil, fmt.Errorf("transform yaml %s to json failed: %v", buff, err)
+	}
+
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(jsonBytes, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal %s to json failed: %v", jsonBytes, err)
+	}
+
+	return m, nil
+}
+
+// mergeMaps merges src into dst recursively, the values of src win except
+// both values are maps.
+func mergeMaps(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		srcMap, srcIsMap := sv.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeMaps(dstMap, srcMap)
+			continue
+		}
+		dst[k] = sv
+	}
+}
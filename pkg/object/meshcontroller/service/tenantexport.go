@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/storage"
+)
+
+// TenantExport is the subtree of a tenant, which are the tenant spec, its member
+// services with their instances and statuses, and the ingresses routing to them.
+// All lists are sorted by keys.
+type TenantExport struct {
+	Tenant                  *spec.Tenant                  `yaml:"tenant"`
+	Services                []*spec.Service               `yaml:"services"`
+	ServiceInstances        []*spec.ServiceInstanceSpec   `yaml:"serviceInstances"`
+	ServiceInstanceStatuses []*spec.ServiceInstanceStatus `yaml:"serviceInstanceStatuses"`
+	Ingresses               []*spec.Ingress               `yaml:"ingresses"`
+}
+
+// ExportTenant exports the subtree of the tenant as YAML from one read of the store.
+// The member services are the ones listed by the tenant or registered to it.
+func (s *Service) ExportTenant(tenantName string) ([]byte, error) {
+	tenantKey := layout.TenantSpecKey(tenantName)
+	prefixes := []string{
+		layout.ServiceSpecPrefix(),
+		layout.AllServiceInstanceSpecPrefix(),
+		layout.AllServiceInstanceStatusPrefix(),
+		layout.IngressPrefix(),
+	}
+	kvs, err := s.store.GetRawMulti([]string{tenantKey}, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := kvs[tenantKey]
+	if kv == nil {
+		return nil, fmt.Errorf("tenant %s not found", tenantName)
+	}
+	export := &TenantExport{Tenant: &spec.Tenant{}}
+	if err = spec.Decode(kv.Value, export.Tenant); err != nil {
+		return nil, fmt.Errorf("unmarshal tenant %s failed: %v", tenantName, err)
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	members := map[string]bool{}
+	for _, service := range export.Tenant.Services {
+		members[service] = true
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, layout.ServiceSpecPrefix()) {
+			continue
+		}
+		service := &spec.Service{}
+		if err = spec.Decode(kvs[k].Value, service); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kvs[k].Value, err)
+			continue
+		}
+		if members[service.Name] || service.RegisterTenant == tenantName {
+			members[service.Name] = true
+			export.Services = append(export.Services, service)
+		}
+	}
+
+	for _, k := range keys {
+		v := kvs[k]
+		switch {
+		case strings.HasPrefix(k, layout.AllServiceInstanceSpecPrefix()):
+			instance := &spec.ServiceInstanceSpec{}
+			if err = spec.Decode(v.Value, instance); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v.Value, err)
+				continue
+			}
+			if members[instance.ServiceName] {
+				export.ServiceInstances = append(export.ServiceInstances, instance)
+			}
+		case strings.HasPrefix(k, layout.AllServiceInstanceStatusPrefix()):
+			status := &spec.ServiceInstanceStatus{}
+			if err = storage.Decode(k, v.Value, status); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v.Value, err)
+				continue
+			}
+			if members[status.ServiceName] {
+				export.ServiceInstanceStatuses = append(export.ServiceInstanceStatuses, status)
+			}
+		case strings.HasPrefix(k, layout.IngressPrefix()):
+			ingress := &spec.Ingress{}
+			if err = spec.Decode(v.Value, ingress); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v.Value, err)
+				continue
+			}
+			// NOTE: Only the paths routing to the member services are exported.
+			if ingress = memberIngress(ingress, members); ingress != nil {
+				export.Ingresses = append(export.Ingresses, ingress)
+			}
+		}
+	}
+
+	return yaml.Marshal(export)
+}
+
+// memberIngress returns the ingress with the paths routing to the members only,
+// it returns nil if no path routes to the members.
+func memberIngress(ingress *spec.Ingress, members map[string]bool) *spec.Ingress {
+	rules := []*spec.IngressRule{}
+	for _, rule := range ingress.Rules {
+		paths := []*spec.IngressPath{}
+		for _, path := range rule.Paths {
+			if members[path.Backend] {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) > 0 {
+			rules = append(rules, &spec.IngressRule{Host: rule.Host, Paths: paths})
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	result := *ingress
+	result.Rules = rules
+	return &result
+}
+
+// ImportTenant imports the subtree of a tenant exported by ExportTenant. All resources
+// are validated before writing, and it fails if any of them already exists.
+// NOTE: A large subtree is written in several transactions, like Restore, every one
+// of them is written only if its keys are still absent.
+func (s *Service) ImportTenant(data []byte) error {
+	export := &TenantExport{}
+	if err := yaml.Unmarshal(data, export); err != nil {
+		return fmt.Errorf("unmarshal tenant export failed: %v", err)
+	}
+	if export.Tenant == nil {
+		return fmt.Errorf("invalid tenant export: tenant is missing")
+	}
+
+	changes := []SpecChange{{Tenant: export.Tenant}}
+	for _, service := range export.Services {
+		changes = append(changes, SpecChange{Service: service})
+	}
+	for _, instance := range export.ServiceInstances {
+		changes = append(changes, SpecChange{ServiceInstance: instance})
+	}
+	for _, ingress := range export.Ingresses {
+		changes = append(changes, SpecChange{Ingress: ingress})
+	}
+
+	kvs := make(map[string]*string, len(changes)+len(export.ServiceInstanceStatuses))
+	keys := make([]string, 0, len(changes)+len(export.ServiceInstanceStatuses))
+	for i := range changes {
+		rc, err := changes[i].resolve()
+		if err != nil {
+			return fmt.Errorf("invalid tenant export: %v", err)
+		}
+		if _, ok := kvs[rc.key]; ok {
+			return fmt.Errorf("invalid tenant export: %s %s duplicated", rc.kind, rc.name)
+		}
+		kvs[rc.key] = rc.value
+		keys = append(keys, rc.key)
+	}
+	for _, status := range export.ServiceInstanceStatuses {
+		key := layout.ServiceInstanceStatusKey(status.ServiceName, status.InstanceID)
+		buff, err := storage.Encode(key, status)
+		if err != nil {
+			return fmt.Errorf("BUG: marshal %#v failed: %v", status, err)
+		}
+		value := string(buff)
+		kvs[key] = &value
+		keys = append(keys, key)
+	}
+
+	existing, err := s.store.GetRawMulti(keys, nil)
+	if err != nil {
+		return err
+	}
+	if len(existing) != 0 {
+		existingKeys := make([]string, 0, len(existing))
+		for key := range existing {
+			existingKeys = append(existingKeys, key)
+		}
+		sort.Strings(existingKeys)
+		return fmt.Errorf("%s already exist", strings.Join(existingKeys, ", "))
+	}
+
+	// NOTE: The tenant is written at last, so it exists only if all others are written.
+	keys = append(keys[1:], keys[0])
+	revisions := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		revisions[key] = 0
+	}
+	if err = s.putInChunks(keys, kvs, revisions); err != nil {
+		return err
+	}
+
+	logger.Infof("imported tenant %s with %d resources", export.Tenant.Name, len(keys))
+
+	return nil
+}
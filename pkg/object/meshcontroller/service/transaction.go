@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/v"
+)
+
+type (
+	// SpecChange is the change of one resource in a transaction, exactly one
+	// resource must be set. Only the identifying fields (names, and the kind
+	// of custom resource) of the resource are used for deletion.
+	SpecChange struct {
+		Delete bool `yaml:"delete,omitempty"`
+
+		Service            *spec.Service             `yaml:"service,omitempty"`
+		ServiceInstance    *spec.ServiceInstanceSpec `yaml:"serviceInstance,omitempty"`
+		Tenant             *spec.Tenant              `yaml:"tenant,omitempty"`
+		Ingress            *spec.Ingress             `yaml:"ingress,omitempty"`
+		CustomResourceKind *spec.CustomResourceKind  `yaml:"customResourceKind,omitempty"`
+		CustomResource     *spec.CustomResource      `yaml:"customResource,omitempty"`
+	}
+
+	// resolvedChange is a validated change with its store key.
+	resolvedChange struct {
+		kind  string
+		name  string
+		key   string
+		value *string
+	}
+)
+
+// ApplyTransaction validates all changes and then commits them in one transaction,
+// so either all or none of them are applied.
+func (s *Service) ApplyTransaction(changes []SpecChange) error {
+	resolved := make([]*resolvedChange, 0, len(changes))
+	kvs := make(map[string]*string, len(changes))
+	for i := range changes {
+		rc, err := changes[i].resolve()
+		if err != nil {
+			return fmt.Errorf("change %d: %v", i, err)
+		}
+		if _, ok := kvs[rc.key]; ok {
+			return fmt.Errorf("change %d: %s %s changed more than once", i, rc.kind, rc.name)
+		}
+
+		kvs[rc.key] = rc.value
+		resolved = append(resolved, rc)
+	}
+
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	// NOTE: Only check the existence when recording, like putAndRecord.
+	var existing map[string]bool
+	if s.eventRecorder() != nil {
+		keys := make([]string, 0, len(kvs))
+		for key := range kvs {
+			keys = append(keys, key)
+		}
+		raws, err := s.store.GetRawMulti(keys, nil)
+		if err != nil {
+			return err
+		}
+		existing = make(map[string]bool, len(raws))
+		for key := range raws {
+			existing[key] = true
+		}
+	}
+
+	err := s.store.PutAndDelete(kvs)
+	if err != nil {
+		return err
+	}
+
+	for _, rc := range resolved {
+		reason := EventReasonUpdated
+		switch {
+		case rc.value == nil:
+			reason = EventReasonDeleted
+		case !existing[rc.key]:
+			reason = EventReasonCreated
+		}
+		s.recordEvent(rc.kind, rc.name, EventTypeNormal, reason, fmt.Sprintf("%s %s", reason, rc.name))
+	}
+
+	return nil
+}
+
+// CreateServiceWithIngress creates the service and the ingress exposing it in one
+// transaction along with adding the service to its tenant, the ingress must route
+// to the service. It returns ErrServiceAlreadyExists or ErrIngressAlreadyExists if
+// either of them exists, and ErrTenantNotFound if the tenant of the service doesn't.
+func (s *Service) CreateServiceWithIngress(service *spec.Service, ingress *spec.Ingress) error {
+	if service == nil || ingress == nil {
+		return fmt.Errorf("both service and ingress are required")
+	}
+
+	if !ingressHasBackend(ingress, service.Name) {
+		return fmt.Errorf("ingress %s doesn't route to service %s", ingress.Name, service.Name)
+	}
+
+	serviceChange, err := (&SpecChange{Service: service}).resolve()
+	if err != nil {
+		return err
+	}
+	ingressChange, err := (&SpecChange{Ingress: ingress}).resolve()
+	if err != nil {
+		return err
+	}
+
+	serviceKey, ingressKey := serviceChange.key, ingressChange.key
+	tenantKey := layout.TenantSpecKey(service.RegisterTenant)
+	for i := 0; i < maxCASRetries; i++ {
+		kvs, err := s.store.GetRawMulti([]string{serviceKey, ingressKey, tenantKey}, nil)
+		if err != nil {
+			return err
+		}
+		if kvs[serviceKey] != nil {
+			return fmt.Errorf("%w: %s", ErrServiceAlreadyExists, service.Name)
+		}
+		if kvs[ingressKey] != nil {
+			return fmt.Errorf("%w: %s", ErrIngressAlreadyExists, ingress.Name)
+		}
+		tenantKV := kvs[tenantKey]
+		if tenantKV == nil {
+			return fmt.Errorf("%w: %s", ErrTenantNotFound, service.RegisterTenant)
+		}
+
+		tenant := &spec.Tenant{}
+		if err = spec.Decode(tenantKV.Value, tenant); err != nil {
+			return fmt.Errorf("BUG: unmarshal %s to yaml failed: %v", tenantKV.Value, err)
+		}
+		tenant.Services = append(tenant.Services, service.Name)
+
+		revisions := map[string]int64{
+			serviceKey: 0,
+			ingressKey: 0,
+			tenantKey:  tenantKV.ModRevision,
+		}
+		changes := map[string]*string{
+			serviceKey: serviceChange.value,
+			ingressKey: ingressChange.value,
+			tenantKey:  marshalToString(tenant),
+		}
+		put, err := s.store.CompareAndPutAndDelete(revisions, changes)
+		if err != nil {
+			return err
+		}
+		if !put {
+			continue
+		}
+
+		s.recordEvent(eventKindService, service.Name, EventTypeNormal, EventReasonCreated,
+			fmt.Sprintf("%s %s", EventReasonCreated, service.Name))
+		s.recordEvent(eventKindIngress, ingress.Name, EventTypeNormal, EventReasonCreated,
+			fmt.Sprintf("%s %s", EventReasonCreated, ingress.Name))
+		s.recordEvent(eventKindTenant, tenant.Name, EventTypeNormal, EventReasonUpdated,
+			fmt.Sprintf("%s %s", EventReasonUpdated, tenant.Name))
+		return nil
+	}
+
+	return ErrTooManyConflicts
+}
+
+// resolve validates the change and resolves its store key and value,
+// the value is nil for deletion.
+func (c *SpecChange) resolve() (*resolvedChange, error) {
+	var (
+		count int
+		rc    *resolvedChange
+		obj   interface{}
+	)
+
+	if c.Service != nil {
+		count++
+		obj = c.Service
+		rc = &resolvedChange{
+			kind: eventKindService,
+			name: c.Service.Name,
+			key:  layout.ServiceSpecKey(c.Service.Name),
+		}
+	}
+	if c.ServiceInstance != nil {
+		count++
+		obj = c.ServiceInstance
+		rc = &resolvedChange{
+			kind: eventKindServiceInstance,
+			name: c.ServiceInstance.ServiceName + "/" + c.ServiceInstance.InstanceID,
+			key:  layout.ServiceInstanceSpecKey(c.ServiceInstance.ServiceName, c.ServiceInstance.InstanceID),
+		}
+		if c.ServiceInstance.ServiceName == "" || c.ServiceInstance.InstanceID == "" {
+			return nil, fmt.Errorf("service name and instance id of service instance cannot be empty")
+		}
+	}
+	if c.Tenant != nil {
+		count++
+		obj = c.Tenant
+		rc = &resolvedChange{
+			kind: eventKindTenant,
+			name: c.Tenant.Name,
+			key:  layout.TenantSpecKey(c.Tenant.Name),
+		}
+	}
+	if c.Ingress != nil {
+		count++
+		obj = c.Ingress
+		rc = &resolvedChange{
+			kind: eventKindIngress,
+			name: c.Ingress.Name,
+			key:  layout.IngressSpecKey(c.Ingress.Name),
+		}
+	}
+	if c.CustomResourceKind != nil {
+		count++
+		obj = c.CustomResourceKind
+		rc = &resolvedChange{
+			kind: eventKindCustomResourceKind,
+			name: c.CustomResourceKind.Name,
+			key:  layout.CustomResourceKindKey(c.CustomResourceKind.Name),
+		}
+	}
+	if c.CustomResource != nil {
+		count++
+		obj = c.CustomResource
+		kind, name := c.CustomResource.Kind(), c.CustomResource.Name()
+		if kind == "" {
+			return nil, fmt.Errorf("kind of custom resource cannot be empty")
+		}
+		rc = &resolvedChange{
+			kind: kind,
+			name: name,
+			key:  layout.CustomResourceKey(kind, name),
+		}
+	}
+
+	if count != 1 {
+		return nil, fmt.Errorf("exactly one resource must be set, got %d", count)
+	}
+	if rc.name == "" {
+		return nil, fmt.Errorf("name of %s cannot be empty", rc.kind)
+	}
+
+	if c.Delete {
+		return rc, nil
+	}
+
+	// NOTE: Custom resources are free-form, they are validated by the schemas
+	// of their kinds in API layer.
+	if c.CustomResource == nil {
+		if vr := v.Validate(obj); !vr.Valid() {
+			return nil, fmt.Errorf("validate %s %s failed:\n%s", rc.kind, rc.name, vr)
+		}
+	}
+	if c.CustomResourceKind != nil && c.CustomResourceKind.JSONSchema != "" {
+		sl := gojsonschema.NewStringLoader(c.CustomResourceKind.JSONSchema)
+		if _, err := gojsonschema.NewSchema(sl); err != nil {
+			return nil, fmt.Errorf("invalid JSONSchema of %s: %v", rc.name, err)
+		}
+	}
+
+	rc.value = marshalToString(obj)
+	return rc, nil
+}
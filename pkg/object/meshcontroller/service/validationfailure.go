@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/v"
+)
+
+// ValidateSpec validates the spec of the resource to write. The failure is recorded
+// under the validation failure prefix besides being returned, so that the repeated
+// invalid writes could be observed by Informer.OnValidationFailures, the source
+// is where the write comes from.
+func (s *Service) ValidateSpec(kind, name, source string, obj interface{}) error {
+	vr := v.Validate(obj)
+	if vr.Valid() {
+		return nil
+	}
+
+	err := fmt.Errorf("validate failed:\n%s", vr)
+	if recordErr := s.RecordValidationFailure(kind, name, source, err); recordErr != nil {
+		logger.Errorf("record validation failure of %s %s failed: %v", kind, name, recordErr)
+	}
+
+	return err
+}
+
+// RecordValidationFailure records the write of the resource rejected by the validation,
+// and the warning event of it. The rejected writes of the same resource from the same
+// source share one record counting them, so the records don't grow with the writes.
+func (s *Service) RecordValidationFailure(kind, name, source string, validateErr error) error {
+	key := layout.ValidationFailureKey(kind, name, source)
+
+	for i := 0; i < maxCASRetries; i++ {
+		kv, err := s.store.GetRaw(key)
+		if err != nil {
+			return err
+		}
+
+		failure := &spec.ValidationFailure{
+			Kind:   kind,
+			Name:   name,
+			Source: source,
+		}
+		var revision int64
+		if kv != nil {
+			if err = spec.Decode(kv.Value, failure); err != nil {
+				logger.Errorf("BUG: unmarshal %s to yaml failed: %v", kv.Value, err)
+			}
+			revision = kv.ModRevision
+		}
+		failure.Count++
+		failure.Message = validateErr.Error()
+		failure.Time = time.Now().Format(time.RFC3339Nano)
+
+		put, err := s.store.CompareAndPut(key, *marshalToString(failure), revision)
+		if err != nil {
+			return err
+		}
+		if put {
+			s.recordEvent(kind, name, EventTypeWarning, EventReasonValidationFailed, failure.Message)
+			return nil
+		}
+	}
+
+	return ErrTooManyConflicts
+}
+
+// PruneValidationFailures deletes the validation failures last recorded before the time,
+// it returns the count of deleted records. The master prunes them periodically.
+func (s *Service) PruneValidationFailures(before time.Time) (int, error) {
+	kvs, err := s.store.GetRawPrefix(layout.ValidationFailurePrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	keys, deletions := []string{}, map[string]*string{}
+	for k, v := range kvs {
+		failure := &spec.ValidationFailure{}
+		if err = spec.Decode(v.Value, failure); err != nil {
+			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", v, err)
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, failure.Time)
+		if err != nil || at.Before(before) {
+			keys = append(keys, k)
+			deletions[k] = nil
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	sort.Strings(keys)
+	if err = s.putInChunks(keys, deletions, nil); err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spec
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// StatusCodecYAML is the name of the yaml status codec.
+	StatusCodecYAML = "yaml"
+	// StatusCodecProtobuf is the name of the protobuf status codec.
+	StatusCodecProtobuf = "protobuf"
+
+	// protobufMagic leads the protobuf encoded value, which never leads a yaml document,
+	// so values in both formats could be decoded during upgrading.
+	protobufMagic byte = 0
+
+	protobufWireVarint = 0
+	protobufWireBytes  = 2
+)
+
+// StatusProtobufCodec encodes ServiceInstanceStatus in protobuf wire format,
+// which is much cheaper than yaml for the high-frequency heartbeats.
+// Other types and yaml encoded values are handled in yaml.
+var StatusProtobufCodec = statusProtobufCodec{}
+
+type (
+	statusProtobufCodec struct{}
+
+	// statusField is a field of ServiceInstanceStatus in protobuf,
+	// strings are encoded as bytes, and bools as varints.
+	statusField struct {
+		str  *string
+		flag *bool
+	}
+)
+
+// Name returns the name of the codec.
+func (c statusProtobufCodec) Name() string { return StatusCodecProtobuf }
+
+func (c statusProtobufCodec) fields(s *ServiceInstanceStatus) []statusField {
+	// The index plus one is the field number, only appending is allowed.
+	return []statusField{
+		{str: &s.ServiceName},
+		{str: &s.InstanceID},
+		{str: &s.LastHeartbeatTime},
+		{str: &s.APIVersion},
+		{str: &s.ServerHeartbeatTime},
+		{str: &s.Phase},
+		{flag: &s.Ready},
+	}
+}
+
+// Marshal marshals v.
+func (c statusProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	status, ok := v.(*ServiceInstanceStatus)
+	if !ok {
+		return yaml.Marshal(v)
+	}
+
+	buff := make([]byte, 1, 128)
+	buff[0] = protobufMagic
+	for i, field := range c.fields(status) {
+		number := uint64(i + 1)
+		switch {
+		case field.str != nil && *field.str != "":
+			buff = appendUvarint(buff, number<<3|protobufWireBytes)
+			buff = appendUvarint(buff, uint64(len(*field.str)))
+			buff = append(buff, *field.str...)
+		case field.flag != nil && *field.flag:
+			buff = appendUvarint(buff, number<<3|protobufWireVarint)
+			buff = appendUvarint(buff, 1)
+		}
+	}
+
+	return buff, nil
+}
+
+func appendUvarint(buff []byte, x uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], x)
+	return append(buff, varint[:n]...)
+}
+
+// Unmarshal unmarshals data into v.
+func (c statusProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	status, ok := v.(*ServiceInstanceStatus)
+	if !ok || len(data) == 0 || data[0] != protobufMagic {
+		return Decode(data, v)
+	}
+
+	fields := c.fields(status)
+	data = data[1:]
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf tag")
+		}
+		data = data[n:]
+
+		// unknown fields added by newer versions are skipped.
+		var field *statusField
+		if number := int(tag >> 3); number >= 1 && number <= len(fields) {
+			field = &fields[number-1]
+		}
+
+		switch tag & 7 {
+		case protobufWireVarint:
+			x, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			data = data[n:]
+			if field != nil && field.flag != nil {
+				*field.flag = x != 0
+			}
+		case protobufWireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("invalid protobuf length")
+			}
+			value := string(data[n : n+int(length)])
+			data = data[n+int(length):]
+			if field != nil && field.str != nil {
+				*field.str = value
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+	}
+
+	return nil
+}
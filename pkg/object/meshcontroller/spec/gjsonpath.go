@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spec
+
+import "fmt"
+
+// GJSONPath is the path of a part of the spec, in GJSON syntax.
+type GJSONPath string
+
+// ValidateGJSONPath validates the syntax of the path, the empty path of the whole
+// structure is valid.
+// It rejects empty components (e.g. "resilience..circuitBreaker"), dangling
+// escapes and unbalanced parentheses of queries.
+func ValidateGJSONPath(path GJSONPath) error {
+	p := string(path)
+	if p == "" {
+		return nil
+	}
+
+	depth, component, quoted := 0, 0, false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '\\':
+			if i == len(p)-1 {
+				return fmt.Errorf("invalid gjson path %q: dangling escape", p)
+			}
+			i++
+			component++
+		case depth > 0:
+			switch {
+			case c == '"':
+				quoted = !quoted
+			case c == '(' && !quoted:
+				depth++
+			case c == ')' && !quoted:
+				depth--
+			}
+			component++
+		case c == '(':
+			depth++
+			component++
+		case c == ')':
+			return fmt.Errorf("invalid gjson path %q: unbalanced parentheses", p)
+		case c == '.' || c == '|':
+			if component == 0 {
+				return fmt.Errorf("invalid gjson path %q: empty component", p)
+			}
+			component = 0
+		default:
+			component++
+		}
+	}
+
+	if depth != 0 || quoted {
+		return fmt.Errorf("invalid gjson path %q: unbalanced parentheses", p)
+	}
+	if component == 0 {
+		return fmt.Errorf("invalid gjson path %q: empty component", p)
+	}
+
+	return nil
+}
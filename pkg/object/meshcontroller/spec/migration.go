@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spec
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// APIVersionV1 is the schema version of specs stored without APIVersion.
+	APIVersionV1 = "v1"
+	// APIVersionV2 is the schema version introducing APIVersion.
+	APIVersionV2 = "v2"
+
+	// CurrentAPIVersion is the schema version of the spec types.
+	CurrentAPIVersion = APIVersionV2
+
+	apiVersionKey = "apiVersion"
+)
+
+var currentAPIVersionLine = []byte(apiVersionKey + ": " + CurrentAPIVersion + "\n")
+
+type migration struct {
+	from    string
+	to      string
+	migrate func(m yaml.MapSlice) yaml.MapSlice
+}
+
+// migrations upgrade the stored values one version a time,
+// a new schema version must append its migration here.
+var migrations = []*migration{
+	{
+		from:    APIVersionV1,
+		to:      APIVersionV2,
+		migrate: func(m yaml.MapSlice) yaml.MapSlice { return m },
+	},
+}
+
+// Migrate upgrades the yaml value of an older-versioned spec to the current schema.
+// The value is returned as is if it is already in the current schema.
+func Migrate(raw []byte) ([]byte, error) {
+	// NOTE: The values written by Encode lead with the current version,
+	// so they skip parsing here.
+	if bytes.HasPrefix(raw, currentAPIVersionLine) {
+		return raw, nil
+	}
+
+	m := yaml.MapSlice{}
+	if err := yaml.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+
+	version := APIVersionV1
+	for _, item := range m {
+		if key, ok := item.Key.(string); ok && key == apiVersionKey {
+			if v, ok := item.Value.(string); ok && v != "" {
+				version = v
+			}
+			break
+		}
+	}
+
+	if version == CurrentAPIVersion {
+		return raw, nil
+	}
+
+	for _, mg := range migrations {
+		if mg.from != version {
+			continue
+		}
+		m = mg.migrate(m)
+		version = mg.to
+	}
+
+	if version != CurrentAPIVersion {
+		return nil, fmt.Errorf("unsupported api version: %s", version)
+	}
+
+	result := yaml.MapSlice{{Key: apiVersionKey, Value: version}}
+	for _, item := range m {
+		if key, ok := item.Key.(string); !ok || key != apiVersionKey {
+			result = append(result, item)
+		}
+	}
+
+	return yaml.Marshal(result)
+}
+
+// Encode marshals the spec to yaml with the current schema version stamped,
+// v itself is left untouched.
+func Encode(v interface{}) ([]byte, error) {
+	return yaml.Marshal(withCurrentAPIVersion(v))
+}
+
+// withCurrentAPIVersion returns a shallow copy of v with APIVersion set to the current one,
+// v is returned as is if it is not a pointer to a struct with APIVersion, or it is current.
+func withCurrentAPIVersion(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return v
+	}
+	field := value.Elem().FieldByName("APIVersion")
+	if !field.IsValid() || field.Kind() != reflect.String || field.String() == CurrentAPIVersion {
+		return v
+	}
+
+	copied := reflect.New(value.Elem().Type())
+	copied.Elem().Set(value.Elem())
+	copied.Elem().FieldByName("APIVersion").SetString(CurrentAPIVersion)
+	return copied.Interface()
+}
+
+// Decode migrates the yaml value to the current schema and unmarshals it into v.
+func Decode(raw []byte, v interface{}) error {
+	raw, err := Migrate(raw)
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(raw, v)
+}
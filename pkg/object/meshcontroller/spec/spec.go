@@ -20,6 +20,8 @@ package spec
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -54,6 +56,14 @@ const (
 	// ServiceStatusOutOfService indicates this service instance can't accept ingress traffic
 	ServiceStatusOutOfService = "OUT_OF_SERVICE"
 
+	// DefaultServiceSpecHistoryDepth is the default max count of prior versions
+	// kept per service spec.
+	DefaultServiceSpecHistoryDepth = 10
+
+	// ServiceInstancePhasePending indicates the instance is registered
+	// but has not reported its heartbeat yet.
+	ServiceInstancePhasePending = "PENDING"
+
 	// WorkerAPIPort is the default port for worker's API server
 	WorkerAPIPort = 13009
 
@@ -92,10 +102,24 @@ type (
 		IngressPort int `yaml:"ingressPort" jsonschema:"required"`
 
 		ExternalServiceRegistry string `yaml:"externalServiceRegistry" jsonschema:"omitempty"`
+
+		// StorageTimeout is the timeout for every storage request, empty means no extra timeout.
+		StorageTimeout string `yaml:"storageTimeout" jsonschema:"omitempty,format=duration"`
+
+		// StatusCodec is the codec of service instance statuses, the default is yaml.
+		// Enable protobuf only after all members of the cluster support it.
+		StatusCodec string `yaml:"statusCodec" jsonschema:"omitempty,enum=,enum=yaml,enum=protobuf"`
+
+		// ServiceSpecHistoryDepth is the max count of prior versions kept per service spec,
+		// zero means DefaultServiceSpecHistoryDepth.
+		ServiceSpecHistoryDepth int `yaml:"serviceSpecHistoryDepth" jsonschema:"omitempty,minimum=0"`
 	}
 
 	// Service contains the information of service.
 	Service struct {
+		// APIVersion is the schema version of the spec, empty means v1.
+		APIVersion string `yaml:"apiVersion,omitempty" jsonschema:"omitempty"`
+
 		// CreatedBy means the source of the service.
 		// It could be adminAPI, externalRegistry:Consul, etc.
 		CreatedBy string `yaml:"source" jsonschema:"omitempty"`
@@ -109,6 +133,13 @@ type (
 		Canary        *Canary        `yaml:"canary" jsonschema:"omitempty"`
 		LoadBalance   *LoadBalance   `yaml:"loadBalance" jsonschema:"omitempty"`
 		Observability *Observability `yaml:"observability" jsonschema:"omitempty"`
+
+		// Dependencies are the names of services this service depends on.
+		Dependencies []string `yaml:"dependencies,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+		// EgressAllowlist are the names of services this service may call,
+		// empty means calling any service is allowed.
+		EgressAllowlist []string `yaml:"egressAllowlist,omitempty" jsonschema:"omitempty,uniqueItems=true"`
 	}
 
 	// Mock is the spec of configured and static API responses for this service.
@@ -226,17 +257,25 @@ type (
 
 	// Tenant contains the information of tenant.
 	Tenant struct {
+		APIVersion string `yaml:"apiVersion,omitempty" jsonschema:"omitempty"`
+
 		Name string `yaml:"name"`
 
 		Services []string `yaml:"services" jsonschema:"omitempty"`
 		// Format: RFC3339
 		CreatedAt   string `yaml:"createdAt" jsonschema:"omitempty"`
 		Description string `yaml:"description"`
+		// Quota is the traffic quota of the tenant, in the count of instances of
+		// all its services, as every instance takes its share of traffic.
+		// Zero means unlimited.
+		Quota int `yaml:"quota,omitempty" jsonschema:"omitempty,minimum=0"`
 	}
 
 	// ServiceInstanceSpec is the spec of service instance.
 	// FIXME: Use the unified struct: serviceregistry.ServiceInstanceSpec.
 	ServiceInstanceSpec struct {
+		APIVersion string `yaml:"apiVersion,omitempty" jsonschema:"omitempty"`
+
 		RegistryName string `yaml:"registryName" jsonschema:"required"`
 		// Provide by registry client
 		ServiceName  string            `yaml:"serviceName" jsonschema:"required"`
@@ -248,6 +287,14 @@ type (
 
 		// Set by heartbeat timer event or API
 		Status string `yaml:"status" jsonschema:"omitempty"`
+
+		// MaintenanceUntil is the end time of the maintenance window in RFC3339, the automated
+		// eviction and draining leave the instance alone before it. Set by API.
+		MaintenanceUntil string `yaml:"maintenanceUntil,omitempty" jsonschema:"omitempty"`
+
+		// Drained marks the instance is taken out of service by draining, it stays
+		// OUT_OF_SERVICE until undrained even if its heartbeat is healthy. Set by API.
+		Drained bool `yaml:"drained,omitempty" jsonschema:"omitempty"`
 	}
 
 	// IngressPath is the path for a mesh ingress rule
@@ -265,16 +312,30 @@ type (
 
 	// Ingress is the spec of mesh ingress
 	Ingress struct {
+		APIVersion string `yaml:"apiVersion,omitempty" jsonschema:"omitempty"`
+
 		Name  string         `yaml:"name" jsonschema:"required"`
 		Rules []*IngressRule `yaml:"rules" jsonschema:"required"`
 	}
 
 	// ServiceInstanceStatus is the status of service instance.
 	ServiceInstanceStatus struct {
+		APIVersion string `yaml:"apiVersion,omitempty" jsonschema:"omitempty"`
+
 		ServiceName string `yaml:"serviceName" jsonschema:"required"`
 		InstanceID  string `yaml:"instanceID" jsonschema:"required"`
 		// RFC3339 format
 		LastHeartbeatTime string `yaml:"lastHeartbeatTime" jsonschema:"required,format=timerfc3339"`
+		// ServerHeartbeatTime is stamped with the clock of the Easegress node recording
+		// the heartbeat, the later one of it and LastHeartbeatTime counts. RFC3339 format.
+		ServerHeartbeatTime string `yaml:"serverHeartbeatTime,omitempty" jsonschema:"omitempty,format=timerfc3339"`
+		// Phase is ServiceInstancePhasePending before the instance reports its first
+		// heartbeat, and empty after that.
+		Phase string `yaml:"phase,omitempty" jsonschema:"omitempty"`
+		// Ready is the readiness gate of the instance, an UP and healthy instance may be
+		// not ready to serve yet, e.g. warming caches. It is set by the worker
+		// from its alive probe and traffic gate.
+		Ready bool `yaml:"ready,omitempty" jsonschema:"omitempty"`
 	}
 
 	pipelineSpecBuilder struct {
@@ -294,6 +355,40 @@ type (
 
 	// CustomResource defines the spec of a custom resource
 	CustomResource map[string]interface{}
+
+	// CanaryCohortMember is the membership of an instance in a canary cohort.
+	CanaryCohortMember struct {
+		Cohort      string `yaml:"cohort" jsonschema:"required"`
+		ServiceName string `yaml:"serviceName" jsonschema:"required"`
+		InstanceID  string `yaml:"instanceID" jsonschema:"required"`
+		JoinTime    string `yaml:"joinTime" jsonschema:"omitempty"`
+	}
+
+	// InstanceTemplate is the common fields of the instances of a service,
+	// which are materialized to instance specs with overrides.
+	InstanceTemplate struct {
+		ServiceName  string            `yaml:"serviceName" jsonschema:"required"`
+		RegistryName string            `yaml:"registryName" jsonschema:"omitempty"`
+		IP           string            `yaml:"ip" jsonschema:"omitempty"`
+		Port         uint32            `yaml:"port" jsonschema:"omitempty"`
+		Labels       map[string]string `yaml:"labels" jsonschema:"omitempty"`
+		Status       string            `yaml:"status" jsonschema:"omitempty"`
+	}
+
+	// ValidationFailure is the record of the writes of a resource from a source
+	// rejected by the validation.
+	ValidationFailure struct {
+		Kind string `yaml:"kind" jsonschema:"required"`
+		Name string `yaml:"name" jsonschema:"omitempty"`
+		// Source is where the writes come from, e.g. the remote host of the requests.
+		Source string `yaml:"source" jsonschema:"omitempty"`
+		// Message is the validation error of the last rejected write.
+		Message string `yaml:"message" jsonschema:"required"`
+		// Count is how many writes have been rejected.
+		Count int `yaml:"count" jsonschema:"omitempty"`
+		// Time is when the last write is rejected in RFC3339Nano.
+		Time string `yaml:"time" jsonschema:"required"`
+	}
 )
 
 // Name returns the 'name' field of the custom resource
@@ -312,6 +407,47 @@ func (cr CustomResource) Kind() string {
 	return ""
 }
 
+// Finalizers returns the 'finalizers' field of the custom resource, the resource
+// is not removed from storage on deletion until all finalizers are removed.
+func (cr CustomResource) Finalizers() []string {
+	var finalizers []string
+	switch v := cr["finalizers"].(type) {
+	case []string:
+		finalizers = append(finalizers, v...)
+	case []interface{}:
+		for _, f := range v {
+			if s, ok := f.(string); ok {
+				finalizers = append(finalizers, s)
+			}
+		}
+	}
+	return finalizers
+}
+
+// SetFinalizers sets the 'finalizers' field of the custom resource,
+// the field is removed if finalizers is empty.
+func (cr CustomResource) SetFinalizers(finalizers []string) {
+	if len(finalizers) == 0 {
+		delete(cr, "finalizers")
+		return
+	}
+	cr["finalizers"] = finalizers
+}
+
+// DeletionTimestamp returns the 'deletionTimestamp' field of the custom resource,
+// which is set when the resource is deleted while finalizers remain. RFC3339 format.
+func (cr CustomResource) DeletionTimestamp() string {
+	if v, ok := cr["deletionTimestamp"].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// SetDeletionTimestamp sets the 'deletionTimestamp' field of the custom resource.
+func (cr CustomResource) SetDeletionTimestamp(timestamp string) {
+	cr["deletionTimestamp"] = timestamp
+}
+
 // Validate validates Spec.
 func (a Admin) Validate() error {
 	switch a.RegistryType {
@@ -320,9 +456,148 @@ func (a Admin) Validate() error {
 		return fmt.Errorf("unsupported registry center type: %s", a.RegistryType)
 	}
 
+	if a.StorageTimeout != "" {
+		if _, err := time.ParseDuration(a.StorageTimeout); err != nil {
+			return fmt.Errorf("invalid storage timeout %s: %v", a.StorageTimeout, err)
+		}
+	}
+
 	return nil
 }
 
+// StorageTimeoutDuration returns the duration of storage timeout,
+// zero means no extra timeout.
+func (a *Admin) StorageTimeoutDuration() time.Duration {
+	if a.StorageTimeout == "" {
+		return 0
+	}
+
+	timeout, err := time.ParseDuration(a.StorageTimeout)
+	if err != nil {
+		logger.Errorf("BUG: parse storage timeout %s to duration failed: %v", a.StorageTimeout, err)
+		return 0
+	}
+
+	return timeout
+}
+
+// Validate validates Observability.
+func (o *Observability) Validate() error {
+	if o == nil {
+		return fmt.Errorf("observability is empty")
+	}
+
+	if o.OutputServer != nil && o.OutputServer.Enabled {
+		if o.OutputServer.BootstrapServer == "" {
+			return fmt.Errorf("empty bootstrap server of enabled output server")
+		}
+		if o.OutputServer.Timeout < 0 {
+			return fmt.Errorf("negative output server timeout: %d", o.OutputServer.Timeout)
+		}
+	}
+
+	if o.Tracings != nil && o.Tracings.SampleByQPS < 0 {
+		return fmt.Errorf("negative tracings sampleByQPS: %d", o.Tracings.SampleByQPS)
+	}
+
+	return nil
+}
+
+// ValidateRateLimiter validates the rate limiter of service resilience,
+// the limits and durations of all policies must be positive.
+func ValidateRateLimiter(rl *ratelimiter.Spec) error {
+	if rl == nil {
+		return fmt.Errorf("rate limiter is empty")
+	}
+
+	for _, p := range rl.Policies {
+		if p == nil {
+			return fmt.Errorf("empty rate limiter policy")
+		}
+		if p.LimitForPeriod <= 0 {
+			return fmt.Errorf("non-positive limitForPeriod of policy %s: %d", p.Name, p.LimitForPeriod)
+		}
+		if err := validatePositiveDuration(p.TimeoutDuration); err != nil {
+			return fmt.Errorf("invalid timeoutDuration of policy %s: %v", p.Name, err)
+		}
+		if err := validatePositiveDuration(p.LimitRefreshPeriod); err != nil {
+			return fmt.Errorf("invalid limitRefreshPeriod of policy %s: %v", p.Name, err)
+		}
+	}
+
+	return rl.Validate()
+}
+
+// validatePositiveDuration validates the duration is positive, empty means the default.
+func validatePositiveDuration(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("non-positive duration: %s", value)
+	}
+
+	return nil
+}
+
+// LastHeartbeat returns the parsed last heartbeat time of the instance,
+// it is the later one of the reported and the server-side heartbeat time,
+// so a stale server-side stamp never freezes the heartbeat.
+func (s *ServiceInstanceStatus) LastHeartbeat() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s.LastHeartbeatTime)
+	if err != nil && s.ServerHeartbeatTime == "" {
+		return time.Time{}, fmt.Errorf("parse last heartbeat time %s failed: %v", s.LastHeartbeatTime, err)
+	}
+	if s.ServerHeartbeatTime == "" {
+		return t, nil
+	}
+
+	serverTime, serverErr := time.Parse(time.RFC3339, s.ServerHeartbeatTime)
+	switch {
+	case serverErr != nil && err != nil:
+		return time.Time{}, fmt.Errorf("parse last heartbeat time %s failed: %v", s.LastHeartbeatTime, err)
+	case serverErr != nil:
+		return t, nil
+	case err != nil || serverTime.After(t):
+		return serverTime, nil
+	default:
+		return t, nil
+	}
+}
+
+// StaleSince returns how long the instance has not reported its heartbeat until now.
+// An invalid last heartbeat time is treated as stale forever.
+func (s *ServiceInstanceStatus) StaleSince(now time.Time) time.Duration {
+	lastHeartbeat, err := s.LastHeartbeat()
+	if err != nil {
+		return time.Duration(math.MaxInt64)
+	}
+	return now.Sub(lastHeartbeat)
+}
+
+// IsHealthy returns whether the instance reported its heartbeat within the timeout.
+func (s *ServiceInstanceStatus) IsHealthy(now time.Time, timeout time.Duration) bool {
+	return s.StaleSince(now) <= timeout
+}
+
+// InMaintenance returns whether the instance is in its maintenance window at now.
+// An invalid end time is treated as not in maintenance.
+func (s *ServiceInstanceSpec) InMaintenance(now time.Time) bool {
+	if s.MaintenanceUntil == "" {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, s.MaintenanceUntil)
+	if err != nil {
+		return false
+	}
+	return now.Before(until)
+}
+
 // Key returns the key of ServiceInstanceSpec.
 func (s *ServiceInstanceSpec) Key() string {
 	return fmt.Sprintf("%s/%s/%s", s.RegistryName, s.ServiceName, s.InstanceID)
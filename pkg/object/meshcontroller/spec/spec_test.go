@@ -18,10 +18,15 @@
 package spec
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
 
 	"github.com/megaease/easegress/pkg/filter/circuitbreaker"
 	"github.com/megaease/easegress/pkg/filter/mock"
@@ -89,6 +94,26 @@ func TestAdminValidat(t *testing.T) {
 	}
 }
 
+func TestAdminStorageTimeout(t *testing.T) {
+	a := Admin{
+		RegistryType:      "eureka",
+		HeartbeatInterval: "10s",
+		StorageTimeout:    "3s",
+	}
+
+	if err := a.Validate(); err != nil {
+		t.Errorf("storage timeout is valid, err: %v", err)
+	}
+	if a.StorageTimeoutDuration() != 3*time.Second {
+		t.Errorf("storage timeout should be 3s, got %v", a.StorageTimeoutDuration())
+	}
+
+	a.StorageTimeout = "3x"
+	if err := a.Validate(); err == nil {
+		t.Errorf("storage timeout is invalid, should failed")
+	}
+}
+
 func TestSideCarEgressPipelineSpec(t *testing.T) {
 	s := &Service{
 		Name: "order-001",
@@ -1033,3 +1058,182 @@ func TestCustomResource(t *testing.T) {
 		t.Error("kind should be kind1")
 	}
 }
+
+func TestCustomResourceFinalizers(t *testing.T) {
+	r := CustomResource{}
+	if len(r.Finalizers()) != 0 || r.DeletionTimestamp() != "" {
+		t.Error("finalizers and deletion timestamp should be empty")
+	}
+
+	r["finalizers"] = []interface{}{"dns", 1, "lb"}
+	if f := r.Finalizers(); len(f) != 2 || f[0] != "dns" || f[1] != "lb" {
+		t.Errorf("unexpected finalizers %v", f)
+	}
+
+	r.SetFinalizers(nil)
+	if _, ok := r["finalizers"]; ok {
+		t.Error("empty finalizers should be removed")
+	}
+
+	r.SetDeletionTimestamp("2021-01-01T00:00:00Z")
+	if r.DeletionTimestamp() != "2021-01-01T00:00:00Z" {
+		t.Error("deletion timestamp should be set")
+	}
+}
+
+func TestServiceInstanceStatusHealth(t *testing.T) {
+	now := time.Now()
+	timeout := 10 * time.Second
+
+	healthy := &ServiceInstanceStatus{LastHeartbeatTime: now.Add(-time.Second).Format(time.RFC3339)}
+	if !healthy.IsHealthy(now, timeout) {
+		t.Errorf("instance reported heartbeat recently should be healthy")
+	}
+
+	stale := &ServiceInstanceStatus{LastHeartbeatTime: now.Add(-time.Minute).Format(time.RFC3339)}
+	if stale.IsHealthy(now, timeout) {
+		t.Errorf("stale instance should not be healthy")
+	}
+	if d := stale.StaleSince(now); d < 59*time.Second || d > 61*time.Second {
+		t.Errorf("stale instance should be stale since about 1m, got %v", d)
+	}
+
+	invalid := &ServiceInstanceStatus{LastHeartbeatTime: "invalid"}
+	if invalid.IsHealthy(now, timeout) {
+		t.Errorf("instance with invalid heartbeat should not be healthy")
+	}
+	if _, err := invalid.LastHeartbeat(); err == nil {
+		t.Errorf("parse invalid heartbeat should fail")
+	}
+
+	// the later one of the reported and the server-side time counts.
+	stampedStale := &ServiceInstanceStatus{
+		LastHeartbeatTime:   now.Add(-time.Second).Format(time.RFC3339),
+		ServerHeartbeatTime: now.Add(-time.Hour).Format(time.RFC3339Nano),
+	}
+	if !stampedStale.IsHealthy(now, timeout) {
+		t.Errorf("stale server-side heartbeat time should not freeze the heartbeat")
+	}
+	stampedRecent := &ServiceInstanceStatus{
+		LastHeartbeatTime:   now.Add(-time.Hour).Format(time.RFC3339),
+		ServerHeartbeatTime: now.Add(-time.Second).Format(time.RFC3339Nano),
+	}
+	if !stampedRecent.IsHealthy(now, timeout) {
+		t.Errorf("recent server-side heartbeat time should count")
+	}
+	stampedInvalid := &ServiceInstanceStatus{
+		LastHeartbeatTime:   now.Add(-time.Second).Format(time.RFC3339),
+		ServerHeartbeatTime: "invalid",
+	}
+	if !stampedInvalid.IsHealthy(now, timeout) {
+		t.Errorf("invalid server-side heartbeat time should be ignored")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	v1 := []byte("name: order\nregisterTenant: shop\n")
+
+	service := &Service{}
+	if err := Decode(v1, service); err != nil {
+		t.Fatalf("decode v1 value failed: %v", err)
+	}
+	if service.APIVersion != CurrentAPIVersion || service.Name != "order" || service.RegisterTenant != "shop" {
+		t.Errorf("v1 value should be migrated to %s: %+v", CurrentAPIVersion, service)
+	}
+
+	current := []byte("apiVersion: v2\nname: order\n")
+	if migrated, err := Migrate(current); err != nil || string(migrated) != string(current) {
+		t.Errorf("current value should be returned as is: %s, %v", migrated, err)
+	}
+
+	if _, err := Migrate([]byte("apiVersion: v100\nname: order\n")); err == nil {
+		t.Errorf("migrate unknown version should fail")
+	}
+
+	// a migration renaming the field.
+	old := migrations
+	defer func() { migrations = old }()
+	migrations = []*migration{{
+		from: APIVersionV1,
+		to:   APIVersionV2,
+		migrate: func(m yaml.MapSlice) yaml.MapSlice {
+			for i := range m {
+				if m[i].Key == "tenant" {
+					m[i].Key = "registerTenant"
+				}
+			}
+			return m
+		},
+	}}
+
+	service = &Service{}
+	if err := Decode([]byte("name: order\ntenant: shop\n"), service); err != nil {
+		t.Fatalf("decode v1 value failed: %v", err)
+	}
+	if service.RegisterTenant != "shop" || service.APIVersion != APIVersionV2 {
+		t.Errorf("renamed field should be migrated: %+v", service)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	service := &Service{Name: "order"}
+	buff, err := Encode(service)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if !bytes.HasPrefix(buff, []byte("apiVersion: "+CurrentAPIVersion+"\n")) {
+		t.Errorf("encoded value should lead with the current api version, got %s", buff)
+	}
+	if service.APIVersion != "" {
+		t.Errorf("the encoded spec should be untouched, got %s", service.APIVersion)
+	}
+
+	// the encoded value is decoded without migration.
+	if migrated, err := Migrate(buff); err != nil || !bytes.Equal(migrated, buff) {
+		t.Errorf("encoded value should be returned as is: %s, %v", migrated, err)
+	}
+	decoded := &Service{}
+	if err = Decode(buff, decoded); err != nil || decoded.Name != "order" || decoded.APIVersion != CurrentAPIVersion {
+		t.Errorf("decode encoded value failed: %+v, %v", decoded, err)
+	}
+
+	// the values without api version are kept as is.
+	if buff, err = Encode(&CustomResource{"name": "record"}); err != nil || string(buff) != "name: record\n" {
+		t.Errorf("custom resource should be encoded as is, got %s, %v", buff, err)
+	}
+}
+
+func TestStatusProtobufCodecCoversAllFields(t *testing.T) {
+	status := &ServiceInstanceStatus{}
+	value := reflect.ValueOf(status).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("value-of-" + value.Type().Field(i).Name)
+		case reflect.Bool:
+			field.SetBool(true)
+		default:
+			t.Fatalf("field %s of kind %s is not supported by the protobuf codec",
+				value.Type().Field(i).Name, field.Kind())
+		}
+	}
+
+	buff, err := StatusProtobufCodec.Marshal(status)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	decoded := &ServiceInstanceStatus{}
+	if err = StatusProtobufCodec.Unmarshal(buff, decoded); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, status) {
+		t.Errorf("all fields should be covered by the protobuf codec, got %+v, expect %+v", decoded, status)
+	}
+
+	// unknown fields of newer versions are skipped.
+	buff = append(buff, 0xf8, 0x01, 0x01)
+	if err = StatusProtobufCodec.Unmarshal(buff, &ServiceInstanceStatus{}); err != nil {
+		t.Errorf("unknown varint field should be skipped: %v", err)
+	}
+}
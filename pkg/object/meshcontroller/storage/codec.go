@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// Codec is the serialization format of values in storage.
+	Codec interface {
+		Name() string
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	yamlCodec struct{}
+
+	prefixCodec struct {
+		prefix string
+		codec  Codec
+	}
+)
+
+var (
+	// YAMLCodec is the default codec, older-versioned specs are migrated while unmarshaling.
+	YAMLCodec Codec = yamlCodec{}
+
+	codecsMutex sync.RWMutex
+	codecs      []*prefixCodec
+)
+
+func (c yamlCodec) Name() string { return "yaml" }
+
+func (c yamlCodec) Marshal(v interface{}) ([]byte, error) { return yaml.Marshal(v) }
+
+func (c yamlCodec) Unmarshal(data []byte, v interface{}) error { return spec.Decode(data, v) }
+
+// RegisterCodec makes values of keys with the prefix use the codec,
+// the longest matched prefix wins. Registering YAMLCodec resets the prefix.
+// NOTE: All members of the cluster must be able to decode the codec before
+// registering it, otherwise they can't read the values.
+func RegisterCodec(prefix string, codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	for i, pc := range codecs {
+		if pc.prefix == prefix {
+			codecs = append(codecs[:i], codecs[i+1:]...)
+			break
+		}
+	}
+	if codec != YAMLCodec {
+		codecs = append(codecs, &prefixCodec{prefix: prefix, codec: codec})
+	}
+}
+
+// CodecFor returns the codec of the key, it is YAMLCodec by default.
+func CodecFor(key string) Codec {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	var matched *prefixCodec
+	for _, pc := range codecs {
+		if strings.HasPrefix(key, pc.prefix) && (matched == nil || len(pc.prefix) > len(matched.prefix)) {
+			matched = pc
+		}
+	}
+	if matched == nil {
+		return YAMLCodec
+	}
+
+	return matched.codec
+}
+
+// Encode marshals v with the codec of the key.
+func Encode(key string, v interface{}) ([]byte, error) {
+	return CodecFor(key).Marshal(v)
+}
+
+// Decode unmarshals the value of the key with the codec of the key.
+func Decode(key string, data []byte, v interface{}) error {
+	return CodecFor(key).Unmarshal(data, v)
+}
@@ -18,10 +18,14 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3/concurrency"
 
 	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/logger"
@@ -37,30 +41,91 @@ type (
 		GetPrefix(prefix string) (map[string]string, error)
 		GetRaw(key string) (*mvccpb.KeyValue, error)
 		GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error)
+		// GetRawMulti gets the keys and the keys with the prefixes as a consistent snapshot.
+		GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error)
+		// GetRawMultiWithRevision is like GetRawMulti, and returns the revision of the snapshot.
+		GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error)
+		// GetRawAtRevision gets the key at the revision, it returns ErrCompacted
+		// if the revision has been compacted.
+		GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error)
 
 		Put(key, value string) error
+		// CompareAndPut puts the value only if the mod revision of the key equals
+		// to modRevision, zero modRevision means the key must not exist.
+		// The returning boolean flag means if the value has been put.
+		CompareAndPut(key, value string, modRevision int64) (bool, error)
 		PutUnderLease(key, value string) error
 		PutAndDelete(map[string]*string) error
 		PutAndDeleteUnderLease(map[string]*string) error
+		// CompareAndPutAndDelete puts and deletes the kvs (nil value means deletion) in one
+		// transaction only if the mod revision of every key in revisions equals to its value,
+		// zero revision means the key must not exist. The returning boolean flag means
+		// if the kvs have been applied.
+		CompareAndPutAndDelete(revisions map[string]int64, kvs map[string]*string) (bool, error)
+
+		// PutIfAbsentUnderNewLease puts the key only if it doesn't exist, under a new lease
+		// with the ttl. It returns zero lease ID if the key already exists.
+		PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error)
+		KeepAliveLeaseOnce(leaseID int64) error
+		RevokeLease(leaseID int64) error
 
 		Delete(key string) error
+		// GetAndDelete deletes the key and returns its value before deletion atomically,
+		// the returning value is nil if the key doesn't exist.
+		GetAndDelete(key string) (*string, error)
 		DeletePrefix(prefix string) error
 
-		Syncer() (*cluster.Syncer, error)
+		Syncer() (Syncer, error)
+
+		Close() error
+	}
+
+	// Syncer is the interface to sync data from storage, it is satisfied by cluster.Syncer.
+	Syncer interface {
+		SetStartRevision(revision int64)
+		SetChannelBuffer(size int)
+		ReestablishedCount() uint64
+
+		SyncRaw(key string) (<-chan *mvccpb.KeyValue, error)
+		SyncPrefix(prefix string) (<-chan map[string]string, error)
+		SyncPrefixWithRevision(prefix string) (<-chan *cluster.PrefixSnapshot, error)
+		SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error)
+
+		Close()
 	}
 
 	clusterStorage struct {
-		name  string
-		cls   cluster.Cluster
-		mutex cluster.Mutex
+		name    string
+		cls     cluster.Cluster
+		mutex   cluster.Mutex
+		timeout time.Duration
+		closed  int32
 	}
 )
 
+var (
+	// ErrTimeout is the error when a storage request exceeds its timeout.
+	ErrTimeout = fmt.Errorf("storage request timeout")
+
+	// ErrClosed is the error when using a closed storage.
+	ErrClosed = fmt.Errorf("storage already been closed")
+
+	// ErrCompacted is the error when reading at a revision which has been compacted.
+	ErrCompacted = fmt.Errorf("required revision has been compacted")
+)
+
 // New creates a storage.
 func New(name string, cls cluster.Cluster) Storage {
+	return NewWithTimeout(name, cls, 0)
+}
+
+// NewWithTimeout creates a storage whose requests are bounded by timeout,
+// zero timeout means no bound besides the one of the cluster itself.
+func NewWithTimeout(name string, cls cluster.Cluster, timeout time.Duration) Storage {
 	cs := &clusterStorage{
-		name: name,
-		cls:  cls,
+		name:    name,
+		cls:     cls,
+		timeout: timeout,
 	}
 
 	err := cs.mutexGoReady()
@@ -88,7 +153,15 @@ func (cs *clusterStorage) mutexGoReady() error {
 	return nil
 }
 
+func (cs *clusterStorage) isClosed() bool {
+	return atomic.LoadInt32(&cs.closed) == 1
+}
+
 func (cs *clusterStorage) Lock() error {
+	if cs.isClosed() {
+		return ErrClosed
+	}
+
 	err := cs.mutexGoReady()
 	if err != nil {
 		return err
@@ -98,6 +171,10 @@ func (cs *clusterStorage) Lock() error {
 }
 
 func (cs *clusterStorage) Unlock() error {
+	if cs.isClosed() {
+		return ErrClosed
+	}
+
 	err := cs.mutexGoReady()
 	if err != nil {
 		return err
@@ -106,46 +183,268 @@ func (cs *clusterStorage) Unlock() error {
 	return cs.mutex.Unlock()
 }
 
+// withTimeout runs fn with the cluster whose requests are canceled after the timeout,
+// so a timed out request is never applied after returning.
+func (cs *clusterStorage) withTimeout(fn func(cls cluster.Cluster) error) error {
+	if cs.isClosed() {
+		return ErrClosed
+	}
+
+	if cs.timeout <= 0 {
+		return fn(cs.cls)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cs.timeout)
+	defer cancel()
+
+	err := fn(cs.cls.WithContext(ctx))
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
 func (cs *clusterStorage) Get(key string) (*string, error) {
-	return cs.cls.Get(key)
+	var value *string
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		value, err = cls.Get(key)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
 }
 
 func (cs *clusterStorage) GetPrefix(prefix string) (map[string]string, error) {
-	return cs.cls.GetPrefix(prefix)
+	var kvs map[string]string
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kvs, err = cls.GetPrefix(prefix)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return kvs, nil
 }
 
 func (cs *clusterStorage) Put(key, value string) error {
-	return cs.cls.Put(key, value)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.Put(key, value)
+	})
+}
+
+func (cs *clusterStorage) CompareAndPut(key, value string, modRevision int64) (bool, error) {
+	var put bool
+	err := cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.STM(func(stm concurrency.STM) error {
+			put = stm.Rev(key) == modRevision
+			if put {
+				stm.Put(key, value)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return put, nil
 }
 
 func (cs *clusterStorage) PutUnderLease(key, value string) error {
-	return cs.cls.PutUnderLease(key, value)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.PutUnderLease(key, value)
+	})
 }
 
 func (cs *clusterStorage) PutAndDelete(kvs map[string]*string) error {
-	return cs.cls.PutAndDelete(kvs)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.PutAndDelete(kvs)
+	})
 }
 
 func (cs *clusterStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
-	return cs.cls.PutAndDeleteUnderLease(kvs)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.PutAndDeleteUnderLease(kvs)
+	})
+}
+
+func (cs *clusterStorage) CompareAndPutAndDelete(revisions map[string]int64, kvs map[string]*string) (bool, error) {
+	var applied bool
+	err := cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.STM(func(stm concurrency.STM) error {
+			applied = false
+			for key, revision := range revisions {
+				if stm.Rev(key) != revision {
+					return nil
+				}
+			}
+			for key, value := range kvs {
+				if value == nil {
+					stm.Del(key)
+				} else {
+					stm.Put(key, *value)
+				}
+			}
+			applied = true
+			return nil
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return applied, nil
+}
+
+func (cs *clusterStorage) PutIfAbsentUnderNewLease(key, value string, ttl time.Duration) (int64, error) {
+	var leaseID int64
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		leaseID, err = cls.PutIfAbsentUnderNewLease(key, value, ttl)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return leaseID, nil
+}
+
+func (cs *clusterStorage) KeepAliveLeaseOnce(leaseID int64) error {
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.KeepAliveLeaseOnce(leaseID)
+	})
+}
+
+func (cs *clusterStorage) RevokeLease(leaseID int64) error {
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.RevokeLease(leaseID)
+	})
 }
 
 func (cs *clusterStorage) Delete(key string) error {
-	return cs.cls.Delete(key)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.Delete(key)
+	})
+}
+
+func (cs *clusterStorage) GetAndDelete(key string) (*string, error) {
+	var value *string
+	err := cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.STM(func(stm concurrency.STM) error {
+			value = nil
+			if stm.Rev(key) == 0 {
+				return nil
+			}
+			v := stm.Get(key)
+			value = &v
+			stm.Del(key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
 }
 
 func (cs *clusterStorage) DeletePrefix(prefix string) error {
-	return cs.cls.DeletePrefix(prefix)
+	return cs.withTimeout(func(cls cluster.Cluster) error {
+		return cls.DeletePrefix(prefix)
+	})
 }
 
 func (cs *clusterStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
-	return cs.cls.GetRaw(key)
+	var kv *mvccpb.KeyValue
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kv, err = cls.GetRaw(key)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return kv, nil
 }
 
 func (cs *clusterStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
-	return cs.cls.GetRawPrefix(prefix)
+	var kvs map[string]*mvccpb.KeyValue
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kvs, err = cls.GetRawPrefix(prefix)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return kvs, nil
+}
+
+func (cs *clusterStorage) GetRawMulti(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, error) {
+	var kvs map[string]*mvccpb.KeyValue
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kvs, err = cls.GetRawMulti(keys, prefixes)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return kvs, nil
 }
 
-func (cs *clusterStorage) Syncer() (*cluster.Syncer, error) {
-	return cs.cls.Syncer(time.Minute)
+func (cs *clusterStorage) GetRawMultiWithRevision(keys []string, prefixes []string) (map[string]*mvccpb.KeyValue, int64, error) {
+	var (
+		kvs      map[string]*mvccpb.KeyValue
+		revision int64
+	)
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kvs, revision, err = cls.GetRawMultiWithRevision(keys, prefixes)
+		return
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return kvs, revision, nil
+}
+
+func (cs *clusterStorage) GetRawAtRevision(key string, revision int64) (*mvccpb.KeyValue, error) {
+	var kv *mvccpb.KeyValue
+	err := cs.withTimeout(func(cls cluster.Cluster) (err error) {
+		kv, err = cls.GetRawAtRevision(key, revision)
+		return
+	})
+	if err == rpctypes.ErrCompacted {
+		return nil, ErrCompacted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+func (cs *clusterStorage) Syncer() (Syncer, error) {
+	if cs.isClosed() {
+		return nil, ErrClosed
+	}
+
+	syncer, err := cs.cls.Syncer(time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return syncer, nil
+}
+
+// Close closes the storage, all requests after closing fail with ErrClosed.
+// NOTE: The cluster is shared by others, so it is not closed.
+func (cs *clusterStorage) Close() error {
+	atomic.StoreInt32(&cs.closed, 1)
+	return nil
 }
@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+)
+
+// delayCluster is a cluster whose requests take delay to finish.
+type delayCluster struct {
+	cluster.Cluster
+	delay time.Duration
+	ctx   context.Context
+	puts  *int32
+}
+
+func (c *delayCluster) WithContext(ctx context.Context) cluster.Cluster {
+	cls := *c
+	cls.ctx = ctx
+	return &cls
+}
+
+// wait waits for the delay, it returns the error of the context if it is done first.
+func (c *delayCluster) wait() error {
+	if c.ctx == nil {
+		time.Sleep(c.delay)
+		return nil
+	}
+	select {
+	case <-time.After(c.delay):
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+func (c *delayCluster) Mutex(name string) (cluster.Mutex, error) {
+	return nil, fmt.Errorf("mutex is not supported")
+}
+
+func (c *delayCluster) Get(key string) (*string, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	value := "value"
+	return &value, nil
+}
+
+func (c *delayCluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return map[string]*mvccpb.KeyValue{}, nil
+}
+
+func (c *delayCluster) Put(key, value string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	if c.puts != nil {
+		atomic.AddInt32(c.puts, 1)
+	}
+	return nil
+}
+
+func (c *delayCluster) Delete(key string) error {
+	return c.wait()
+}
+
+func TestStorageTimeout(t *testing.T) {
+	logger.InitNop()
+
+	cls := &delayCluster{delay: 200 * time.Millisecond}
+	store := NewWithTimeout("test", cls, 20*time.Millisecond)
+
+	if _, err := store.Get("/key"); err != ErrTimeout {
+		t.Errorf("get should time out, got: %v", err)
+	}
+	if _, err := store.GetRawPrefix("/prefix/"); err != ErrTimeout {
+		t.Errorf("get prefix should time out, got: %v", err)
+	}
+	if err := store.Put("/key", "value"); err != ErrTimeout {
+		t.Errorf("put should time out, got: %v", err)
+	}
+	if err := store.Delete("/key"); err != ErrTimeout {
+		t.Errorf("delete should time out, got: %v", err)
+	}
+}
+
+func TestStorageTimeoutCancelsRequest(t *testing.T) {
+	logger.InitNop()
+
+	var puts int32
+	cls := &delayCluster{delay: 100 * time.Millisecond, puts: &puts}
+	store := NewWithTimeout("test", cls, 20*time.Millisecond)
+
+	if err := store.Put("/key", "value"); err != ErrTimeout {
+		t.Fatalf("put should time out, got: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&puts); n != 0 {
+		t.Errorf("timed out put should not be applied, applied %d times", n)
+	}
+}
+
+func TestStorageWithinTimeout(t *testing.T) {
+	logger.InitNop()
+
+	cls := &delayCluster{delay: time.Millisecond}
+	store := NewWithTimeout("test", cls, time.Second)
+
+	value, err := store.Get("/key")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if value == nil || *value != "value" {
+		t.Errorf("get returns unexpected value: %v", value)
+	}
+	if err := store.Put("/key", "value"); err != nil {
+		t.Errorf("put failed: %v", err)
+	}
+
+	// zero timeout means no extra bound.
+	store = New("test", &delayCluster{delay: 20 * time.Millisecond})
+	if _, err := store.Get("/key"); err != nil {
+		t.Errorf("get without timeout failed: %v", err)
+	}
+}
+
+func TestStorageClose(t *testing.T) {
+	logger.InitNop()
+
+	store := New("test", &delayCluster{})
+	if err := store.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("close twice failed: %v", err)
+	}
+
+	if _, err := store.Get("/key"); err != ErrClosed {
+		t.Errorf("get should fail after closing, got: %v", err)
+	}
+	if err := store.Put("/key", "value"); err != ErrClosed {
+		t.Errorf("put should fail after closing, got: %v", err)
+	}
+	if _, err := store.Syncer(); err != ErrClosed {
+		t.Errorf("syncer should fail after closing, got: %v", err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	prefix := "/mesh/service-instances/status/"
+	key := prefix + "order/ins-1"
+
+	if CodecFor(key) != YAMLCodec {
+		t.Errorf("default codec should be yaml")
+	}
+
+	RegisterCodec(prefix, spec.StatusProtobufCodec)
+	defer RegisterCodec(prefix, YAMLCodec)
+
+	if CodecFor(key) != spec.StatusProtobufCodec {
+		t.Errorf("codec of the prefix should be protobuf")
+	}
+	if CodecFor("/mesh/service-spec/order") != YAMLCodec {
+		t.Errorf("codec of other keys should be yaml")
+	}
+
+	status := &spec.ServiceInstanceStatus{
+		ServiceName:       "order",
+		InstanceID:        "ins-1",
+		LastHeartbeatTime: "2021-10-01T00:00:00Z",
+	}
+	buff, err := Encode(key, status)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	decoded := &spec.ServiceInstanceStatus{}
+	if err = Decode(key, buff, decoded); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if *decoded != *status {
+		t.Errorf("decoded status %+v should equal to %+v", decoded, status)
+	}
+
+	// values written in yaml are still readable.
+	buff, _ = YAMLCodec.Marshal(status)
+	decoded = &spec.ServiceInstanceStatus{}
+	if err = Decode(key, buff, decoded); err != nil || decoded.InstanceID != "ins-1" {
+		t.Errorf("decode yaml value failed: %+v, %v", decoded, err)
+	}
+
+	RegisterCodec(prefix, YAMLCodec)
+	if CodecFor(key) != YAMLCodec {
+		t.Errorf("codec should be reset to yaml")
+	}
+}
+
+func benchmarkStatusCodec(b *testing.B, codec Codec) {
+	status := &spec.ServiceInstanceStatus{
+		ServiceName:       "order",
+		InstanceID:        "ins-1",
+		LastHeartbeatTime: "2021-10-01T00:00:00Z",
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buff, err := codec.Marshal(status)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = codec.Unmarshal(buff, &spec.ServiceInstanceStatus{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStatusCodecYAML(b *testing.B) {
+	benchmarkStatusCodec(b, YAMLCodec)
+}
+
+func BenchmarkStatusCodecProtobuf(b *testing.B) {
+	benchmarkStatusCodec(b, spec.StatusProtobufCodec)
+}
@@ -49,7 +49,9 @@ type (
 		serviceName      string
 		egressServerName string
 		service          *service.Service
-		mutex            sync.RWMutex
+		// instances is the last informed instance specs, nil before informed.
+		instances map[string]*spec.ServiceInstanceSpec
+		mutex     sync.RWMutex
 	}
 
 	httpServerSpecBuilder struct {
@@ -138,6 +140,14 @@ func (egs *EgressServer) InitEgress(service *spec.Service) error {
 			return err
 		}
 	}
+
+	// NOTE: Only the readiness changes matter, the heartbeats are ignored.
+	err = egs.inf.OnAllServiceInstanceStatuses(egs.reloadByStatuses, informer.WithIgnoredPaths(
+		informer.ServiceInstanceLastHeartbeatTime, informer.ServiceInstanceServerHeartbeatTime))
+	if err != nil && err != informer.ErrAlreadyWatched {
+		logger.Errorf("add instance status watching service: %s failed: %v", service.Name, err)
+		return err
+	}
 	return nil
 }
 
@@ -154,6 +164,27 @@ func (egs *EgressServer) _ready() bool {
 }
 
 func (egs *EgressServer) reloadByInstances(value map[string]*spec.ServiceInstanceSpec) bool {
+	egs.mutex.Lock()
+	egs.instances = value
+	egs.mutex.Unlock()
+
+	return egs.reloadHTTPServer(egs.specsOfInstances(value))
+}
+
+func (egs *EgressServer) reloadByStatuses(value map[string]*spec.ServiceInstanceStatus) bool {
+	egs.mutex.RLock()
+	instances := egs.instances
+	egs.mutex.RUnlock()
+
+	// the instance specs are not informed yet.
+	if instances == nil {
+		return true
+	}
+
+	return egs.reloadHTTPServer(egs.specsOfInstances(instances))
+}
+
+func (egs *EgressServer) specsOfInstances(value map[string]*spec.ServiceInstanceSpec) map[string]*spec.Service {
 	specs := make(map[string]*spec.Service)
 	for _, v := range value {
 		if _, exist := specs[v.ServiceName]; !exist {
@@ -162,7 +193,7 @@ func (egs *EgressServer) reloadByInstances(value map[string]*spec.ServiceInstanc
 		}
 	}
 
-	return egs.reloadHTTPServer(specs)
+	return specs
 }
 
 func (egs *EgressServer) reloadBySpecs(value map[string]*spec.Service) bool {
@@ -177,7 +208,7 @@ func (egs *EgressServer) reloadHTTPServer(specs map[string]*spec.Service) bool {
 	serverName2PipelineName := make(map[string]string)
 
 	for _, v := range specs {
-		instances := egs.service.ListServiceInstanceSpecs(v.Name)
+		instances := egs.service.ListReadyInstances(v.Name)
 		pipelineSpec, err := v.SideCarEgressPipelineSpec(instances)
 		if err != nil {
 			logger.Errorf("BUG: gen sidecar egress httpserver spec failed: %v", err)
@@ -18,8 +18,12 @@
 package worker
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/pkg/util/jmxtool"
 )
@@ -28,6 +32,9 @@ const (
 	easeAgentConfigManager = "com.megaease.easeagent:type=ConfigManager"
 	updateServiceOperation = "updateService"
 	updateCanaryOperation  = "updateCanary"
+
+	// criticalRetryInterval is the interval of retrying the failed critical push.
+	criticalRetryInterval = 5 * time.Second
 )
 
 type (
@@ -35,33 +42,171 @@ type (
 	ObservabilityManager struct {
 		serviceName string
 		agentClient *jmxtool.AgentClient
+
+		mutex sync.Mutex
+		// criticalPending is the service whose critical push failed, other config
+		// changes are blocked until it is pushed by the retrying routine.
+		criticalPending *pendingService
+		retrying        bool
+		// blockedCanary and blockedObservability are the latest config changes blocked
+		// by the critical push, they are replayed after it succeeds.
+		blockedCanary        func() error
+		blockedObservability func() error
+
+		done chan struct{}
+	}
+
+	pendingService struct {
+		service *spec.Service
+		version int64
 	}
 )
 
+// errCriticalConfigPending is the error when a config change is blocked by
+// the failed critical push of the service.
+var errCriticalConfigPending = fmt.Errorf("blocked by pending critical config push")
+
 // NewObservabilityServer creates an ObservabilityServer.
 func NewObservabilityServer(serviceName string) *ObservabilityManager {
 	client := jmxtool.NewAgentClient("localhost", "9900")
 	return &ObservabilityManager{
 		serviceName: serviceName,
 		agentClient: client,
+		done:        make(chan struct{}),
 	}
 }
 
-// UpdateService updates service.
+// UpdateService updates service. If the critical config fails to push, it is retried
+// in the background, and the config changes blocked meanwhile are replayed after it.
 func (server *ObservabilityManager) UpdateService(newService *spec.Service, version int64) error {
 	err := server.agentClient.UpdateService(newService, version)
+
+	var replay func()
+	server.mutex.Lock()
+	if err == nil {
+		server.criticalPending = nil
+		replay = server.takeBlocked()
+	} else if errors.Is(err, jmxtool.ErrCriticalConfigPushFailed) {
+		server.criticalPending = &pendingService{service: newService, version: version}
+		if !server.retrying {
+			server.retrying = true
+			go server.retryCriticalPush()
+		}
+	}
+	server.mutex.Unlock()
+
+	if replay != nil {
+		replay()
+	}
+
 	if err != nil {
-		return fmt.Errorf("Update Service Spec failed: %v ", err)
+		return fmt.Errorf("Update Service Spec failed: %w ", err)
 	}
 
 	return nil
 }
 
+// retryCriticalPush retries the pending critical push until it succeeds,
+// is superseded by a successful UpdateService, or the manager is closed.
+func (server *ObservabilityManager) retryCriticalPush() {
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-time.After(criticalRetryInterval):
+		}
+
+		server.mutex.Lock()
+		pending := server.criticalPending
+		if pending == nil {
+			server.retrying = false
+			server.mutex.Unlock()
+			return
+		}
+		server.mutex.Unlock()
+
+		err := server.agentClient.UpdateService(pending.service, pending.version)
+		if err != nil {
+			logger.Errorf("retry critical config push of service %s failed: %v", server.serviceName, err)
+			continue
+		}
+
+		server.mutex.Lock()
+		// NOTE: A newer service may fail to push meanwhile, which is retried then.
+		if server.criticalPending != pending {
+			server.mutex.Unlock()
+			continue
+		}
+		server.criticalPending, server.retrying = nil, false
+		replay := server.takeBlocked()
+		server.mutex.Unlock()
+
+		replay()
+		return
+	}
+}
+
+// takeBlocked takes the blocked config changes out and returns the function replaying
+// them, the caller must hold the mutex and call the function without it.
+func (server *ObservabilityManager) takeBlocked() func() {
+	canary, observability := server.blockedCanary, server.blockedObservability
+	server.blockedCanary, server.blockedObservability = nil, nil
+
+	return func() {
+		if canary != nil {
+			if err := canary(); err != nil {
+				logger.Errorf("replay blocked canary config of service %s failed: %v", server.serviceName, err)
+			}
+		}
+		if observability != nil {
+			if err := observability(); err != nil {
+				logger.Errorf("replay blocked observability config of service %s failed: %v", server.serviceName, err)
+			}
+		}
+	}
+}
+
 // UpdateCanary updates canary.
 func (server *ObservabilityManager) UpdateCanary(globalHeaders *spec.GlobalCanaryHeaders, version int64) error {
-	err := server.agentClient.UpdateCanary(globalHeaders, version)
-	if err != nil {
+	update := func() error {
+		return server.agentClient.UpdateCanary(globalHeaders, version)
+	}
+
+	server.mutex.Lock()
+	if server.criticalPending != nil {
+		server.blockedCanary = update
+		server.mutex.Unlock()
+		return errCriticalConfigPending
+	}
+	server.mutex.Unlock()
+
+	if err := update(); err != nil {
 		return fmt.Errorf("Update Canary Spec: %v ", err)
 	}
 	return nil
 }
+
+// UpdateObservability updates observability.
+func (server *ObservabilityManager) UpdateObservability(observability *spec.Observability, version int64) error {
+	update := func() error {
+		return server.agentClient.UpdateObservability(server.serviceName, observability, version)
+	}
+
+	server.mutex.Lock()
+	if server.criticalPending != nil {
+		server.blockedObservability = update
+		server.mutex.Unlock()
+		return errCriticalConfigPending
+	}
+	server.mutex.Unlock()
+
+	if err := update(); err != nil {
+		return fmt.Errorf("Update Observability Spec failed: %v ", err)
+	}
+	return nil
+}
+
+// Close stops retrying the pending critical push.
+func (server *ObservabilityManager) Close() {
+	close(server.done)
+}
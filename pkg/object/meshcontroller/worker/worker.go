@@ -27,12 +27,9 @@ import (
 	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
-
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/informer"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/label"
-	"github.com/megaease/easegress/pkg/object/meshcontroller/layout"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/registrycenter"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/service"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
@@ -55,6 +52,9 @@ type (
 		applicationPort uint32
 		applicationIP   string
 		serviceLabels   map[string]string
+		// ready and readyRecorded are accessed by the heartbeat routine only.
+		ready         bool
+		readyRecorded bool
 
 		store    storage.Storage
 		service  *service.Service
@@ -342,43 +342,41 @@ func (worker *Worker) initTrafficGate() error {
 func (worker *Worker) updateHeartbeat() error {
 	resp, err := http.Get(worker.aliveProbe)
 	if err != nil {
+		worker.updateReadiness(false)
 		return fmt.Errorf("probe: %s check service: %s instanceID: %s heartbeat failed: %v",
 			worker.aliveProbe, worker.serviceName, worker.instanceID, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		worker.updateReadiness(false)
 		return fmt.Errorf("probe: %s check service: %s instanceID: %s heartbeat failed status code is %d",
 			worker.aliveProbe, worker.serviceName, worker.instanceID, resp.StatusCode)
 	}
 
-	value, err := worker.store.Get(layout.ServiceInstanceStatusKey(worker.serviceName, worker.instanceID))
+	err = worker.service.RecordHeartbeat(worker.serviceName, worker.instanceID, time.Now())
 	if err != nil {
-		return fmt.Errorf("get service: %s instance: %s status failed: %v", worker.serviceName, worker.instanceID, err)
+		return err
 	}
 
-	status := &spec.ServiceInstanceStatus{
-		ServiceName: worker.serviceName,
-		InstanceID:  worker.instanceID,
-	}
-	if value != nil {
-		err := yaml.Unmarshal([]byte(*value), status)
-		if err != nil {
-			logger.Errorf("BUG: unmarshal %s to yaml failed: %v", *value, err)
+	worker.updateReadiness(worker.ingressServer.Ready() && worker.egressServer.Ready())
+	return nil
+}
 
-			// NOTE: This is a little strict, maybe we could use the brand new status to update.
-			return err
-		}
+// updateReadiness records the readiness of the instance from the probe and
+// the traffic gate, it only writes the status when the readiness changes.
+func (worker *Worker) updateReadiness(ready bool) {
+	if worker.readyRecorded && worker.ready == ready {
+		return
 	}
 
-	status.LastHeartbeatTime = time.Now().Format(time.RFC3339)
-	buff, err := yaml.Marshal(status)
+	err := worker.service.SetInstanceReady(worker.serviceName, worker.instanceID, ready)
 	if err != nil {
-		logger.Errorf("BUG: marshal %#v to yaml failed: %v", status, err)
-		return err
+		logger.Errorf("set service: %s instance: %s ready to %v failed: %v",
+			worker.serviceName, worker.instanceID, ready, err)
+		return
 	}
-
-	return worker.store.Put(layout.ServiceInstanceStatusKey(worker.serviceName, worker.instanceID), string(buff))
+	worker.ready, worker.readyRecorded = ready, true
 }
 
 func (worker *Worker) informJavaAgent() error {
@@ -420,4 +418,6 @@ func (worker *Worker) Close() {
 	worker.ingressServer.Close()
 	worker.registryServer.Close()
 	worker.apiServer.Close()
+	worker.observabilityManager.Close()
+	worker.service.Close()
 }
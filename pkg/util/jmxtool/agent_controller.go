@@ -18,10 +18,15 @@
 package jmxtool
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
 	yamljsontool "github.com/ghodss/yaml"
 	"gopkg.in/yaml.v2"
@@ -31,80 +36,437 @@ import (
 )
 
 const (
-	canaryConfigURL  = "/config-canary"
-	serviceConfigURL = "/config-service"
+	canaryConfigURL        = "/config-canary"
+	serviceConfigURL       = "/config-service"
+	observabilityConfigURL = "/config-observability"
+	rollbackConfigURL      = "/config-rollback"
+	appliedVersionURL      = "/config-version"
+	schemaVersionURL       = "/config-schema-version"
+	drainURL               = "/drain"
+
+	// LegacySchemaVersion is the payload schema version of the agents not supporting
+	// negotiation, whose payloads carry no schema version.
+	LegacySchemaVersion = 1
+	// CurrentSchemaVersion is the latest payload schema version of the client,
+	// whose payloads carry the schema version in the field schemaVersion.
+	CurrentSchemaVersion = 2
+
+	// criticalPushRetries is the max times of pushing the critical config.
+	criticalPushRetries = 3
+)
+
+var (
+	// ErrNotSupported is the error when the agent doesn't support the request,
+	// the caller could fall back to other ways.
+	ErrNotSupported = fmt.Errorf("not supported by agent")
+
+	// ErrVersionNotAvailable is the error when the agent doesn't retain
+	// the config version to roll back to.
+	ErrVersionNotAvailable = fmt.Errorf("version not available in agent")
+
+	// ErrCriticalConfigPushFailed is the error when pushing the config which must not be
+	// partially applied (e.g. circuit breaker) still fails after retrying, the caller
+	// should block other config changes of the service until the push succeeds.
+	ErrCriticalConfigPushFailed = fmt.Errorf("critical config push failed")
+
+	// criticalPushRetryInterval is the interval between retries of pushing the critical config.
+	criticalPushRetryInterval = 500 * time.Millisecond
+
+	// negotiateTimeout is the timeout of negotiating the schema version before pushing.
+	negotiateTimeout = 3 * time.Second
+)
+
+type (
+	// ConfigDiff is the difference between the config applied by the agent and the
+	// config to push, keyed by the flattened config keys.
+	ConfigDiff struct {
+		Added   map[string]string
+		Removed map[string]string
+		Changed map[string]ConfigChange
+	}
+
+	// ConfigChange is the change of one config key.
+	ConfigChange struct {
+		Old string
+		New string
+	}
 )
 
 // AgentInterface is the interface operate the agent client
 type AgentInterface interface {
 	UpdateService(newService *spec.Service, version int64) error
 	UpdateCanary(globalHeaders *spec.GlobalCanaryHeaders, version int64) error
+	UpdateObservability(serviceName string, observability *spec.Observability, version int64) error
+	RollbackService(serviceName string, toVersion int64) error
+	GetAppliedVersion(ctx context.Context, serviceName string) (int64, error)
+	Negotiate(ctx context.Context) (int, error)
+	NotifyDrain(ctx context.Context, gracePeriod time.Duration) error
+	DiffService(ctx context.Context, service *spec.Service) (ConfigDiff, error)
 }
 
 // AgentClient stores the information of agent client
 type AgentClient struct {
 	URL        string
 	HTTPClient *http.Client
+
+	// mutex protects the negotiated schema version, zero means not negotiated yet.
+	mutex         sync.Mutex
+	schemaVersion int
 }
 
 // NewAgentClient creates the agent client
 func NewAgentClient(host, port string) *AgentClient {
 	return &AgentClient{
-		"http://" + host + ":" + port,
-		&http.Client{},
+		URL:        "http://" + host + ":" + port,
+		HTTPClient: &http.Client{},
 	}
 }
 
-// UpdateService updates service.
-func (agent *AgentClient) UpdateService(newService *spec.Service, version int64) error {
-	buff, err := yaml.Marshal(newService)
+// configPayload converts the config to the key value pairs accepted by agent.
+func configPayload(config interface{}, version int64) (map[string]string, error) {
+	buff, err := yaml.Marshal(config)
 	if err != nil {
-		return fmt.Errorf("marshal %#v to yaml failed: %v", newService, err)
+		return nil, fmt.Errorf("marshal %#v to yaml failed: %v", config, err)
 	}
 	jsonBytes, err := yamljsontool.YAMLToJSON(buff)
 	if err != nil {
-		return fmt.Errorf("convert yaml %s to json failed: %v", buff, err)
+		return nil, fmt.Errorf("convert yaml %s to json failed: %v", buff, err)
 	}
 	kvMap, err := JSONToKVMap(string(jsonBytes))
+	if err != nil {
+		return nil, fmt.Errorf("convert json %s to kv map failed: %v", jsonBytes, err)
+	}
 	kvMap["version"] = strconv.FormatInt(version, 10)
 
+	return kvMap, nil
+}
+
+func (agent *AgentClient) sendConfig(method, path string, kvMap map[string]string) ([]byte, error) {
 	bytes, err := json.Marshal(kvMap)
 	if err != nil {
-		return fmt.Errorf("marshal %s to json failed: %v", kvMap, err)
+		return nil, fmt.Errorf("marshal %s to json failed: %v", kvMap, err)
+	}
+
+	url := agent.URL + path
+	bodyString, err := handleRequest(method, url, bytes)
+	if err != nil {
+		// NOTE: The agent may have been replaced by another version, e.g. it rejects
+		// the payload of the mismatched schema version, so negotiate again next time.
+		agent.resetSchemaVersion()
+		return nil, fmt.Errorf("handleRequest error: %w", err)
+	}
+	logger.Infof("Update config, URL: %s,request: %s, result: %v", url, string(bytes), string(bodyString))
+
+	return bodyString, nil
+}
+
+// sendCriticalConfig sends the config with retries, and returns
+// ErrCriticalConfigPushFailed if all retries fail. The payload is shaped
+// again before each retry, with the schema version negotiated again.
+func (agent *AgentClient) sendCriticalConfig(method, path string, kvMap map[string]string) error {
+	var err error
+	for i := 0; i < criticalPushRetries; i++ {
+		if i > 0 {
+			time.Sleep(criticalPushRetryInterval)
+			agent.shapePayload(kvMap)
+		}
+		if _, err = agent.sendConfig(method, path, kvMap); err == nil {
+			return nil
+		}
+		logger.Warnf("push critical config to %s failed (attempt %d): %v", path, i+1, err)
 	}
 
-	url := agent.URL + serviceConfigURL
-	bodyString, err := handleRequest(http.MethodPut, url, bytes)
+	return fmt.Errorf("%w: %v", ErrCriticalConfigPushFailed, err)
+}
+
+// UpdateService updates service. The push carrying resilience config is critical,
+// it's retried on failure and returns ErrCriticalConfigPushFailed if still failing.
+// The rate limiter of resilience is validated before pushing.
+func (agent *AgentClient) UpdateService(newService *spec.Service, version int64) error {
+	kvMap, err := agent.servicePayload(newService, version)
 	if err != nil {
-		return fmt.Errorf("handleRequest error: %v", err)
+		return err
+	}
+
+	if newService.Resilience != nil {
+		return agent.sendCriticalConfig(http.MethodPut, serviceConfigURL, kvMap)
 	}
-	logger.Infof("Update Service, URL: %s,request: %s, result: %v", url, string(bytes), string(bodyString))
+
+	_, err = agent.sendConfig(http.MethodPut, serviceConfigURL, kvMap)
 	return err
 }
 
+// servicePayload validates the service and converts it to the payload of UpdateService.
+func (agent *AgentClient) servicePayload(service *spec.Service, version int64) (map[string]string, error) {
+	if service.Resilience != nil && service.Resilience.RateLimiter != nil {
+		if err := spec.ValidateRateLimiter(service.Resilience.RateLimiter); err != nil {
+			return nil, fmt.Errorf("invalid rate limiter: %v", err)
+		}
+	}
+
+	kvMap, err := configPayload(service, version)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The empty allowlist is omitted from the yaml, send it explicitly,
+	// otherwise the agent keeps enforcing the cleared one.
+	if len(service.EgressAllowlist) == 0 {
+		kvMap["egressAllowlist"] = ""
+	}
+	agent.shapePayload(kvMap)
+
+	return kvMap, nil
+}
+
 // UpdateCanary updates canary.
 func (agent *AgentClient) UpdateCanary(globalHeaders *spec.GlobalCanaryHeaders, version int64) error {
-	buff, err := yaml.Marshal(globalHeaders)
+	kvMap, err := configPayload(globalHeaders, version)
 	if err != nil {
-		return fmt.Errorf("marshal %#v to yaml failed: %v", globalHeaders, err)
+		return err
 	}
-	jsonBytes, err := yamljsontool.YAMLToJSON(buff)
+
+	_, err = agent.sendConfig(http.MethodPut, canaryConfigURL, kvMap)
+	return err
+}
+
+// UpdateObservability updates observability of the service.
+// It returns ErrNotSupported if the agent doesn't support it.
+func (agent *AgentClient) UpdateObservability(serviceName string, observability *spec.Observability, version int64) error {
+	if err := observability.Validate(); err != nil {
+		return fmt.Errorf("invalid observability: %v", err)
+	}
+
+	kvMap, err := configPayload(observability, version)
 	if err != nil {
-		return fmt.Errorf("convert yaml %s to json failed: %v", buff, err)
+		return err
+	}
+	kvMap["serviceName"] = serviceName
+
+	_, err = agent.sendConfig(http.MethodPut, observabilityConfigURL, kvMap)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusNotFound {
+		return ErrNotSupported
+	}
+
+	return err
+}
+
+// RollbackService asks the agent to revert the service config to a version it retains.
+// It returns ErrVersionNotAvailable if the agent doesn't retain the version.
+func (agent *AgentClient) RollbackService(serviceName string, toVersion int64) error {
+	kvMap := map[string]string{
+		"serviceName": serviceName,
+		"version":     strconv.FormatInt(toVersion, 10),
+	}
+
+	_, err := agent.sendConfig(http.MethodPost, rollbackConfigURL, kvMap)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode {
+		case http.StatusGone:
+			return ErrVersionNotAvailable
+		case http.StatusNotFound:
+			return ErrNotSupported
+		}
+	}
+
+	return err
+}
+
+// GetAppliedVersion queries the config version of the service applied by the agent,
+// so the caller could confirm the agent has converged after updating the service.
+// Zero version means no config has been applied yet.
+func (agent *AgentClient) GetAppliedVersion(ctx context.Context, serviceName string) (int64, error) {
+	body, err := agent.queryService(ctx, appliedVersionURL, serviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	result := struct {
+		Version json.Number `json:"version"`
+	}{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("unmarshal %s to json failed: %v", body, err)
+	}
+	if result.Version == "" {
+		return 0, nil
+	}
+
+	version, err := result.Version.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %s: %v", result.Version, err)
+	}
+
+	return version, nil
+}
+
+// DiffService previews what UpdateService would change on the agent without applying,
+// by diffing the service config applied by the agent against the would-be payload.
+// The version fields are excluded. It returns ErrNotSupported if the agent doesn't
+// support querying the applied config.
+func (agent *AgentClient) DiffService(ctx context.Context, service *spec.Service) (ConfigDiff, error) {
+	payload, err := agent.servicePayload(service, 0)
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+
+	body, err := agent.queryService(ctx, serviceConfigURL, service.Name)
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+	current := map[string]string{}
+	if err = json.Unmarshal(body, &current); err != nil {
+		return ConfigDiff{}, fmt.Errorf("unmarshal %s to json failed: %v", body, err)
+	}
+
+	return diffConfig(current, payload), nil
+}
+
+// queryService gets the path of the service from the agent,
+// it returns ErrNotSupported if the agent doesn't support the path.
+func (agent *AgentClient) queryService(ctx context.Context, path, serviceName string) ([]byte, error) {
+	reqURL := agent.URL + path + "?serviceName=" + url.QueryEscape(serviceName)
+	body, err := handleRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusNotFound {
+		return nil, ErrNotSupported
+	}
+	if err != nil {
+		return nil, fmt.Errorf("handleRequest error: %w", err)
+	}
+
+	return body, nil
+}
+
+// Negotiate queries the payload schema version supported by the agent, the result is
+// capped by CurrentSchemaVersion and cached until a push to the agent fails, so the
+// agent is queried again only after that. The agents not supporting negotiation are
+// considered as LegacySchemaVersion.
+func (agent *AgentClient) Negotiate(ctx context.Context) (int, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	if agent.schemaVersion != 0 {
+		return agent.schemaVersion, nil
+	}
+
+	body, err := handleRequestWithContext(ctx, http.MethodGet, agent.URL+schemaVersionURL, nil)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusNotFound {
+		agent.schemaVersion = LegacySchemaVersion
+		return agent.schemaVersion, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("handleRequest error: %w", err)
+	}
+
+	result := struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("unmarshal %s to json failed: %v", body, err)
+	}
+	if result.SchemaVersion < LegacySchemaVersion {
+		return 0, fmt.Errorf("invalid schema version %d", result.SchemaVersion)
+	}
+
+	agent.schemaVersion = result.SchemaVersion
+	if agent.schemaVersion > CurrentSchemaVersion {
+		agent.schemaVersion = CurrentSchemaVersion
+	}
+
+	return agent.schemaVersion, nil
+}
+
+// resetSchemaVersion drops the negotiated schema version.
+func (agent *AgentClient) resetSchemaVersion() {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	agent.schemaVersion = 0
+}
+
+// NotifyDrain asks the agent to stop accepting new connections and shut down its
+// listeners gracefully, the in-flight requests are given the grace period to finish.
+// It returns ErrNotSupported if the agent doesn't support it.
+func (agent *AgentClient) NotifyDrain(ctx context.Context, gracePeriod time.Duration) error {
+	if gracePeriod < 0 {
+		return fmt.Errorf("invalid grace period %v", gracePeriod)
 	}
-	kvMap, err := JSONToKVMap(string(jsonBytes))
-	kvMap["version"] = strconv.FormatInt(version, 10)
 
+	kvMap := map[string]string{"gracePeriod": gracePeriod.String()}
 	bytes, err := json.Marshal(kvMap)
 	if err != nil {
 		return fmt.Errorf("marshal %s to json failed: %v", kvMap, err)
 	}
 
-	url := agent.URL + canaryConfigURL
-	bodyString, err := handleRequest(http.MethodPut, url, bytes)
+	_, err = handleRequestWithContext(ctx, http.MethodPost, agent.URL+drainURL, bytes)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusNotFound {
+		return ErrNotSupported
+	}
 	if err != nil {
-		return fmt.Errorf("handleRequest error: %v", err)
+		return fmt.Errorf("handleRequest error: %w", err)
 	}
-	logger.Infof("Update Canary, URL: %s,request: %s, result: %v", url, string(bytes), string(bodyString))
-	return err
+	logger.Infof("notify agent %s to drain with grace period %v", agent.URL, gracePeriod)
+
+	return nil
+}
+
+// shapePayload adapts the payload to the schema version of the agent, it falls back
+// to LegacySchemaVersion without caching if the negotiation fails.
+func (agent *AgentClient) shapePayload(kvMap map[string]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), negotiateTimeout)
+	defer cancel()
+
+	schemaVersion, err := agent.Negotiate(ctx)
+	if err != nil {
+		logger.Warnf("negotiate schema version with agent %s failed, fall back to %d: %v",
+			agent.URL, LegacySchemaVersion, err)
+		schemaVersion = LegacySchemaVersion
+	}
+
+	if schemaVersion >= CurrentSchemaVersion {
+		kvMap["schemaVersion"] = strconv.Itoa(schemaVersion)
+	} else {
+		delete(kvMap, "schemaVersion")
+	}
+}
+
+// IsEmpty returns whether nothing would be changed.
+func (d ConfigDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffConfig diffs the payloads excluding the version fields.
+func diffConfig(current, desired map[string]string) ConfigDiff {
+	diff := ConfigDiff{
+		Added:   map[string]string{},
+		Removed: map[string]string{},
+		Changed: map[string]ConfigChange{},
+	}
+
+	ignored := func(key string) bool {
+		return key == "version" || key == "schemaVersion"
+	}
+
+	for k, v := range desired {
+		if ignored(k) {
+			continue
+		}
+		old, ok := current[k]
+		switch {
+		case !ok:
+			diff.Added[k] = v
+		case old != v:
+			diff.Changed[k] = ConfigChange{Old: old, New: v}
+		}
+	}
+	for k, v := range current {
+		if _, ok := desired[k]; !ok && !ignored(k) {
+			diff.Removed[k] = v
+		}
+	}
+
+	return diff
 }
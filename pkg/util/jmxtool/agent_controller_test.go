@@ -19,15 +19,22 @@ package jmxtool
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/megaease/easegress/pkg/filter/proxy"
+	"github.com/megaease/easegress/pkg/filter/ratelimiter"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/pkg/util/urlrule"
 )
 
 func httpServer(finished chan bool, notFoundFlag bool) {
@@ -138,3 +145,528 @@ func TestAgentClientFail(t *testing.T) {
 	client.Get("http://127.0.0.1:8181/shutdown")
 	<-finished
 }
+
+func TestAgentClientUpdateObservability(t *testing.T) {
+	logger.InitNop()
+
+	var body string
+	m := http.NewServeMux()
+	m.HandleFunc(observabilityConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		buff, _ := ioutil.ReadAll(r.Body)
+		body = string(buff)
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	observability := &spec.Observability{
+		OutputServer: &spec.ObservabilityOutputServer{
+			Enabled:         true,
+			BootstrapServer: "127.0.0.1:9092",
+		},
+	}
+
+	err := agent.UpdateObservability("order", observability, 2)
+	if err != nil {
+		t.Fatalf("agent update observability failed: %v", err)
+	}
+	for _, s := range []string{`"serviceName":"order"`, `"version":"2"`, `"outputServer.bootstrapServer":"127.0.0.1:9092"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("request body %s should contain %s", body, s)
+		}
+	}
+
+	observability.OutputServer.BootstrapServer = ""
+	if err = agent.UpdateObservability("order", observability, 3); err == nil {
+		t.Errorf("invalid observability should not be sent")
+	}
+
+	// the agent doesn't support observability config.
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	agent = &AgentClient{URL: notFoundServer.URL, HTTPClient: &http.Client{}}
+	err = agent.UpdateObservability("order", &spec.Observability{}, 1)
+	if err != ErrNotSupported {
+		t.Errorf("agent should return ErrNotSupported, got: %v", err)
+	}
+}
+
+func TestAgentClientRollbackService(t *testing.T) {
+	logger.InitNop()
+
+	retained := map[string]bool{"3": true}
+	var method string
+	m := http.NewServeMux()
+	m.HandleFunc(rollbackConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		kvMap := map[string]string{}
+		buff, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(buff, &kvMap)
+		if kvMap["serviceName"] != "order" || !retained[kvMap["version"]] {
+			w.WriteHeader(http.StatusGone)
+		}
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	if err := agent.RollbackService("order", 3); err != nil {
+		t.Fatalf("agent rollback service failed: %v", err)
+	}
+	if method != http.MethodPost {
+		t.Errorf("rollback should be posted, got %s", method)
+	}
+
+	if err := agent.RollbackService("order", 1); err != ErrVersionNotAvailable {
+		t.Errorf("agent should return ErrVersionNotAvailable, got: %v", err)
+	}
+
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	agent = &AgentClient{URL: notFoundServer.URL, HTTPClient: &http.Client{}}
+	if err := agent.RollbackService("order", 3); err != ErrNotSupported {
+		t.Errorf("agent should return ErrNotSupported, got: %v", err)
+	}
+}
+
+func TestAgentClientGetAppliedVersion(t *testing.T) {
+	logger.InitNop()
+
+	applied := map[string]string{
+		"order":    `{"version": 5}`,
+		"delivery": `{"version": "7"}`,
+		"payment":  `{}`,
+	}
+	m := http.NewServeMux()
+	m.HandleFunc(appliedVersionURL, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte(applied[r.URL.Query().Get("serviceName")]))
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	for name, expected := range map[string]int64{"order": 5, "delivery": 7, "payment": 0} {
+		version, err := agent.GetAppliedVersion(context.Background(), name)
+		if err != nil {
+			t.Fatalf("get applied version of %s failed: %v", name, err)
+		}
+		if version != expected {
+			t.Errorf("expect version %d of %s, got %d", expected, name, version)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := agent.GetAppliedVersion(ctx, "order"); err == nil {
+		t.Errorf("canceled request should fail")
+	}
+
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	agent = &AgentClient{URL: notFoundServer.URL, HTTPClient: &http.Client{}}
+	if _, err := agent.GetAppliedVersion(context.Background(), "order"); err != ErrNotSupported {
+		t.Errorf("agent should return ErrNotSupported, got: %v", err)
+	}
+}
+
+func TestAgentClientCriticalConfigPush(t *testing.T) {
+	logger.InitNop()
+	criticalPushRetryInterval = time.Millisecond
+
+	requests, failures := 0, 0
+	m := http.NewServeMux()
+	m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	m.HandleFunc(canaryConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	service := getTestService()
+
+	// best-effort push is not retried.
+	failures = 1
+	err := agent.UpdateService(&service, 1)
+	if err == nil || errors.Is(err, ErrCriticalConfigPushFailed) {
+		t.Errorf("expect non-critical error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("best-effort push should not be retried, got %d requests", requests)
+	}
+
+	err = agent.UpdateCanary(&spec.GlobalCanaryHeaders{}, 1)
+	if err == nil || errors.Is(err, ErrCriticalConfigPushFailed) {
+		t.Errorf("expect non-critical error, got %v", err)
+	}
+
+	// resilience push succeeds after a transient failure.
+	service.Resilience = &spec.Resilience{}
+	requests, failures = 0, 1
+	if err = agent.UpdateService(&service, 2); err != nil {
+		t.Errorf("resilience push should succeed after retrying, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expect 2 requests, got %d", requests)
+	}
+
+	// resilience push keeps failing.
+	requests, failures = 0, criticalPushRetries
+	err = agent.UpdateService(&service, 3)
+	if !errors.Is(err, ErrCriticalConfigPushFailed) {
+		t.Errorf("expect ErrCriticalConfigPushFailed, got %v", err)
+	}
+	if requests != criticalPushRetries {
+		t.Errorf("expect %d requests, got %d", criticalPushRetries, requests)
+	}
+}
+
+func TestAgentClientUpdateServiceRateLimiter(t *testing.T) {
+	logger.InitNop()
+
+	var payload map[string]string
+	m := http.NewServeMux()
+	m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload = map[string]string{}
+		json.Unmarshal(body, &payload)
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	service := getTestService()
+	service.Resilience = &spec.Resilience{
+		RateLimiter: &ratelimiter.Spec{
+			Policies: []*ratelimiter.Policy{{
+				Name:               "default",
+				TimeoutDuration:    "100ms",
+				LimitRefreshPeriod: "10ms",
+				LimitForPeriod:     50,
+			}},
+			DefaultPolicyRef: "default",
+			URLs: []*ratelimiter.URLRule{{
+				URLRule: urlrule.URLRule{
+					Methods: []string{"GET"},
+					URL:     urlrule.StringMatch{Prefix: "/users"},
+				},
+			}},
+		},
+	}
+
+	if err := agent.UpdateService(&service, 1); err != nil {
+		t.Fatalf("update service failed: %v", err)
+	}
+	expected := map[string]string{
+		"resilience.rateLimiter.policies.0.limitForPeriod": "50",
+		"resilience.rateLimiter.defaultPolicyRef":          "default",
+		"resilience.rateLimiter.urls.0.url.prefix":         "/users",
+	}
+	for k, v := range expected {
+		if payload[k] != v {
+			t.Errorf("expect %s to be %s in payload, got %q", k, v, payload[k])
+		}
+	}
+
+	payload = nil
+	service.Resilience.RateLimiter.Policies[0].LimitForPeriod = -1
+	if err := agent.UpdateService(&service, 2); err == nil {
+		t.Errorf("negative limitForPeriod should be rejected")
+	}
+	if payload != nil {
+		t.Errorf("invalid rate limiter should not be pushed")
+	}
+}
+
+func TestAgentClientUpdateServiceEgressAllowlist(t *testing.T) {
+	logger.InitNop()
+
+	var payload map[string]string
+	m := http.NewServeMux()
+	m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload = map[string]string{}
+		json.Unmarshal(body, &payload)
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	service := getTestService()
+	service.EgressAllowlist = []string{"delivery", "payment"}
+
+	if err := agent.UpdateService(&service, 1); err != nil {
+		t.Fatalf("update service failed: %v", err)
+	}
+	if payload["egressAllowlist.0"] != "delivery" || payload["egressAllowlist.1"] != "payment" {
+		t.Errorf("egress allowlist should be propagated, got payload %v", payload)
+	}
+
+	service.EgressAllowlist = nil
+	if err := agent.UpdateService(&service, 2); err != nil {
+		t.Fatalf("update service failed: %v", err)
+	}
+	if value, ok := payload["egressAllowlist"]; !ok || value != "" {
+		t.Errorf("cleared egress allowlist should be sent as empty, got payload %v", payload)
+	}
+	for k := range payload {
+		if strings.HasPrefix(k, "egressAllowlist.") {
+			t.Errorf("cleared egress allowlist should have no items, got %s", k)
+		}
+	}
+}
+
+func TestAgentClientNegotiate(t *testing.T) {
+	logger.InitNop()
+
+	newAgent := func(advertised string) (*AgentClient, *int, *map[string]string, func()) {
+		negotiations := 0
+		payload := map[string]string{}
+		m := http.NewServeMux()
+		if advertised != "" {
+			m.HandleFunc(schemaVersionURL, func(w http.ResponseWriter, r *http.Request) {
+				negotiations++
+				fmt.Fprint(w, advertised)
+			})
+		}
+		m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			payload = map[string]string{}
+			json.Unmarshal(body, &payload)
+		})
+		server := httptest.NewServer(m)
+		agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+		return agent, &negotiations, &payload, server.Close
+	}
+
+	cases := []struct {
+		advertised    string
+		schemaVersion int
+		field         string
+	}{
+		// the legacy agent doesn't support negotiation.
+		{advertised: "", schemaVersion: LegacySchemaVersion, field: ""},
+		{advertised: `{"schemaVersion": 1}`, schemaVersion: 1, field: ""},
+		{advertised: `{"schemaVersion": 2}`, schemaVersion: 2, field: "2"},
+		// the newer agent is capped by the client.
+		{advertised: `{"schemaVersion": 5}`, schemaVersion: CurrentSchemaVersion, field: "2"},
+	}
+
+	for _, c := range cases {
+		agent, negotiations, payload, closeServer := newAgent(c.advertised)
+
+		schemaVersion, err := agent.Negotiate(context.Background())
+		if err != nil {
+			t.Errorf("negotiate with %q failed: %v", c.advertised, err)
+		}
+		if schemaVersion != c.schemaVersion {
+			t.Errorf("expect schema version %d for %q, got %d", c.schemaVersion, c.advertised, schemaVersion)
+		}
+
+		service := getTestService()
+		for version := int64(1); version <= 2; version++ {
+			if err = agent.UpdateService(&service, version); err != nil {
+				t.Errorf("update service failed: %v", err)
+			}
+			if field, ok := (*payload)["schemaVersion"]; field != c.field || ok != (c.field != "") {
+				t.Errorf("expect schemaVersion field %q for %q, got %q", c.field, c.advertised, field)
+			}
+			if (*payload)["name"] != "agent" {
+				t.Errorf("payload should carry the service, got %v", *payload)
+			}
+		}
+
+		if c.advertised != "" && *negotiations != 1 {
+			t.Errorf("negotiated version should be cached, got %d negotiations", *negotiations)
+		}
+
+		closeServer()
+	}
+
+	agent, _, _, closeServer := newAgent(`{"schemaVersion": 0}`)
+	defer closeServer()
+	if _, err := agent.Negotiate(context.Background()); err == nil {
+		t.Errorf("invalid schema version should be rejected")
+	}
+}
+
+func TestAgentClientRenegotiate(t *testing.T) {
+	logger.InitNop()
+
+	var (
+		advertised   = 2
+		negotiations int
+		payloads     []map[string]string
+	)
+	m := http.NewServeMux()
+	m.HandleFunc(schemaVersionURL, func(w http.ResponseWriter, r *http.Request) {
+		negotiations++
+		fmt.Fprintf(w, `{"schemaVersion": %d}`, advertised)
+	})
+	m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]string{}
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+		// the downgraded agent rejects the payload of the mismatched schema version.
+		if _, ok := payload["schemaVersion"]; ok && advertised < CurrentSchemaVersion {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+
+	service := getTestService()
+	if err := agent.UpdateService(&service, 1); err != nil {
+		t.Fatalf("update service failed: %v", err)
+	}
+
+	// the agent is downgraded, the first push fails and drops the negotiated version.
+	advertised = LegacySchemaVersion
+	if err := agent.UpdateService(&service, 2); err == nil {
+		t.Errorf("push of the mismatched schema version should fail")
+	}
+	if err := agent.UpdateService(&service, 3); err != nil {
+		t.Errorf("update service after renegotiation failed: %v", err)
+	}
+	if negotiations != 2 {
+		t.Errorf("expect 2 negotiations, got %d", negotiations)
+	}
+	if _, ok := payloads[len(payloads)-1]["schemaVersion"]; ok {
+		t.Errorf("payload should be shaped for the legacy agent, got %v", payloads[len(payloads)-1])
+	}
+
+	// the critical push is shaped again with the renegotiated version on retry.
+	advertised = CurrentSchemaVersion
+	agent.resetSchemaVersion()
+	agent.Negotiate(context.Background())
+	advertised = LegacySchemaVersion
+	service.Resilience = &spec.Resilience{}
+	if err := agent.UpdateService(&service, 4); err != nil {
+		t.Errorf("critical push should succeed on retry: %v", err)
+	}
+	if _, ok := payloads[len(payloads)-1]["schemaVersion"]; ok {
+		t.Errorf("retried payload should be shaped for the legacy agent, got %v", payloads[len(payloads)-1])
+	}
+}
+
+func TestAgentClientNotifyDrain(t *testing.T) {
+	logger.InitNop()
+
+	var gracePeriod string
+	m := http.NewServeMux()
+	m.HandleFunc(drainURL, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]string{}
+		json.Unmarshal(body, &payload)
+		gracePeriod = payload["gracePeriod"]
+		if gracePeriod == "0s" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	if err := agent.NotifyDrain(context.Background(), 30*time.Second); err != nil {
+		t.Errorf("notify drain failed: %v", err)
+	}
+	if gracePeriod != "30s" {
+		t.Errorf("expect grace period 30s, got %q", gracePeriod)
+	}
+
+	if err := agent.NotifyDrain(context.Background(), 0); err == nil {
+		t.Errorf("failed drain should return error")
+	}
+	if err := agent.NotifyDrain(context.Background(), -time.Second); err == nil {
+		t.Errorf("negative grace period should be rejected")
+	}
+
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	agent = &AgentClient{URL: notFoundServer.URL, HTTPClient: &http.Client{}}
+	if err := agent.NotifyDrain(context.Background(), time.Second); err != ErrNotSupported {
+		t.Errorf("agent should return ErrNotSupported, got: %v", err)
+	}
+}
+
+func TestAgentClientDiffService(t *testing.T) {
+	logger.InitNop()
+
+	applied := map[string]string{}
+	m := http.NewServeMux()
+	m.HandleFunc(serviceConfigURL, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("serviceName") != applied["name"] {
+				w.Write([]byte(`{}`))
+				return
+			}
+			body, _ := json.Marshal(applied)
+			w.Write(body)
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			applied = map[string]string{}
+			json.Unmarshal(body, &applied)
+		}
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	agent := &AgentClient{URL: server.URL, HTTPClient: &http.Client{}}
+	service := getTestService()
+	if err := agent.UpdateService(&service, 1); err != nil {
+		t.Fatalf("update service failed: %v", err)
+	}
+
+	diff, err := agent.DiffService(context.Background(), &service)
+	if err != nil {
+		t.Fatalf("diff service failed: %v", err)
+	}
+	if !diff.IsEmpty() {
+		t.Errorf("expect empty diff for identical service, got %+v", diff)
+	}
+
+	service.Sidecar.IngressPort = 8081
+	diff, err = agent.DiffService(context.Background(), &service)
+	if err != nil {
+		t.Fatalf("diff service failed: %v", err)
+	}
+	expected := ConfigChange{Old: "8080", New: "8081"}
+	if change := diff.Changed["sidecar.ingressPort"]; change != expected {
+		t.Errorf("expect change %+v of ingress port, got %+v", expected, change)
+	}
+	if len(diff.Changed) != 1 || len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Errorf("expect only ingress port changed, got %+v", diff)
+	}
+	if applied["sidecar.ingressPort"] != "8080" {
+		t.Errorf("diff should not apply the service")
+	}
+
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	agent = &AgentClient{URL: notFoundServer.URL, HTTPClient: &http.Client{}}
+	if _, err = agent.DiffService(context.Background(), &service); err != ErrNotSupported {
+		t.Errorf("agent should return ErrNotSupported, got: %v", err)
+	}
+}
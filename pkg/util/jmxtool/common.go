@@ -19,6 +19,7 @@ package jmxtool
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -95,8 +96,22 @@ type APIErr struct {
 	Message string `yaml:"message"`
 }
 
+// RequestError is the error of a request answered with an unsuccessful status code.
+type RequestError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request failed: Code: %d, Msg: %s ", e.StatusCode, e.Message)
+}
+
 func handleRequest(httpMethod string, url string, reqBody []byte) ([]byte, error) {
-	req, err := http.NewRequest(httpMethod, url, bytes.NewReader(reqBody))
+	return handleRequestWithContext(context.Background(), httpMethod, url, reqBody)
+}
+
+func handleRequestWithContext(ctx context.Context, httpMethod string, url string, reqBody []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, httpMethod, url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +138,7 @@ func handleRequest(httpMethod string, url string, reqBody []byte) ([]byte, error
 		msg = apiErr.Message
 	}
 
-	return nil, fmt.Errorf("Request failed: Code: %d, Msg: %s ", resp.StatusCode, msg)
+	return nil, &RequestError{StatusCode: resp.StatusCode, Message: msg}
 }
 
 func successfulStatusCode(code int) bool {